@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	scrapeModeLive   = "live"
+	scrapeModeCached = "cached"
+)
+
+func validateScrapeMode(mode string) error {
+	switch mode {
+	case scrapeModeLive, scrapeModeCached:
+		return nil
+	default:
+		return fmt.Errorf("invalid scrape mode %q, expected %s or %s", mode, scrapeModeLive, scrapeModeCached)
+	}
+}
+
+// cachedGatherer gathers from the underlying gatherer in the background and
+// serves the result of the last completed gather. Like the live scrapes, a
+// failing collector only leaves out its metrics, the metrics of the other
+// collectors are still cached. A gather exceeding the timeout is not aborted,
+// the cached data just ages until it completes.
+type cachedGatherer struct {
+	gatherer prometheus.Gatherer
+	interval time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+
+	mtx      sync.Mutex
+	families []*dto.MetricFamily
+	updated  time.Time
+	inflight bool
+}
+
+func newCachedGatherer(g prometheus.Gatherer, interval, timeout time.Duration) *cachedGatherer {
+	c := &cachedGatherer{
+		gatherer: g,
+		interval: interval,
+		timeout:  timeout,
+		now:      time.Now,
+	}
+	// until the first gather completes, the age is counted from the start
+	c.updated = c.now()
+	return c
+}
+
+// Gather returns the cached metric families.
+func (c *cachedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.families, nil
+}
+
+func (c *cachedGatherer) staleSeconds() float64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now().Sub(c.updated).Seconds()
+}
+
+// refresh gathers from the underlying gatherer and waits at most until the
+// timeout for the result. It is skipped while the previous gather is still
+// running.
+func (c *cachedGatherer) refresh(ctx context.Context) {
+	c.mtx.Lock()
+	if c.inflight {
+		c.mtx.Unlock()
+		logger.Debug().Msg("previous gather is still running, skipping refresh")
+		return
+	}
+	c.inflight = true
+	c.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		families, err := c.gatherer.Gather()
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.inflight = false
+		if err != nil {
+			logger.Error().Msgf("error gathering metrics, caching the partial result: %v", err)
+		}
+		c.families = families
+		c.updated = c.now()
+	}()
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		logger.Warn().Msgf("gathering metrics exceeded %s, serving cached data", c.timeout)
+	case <-ctx.Done():
+	}
+}
+
+// run refreshes the cache every interval until ctx is cancelled.
+func (c *cachedGatherer) run(ctx context.Context) {
+	c.refresh(ctx)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refresh(ctx)
+		}
+	}
+}
+
+func (c *cachedGatherer) collector() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "zfs_exporter_data_stale_seconds",
+		Help: "Age of the cached metrics served in the cached scrape mode.",
+	}, c.staleSeconds)
+}
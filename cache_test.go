@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// slowGatherer blocks every Gather until release is called.
+type slowGatherer struct {
+	reg   *prometheus.Registry
+	value prometheus.Gauge
+
+	mtx     sync.Mutex
+	blocked chan struct{}
+}
+
+func newSlowGatherer() *slowGatherer {
+	g := &slowGatherer{
+		reg:   prometheus.NewRegistry(),
+		value: prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_value", Help: "Test value."}),
+	}
+	g.reg.MustRegister(g.value)
+	return g
+}
+
+func (g *slowGatherer) block() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.blocked = make(chan struct{})
+}
+
+func (g *slowGatherer) release() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	close(g.blocked)
+	g.blocked = nil
+}
+
+func (g *slowGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mtx.Lock()
+	blocked := g.blocked
+	g.mtx.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	return g.reg.Gather()
+}
+
+func TestCachedGatherer(t *testing.T) {
+	var (
+		nowMtx sync.Mutex
+		now    = time.Unix(1700000000, 0)
+		slow   = newSlowGatherer()
+		cache  = newCachedGatherer(slow, time.Minute, 10*time.Millisecond)
+		reg    = prometheus.NewPedanticRegistry()
+		g      = prometheus.Gatherers{cache, reg}
+		ctx    = context.Background()
+	)
+	cache.now = func() time.Time {
+		nowMtx.Lock()
+		defer nowMtx.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowMtx.Lock()
+		defer nowMtx.Unlock()
+		now = now.Add(d)
+	}
+	cache.updated = cache.now()
+	reg.MustRegister(cache.collector())
+
+	expect := func(t *testing.T, value, stale string) {
+		t.Helper()
+		require.NoError(t, testutil.GatherAndCompare(g, strings.NewReader(`
+# HELP zfs_exporter_data_stale_seconds Age of the cached metrics served in the cached scrape mode.
+# TYPE zfs_exporter_data_stale_seconds gauge
+zfs_exporter_data_stale_seconds `+stale+`
+# HELP zfs_value Test value.
+# TYPE zfs_value gauge
+zfs_value `+value+`
+`)))
+	}
+
+	slow.value.Set(1)
+	cache.refresh(ctx)
+	expect(t, "1", "0")
+
+	// the gather exceeds the timeout, so the cache ages
+	slow.value.Set(2)
+	slow.block()
+	advance(30 * time.Second)
+	cache.refresh(ctx)
+	expect(t, "1", "30")
+
+	// a refresh is skipped while the previous gather is still running
+	advance(30 * time.Second)
+	cache.refresh(ctx)
+	expect(t, "1", "60")
+
+	// once the backend is fast again, the cache recovers
+	slow.release()
+	require.Eventually(t, func() bool {
+		return cache.staleSeconds() == 0
+	}, time.Second, time.Millisecond)
+	expect(t, "2", "0")
+
+	slow.value.Set(3)
+	advance(15 * time.Second)
+	cache.refresh(ctx)
+	expect(t, "3", "0")
+}
+
+func TestCachedGathererPartial(t *testing.T) {
+	var (
+		reg     = prometheus.NewRegistry()
+		value   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_value", Help: "Test value."})
+		failing = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errors.New("zpool status failed")
+		})
+		cache = newCachedGatherer(prometheus.Gatherers{reg, failing}, time.Minute, time.Second)
+	)
+	reg.MustRegister(value)
+
+	// a failing collector doesn't keep the metrics of the others from
+	// being refreshed
+	value.Set(1)
+	cache.refresh(context.Background())
+	require.NoError(t, testutil.GatherAndCompare(cache, strings.NewReader(`
+# HELP zfs_value Test value.
+# TYPE zfs_value gauge
+zfs_value 1
+`)))
+
+	value.Set(2)
+	cache.refresh(context.Background())
+	require.NoError(t, testutil.GatherAndCompare(cache, strings.NewReader(`
+# HELP zfs_value Test value.
+# TYPE zfs_value gauge
+zfs_value 2
+`)))
+}
+
+func TestValidateScrapeMode(t *testing.T) {
+	require.NoError(t, validateScrapeMode("live"))
+	require.NoError(t, validateScrapeMode("cached"))
+	require.Error(t, validateScrapeMode("lazy"))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+var checkCommand = &cli.Command{
+	Name:   "check",
+	Usage:  "verify that the exporter is able to run with the current user and configuration",
+	Action: runCheck,
+}
+
+// commandRunner runs a command and returns its stdout.
+type commandRunner interface {
+	Output(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+// check is a single preflight check, it returns nil on success.
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// checkBinary verifies that an executable is found in PATH.
+func checkBinary(lookPath func(string) (string, error), name string) error {
+	path, err := lookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s not found in PATH: %w", name, err)
+	}
+	logger.Debug().Msgf("found %s at %s", name, path)
+	return nil
+}
+
+// checkExec verifies that a command executes successfully.
+func checkExec(ctx context.Context, runner commandRunner, name string, args ...string) error {
+	_, err := runner.Output(ctx, name, args...)
+	return err
+}
+
+// checkWritableDir verifies that files can be created in dir.
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".zfs-event-exporter-check.*.tmp")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkListen verifies that the listen address can be bound. For unix domain
+// sockets, an existing socket is left alone and only the directory is checked.
+func checkListen(addr string) error {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		path := strings.TrimPrefix(addr, unixSocketPrefix)
+		if path == "" {
+			return fmt.Errorf("empty unix socket path in listen address %q", addr)
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode().Type() != os.ModeSocket {
+			return fmt.Errorf("%s exists and is not a unix socket", path)
+		}
+		return checkWritableDir(filepath.Dir(path))
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// newChecks returns the preflight checks for the configuration in c.
+func newChecks(c *cli.Context, runner commandRunner, lookPath func(string) (string, error)) ([]check, error) {
+	result := []check{
+		{name: "zfs binary", run: func(context.Context) error { return checkBinary(lookPath, "zfs") }},
+		{name: "zpool binary", run: func(context.Context) error { return checkBinary(lookPath, "zpool") }},
+		{name: "zpool status", run: func(ctx context.Context) error { return checkExec(ctx, runner, "zpool", "status", "-pP") }},
+		{name: "zfs list", run: func(ctx context.Context) error { return checkExec(ctx, runner, "zfs", "list", "-H", "-o", "name") }},
+		{name: "zpool events", run: func(ctx context.Context) error { return checkExec(ctx, runner, "zpool", "events", "-H") }},
+	}
+
+	collectorDataset, err := newDatasetCollector(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	kstats, err := newKstatCollectors(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	poolCapacity, err := newPoolCapacityCollector(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	poolDisks, err := newPoolDiskCollector(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := parseTextFileOutputs(stringSlice(c, "text-file-output"), (&exporterCollectors{
+		kstats:           kstats,
+		dataset:          collectorDataset,
+		poolQueue:        newPoolQueueCollector(c, nil),
+		poolRequestSizes: newPoolRequestSizeCollector(c, nil),
+		poolCapacity:     poolCapacity,
+		poolDisks:        poolDisks,
+		poolCount:        newPoolCountCollector(c, nil),
+	}).byName())
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range outputs {
+		dir := filepath.Dir(o.filename)
+		result = append(result, check{
+			name: "text file directory " + dir,
+			run:  func(context.Context) error { return checkWritableDir(dir) },
+		})
+	}
+
+	if addr := c.String("listen-addr"); addr != "" {
+		result = append(result, check{
+			name: "listen address " + addr,
+			run:  func(context.Context) error { return checkListen(addr) },
+		})
+	}
+
+	return result, nil
+}
+
+// runChecks runs all checks, writes a report to w and returns the number of
+// failed checks.
+func runChecks(ctx context.Context, w io.Writer, checks []check) int {
+	failed := 0
+	for _, c := range checks {
+		if err := c.run(ctx); err != nil {
+			failed++
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(w, "[ OK ] %s\n", c.name)
+	}
+	return failed
+}
+
+func runCheck(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	limiter, err := newCommandLimiter(c.Float64("command.rate-limit"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	runner, err := newCommandRunner(stringSlice(c, "command.timeout"), command.LocalExecutor{}, limiter)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	list, err := newChecks(c, runner, exec.LookPath)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if failed := runChecks(ctx, c.App.Writer, list); failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d of %d checks failed", failed, len(list)), 1)
+	}
+	return nil
+}
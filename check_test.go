@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// fakeRunner returns the configured error for a command.
+type fakeRunner map[string]error
+
+func (f fakeRunner) Output(_ context.Context, name string, args ...string) ([]byte, error) {
+	return nil, f[command.Name(name, args...)]
+}
+
+func TestCheckBinary(t *testing.T) {
+	lookPath := func(name string) (string, error) {
+		if name == "zpool" {
+			return "/sbin/zpool", nil
+		}
+		return "", errors.New("executable file not found in $PATH")
+	}
+
+	require.NoError(t, checkBinary(lookPath, "zpool"))
+
+	err := checkBinary(lookPath, "zfs")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "zfs not found in PATH")
+}
+
+func TestCheckExec(t *testing.T) {
+	runner := fakeRunner{"zpool events": errors.New("permission denied")}
+
+	require.NoError(t, checkExec(context.Background(), runner, "zpool", "status"))
+
+	err := checkExec(context.Background(), runner, "zpool", "events", "-H")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission denied")
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkWritableDir(dir))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.Error(t, checkWritableDir(filepath.Join(dir, "missing")))
+}
+
+func TestCheckListen(t *testing.T) {
+	require.NoError(t, checkListen("127.0.0.1:0"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	require.Error(t, checkListen(l.Addr().String()))
+
+	dir := t.TempDir()
+	require.NoError(t, checkListen("unix://"+filepath.Join(dir, "metrics.sock")))
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	require.Error(t, checkListen("unix://"+file))
+}
+
+func TestRunChecks(t *testing.T) {
+	var out bytes.Buffer
+	failed := runChecks(context.Background(), &out, []check{
+		{name: "good", run: func(context.Context) error { return nil }},
+		{name: "bad", run: func(context.Context) error { return errors.New("broken") }},
+	})
+	require.Equal(t, 1, failed)
+	require.Equal(t, "[ OK ] good\n[FAIL] bad: broken\n", out.String())
+}
+
+func runCheckApp(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	var (
+		out       bytes.Buffer
+		exitCode  int
+		oldExiter = cli.OsExiter
+	)
+	cli.OsExiter = func(code int) { exitCode = code }
+	defer func() { cli.OsExiter = oldExiter }()
+
+	app := newApp()
+	app.Writer = &out
+	app.ErrWriter = &out
+	_ = app.Run(append([]string{"zfs-event-exporter"}, append(args, "check")...))
+	return out.String(), exitCode
+}
+
+func TestCheck(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "echo pool\n",
+		"zpool": `if [ "$1" = "events" ]; then echo 'permission denied' >&2; exit 1; fi` + "\n",
+	})
+	dir := t.TempDir()
+
+	out, code := runCheckApp(t,
+		"--listen-addr", "127.0.0.1:0",
+		"--text-file-output", filepath.Join(dir, "zfs.prom"),
+	)
+	require.Equal(t, 1, code)
+	require.Contains(t, out, "[ OK ] zfs binary\n")
+	require.Contains(t, out, "[ OK ] zpool status\n")
+	require.Contains(t, out, "[ OK ] zfs list\n")
+	require.Contains(t, out, "[FAIL] zpool events: zpool events failed: exit status 1: permission denied: insufficient permissions, run as root or check access to /dev/zfs\n")
+	require.Contains(t, out, "[ OK ] text file directory "+dir+"\n")
+	require.Contains(t, out, "[ OK ] listen address 127.0.0.1:0\n")
+}
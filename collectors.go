@@ -0,0 +1,872 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/time/rate"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/dataset"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+	"github.com/simonswine/zfs-event-exporter/zfs/kstat"
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+	zfsversion "github.com/simonswine/zfs-event-exporter/zfs/version"
+)
+
+var metricPrefixRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type snapshotCollector interface {
+	prometheus.Collector
+	Status() snapshot.Status
+	Run(ctx context.Context) error
+	Wait()
+	Observe(func(*events.Event))
+}
+
+// cachingSnapshotCollector is implemented by the snapshot collectors, which
+// can keep the snapshots in a cache file across restarts.
+type cachingSnapshotCollector interface {
+	UseCache(filename string, interval time.Duration)
+}
+
+type datasetCollector interface {
+	prometheus.Collector
+	Notify(*events.Event)
+}
+
+type poolCollector interface {
+	prometheus.Collector
+	Status() pool.Status
+}
+
+// exporterCollectors are the ZFS collectors shared by all modes of the
+// exporter.
+type exporterCollectors struct {
+	snapshot snapshotCollector
+	pool     poolCollector
+
+	// runner executes all zfs and zpool commands
+	runner *command.Runner
+
+	// up exports whether ZFS is available to runner
+	up prometheus.Collector
+
+	// version exports the versions of ZFS probed at start up and once ZFS
+	// becomes available
+	version prometheus.Collector
+
+	// kstats are the collectors based on kstats by name, they only exist
+	// for the local host
+	kstats map[string]prometheus.Collector
+
+	// dataset exports the properties of the datasets, it is nil unless
+	// enabled by --collector.dataset
+	dataset datasetCollector
+
+	// poolCount exports the number of datasets of the pools, it is nil
+	// unless enabled by --collector.pool.counts
+	poolCount datasetCollector
+
+	// poolQueue exports the queued I/Os of the pools, it is nil unless
+	// enabled by --collector.pool.queues
+	poolQueue prometheus.Collector
+
+	// poolRequestSizes exports the request sizes of the pools, it is nil
+	// unless enabled by --collector.pool.request-sizes
+	poolRequestSizes prometheus.Collector
+
+	// poolCapacity exports the capacity of the pools and when they are
+	// full, it is nil unless enabled by --collector.pool.capacity
+	poolCapacity prometheus.Collector
+
+	// poolDisks exports the I/O of the disks of the pools, it is nil unless
+	// enabled by --collector.pool.disks and in once mode, as it follows zpool
+	// iostat
+	poolDisks *pool.DiskCollector
+
+	// health exports the overall health of the pools and snapshots
+	health prometheus.Collector
+
+	// labels are added to every exported metric
+	labels prometheus.Labels
+
+	// host is the remote host the collectors gather from, it is empty for
+	// the local host
+	host string
+}
+
+// reservedLabels can't be used as constant labels, as they are either set by
+// Prometheus or by the collectors.
+var reservedLabels = map[string]bool{
+	"job":       true,
+	"instance":  true,
+	"dataset":   true,
+	"pool":      true,
+	"disk":      true,
+	"state":     true,
+	"type":      true,
+	"file":      true,
+	"version":   true,
+	"revision":  true,
+	"branch":    true,
+	"goversion": true,
+	"host":      true,
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseConstLabels parses the key=value pairs of the --label flag.
+func parseConstLabels(values []string) (prometheus.Labels, error) {
+	labels := make(prometheus.Labels, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", v)
+		}
+		if !labelNameRegexp.MatchString(key) || strings.HasPrefix(key, "__") {
+			return nil, fmt.Errorf("invalid label name %q", key)
+		}
+		if reservedLabels[key] {
+			return nil, fmt.Errorf("label name %q is reserved", key)
+		}
+		if _, ok := labels[key]; ok {
+			return nil, fmt.Errorf("duplicate label name %q", key)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// newCommandLimiter creates the limiter of the --command.rate-limit flag, which
+// is shared by the runners of all targets. A limit of 0 returns no limiter.
+func newCommandLimiter(limit float64) (*rate.Limiter, error) {
+	if limit < 0 || math.IsNaN(limit) || math.IsInf(limit, 0) {
+		return nil, fmt.Errorf("invalid command rate limit %v", limit)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	// a limit below one command per second still allows a single one
+	return rate.NewLimiter(rate.Limit(limit), int(math.Ceil(limit))), nil
+}
+
+// newCommandRunner creates the runner for zfs and zpool commands using executor.
+// The values of the --command.timeout flag are either a duration, which applies
+// to all commands, or a command=duration pair, e.g. "zpool status=1m". Commands
+// are started at the rate of limiter, unless it is nil.
+func newCommandRunner(values []string, executor command.Executor, limiter *rate.Limiter) (*command.Runner, error) {
+	var (
+		defaultTimeout = command.DefaultTimeout
+		timeouts       = make(map[string]time.Duration)
+	)
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			name, value = "", v
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid command timeout %q", v)
+		}
+		if name == "" {
+			defaultTimeout = d
+			continue
+		}
+		timeouts[name] = d
+	}
+
+	runner := command.NewRunnerWithExecutor(executor, defaultTimeout)
+	for name, d := range timeouts {
+		runner.SetTimeout(name, d)
+	}
+	if limiter != nil {
+		runner.SetRateLimit(limiter)
+	}
+	return runner, nil
+}
+
+// snapshotFilter returns the function deciding which snapshots are exported,
+// based on the --exclude-snapshot-name flag.
+func snapshotFilter(c *cli.Context) (func(dataset, snapshot string) bool, error) {
+	keep := func(_, _ string) bool {
+		return true
+	}
+
+	if excludes := regexpSlice(c, "exclude-snapshot-name"); len(excludes) > 0 {
+		var match []*regexp.Regexp
+		for _, exclude := range excludes {
+			r, err := regexp.Compile(exclude)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling exclude regular expression: %w", err)
+			}
+			match = append(match, r)
+		}
+
+		keep = func(dataset, snapshot string) bool {
+			for _, r := range match {
+				if r.MatchString(dataset + "@" + snapshot) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	return keep, nil
+}
+
+// snapshotLister returns the lister of the --snapshot-backend flag, which runs
+// commands using runner. It is nil for the exec backend, which runs zfs list
+// using the runner of every target.
+func snapshotLister(c *cli.Context, runner command.CommandRunner) (snapshot.Lister, error) {
+	backend := c.String("snapshot-backend")
+	if backend == snapshot.BackendExec {
+		return nil, nil
+	}
+	if len(stringSlice(c, "remote")) > 0 || c.String("host-root") != "" || c.String("snapshot-list-file") != "" {
+		return nil, fmt.Errorf("--snapshot-backend=%s lists the snapshots of the local host, it can't be combined with --remote, --host-root or --snapshot-list-file", backend)
+	}
+	return snapshot.NewLister(logger, backend, runner)
+}
+
+// The values of the --event-source flag.
+const (
+	eventSourceEvents  = "events"
+	eventSourceHistory = "history"
+)
+
+// historyInterval returns the interval of polling zpool history for the
+// --event-source flag, it is 0 when following zpool events.
+func historyInterval(c *cli.Context) (time.Duration, error) {
+	switch source := c.String("event-source"); source {
+	case eventSourceEvents:
+		return 0, nil
+	case eventSourceHistory:
+		if c.String("snapshot-list-file") != "" {
+			return 0, fmt.Errorf("--event-source=%s can't be combined with --snapshot-list-file", source)
+		}
+		interval := c.Duration("event-source.history-interval")
+		if interval <= 0 {
+			return 0, fmt.Errorf("invalid --event-source.history-interval %s, it has to be positive", interval)
+		}
+		return interval, nil
+	default:
+		return 0, fmt.Errorf("unknown event source %q, it has to be %s or %s", source, eventSourceEvents, eventSourceHistory)
+	}
+}
+
+// The values of the --collector.snapshot.mode flag.
+const (
+	snapshotModeEvents = snapshot.ModeEvents
+	snapshotModePoll   = snapshot.ModePoll
+)
+
+// snapshotPollInterval returns the interval of listing all snapshots for the
+// --collector.snapshot.mode flag, it is 0 when following an event source.
+func snapshotPollInterval(c *cli.Context) (time.Duration, error) {
+	switch mode := c.String("collector.snapshot.mode"); mode {
+	case snapshotModeEvents:
+		return 0, nil
+	case snapshotModePoll:
+		if source := c.String("event-source"); source != eventSourceEvents {
+			return 0, fmt.Errorf("--event-source=%s can't be combined with --collector.snapshot.mode=%s, which doesn't follow any events", source, mode)
+		}
+		if c.String("events-file") != "" {
+			return 0, fmt.Errorf("--events-file can't be combined with --collector.snapshot.mode=%s, which doesn't follow any events", mode)
+		}
+		interval := c.Duration("collector.snapshot.poll-interval")
+		if interval <= 0 {
+			return 0, fmt.Errorf("invalid --collector.snapshot.poll-interval %s, it has to be positive", interval)
+		}
+		return interval, nil
+	default:
+		return 0, fmt.Errorf("unknown snapshot collector mode %q, it has to be %s or %s", mode, snapshotModeEvents, snapshotModePoll)
+	}
+}
+
+// snapshotCache returns the cache file of the snapshots of host given by
+// --collector.snapshot.cache-file and the interval of saving it. The cache
+// files of remote hosts are suffixed with their host.
+func snapshotCache(c *cli.Context, host string) (string, time.Duration, error) {
+	filename := c.String("collector.snapshot.cache-file")
+	if filename == "" {
+		return "", 0, nil
+	}
+	interval := c.Duration("collector.snapshot.cache-interval")
+	if interval <= 0 {
+		return "", 0, fmt.Errorf("invalid --collector.snapshot.cache-interval %s, it has to be positive", interval)
+	}
+	if host != "" {
+		filename += "." + host
+	}
+	return filename, interval, nil
+}
+
+// datasetFilter returns the function deciding which datasets are exported by
+// the dataset collector, based on the --exclude-dataset flag.
+func datasetFilter(c *cli.Context) (func(dataset string) bool, error) {
+	var match []*regexp.Regexp
+	for _, exclude := range regexpSlice(c, "exclude-dataset") {
+		r, err := regexp.Compile(exclude)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling exclude regular expression: %w", err)
+		}
+		match = append(match, r)
+	}
+
+	return func(dataset string) bool {
+		for _, r := range match {
+			if r.MatchString(dataset) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// newCommandTargets returns the hosts commands are executed on, these are the
+// --remote targets or the local host, if there are none.
+func newCommandTargets(c *cli.Context) ([]remote, error) {
+	remotes, err := newRemotes(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(remotes) > 0 {
+		if c.String("host-root") != "" {
+			return nil, fmt.Errorf("--host-root can't be combined with --remote")
+		}
+		return remotes, nil
+	}
+
+	var executor command.Executor = command.LocalExecutor{}
+	if hostRoot := c.String("host-root"); hostRoot != "" {
+		if err := checkHostRoot(hostRoot); err != nil {
+			return nil, err
+		}
+		executor = command.NsenterExecutor{}
+	}
+	return []remote{{executor: executor}}, nil
+}
+
+// newExporterTargets creates the collectors for every --remote target or for
+// the local host, if there are none. Unless follow is set, the snapshot
+// collectors only contain the initial listing and don't follow zpool events.
+func newExporterTargets(ctx context.Context, c *cli.Context, follow bool) (exporterTargets, error) {
+	keep, err := snapshotFilter(c)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := parseConstLabels(stringSlice(c, "label"))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := c.String("metric-prefix")
+	if !metricPrefixRegexp.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid metric prefix %q", prefix)
+	}
+
+	inputs, err := parseOfflineInputs(c)
+	if err != nil {
+		return nil, err
+	}
+	history, err := historyInterval(c)
+	if err != nil {
+		return nil, err
+	}
+	poll, err := snapshotPollInterval(c)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes, err := newCommandTargets(c)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := newCommandLimiter(c.Float64("command.rate-limit"))
+	if err != nil {
+		return nil, err
+	}
+
+	var targets exporterTargets
+	for _, r := range remotes {
+		runner, err := newCommandRunner(stringSlice(c, "command.timeout"), r.executor, limiter)
+		if err != nil {
+			return nil, err
+		}
+		lister, err := snapshotLister(c, runner)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := newExporterCollectors(ctx, runner, lister, inputs, prefix, keep, follow, history, poll)
+		if err != nil {
+			if r.host != "" {
+				return nil, fmt.Errorf("%s: %w", r.host, err)
+			}
+			return nil, err
+		}
+		e.labels = labels
+		e.host = r.host
+		// there is no restart to speed up in once mode
+		if follow {
+			filename, interval, err := snapshotCache(c, r.host)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := e.snapshot.(cachingSnapshotCollector); ok && filename != "" {
+				s.UseCache(filename, interval)
+			}
+		}
+		// the offline inputs replace zpool status and the snapshot listing,
+		// the other collectors only work on a live system
+		if inputs == (offlineInputs{}) {
+			if err := e.addLiveCollectors(c, runner, follow); err != nil {
+				return nil, err
+			}
+		}
+		// the event stream of the snapshot collector triggers refreshes
+		if e.dataset != nil {
+			e.snapshot.Observe(e.dataset.Notify)
+		}
+		if e.poolCount != nil {
+			e.snapshot.Observe(e.poolCount.Notify)
+		}
+		if e.health, err = newHealthCollector(c, e); err != nil {
+			return nil, err
+		}
+		targets = append(targets, e)
+	}
+
+	return targets, nil
+}
+
+// addLiveCollectors adds the optional collectors, which always run commands
+// using runner or read the kstats of the local host.
+func (e *exporterCollectors) addLiveCollectors(c *cli.Context, runner *command.Runner, follow bool) error {
+	var err error
+	if e.host == "" {
+		if e.kstats, err = newKstatCollectors(c, runner); err != nil {
+			return err
+		}
+	}
+	if e.dataset, err = newDatasetCollector(c, runner); err != nil {
+		return err
+	}
+	e.poolQueue = newPoolQueueCollector(c, runner)
+	e.poolRequestSizes = newPoolRequestSizeCollector(c, runner)
+	if e.poolCapacity, err = newPoolCapacityCollector(c, runner); err != nil {
+		return err
+	}
+	poolDisks, err := newPoolDiskCollector(c, runner)
+	if err != nil {
+		return err
+	}
+	// there are no reports of zpool iostat to sum up in once mode
+	if follow {
+		e.poolDisks = poolDisks
+	}
+	e.poolCount = newPoolCountCollector(c, runner)
+	return nil
+}
+
+// newExporterCollectors creates the collectors, which run commands using
+// runner, unless inputs replace them. The snapshots are listed by lister, if
+// it is set. With a history interval, the snapshot collector polls zpool
+// history instead of following zpool events, with a poll interval it lists
+// all snapshots periodically instead of following any events.
+func newExporterCollectors(ctx context.Context, runner *command.Runner, lister snapshot.Lister, inputs offlineInputs, prefix string, keep func(string, string) bool, follow bool, history, poll time.Duration) (*exporterCollectors, error) {
+	// the arguments of the commands depend on the capabilities of zfs and
+	// zpool
+	versions := zfsversion.Fixed(zfsversion.Versions{})
+	if inputs.poolStatusFile == "" || inputs.snapshotListFile == "" {
+		versions = zfsversion.NewProber(logger, runner).Versions
+	}
+
+	var (
+		collectorSnapshot snapshotCollector
+		err               error
+	)
+	switch {
+	case inputs.snapshotListFile != "" && follow && poll > 0:
+		collectorSnapshot = snapshot.NewPollCollector(logger, runner, snapshot.TextLister(snapshot.ListFile(inputs.snapshotListFile)), poll, prefix, keep)
+	case inputs.snapshotListFile != "" && follow:
+		var eventCh chan *events.Event
+		if eventCh, err = replayEvents(ctx, inputs.eventsFile); err == nil {
+			collectorSnapshot = snapshot.NewListCollector(logger, snapshot.ListFile(inputs.snapshotListFile), eventCh, prefix, keep)
+		}
+	case inputs.snapshotListFile != "":
+		collectorSnapshot, err = snapshot.NewOneShotListCollector(ctx, logger, snapshot.ListFile(inputs.snapshotListFile), prefix, keep)
+	case follow && poll > 0:
+		collectorSnapshot = snapshot.NewPollCollector(logger, runner, lister, poll, prefix, keep)
+	case follow && history > 0:
+		collectorSnapshot, err = snapshot.NewHistoryCollector(ctx, logger, runner, lister, history, prefix, keep)
+	case follow:
+		collectorSnapshot, err = snapshot.NewCollector(ctx, logger, runner, lister, prefix, keep)
+	default:
+		collectorSnapshot, err = snapshot.NewOneShotCollector(ctx, logger, runner, lister, prefix, keep)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating snapshot collector: %w", err)
+	}
+
+	collectorPool := pool.NewCollector(logger, runner, versions, prefix)
+	if filename := inputs.poolStatusFile; filename != "" {
+		collectorPool = pool.NewStatusCollector(logger, func() ([]byte, error) {
+			return os.ReadFile(filename)
+		}, prefix)
+	}
+
+	return &exporterCollectors{
+		snapshot: collectorSnapshot,
+		pool:     collectorPool,
+		runner:   runner,
+		up:       newUpCollector(prefix, runner),
+		version:  zfsversion.NewCollector(versions, prefix),
+	}, nil
+}
+
+// newUpCollector exports whether ZFS is available to the commands of runner.
+// Without any imported pools ZFS is still available.
+func newUpCollector(prefix string, runner *command.Runner) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: prefix,
+		Name:      "up",
+		Help:      "Whether ZFS is available, it is 0 while the kernel module is not loaded.",
+	}, func() float64 {
+		if runner.Available() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// available reports whether ZFS is available to the collectors. Until it
+// shows up, there is no data to wait for.
+func (e *exporterCollectors) available() bool {
+	return e.runner == nil || e.runner.Available()
+}
+
+func (e *exporterCollectors) byName() map[string]prometheus.Collector {
+	result := map[string]prometheus.Collector{
+		"pool":     e.pool,
+		"snapshot": e.snapshot,
+	}
+	for name, collector := range e.kstats {
+		result[name] = collector
+	}
+	if e.dataset != nil {
+		result["dataset"] = e.dataset
+	}
+	if e.poolQueue != nil {
+		result["pool_queue"] = e.poolQueue
+	}
+	if e.poolRequestSizes != nil {
+		result["pool_request_sizes"] = e.poolRequestSizes
+	}
+	if e.poolCapacity != nil {
+		result["pool_capacity"] = e.poolCapacity
+	}
+	if e.poolDisks != nil {
+		result["pool_disks"] = e.poolDisks
+	}
+	if e.poolCount != nil {
+		result["pool_count"] = e.poolCount
+	}
+	if e.health != nil {
+		result["health"] = e.health
+	}
+	return result
+}
+
+// newPoolQueueCollector creates the collector for the queued I/Os of the
+// pools, if it is enabled.
+func newPoolQueueCollector(c *cli.Context, runner *command.Runner) prometheus.Collector {
+	if !c.Bool("collector.pool.queues") {
+		return nil
+	}
+	return pool.NewQueueCollector(logger, runner, c.String("metric-prefix"))
+}
+
+// newPoolRequestSizeCollector creates the collector for the request sizes of
+// the pools, if it is enabled.
+func newPoolRequestSizeCollector(c *cli.Context, runner *command.Runner) prometheus.Collector {
+	if !c.Bool("collector.pool.request-sizes") {
+		return nil
+	}
+	return pool.NewRequestSizeCollector(logger, runner, c.String("metric-prefix"), c.Bool("native-histograms"))
+}
+
+// newPoolCapacityCollector creates the collector for the capacity of the
+// pools, if it is enabled.
+func newPoolCapacityCollector(c *cli.Context, runner *command.Runner) (prometheus.Collector, error) {
+	if !c.Bool("collector.pool.capacity") {
+		return nil, nil
+	}
+	window := c.Duration("collector.pool.capacity.window")
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid --collector.pool.capacity.window %s", window)
+	}
+	return pool.NewCapacityCollector(logger, runner, c.String("metric-prefix"), window), nil
+}
+
+// newPoolDiskCollector creates the collector for the I/O of the disks of the
+// pools, if it is enabled. It only collects once it runs.
+func newPoolDiskCollector(c *cli.Context, runner *command.Runner) (*pool.DiskCollector, error) {
+	if !c.Bool("collector.pool.disks") {
+		return nil, nil
+	}
+	interval := c.Duration("collector.pool.disks.interval")
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid --collector.pool.disks.interval %s", interval)
+	}
+	return pool.NewDiskCollector(logger, runner, c.String("metric-prefix"), interval), nil
+}
+
+// newPoolCountCollector creates the collector for the number of datasets of
+// the pools, if it is enabled.
+func newPoolCountCollector(c *cli.Context, runner *command.Runner) datasetCollector {
+	if !c.Bool("collector.pool.counts") {
+		return nil
+	}
+	return dataset.NewCountCollector(logger, runner, c.String("metric-prefix"), c.Duration("collector.dataset.interval"))
+}
+
+// newDatasetCollector creates the collector for the properties of the
+// datasets, if it is enabled.
+func newDatasetCollector(c *cli.Context, runner *command.Runner) (datasetCollector, error) {
+	if !c.Bool("collector.dataset") {
+		return nil, nil
+	}
+	keep, err := datasetFilter(c)
+	if err != nil {
+		return nil, err
+	}
+	props := stringSlice(c, "collector.dataset.properties")
+	if err := dataset.ValidateProperties(c.Context, runner, props); err != nil {
+		return nil, err
+	}
+	// the fetcher batches the properties of the dataset collectors of a
+	// target into a single zfs get
+	fetcher := dataset.NewFetcher(runner, c.Duration("collector.dataset.interval"))
+	return dataset.NewCollector(logger, fetcher, c.String("metric-prefix"), dataset.Options{
+		Keep:           keep,
+		AllKeyStatuses: c.Bool("collector.dataset.keystatus.all"),
+		Properties:     props,
+	}), nil
+}
+
+// newKstatCollectors creates the collectors based on the kstats of the local
+// host, which is mounted at --host-root if set.
+func newKstatCollectors(c *cli.Context, runner *command.Runner) (map[string]prometheus.Collector, error) {
+	root := c.String("host-root")
+	if root == "" {
+		root = "/"
+	}
+	var (
+		provider = kstat.NewProvider(runner, root)
+		prefix   = c.String("metric-prefix")
+	)
+	result := map[string]prometheus.Collector{
+		"l2arc":  kstat.NewL2ARCCollector(logger, provider, prefix, c.Bool("collector.l2arc.always")),
+		"dmu_tx": kstat.NewDmuTxCollector(logger, provider, prefix),
+		"txg":    kstat.NewTXGCollector(logger, provider, prefix, c.Bool("native-histograms")),
+	}
+	if c.Bool("collector.zfetch") {
+		result["zfetch"] = kstat.NewZfetchCollector(logger, provider, prefix)
+	}
+	if c.Bool("collector.dbuf") {
+		result["dbuf"] = kstat.NewDbufCollector(logger, provider, prefix)
+	}
+	if c.Bool("collector.spl") {
+		result["spl"] = kstat.NewSPLCollector(logger, provider, prefix, c.Int("collector.spl.top-caches"))
+	}
+	if c.Bool("collector.dataset-io") {
+		keep, err := datasetFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		result["dataset_io"] = kstat.NewObjsetCollector(logger, provider, prefix, keep)
+	}
+	return result, nil
+}
+
+func (e *exporterCollectors) names() []string {
+	var names []string
+	for name := range e.byName() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wrap returns a registerer, which adds the constant labels to all metrics
+// registered through it.
+func (e *exporterCollectors) wrap(reg prometheus.Registerer) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(e.labels, reg)
+}
+
+// wrapTarget is like wrap, but it also adds the host label for remote targets.
+func (e *exporterCollectors) wrapTarget(reg prometheus.Registerer) prometheus.Registerer {
+	if e.host == "" {
+		return e.wrap(reg)
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"host": e.host}, e.wrap(reg))
+}
+
+// newRegistry creates a registry with the build information and the named
+// collectors, which are instrumented with their collection duration and
+// success.
+func (e *exporterCollectors) newRegistry(names []string) *prometheus.Registry {
+	return exporterTargets{e}.newRegistry(names)
+}
+
+// exporterTargets are the collectors of all hosts the exporter gathers from.
+type exporterTargets []*exporterCollectors
+
+func (t exporterTargets) byName() map[string]prometheus.Collector {
+	return t[0].byName()
+}
+
+func (t exporterTargets) names() []string {
+	return t[0].names()
+}
+
+// wrap adds the constant labels shared by all targets.
+func (t exporterTargets) wrap(reg prometheus.Registerer) prometheus.Registerer {
+	return t[0].wrap(reg)
+}
+
+// newRegistry creates a registry with the build information and the named
+// collectors of all targets.
+func (t exporterTargets) newRegistry(names []string) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	t.wrap(reg).MustRegister(newBuildInfoCollector())
+	for _, e := range t {
+		var (
+			wrapped = e.wrapTarget(reg)
+			byName  = e.byName()
+		)
+		for _, name := range names {
+			wrapped.MustRegister(newInstrumentedCollector(name, byName[name]))
+		}
+	}
+	return reg
+}
+
+// newSharedGatherers creates a shared gatherer for every collector, which
+// covers that collector of all targets.
+func (t exporterTargets) newSharedGatherers() map[string]prometheus.Gatherer {
+	result := make(map[string]prometheus.Gatherer)
+	for _, name := range t.names() {
+		reg := prometheus.NewRegistry()
+		for _, e := range t {
+			e.wrapTarget(reg).MustRegister(newInstrumentedCollector(name, e.byName()[name]))
+		}
+		result[name] = newSharedGatherer(reg)
+	}
+	return result
+}
+
+// gatherer combines the build information with the shared gatherers of the
+// named collectors.
+func (t exporterTargets) gatherer(shared map[string]prometheus.Gatherer, names []string) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	t.wrap(reg).MustRegister(newBuildInfoCollector())
+	gatherers := prometheus.Gatherers{reg}
+	for _, name := range gatherOrder(names) {
+		gatherers = append(gatherers, shared[name])
+	}
+	return gatherers
+}
+
+// gatherOrder returns names in the order they are gathered. The gatherers
+// run one after another, health follows pool right away to reuse the zpool
+// status it has just parsed.
+func gatherOrder(names []string) []string {
+	var hasPool, hasHealth bool
+	for _, name := range names {
+		hasPool = hasPool || name == "pool"
+		hasHealth = hasHealth || name == "health"
+	}
+	if !hasPool || !hasHealth {
+		return names
+	}
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "health":
+		case "pool":
+			result = append(result, "pool", "health")
+		default:
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// registerRunners registers the command metrics, the availability and the
+// versions of ZFS of all targets.
+func (t exporterTargets) registerRunners(reg prometheus.Registerer) {
+	for _, e := range t {
+		e.wrapTarget(reg).MustRegister(e.runner, e.up, e.version)
+	}
+}
+
+// PoolStatus combines the pool collector status of all targets. Targets
+// without ZFS are skipped.
+func (t exporterTargets) PoolStatus() pool.Status {
+	result := pool.Status{InitialParseDone: true}
+	for _, e := range t {
+		if !e.available() {
+			continue
+		}
+		if !e.pool.Status().InitialParseDone {
+			result.InitialParseDone = false
+		}
+	}
+	return result
+}
+
+// Status combines the snapshot collector status of all targets. The event
+// stream counts as down since the earliest change of any target, which is
+// down. Targets without ZFS are skipped.
+func (t exporterTargets) Status() snapshot.Status {
+	result := snapshot.Status{InitialListingDone: true, EventStreamUp: true}
+	for _, e := range t {
+		if !e.available() {
+			continue
+		}
+		s := e.snapshot.Status()
+		result.Mode = s.Mode
+		if !s.InitialListingDone {
+			result.InitialListingDone = false
+		}
+		if s.EventStreamUp {
+			continue
+		}
+		if result.EventStreamUp || s.EventStreamChanged.Before(result.EventStreamChanged) {
+			result.EventStreamChanged = s.EventStreamChanged
+		}
+		result.EventStreamUp = false
+	}
+	return result
+}
+
+// wait waits for zpool events of all targets to exit.
+func (t exporterTargets) wait() {
+	for _, e := range t {
+		e.snapshot.Wait()
+	}
+}
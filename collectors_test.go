@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+type fakeSnapshotCollector struct {
+	prometheus.Gauge
+	fakeSnapshotStatus
+}
+
+func (f *fakeSnapshotCollector) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeSnapshotCollector) Wait() {}
+
+func (f *fakeSnapshotCollector) Observe(func(*events.Event)) {}
+
+type fakePoolCollector struct {
+	prometheus.Gauge
+	status pool.Status
+}
+
+func (f *fakePoolCollector) Status() pool.Status {
+	return f.status
+}
+
+func newFakeExporterCollectors(labels prometheus.Labels) *exporterCollectors {
+	return &exporterCollectors{
+		snapshot: &fakeSnapshotCollector{
+			Gauge:              prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_snapshot_count"}),
+			fakeSnapshotStatus: fakeSnapshotStatus{status: snapshot.Status{InitialListingDone: true}},
+		},
+		pool: &fakePoolCollector{
+			Gauge:  prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_pool_status"}),
+			status: pool.Status{InitialParseDone: true},
+		},
+		labels: labels,
+	}
+}
+
+func TestParseConstLabels(t *testing.T) {
+	labels, err := parseConstLabels([]string{"site=ams1", "role=backup", "empty="})
+	require.NoError(t, err)
+	require.Equal(t, prometheus.Labels{"site": "ams1", "role": "backup", "empty": ""}, labels)
+
+	for _, invalid := range [][]string{
+		{"site"},
+		{"1site=ams1"},
+		{"__name__=foo"},
+		{"instance=host1"},
+		{"job=zfs"},
+		{"dataset=pool/data"},
+		{"site=ams1", "site=ams2"},
+	} {
+		_, err := parseConstLabels(invalid)
+		require.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	e := newFakeExporterCollectors(prometheus.Labels{"site": "ams1", "role": "backup"})
+
+	for _, names := range [][]string{
+		e.names(),
+		{"pool"},
+		{"snapshot"},
+	} {
+		reg := e.newRegistry(names)
+		e.wrap(reg).MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_exporter_ready"}))
+
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		// build info, ready and the collector duration, success and panics
+		require.Len(t, families, len(names)+5)
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				require.Equal(t, "ams1", labels["site"], f.GetName())
+				require.Equal(t, "backup", labels["role"], f.GetName())
+			}
+		}
+	}
+}
+
+func TestNewCommandRunner(t *testing.T) {
+	_, err := newCommandRunner([]string{"1m", "zpool status=2m"}, command.LocalExecutor{}, nil)
+	require.NoError(t, err)
+
+	for _, invalid := range []string{"fast", "zpool status=", "zfs list=-1s", "0s"} {
+		_, err := newCommandRunner([]string{invalid}, command.LocalExecutor{}, nil)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestNewCommandLimiter(t *testing.T) {
+	l, err := newCommandLimiter(0)
+	require.NoError(t, err)
+	require.Nil(t, l)
+
+	l, err = newCommandLimiter(2.5)
+	require.NoError(t, err)
+	require.Equal(t, rate.Limit(2.5), l.Limit())
+	require.Equal(t, 3, l.Burst())
+
+	// a single command is allowed below one per second
+	l, err = newCommandLimiter(0.1)
+	require.NoError(t, err)
+	require.Equal(t, 1, l.Burst())
+
+	for _, invalid := range []float64{-1, math.NaN(), math.Inf(1)} {
+		_, err := newCommandLimiter(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestExporterTargets(t *testing.T) {
+	var (
+		labels = prometheus.Labels{"site": "ams1"}
+		nas1   = newFakeExporterCollectors(labels)
+		nas2   = newFakeExporterCollectors(labels)
+	)
+	nas1.host = "nas1"
+	nas2.host = "nas2:2222"
+	targets := exporterTargets{nas1, nas2}
+
+	families, err := targets.newRegistry(targets.names()).Gather()
+	require.NoError(t, err)
+
+	hosts := make(map[string][]string)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "host" {
+					hosts[f.GetName()] = append(hosts[f.GetName()], l.GetValue())
+				}
+			}
+		}
+	}
+	require.Equal(t, []string{"nas1", "nas2:2222"}, hosts["zfs_pool_status"])
+	require.Equal(t, []string{"nas1", "nas2:2222"}, hosts["zfs_snapshot_count"])
+	require.Empty(t, hosts["zfs_exporter_build_info"])
+}
+
+func TestExporterTargetsStatus(t *testing.T) {
+	var (
+		now     = time.Unix(1700000000, 0)
+		targets = exporterTargets{newFakeExporterCollectors(nil), newFakeExporterCollectors(nil), newFakeExporterCollectors(nil)}
+		status  = func(i int) *snapshot.Status {
+			return &targets[i].snapshot.(*fakeSnapshotCollector).status
+		}
+	)
+	for i := range targets {
+		status(i).EventStreamUp = true
+	}
+	require.Equal(t, snapshot.Status{InitialListingDone: true, EventStreamUp: true}, targets.Status())
+
+	status(1).InitialListingDone = false
+	status(1).EventStreamUp = false
+	status(1).EventStreamChanged = now
+	status(2).EventStreamUp = false
+	status(2).EventStreamChanged = now.Add(-time.Minute)
+	require.Equal(t, snapshot.Status{EventStreamChanged: now.Add(-time.Minute)}, targets.Status())
+
+	require.Equal(t, pool.Status{InitialParseDone: true}, targets.PoolStatus())
+	targets[2].pool.(*fakePoolCollector).status.InitialParseDone = false
+	require.Equal(t, pool.Status{}, targets.PoolStatus())
+}
+
+// zfsNotLoaded is the output of zfs and zpool without the kernel module.
+const zfsNotLoaded = `echo 'The ZFS modules are not loaded.' >&2
+echo "Try running '/sbin/modprobe zfs' as root to load them." >&2
+exit 1
+`
+
+func TestZFSUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		scripts  map[string]string
+		up       string
+		metrics  []string
+		excluded []string
+	}{
+		{
+			name:    "module not loaded",
+			scripts: map[string]string{"zfs": zfsNotLoaded, "zpool": zfsNotLoaded},
+			up:      "zfs_up 0",
+			metrics: []string{`zfs_exporter_collector_success{collector="pool"} 1`},
+			excluded: []string{
+				"zfs_pool_status",
+				"zfs_exporter_tracked_pools",
+			},
+		},
+		{
+			name: "no pools imported",
+			scripts: map[string]string{
+				"zfs": "echo 'no datasets available' >&2\n",
+				"zpool": `if [ "$1" = "events" ]; then exec sleep 3600; fi
+echo 'no pools available' >&2
+`,
+			},
+			up: "zfs_up 1",
+			metrics: []string{
+				`zfs_exporter_collector_success{collector="pool"} 1`,
+				"zfs_exporter_tracked_pools 0",
+			},
+			excluded: []string{"zfs_pool_status"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fakeCommands(t, tc.scripts)
+			get, out := startExporter(t)
+
+			// the exporter keeps serving and is ready, as there is nothing to
+			// wait for
+			require.Eventually(t, func() bool {
+				code, _ := get("/readyz")
+				return code == http.StatusOK
+			}, 10*time.Second, 50*time.Millisecond, out.String())
+
+			var metrics string
+			require.Eventually(t, func() bool {
+				_, metrics = get("/metrics")
+				return strings.Contains(metrics, tc.up+"\n")
+			}, 10*time.Second, 50*time.Millisecond, out.String())
+			for _, m := range tc.metrics {
+				require.Contains(t, metrics, m)
+			}
+			for _, m := range tc.excluded {
+				require.NotContains(t, metrics, m)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+)
+
+// redactedValue replaces secrets in the effective configuration.
+const redactedValue = "REDACTED"
+
+// flagRedaction is how the value of a string flag is shown in the effective
+// configuration.
+type flagRedaction int
+
+const (
+	// redactFlag replaces the value, it applies to all string flags missing
+	// in flagRedactions.
+	redactFlag flagRedaction = iota
+	// showFlag shows the value as it is.
+	showFlag
+	// redactURLFlag replaces the password and the query values of URLs.
+	redactURLFlag
+	// redactKeyValueFlag replaces the values of key=value pairs, e.g. headers.
+	redactKeyValueFlag
+)
+
+// flagRedactions lists how the values of string flags are shown. Flags of
+// other types can't hold secrets and are always shown. A string flag missing
+// here is redacted, so a new flag holding a secret doesn't leak.
+var flagRedactions = map[string]flagRedaction{
+	"listen-addr":                   showFlag,
+	"listen-socket-mode":            showFlag,
+	"log-level":                     showFlag,
+	"log-format":                    showFlag,
+	"log-output":                    showFlag,
+	"web.config.file":               showFlag,
+	"text-file-output":              showFlag,
+	"text-file-mode":                showFlag,
+	"text-file-format":              showFlag,
+	"text-file-group":               showFlag,
+	"scrape-mode":                   showFlag,
+	"push.gateway-url":              redactURLFlag,
+	"push.job":                      showFlag,
+	"push.grouping-label":           showFlag,
+	"otlp.endpoint":                 redactURLFlag,
+	"otlp.protocol":                 showFlag,
+	"otlp.header":                   redactKeyValueFlag,
+	"metric-prefix":                 showFlag,
+	"label":                         showFlag,
+	"command.timeout":               showFlag,
+	"remote":                        redactURLFlag,
+	"remote.identity-file":          showFlag,
+	"remote.known-hosts":            showFlag,
+	"host-root":                     showFlag,
+	"pool-status-file":              showFlag,
+	"snapshot-list-file":            showFlag,
+	"snapshot-backend":              showFlag,
+	"events-file":                   showFlag,
+	"event-source":                  showFlag,
+	"collector.snapshot.mode":       showFlag,
+	"collector.snapshot.cache-file": showFlag,
+	"on-background-failure":         showFlag,
+	"kubernetes.kubeconfig":         showFlag,
+	"drop-privileges":               showFlag,
+	"exclude-snapshot-name":         showFlag,
+	"exclude-dataset":               showFlag,
+	"collector.dataset.properties":  showFlag,
+}
+
+// redact returns value as it is shown for redaction r.
+func (r flagRedaction) redact(value string) string {
+	switch r {
+	case showFlag:
+		return value
+	case redactURLFlag:
+		u, err := url.Parse(value)
+		if err != nil {
+			return redactedValue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redactedValue)
+		}
+		if u.RawQuery != "" {
+			query := u.Query()
+			for key := range query {
+				query[key] = []string{redactedValue}
+			}
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	case redactKeyValueFlag:
+		key, _, ok := strings.Cut(value, "=")
+		if !ok {
+			return redactedValue
+		}
+		return key + "=" + redactedValue
+	default:
+		return redactedValue
+	}
+}
+
+// effectiveConfig is the configuration the exporter runs with, after the
+// precedence of the command line, the environment variables and the defaults
+// has been resolved. Secrets are redacted.
+type effectiveConfig struct {
+	Flags     map[string]interface{} `json:"flags"`
+	WebConfig *webConfig             `json:"web_config"`
+}
+
+// newEffectiveConfig returns the redacted configuration of the flags of the
+// application of c and the web config.
+func newEffectiveConfig(c *cli.Context, web *webConfig) effectiveConfig {
+	cfg := effectiveConfig{
+		Flags:     make(map[string]interface{}),
+		WebConfig: web.redacted(),
+	}
+	for _, f := range c.App.Flags {
+		if f == cli.HelpFlag || f == cli.VersionFlag {
+			continue
+		}
+		name := f.Names()[0]
+		redaction := flagRedactions[name]
+		switch f.(type) {
+		case *cli.StringFlag:
+			cfg.Flags[name] = redaction.redact(c.String(name))
+		case *cli.StringSliceFlag:
+			values := []string{}
+			for _, v := range stringSlice(c, name) {
+				values = append(values, redaction.redact(v))
+			}
+			cfg.Flags[name] = values
+		case *cli.BoolFlag:
+			cfg.Flags[name] = c.Bool(name)
+		case *cli.IntFlag:
+			cfg.Flags[name] = c.Int(name)
+		case *cli.DurationFlag:
+			cfg.Flags[name] = c.Duration(name).String()
+		case *cli.Float64Flag:
+			cfg.Flags[name] = c.Float64(name)
+		default:
+			cfg.Flags[name] = redactedValue
+		}
+	}
+	return cfg
+}
+
+// hash returns a hash of the configuration, which fits into a float64
+// without losing precision. Secrets only change it when they are set or
+// unset, as they are redacted.
+func (cfg effectiveConfig) hash() float64 {
+	// maps are encoded with sorted keys, so the encoding is stable
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+	return float64(binary.BigEndian.Uint64(sum[:8]) >> 11)
+}
+
+func (cfg effectiveConfig) collector() prometheus.Collector {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "zfs_exporter_config_hash",
+		Help: "Hash of the effective configuration served on /config, secrets only affect it when they are set or unset.",
+	})
+	g.Set(cfg.hash())
+	return g
+}
+
+// configHandler serves the effective configuration as JSON.
+func configHandler(cfg effectiveConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cfg); err != nil {
+			logger.Warn().Msgf("error writing config: %v", err)
+		}
+	})
+}
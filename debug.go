@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+type snapshotStateSource interface {
+	State(dataset string) snapshot.State
+}
+
+type poolStateSource interface {
+	State() pool.State
+}
+
+// debugTargetState is the state of the collectors of a single target.
+type debugTargetState struct {
+	Host     string          `json:"host,omitempty"`
+	Pool     *pool.State     `json:"pool,omitempty"`
+	Snapshot *snapshot.State `json:"snapshot,omitempty"`
+}
+
+type debugState struct {
+	Targets []debugTargetState `json:"targets"`
+}
+
+// newDebugState returns what the collectors of all targets know. With a
+// non-empty dataset, only the snapshots of it and its children are included.
+func newDebugState(targets exporterTargets, dataset string) debugState {
+	state := debugState{Targets: make([]debugTargetState, 0, len(targets))}
+	for _, e := range targets {
+		t := debugTargetState{Host: e.host}
+		if s, ok := e.pool.(poolStateSource); ok {
+			poolState := s.State()
+			t.Pool = &poolState
+		}
+		if s, ok := e.snapshot.(snapshotStateSource); ok {
+			snapshotState := s.State(dataset)
+			t.Snapshot = &snapshotState
+		}
+		state.Targets = append(state.Targets, t)
+	}
+	return state
+}
+
+// debugStateHandler dumps what the collectors of all targets know as JSON.
+// The snapshots can be limited to a dataset and its children with the
+// dataset query parameter.
+func debugStateHandler(targets exporterTargets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := newDebugState(targets, r.URL.Query().Get("dataset"))
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state); err != nil {
+			logger.Warn().Msgf("error writing debug state: %v", err)
+		}
+	})
+}
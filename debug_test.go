@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+type fakeStateSnapshotCollector struct {
+	*fakeSnapshotCollector
+	state   snapshot.State
+	dataset string
+}
+
+func (f *fakeStateSnapshotCollector) State(dataset string) snapshot.State {
+	f.dataset = dataset
+	return f.state
+}
+
+type fakeStatePoolCollector struct {
+	poolCollector
+	state pool.State
+}
+
+func (f *fakeStatePoolCollector) State() pool.State {
+	return f.state
+}
+
+func TestDebugStateHandler(t *testing.T) {
+	var (
+		ts   = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+		e    = newFakeExporterCollectors(nil)
+		snap = &fakeStateSnapshotCollector{
+			fakeSnapshotCollector: e.snapshot.(*fakeSnapshotCollector),
+			state: snapshot.State{
+				Status:        snapshot.Status{Mode: snapshot.ModeEvents, InitialListingDone: true, EventStreamUp: true, EventStreamChanged: ts},
+				Resyncs:       2,
+				EventsApplied: 5,
+				Datasets: map[string][]snapshot.Snapshot{
+					"tank/data": {{Name: "daily", Creation: ts, Used: 4096}},
+				},
+			},
+		}
+	)
+	e.host = "nas1"
+	e.snapshot = snap
+	e.pool = &fakeStatePoolCollector{
+		poolCollector: e.pool,
+		state: pool.State{
+			LastAttempt: ts,
+			LastSuccess: ts,
+			Pools:       []pool.PoolState{{Name: "tank", Health: "ONLINE", Errors: pool.Errors{Checksum: 1}}},
+			Disks:       []pool.DiskState{{Name: "/dev/sda", Pool: "tank", Health: "ONLINE"}},
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	debugStateHandler(exporterTargets{e}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state?dataset=tank/data", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, "tank/data", snap.dataset)
+	require.JSONEq(t, `{
+  "targets": [{
+    "host": "nas1",
+    "pool": {
+      "last_attempt": "2023-11-14T22:13:20Z",
+      "last_success": "2023-11-14T22:13:20Z",
+      "pools": [{"name": "tank", "health": "ONLINE", "errors": {"read": 0, "write": 0, "checksum": 1}}],
+      "disks": [{"name": "/dev/sda", "pool": "tank", "health": "ONLINE", "errors": {"read": 0, "write": 0, "checksum": 0}}]
+    },
+    "snapshot": {
+      "status": {"mode": "events", "initial_listing_done": true, "event_stream_up": true, "event_stream_changed": "2023-11-14T22:13:20Z"},
+      "resyncs": 2,
+      "events_applied": 5,
+      "datasets": {"tank/data": [{"name": "daily", "creation": "2023-11-14T22:13:20Z", "used": 4096}]}
+    }
+  }]
+}`, rec.Body.String())
+}
+
+func TestDebugStateHandlerWithoutState(t *testing.T) {
+	rec := httptest.NewRecorder()
+	debugStateHandler(exporterTargets{newFakeExporterCollectors(nil)}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"targets": [{}]}`, rec.Body.String())
+}
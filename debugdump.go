@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/fixture"
+)
+
+var debugDumpCommand = &cli.Command{
+	Name:   "debug-dump",
+	Usage:  "collect the zfs and zpool output, metrics and collector state into a tarball for bug reports",
+	Action: runDebugDump,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output",
+			Value: "zfs-event-exporter-dump.tar.gz",
+			Usage: "file the tarball is written to",
+		},
+		&cli.BoolFlag{
+			Name:  "sanitize",
+			Usage: "replace the names of pools, datasets, snapshots and devices with consistent hashes",
+		},
+	},
+}
+
+// dumpCommands are the commands, which output is part of a debug dump.
+var dumpCommands = []struct {
+	filename string
+	name     string
+	args     []string
+	learn    func(*sanitizer, []byte)
+}{
+	{filename: fixture.ZpoolStatus, name: "zpool", args: []string{"status", "-pP"}, learn: (*sanitizer).learnZpoolStatus},
+	{filename: fixture.ZFSList, name: "zfs", args: []string{"list", "-H", "-p", "-t", "all", "-o", "name,type,creation,used"}, learn: (*sanitizer).learnZFSList},
+	{filename: fixture.SnapshotsList, name: "zfs", args: []string{"list", "-H", "-p", "-t", "snapshot", "-o", "name,creation,used"}, learn: (*sanitizer).learnZFSList},
+	{filename: fixture.ZpoolEvents, name: "zpool", args: []string{"events", "-H", "-v"}, learn: (*sanitizer).learnZpoolEvents},
+}
+
+// captureCommands runs the dump commands and returns their output and
+// errors by file name. The names found in the output are registered with s,
+// unless it is nil.
+func captureCommands(ctx context.Context, runner commandRunner, s *sanitizer) (map[string][]byte, map[string]error) {
+	var (
+		files  = make(map[string][]byte)
+		failed = make(map[string]error)
+	)
+	for _, cmd := range dumpCommands {
+		out, err := runner.Output(ctx, cmd.name, cmd.args...)
+		if err != nil {
+			failed[cmd.filename] = err
+		}
+		if len(out) == 0 {
+			continue
+		}
+		files[cmd.filename] = out
+		if s != nil {
+			cmd.learn(s, out)
+		}
+	}
+	return files, failed
+}
+
+// dumpFile is a single file of a debug dump.
+type dumpFile struct {
+	name string
+	data []byte
+}
+
+// debugDump collects the files of a debug dump.
+type debugDump struct {
+	files     []dumpFile
+	sanitizer *sanitizer
+}
+
+func (d *debugDump) add(name string, data []byte) {
+	d.files = append(d.files, dumpFile{name: name, data: data})
+}
+
+// addError records err in a file next to the one, which couldn't be captured.
+func (d *debugDump) addError(name string, err error) {
+	d.add(name+".error", []byte(err.Error()+"\n"))
+}
+
+// addCommands captures the output of the dump commands of all targets. When
+// sanitizing, the names found in the output are registered.
+func (d *debugDump) addCommands(ctx context.Context, c *cli.Context) error {
+	remotes, err := newCommandTargets(c)
+	if err != nil {
+		return err
+	}
+	limiter, err := newCommandLimiter(c.Float64("command.rate-limit"))
+	if err != nil {
+		return err
+	}
+	for _, r := range remotes {
+		runner, err := newCommandRunner(stringSlice(c, "command.timeout"), r.executor, limiter)
+		if err != nil {
+			return err
+		}
+		files, failed := captureCommands(ctx, runner, d.sanitizer)
+		for _, cmd := range dumpCommands {
+			filename := path.Join(r.host, cmd.filename)
+			if err, ok := failed[cmd.filename]; ok {
+				d.addError(filename, err)
+			}
+			if out, ok := files[cmd.filename]; ok {
+				d.add(filename, out)
+			}
+		}
+	}
+	return nil
+}
+
+// addExporter captures the metrics and the collector state of an exporter
+// running in-process.
+func (d *debugDump) addExporter(ctx context.Context, c *cli.Context) {
+	targets, err := newExporterTargets(ctx, c, false)
+	if err != nil {
+		d.addError("metrics.txt", err)
+		return
+	}
+
+	metrics, _ := newMetricsHandler(targets.newRegistry(targets.names()), 0)
+	for _, h := range []struct {
+		filename string
+		handler  http.Handler
+	}{
+		{filename: "metrics.txt", handler: metrics},
+		{filename: "debug-state.json", handler: debugStateHandler(targets)},
+	} {
+		rec := httptest.NewRecorder()
+		h.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			d.addError(h.filename, fmt.Errorf("unexpected status %d", rec.Code))
+		}
+		d.add(h.filename, rec.Body.Bytes())
+	}
+}
+
+// writeTo writes the dump as gzipped tarball, the files are sanitized if
+// configured.
+func (d *debugDump) writeTo(w io.Writer, now time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range d.files {
+		data := f.data
+		if d.sanitizer != nil {
+			data = d.sanitizer.sanitize(data)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func runDebugDump(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	d := &debugDump{}
+	if c.Bool("sanitize") {
+		s, err := newRandomSanitizer()
+		if err != nil {
+			return err
+		}
+		d.sanitizer = s
+	}
+
+	var version bytes.Buffer
+	writeVersion(&version, c.App.Name)
+	d.add("version.txt", version.Bytes())
+
+	if err := d.addCommands(ctx, c); err != nil {
+		return cli.Exit(err, 1)
+	}
+	d.addExporter(ctx, c)
+
+	filename := c.String("output")
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("error creating dump: %v", err), 1)
+	}
+	if err := d.writeTo(f, time.Now()); err != nil {
+		_ = f.Close()
+		return cli.Exit(fmt.Sprintf("error writing dump: %v", err), 1)
+	}
+	if err := f.Close(); err != nil {
+		return cli.Exit(fmt.Sprintf("error writing dump: %v", err), 1)
+	}
+	fmt.Fprintf(c.App.Writer, "wrote debug dump to %s\n", filename)
+	return nil
+}
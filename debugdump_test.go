@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readDump returns the files of a debug dump tarball.
+func readDump(t *testing.T, filename string) map[string]string {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	files := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[h.Name] = string(content)
+	}
+	return files
+}
+
+func runDebugDumpApp(t *testing.T, args ...string) map[string]string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "dump.tar.gz")
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	require.NoError(t, app.Run(append([]string{"zfs-event-exporter", "debug-dump", "--output", filename}, args...)))
+	require.Equal(t, "wrote debug dump to "+filename+"\n", out.String())
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	return readDump(t, filename)
+}
+
+func TestDebugDump(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": `[ "$5" = all ] && { printf 'pool\tfilesystem\t1700000000\t0\npool/data\tfilesystem\t1700000000\t0\n'; exit 0; }
+printf '` + fakeZfsList + `'
+`,
+		"zpool": `case "$1" in
+status) cat <<'EOF'
+` + fakeZpoolStatus + `EOF
+;;
+*) echo "events are not available" >&2; exit 1;;
+esac
+`,
+	})
+
+	files := runDebugDumpApp(t)
+	require.Contains(t, files["version.txt"], "version")
+	require.Equal(t, fakeZpoolStatus, files["zpool-status.txt"])
+	require.Contains(t, files["zfs-list.txt"], "pool/data\tfilesystem")
+	require.Equal(t, fakeZfsList, files["zfs-list-snapshots.txt"])
+	require.Contains(t, files["zpool-events.txt.error"], "events are not available")
+	require.Contains(t, files["metrics.txt"], `zfs_snapshot_count{dataset="pool/data"} 2`)
+	require.Contains(t, files["debug-state.json"], `"pool/data"`)
+
+	files = runDebugDumpApp(t, "--sanitize")
+	snapshots := files["zfs-list-snapshots.txt"]
+	dataset, _, ok := strings.Cut(snapshots, "@")
+	require.True(t, ok)
+	require.NotContains(t, dataset, "pool")
+	require.NotContains(t, dataset, "data")
+	for name, content := range files {
+		require.NotContains(t, content, "pool/data", name)
+		require.NotContains(t, content, "daily-1", name)
+	}
+	require.Contains(t, files["metrics.txt"], `zfs_snapshot_count{dataset="`+dataset+`"} 2`)
+	require.Contains(t, files["zfs-list.txt"], dataset+"\tfilesystem")
+	require.Contains(t, files["debug-state.json"], `"`+dataset+`"`)
+}
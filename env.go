@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// envPrefix is the prefix of the environment variables configuring the flags.
+const envPrefix = "ZFS_EVENT_EXPORTER_"
+
+// envVarName returns the environment variable of a flag, e.g.
+// ZFS_EVENT_EXPORTER_WEB_CONFIG_FILE for web.config.file. Flags of
+// subcommands include the command name, e.g. ZFS_EVENT_EXPORTER_ONCE_OUTPUT.
+func envVarName(command, flag string) string {
+	name := flag
+	if command != "" {
+		name = command + "_" + flag
+	}
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// setEnvVars configures the environment variable of every flag. It panics on
+// a flag type it doesn't know, so a new flag can't be added without one. The
+// help and version flags are shared by all commands and left alone.
+func setEnvVars(command string, flags []cli.Flag) {
+	for _, f := range flags {
+		if f == cli.HelpFlag || f == cli.VersionFlag {
+			continue
+		}
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			f.EnvVars = []string{envVarName(command, f.Name)}
+		case *cli.StringSliceFlag:
+			f.EnvVars = []string{envVarName(command, f.Name)}
+		case *cli.BoolFlag:
+			f.EnvVars = []string{envVarName(command, f.Name)}
+		case *cli.IntFlag:
+			f.EnvVars = []string{envVarName(command, f.Name)}
+		case *cli.DurationFlag:
+			f.EnvVars = []string{envVarName(command, f.Name)}
+		case *cli.Float64Flag:
+			f.EnvVars = []string{envVarName(command, f.Name)}
+		default:
+			panic(fmt.Sprintf("no environment variable for flag %v of type %T", f.Names(), f))
+		}
+	}
+}
+
+// lookupStringSliceFlag finds the definition of the slice flag name in the
+// commands of c and its parents.
+func lookupStringSliceFlag(c *cli.Context, name string) *cli.StringSliceFlag {
+	for _, ctx := range c.Lineage() {
+		if ctx.Command == nil {
+			continue
+		}
+		for _, f := range ctx.Command.Flags {
+			if f, ok := f.(*cli.StringSliceFlag); ok && f.Name == name {
+				return f
+			}
+		}
+	}
+	for _, f := range c.App.Flags {
+		if f, ok := f.(*cli.StringSliceFlag); ok && f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// stringSlice returns the values of the slice flag name. urfave/cli drops the
+// values of the environment variable as soon as the flag is given on the
+// command line, here both are merged with the command line values last, so
+// they take precedence where later values override earlier ones.
+func stringSlice(c *cli.Context, name string) []string {
+	values := c.StringSlice(name)
+
+	f := lookupStringSliceFlag(c, name)
+	if f == nil {
+		return values
+	}
+	var env []string
+	for _, v := range f.EnvVars {
+		if value := os.Getenv(v); value != "" {
+			for _, s := range strings.Split(value, ",") {
+				env = append(env, strings.TrimSpace(s))
+			}
+			break
+		}
+	}
+
+	// without the flag on the command line the values are the ones of the
+	// environment variable already
+	if len(env) == 0 || equalStrings(values, env) {
+		return values
+	}
+	return append(env, values...)
+}
+
+// regexpSlice returns the regular expressions of the slice flag name. Like
+// all slice flags, their values are split on commas, on the command line as
+// well as in the environment variable, so the parts of a regular expression
+// like x{1,3} or [,;] are joined again.
+func regexpSlice(c *cli.Context, name string) []string {
+	return joinRegexps(stringSlice(c, name))
+}
+
+// joinRegexps joins values with an unclosed brace or bracket with the
+// following values, which have been split at a comma.
+func joinRegexps(values []string) []string {
+	var (
+		result []string
+		joined string
+		open   bool
+	)
+	for _, v := range values {
+		if open {
+			joined += "," + v
+		} else {
+			joined = v
+		}
+		if open = unclosedRegexp(joined); !open {
+			result = append(result, joined)
+		}
+	}
+	if open {
+		result = append(result, joined)
+	}
+	return result
+}
+
+// unclosedRegexp reports whether re ends within a repetition or a character
+// class.
+func unclosedRegexp(re string) bool {
+	var braces, brackets bool
+	for i := 0; i < len(re); i++ {
+		switch c := re[i]; {
+		case c == '\\':
+			i++
+		case brackets:
+			brackets = c != ']'
+		case c == '[':
+			brackets = true
+		case c == '{':
+			braces = true
+		case c == '}':
+			braces = false
+		}
+	}
+	return braces || brackets
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
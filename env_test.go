@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestEnvVarName(t *testing.T) {
+	require.Equal(t, "ZFS_EVENT_EXPORTER_LISTEN_ADDR", envVarName("", "listen-addr"))
+	require.Equal(t, "ZFS_EVENT_EXPORTER_WEB_CONFIG_FILE", envVarName("", "web.config.file"))
+	require.Equal(t, "ZFS_EVENT_EXPORTER_WATCH_EVENTS_CLASS", envVarName("watch-events", "class"))
+}
+
+func TestEnvVarsAllFlags(t *testing.T) {
+	app := newApp()
+	check := func(command string, flags []cli.Flag) {
+		for _, f := range flags {
+			if f == cli.HelpFlag {
+				continue
+			}
+			ef, ok := f.(interface{ GetEnvVars() []string })
+			require.True(t, ok, f.Names())
+			require.Equal(t, []string{envVarName(command, f.Names()[0])}, ef.GetEnvVars())
+		}
+	}
+	check("", app.Flags)
+	for _, cmd := range app.Commands {
+		check(cmd.Name, cmd.Flags)
+	}
+}
+
+func TestEnvConfiguration(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	run := func(t *testing.T, args ...string) string {
+		t.Helper()
+		var out bytes.Buffer
+		app := newApp()
+		app.Writer = &out
+		require.NoError(t, app.Run(append([]string{"zfs-event-exporter"}, args...)))
+		return out.String()
+	}
+
+	t.Setenv("ZFS_EVENT_EXPORTER_METRIC_PREFIX", "storage")
+	t.Setenv("ZFS_EVENT_EXPORTER_LABEL", "site=ams1, role=backup")
+	t.Setenv("ZFS_EVENT_EXPORTER_EXCLUDE_SNAPSHOT_NAME", "daily-1{1,3}$")
+
+	t.Run("env only", func(t *testing.T) {
+		out := run(t, "once")
+		require.Contains(t, out, `storage_snapshot_count{dataset="pool/data",role="backup",site="ams1"} 1`)
+		require.Contains(t, out, `storage_pool_status{pool="pool",role="backup",site="ams1",state="online"} 1`)
+	})
+
+	t.Run("flags override and merge", func(t *testing.T) {
+		out := run(t, "--metric-prefix", "zfs", "--label", "rack=r1", "--exclude-snapshot-name", "weekly-.*", "once")
+		require.Contains(t, out, `zfs_snapshot_count{dataset="pool/data",rack="r1",role="backup",site="ams1"} 1`)
+		require.NotContains(t, out, "storage_")
+	})
+}
+
+func TestJoinRegexps(t *testing.T) {
+	for _, tc := range []struct {
+		values   []string
+		expected []string
+	}{
+		{values: nil, expected: nil},
+		{values: []string{"daily-.*", "weekly-.*"}, expected: []string{"daily-.*", "weekly-.*"}},
+		{values: []string{"daily-[0-9]{1", "3}$", "weekly-.*"}, expected: []string{"daily-[0-9]{1,3}$", "weekly-.*"}},
+		{values: []string{"^[", ";]tmp", "x{2", "}"}, expected: []string{"^[,;]tmp", "x{2,}"}},
+		// escaped and within a character class, braces are literal
+		{values: []string{`a\{`, "b[{]", "c"}, expected: []string{`a\{`, "b[{]", "c"}},
+		// an unclosed brace at the end is passed on to fail compiling
+		{values: []string{"x{1", "y"}, expected: []string{"x{1,y"}},
+	} {
+		require.Equal(t, tc.expected, joinRegexps(tc.values), tc.values)
+	}
+}
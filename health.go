@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// poolStatusRetryInterval is the time between attempts to parse the initial
+// pool status.
+const poolStatusRetryInterval = 10 * time.Second
+
+type statusSource interface {
+	Status() snapshot.Status
+	PoolStatus() pool.Status
+}
+
+// readiness reports if the exporter is serving complete data.
+type readiness struct {
+	status      statusSource
+	gracePeriod time.Duration
+	now         func() time.Time
+
+	mtx sync.Mutex
+	// wasReady is set once the exporter has been ready, from then on the
+	// event stream may be down for the grace period
+	wasReady bool
+}
+
+func newReadiness(status statusSource, gracePeriod time.Duration) *readiness {
+	return &readiness{
+		status:      status,
+		gracePeriod: gracePeriod,
+		now:         time.Now,
+	}
+}
+
+// check returns the reason why the exporter is not ready or nil.
+func (r *readiness) check() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if !r.status.PoolStatus().InitialParseDone {
+		return errors.New("initial pool status has not been parsed")
+	}
+	s := r.status.Status()
+	if !s.InitialListingDone {
+		return errors.New("initial snapshot listing has not completed")
+	}
+	if !s.EventStreamUp {
+		down := r.now().Sub(s.EventStreamChanged)
+		switch {
+		case s.Mode == snapshot.ModePoll:
+			// there is no stream to attach to, the initial listing succeeded
+			if down > r.gracePeriod {
+				return fmt.Errorf("polling snapshots is failing for %s", down.Truncate(time.Second))
+			}
+		case !r.wasReady:
+			return errors.New("zpool events stream is not attached")
+		case down > r.gracePeriod:
+			return fmt.Errorf("zpool events stream is down for %s", down.Truncate(time.Second))
+		}
+	}
+	r.wasReady = true
+	return nil
+}
+
+// primePoolStatus gathers g, which includes the pool collectors, until the
+// initial pool status has been parsed. Otherwise it would only be parsed by
+// the first scrape.
+func primePoolStatus(ctx context.Context, g prometheus.Gatherer, status statusSource, interval time.Duration) {
+	for {
+		if _, err := g.Gather(); err != nil {
+			logger.Warn().Msgf("initial pool status failed, retrying in %s: %v", interval, err)
+		}
+		if status.PoolStatus().InitialParseDone {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if err := r.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (r *readiness) collector() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "zfs_exporter_ready",
+		Help: "Whether the exporter is ready to serve complete data.",
+	}, func() float64 {
+		if r.check() != nil {
+			return 0
+		}
+		return 1
+	})
+}
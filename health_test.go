@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+type fakeSnapshotStatus struct {
+	status snapshot.Status
+}
+
+func (f *fakeSnapshotStatus) Status() snapshot.Status {
+	return f.status
+}
+
+// fakeStatusSource combines the status of fake collectors for readiness.
+type fakeStatusSource struct {
+	fakeSnapshotStatus
+	pool pool.Status
+}
+
+func (f *fakeStatusSource) PoolStatus() pool.Status {
+	return f.pool
+}
+
+func TestReadiness(t *testing.T) {
+	var (
+		now    = time.Unix(1700000000, 0)
+		source = &fakeStatusSource{}
+		r      = newReadiness(source, time.Minute)
+		reg    = prometheus.NewPedanticRegistry()
+	)
+	r.now = func() time.Time { return now }
+	reg.MustRegister(r.collector())
+
+	expect := func(t *testing.T, code int, ready string, reason string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+		require.Equal(t, code, rec.Code)
+		require.Contains(t, rec.Body.String(), reason)
+		require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_exporter_ready Whether the exporter is ready to serve complete data.
+# TYPE zfs_exporter_ready gauge
+zfs_exporter_ready `+ready+`
+`)))
+	}
+
+	t.Run("initial pool status pending", func(t *testing.T) {
+		source.status.InitialListingDone = true
+		source.status.EventStreamUp = true
+		expect(t, http.StatusServiceUnavailable, "0", "initial pool status has not been parsed")
+	})
+
+	t.Run("initial listing pending", func(t *testing.T) {
+		source.pool.InitialParseDone = true
+		source.status.InitialListingDone = false
+		expect(t, http.StatusServiceUnavailable, "0", "initial snapshot listing has not completed")
+	})
+
+	t.Run("event stream not attached", func(t *testing.T) {
+		source.status.InitialListingDone = true
+		source.status.EventStreamUp = false
+		source.status.EventStreamChanged = now
+		expect(t, http.StatusServiceUnavailable, "0", "zpool events stream is not attached")
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		source.status.EventStreamUp = true
+		expect(t, http.StatusOK, "1", "ok")
+	})
+
+	t.Run("event stream down within grace period", func(t *testing.T) {
+		source.status.EventStreamUp = false
+		source.status.EventStreamChanged = now
+		now = now.Add(30 * time.Second)
+		expect(t, http.StatusOK, "1", "ok")
+	})
+
+	t.Run("event stream down beyond grace period", func(t *testing.T) {
+		now = now.Add(time.Minute)
+		expect(t, http.StatusServiceUnavailable, "0", "zpool events stream is down for 1m30s")
+	})
+
+	t.Run("event stream recovered", func(t *testing.T) {
+		source.status.EventStreamUp = true
+		source.status.EventStreamChanged = now
+		expect(t, http.StatusOK, "1", "ok")
+	})
+}
+
+func TestReadinessPollMode(t *testing.T) {
+	var (
+		now    = time.Unix(1700000000, 0)
+		source = &fakeStatusSource{pool: pool.Status{InitialParseDone: true}}
+		r      = newReadiness(source, time.Minute)
+	)
+	r.now = func() time.Time { return now }
+	source.status = snapshot.Status{Mode: snapshot.ModePoll, InitialListingDone: true, EventStreamUp: true, EventStreamChanged: now}
+	require.NoError(t, r.check())
+
+	// a failing poll is tolerated for the grace period
+	source.status.EventStreamUp = false
+	now = now.Add(30 * time.Second)
+	require.NoError(t, r.check())
+	now = now.Add(time.Minute)
+	require.EqualError(t, r.check(), "polling snapshots is failing for 1m30s")
+
+	source.status.EventStreamUp = true
+	require.NoError(t, r.check())
+}
+
+// countingGatherer marks the pool status as parsed after the given number of
+// gathers.
+type countingGatherer struct {
+	source  *fakeStatusSource
+	succeed int
+	gathers int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.gathers++
+	if g.gathers < g.succeed {
+		return nil, errors.New("zpool status failed")
+	}
+	g.source.pool.InitialParseDone = true
+	return nil, nil
+}
+
+func TestPrimePoolStatus(t *testing.T) {
+	source := &fakeStatusSource{}
+	g := &countingGatherer{source: source, succeed: 3}
+
+	primePoolStatus(context.Background(), g, source, time.Millisecond)
+	require.Equal(t, 3, g.gathers)
+	require.True(t, source.pool.InitialParseDone)
+
+	// it gives up once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g = &countingGatherer{source: &fakeStatusSource{}, succeed: 100}
+	primePoolStatus(ctx, g, g.source, time.Hour)
+	require.Equal(t, 1, g.gathers)
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var healthcheckCommand = &cli.Command{
+	Name:   "healthcheck",
+	Usage:  "request the health endpoint of a running exporter and exit non-zero if it is not healthy, e.g. for a container HEALTHCHECK",
+	Action: runHealthcheck,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "url",
+			Usage: "URL of the health endpoint, use unix:///path/to/socket for a unix domain socket, defaults to /healthz of the listen address",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Value: 2 * time.Second,
+			Usage: "timeout of the request",
+		},
+	},
+}
+
+// healthcheckTarget returns the URL of the health endpoint and the unix
+// domain socket it is reached through, if any. Without an explicit URL it is
+// derived from the listen address of the exporter.
+func healthcheckTarget(rawURL, listenAddr string, useTLS bool) (url, socket string, err error) {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+
+	if rawURL == "" {
+		rawURL = listenAddr
+		if rawURL == "" {
+			return "", "", fmt.Errorf("the http server is disabled, no health endpoint to check")
+		}
+		if !strings.HasPrefix(rawURL, unixSocketPrefix) {
+			host, port, err := net.SplitHostPort(listenAddr)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid listen address %q: %w", listenAddr, err)
+			}
+			// connect to the loopback address instead of any address
+			switch host {
+			case "", "0.0.0.0":
+				host = "127.0.0.1"
+			case "::":
+				host = "::1"
+			}
+			return scheme + "://" + net.JoinHostPort(host, port) + "/healthz", "", nil
+		}
+	}
+
+	if strings.HasPrefix(rawURL, unixSocketPrefix) {
+		socket = strings.TrimPrefix(rawURL, unixSocketPrefix)
+		if socket == "" {
+			return "", "", fmt.Errorf("empty unix socket path in URL %q", rawURL)
+		}
+		// the host name is only used for the Host header
+		return scheme + "://localhost/healthz", socket, nil
+	}
+	return rawURL, "", nil
+}
+
+// newHealthcheckClient returns a client using the TLS settings of the http
+// client config, which connects to socket instead of the host of the URL if
+// it is set.
+func newHealthcheckClient(web *webConfig, socket string, timeout time.Duration) (*http.Client, error) {
+	client, err := web.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = timeout
+	if socket == "" {
+		return client, nil
+	}
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	client.Transport = transport
+	return client, nil
+}
+
+// healthcheck requests url and returns an error unless it responds with 200.
+// The credentials of the http client config are used for basic
+// authentication.
+func healthcheck(ctx context.Context, client *http.Client, web *webConfig, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	user, password, ok, err := web.basicAuth()
+	if err != nil {
+		return err
+	}
+	if ok {
+		req.SetBasicAuth(user, password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func runHealthcheck(c *cli.Context) error {
+	web, err := loadWebConfig(c.String("web.config.file"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	url, socket, err := healthcheckTarget(c.String("url"), c.String("listen-addr"), web.TLSServerConfig != nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	client, err := newHealthcheckClient(web, socket, c.Duration("timeout"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err := healthcheck(c.Context, client, web, url); err != nil {
+		return cli.Exit(fmt.Sprintf("unhealthy: %v", err), 1)
+	}
+	fmt.Fprintln(c.App.Writer, "ok")
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// runHealthcheckApp runs the healthcheck subcommand with the global flags
+// args and returns its output and exit code.
+func runHealthcheckApp(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	var (
+		out, errOut bytes.Buffer
+		exitCode    int
+		oldExiter   = cli.OsExiter
+	)
+	cli.OsExiter = func(code int) { exitCode = code }
+	defer func() { cli.OsExiter = oldExiter }()
+
+	app := newApp()
+	app.Writer = &out
+	app.ErrWriter = &errOut
+	_ = app.Run(append(append([]string{"zfs-event-exporter"}, args...), "healthcheck"))
+	return out.String(), exitCode
+}
+
+func TestHealthcheckTarget(t *testing.T) {
+	for _, tc := range []struct {
+		url, listenAddr string
+		tls             bool
+		expectedURL     string
+		expectedSocket  string
+	}{
+		{listenAddr: ":9128", expectedURL: "http://127.0.0.1:9128/healthz"},
+		{listenAddr: ":9128", tls: true, expectedURL: "https://127.0.0.1:9128/healthz"},
+		{listenAddr: "[::]:9128", expectedURL: "http://[::1]:9128/healthz"},
+		{listenAddr: "192.0.2.1:9128", expectedURL: "http://192.0.2.1:9128/healthz"},
+		{listenAddr: "unix:///run/zfs.sock", expectedURL: "http://localhost/healthz", expectedSocket: "/run/zfs.sock"},
+		{url: "http://exporter:9128/readyz", listenAddr: ":9128", expectedURL: "http://exporter:9128/readyz"},
+		{url: "unix:///tmp/zfs.sock", expectedURL: "http://localhost/healthz", expectedSocket: "/tmp/zfs.sock"},
+	} {
+		url, socket, err := healthcheckTarget(tc.url, tc.listenAddr, tc.tls)
+		require.NoError(t, err)
+		require.Equal(t, tc.expectedURL, url)
+		require.Equal(t, tc.expectedSocket, socket)
+	}
+
+	for _, invalid := range []string{"", "9128", "unix://"} {
+		_, _, err := healthcheckTarget("", invalid, false)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	t.Run("healthy", func(t *testing.T) {
+		out, code := runHealthcheckApp(t, "--listen-addr", srv.Listener.Addr().String())
+		require.Equal(t, 0, code)
+		require.Equal(t, "ok\n", out)
+	})
+
+	t.Run("unhealthy", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		defer func() { status = http.StatusOK }()
+
+		_, code := runHealthcheckApp(t, "--listen-addr", srv.Listener.Addr().String())
+		require.Equal(t, 1, code)
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		require.NoError(t, l.Close())
+
+		_, code := runHealthcheckApp(t, "--listen-addr", addr)
+		require.Equal(t, 1, code)
+	})
+}
+
+func TestHealthcheckUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zfs.sock")
+	l, err := listen(unixSocketPrefix+path, 0o600)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: mux}}
+	srv.Start()
+	defer srv.Close()
+
+	out, code := runHealthcheckApp(t, "--listen-addr", unixSocketPrefix+path)
+	require.Equal(t, 0, code)
+	require.Equal(t, "ok\n", out)
+}
+
+func TestHealthcheckBasicAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	srv := httptest.NewServer(testWebConfig(t).handler(mux))
+	defer srv.Close()
+
+	// the users of the server side only and with the credentials of the http
+	// client config
+	withoutCredentials := testWebConfigFile(t)
+	data, err := os.ReadFile(withoutCredentials)
+	require.NoError(t, err)
+	withCredentials := filepath.Join(t.TempDir(), "web.yml")
+	require.NoError(t, os.WriteFile(withCredentials, append(data, []byte("http_client_config:\n  basic_auth:\n    username: prometheus\n    password: secret\n")...), 0o600))
+
+	_, code := runHealthcheckApp(t, "--listen-addr", srv.Listener.Addr().String(), "--web.config.file", withoutCredentials)
+	require.Equal(t, 1, code)
+
+	out, code := runHealthcheckApp(t, "--listen-addr", srv.Listener.Addr().String(), "--web.config.file", withCredentials)
+	require.Equal(t, 0, code)
+	require.Equal(t, "ok\n", out)
+}
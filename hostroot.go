@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// hostNamespaces are the namespaces of the host, which commands are executed
+// in with --host-root.
+var hostNamespaces = []string{"mnt", "uts", "ipc", "net", "pid"}
+
+// checkHostRoot verifies the root file system of the host is mounted at root
+// and the namespaces of its init process are accessible. As nsenter enters
+// the namespaces of pid 1, the exporter has to share the PID namespace of the
+// host.
+func checkHostRoot(root string) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("--host-root is only supported on Linux")
+	}
+
+	var hostPID string
+	for _, ns := range hostNamespaces {
+		link, err := os.Readlink(filepath.Join(root, "proc", "1", "ns", ns))
+		if err != nil {
+			return fmt.Errorf("namespaces of the host are not accessible below %s, mount the root file system of the host there and run privileged: %w", root, err)
+		}
+		if ns == "pid" {
+			hostPID = link
+		}
+	}
+
+	ownPID, err := os.Readlink("/proc/1/ns/pid")
+	if err != nil {
+		return fmt.Errorf("error reading PID namespace of pid 1: %w", err)
+	}
+	if ownPID != hostPID {
+		return fmt.Errorf("pid 1 is not the init process of the host mounted at %s, run the exporter in the PID namespace of the host", root)
+	}
+
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		return fmt.Errorf("nsenter is required for --host-root: %w", err)
+	}
+	return nil
+}
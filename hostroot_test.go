@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHostRoot creates a root file system with the namespace links of pid 1.
+func fakeHostRoot(t *testing.T, links map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "proc", "1", "ns")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	for ns, link := range links {
+		require.NoError(t, os.Symlink(link, filepath.Join(dir, ns)))
+	}
+	return root
+}
+
+func TestCheckHostRoot(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		require.Error(t, checkHostRoot("/"))
+		t.Skip("host root is only supported on Linux")
+	}
+
+	err := checkHostRoot(t.TempDir())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not accessible")
+
+	err = checkHostRoot(fakeHostRoot(t, map[string]string{"mnt": "mnt:[1]", "uts": "uts:[2]"}))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not accessible")
+
+	err = checkHostRoot(fakeHostRoot(t, map[string]string{
+		"mnt": "mnt:[1]",
+		"uts": "uts:[2]",
+		"ipc": "ipc:[3]",
+		"net": "net:[4]",
+		"pid": "pid:[5]",
+	}))
+	require.Error(t, err)
+	if _, readErr := os.Readlink("/proc/1/ns/pid"); readErr == nil {
+		require.Contains(t, err.Error(), "PID namespace of the host")
+	}
+
+	if _, err := os.Readlink("/proc/1/ns/mnt"); err != nil {
+		t.Skip("namespaces of pid 1 are not accessible")
+	}
+	fakeCommands(t, map[string]string{"nsenter": ""})
+	require.NoError(t, checkHostRoot("/"))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	textFileFormatPrometheus = "prometheus"
+	textFileFormatInflux     = "influx"
+)
+
+func validateTextFileFormat(format string) error {
+	switch format {
+	case textFileFormatPrometheus, textFileFormatInflux:
+		return nil
+	}
+	return fmt.Errorf("invalid text file format %q, expected %s or %s", format, textFileFormatPrometheus, textFileFormatInflux)
+}
+
+// The escaping follows the influx serializer of Telegraf: control characters
+// and the delimiters of the element are escaped with a backslash.
+var (
+	// influxMeasurementEscaper escapes measurement names of the line protocol.
+	influxMeasurementEscaper = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\f", `\f`, "\r", `\r`, ",", `\,`, " ", `\ `)
+
+	// influxKeyEscaper escapes tag keys, tag values and field keys of the line
+	// protocol.
+	influxKeyEscaper = strings.NewReplacer("\t", `\t`, "\n", `\n`, "\f", `\f`, "\r", `\r`, ",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxField is a field of a line, the value is a float.
+type influxField struct {
+	key   string
+	value float64
+}
+
+// influxFields converts a sample into line protocol fields, like the
+// prometheus input of Telegraf does: counters, gauges and untyped metrics
+// have a single field named after their type, histograms a field per bucket
+// and summaries a field per quantile next to the count and sum.
+func influxFields(t dto.MetricType, m *dto.Metric) []influxField {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return []influxField{{key: "counter", value: m.GetCounter().GetValue()}}
+	case dto.MetricType_GAUGE:
+		return []influxField{{key: "gauge", value: m.GetGauge().GetValue()}}
+	case dto.MetricType_UNTYPED:
+		return []influxField{{key: "value", value: m.GetUntyped().GetValue()}}
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		h := m.GetHistogram()
+		fields := []influxField{
+			{key: "count", value: float64(h.GetSampleCount())},
+			{key: "sum", value: h.GetSampleSum()},
+		}
+		for _, b := range h.GetBucket() {
+			if math.IsInf(b.GetUpperBound(), 1) {
+				continue
+			}
+			fields = append(fields, influxField{key: strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64), value: float64(b.GetCumulativeCount())})
+		}
+		return append(fields, influxField{key: "+Inf", value: float64(h.GetSampleCount())})
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		fields := []influxField{
+			{key: "count", value: float64(s.GetSampleCount())},
+			{key: "sum", value: s.GetSampleSum()},
+		}
+		for _, q := range s.GetQuantile() {
+			fields = append(fields, influxField{key: strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64), value: q.GetValue()})
+		}
+		return fields
+	}
+	return nil
+}
+
+// encodeInflux writes families in the InfluxDB line protocol to w. The metric
+// name becomes the measurement and the labels become tags, sorted by key. The
+// samples are timestamped with now, unless they carry their own timestamp.
+// NaN and infinite values can't be represented and are left out, as are
+// labels with an empty value.
+func encodeInflux(w io.Writer, families []*dto.MetricFamily, now time.Time) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		measurement := influxMeasurementEscaper.Replace(f.GetName())
+		for _, m := range f.GetMetric() {
+			var fields []string
+			for _, field := range influxFields(f.GetType(), m) {
+				if math.IsNaN(field.value) || math.IsInf(field.value, 0) {
+					continue
+				}
+				fields = append(fields, influxKeyEscaper.Replace(field.key)+"="+strconv.FormatFloat(field.value, 'g', -1, 64))
+			}
+			if len(fields) == 0 {
+				continue
+			}
+
+			labels := append([]*dto.LabelPair(nil), m.GetLabel()...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+			_, _ = bw.WriteString(measurement)
+			for _, l := range labels {
+				if l.GetValue() == "" {
+					continue
+				}
+				_, _ = bw.WriteString("," + influxKeyEscaper.Replace(l.GetName()) + "=" + influxKeyEscaper.Replace(l.GetValue()))
+			}
+
+			ts := now.UnixNano()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs() * int64(time.Millisecond)
+			}
+			_, _ = bw.WriteString(" " + strings.Join(fields, ",") + " " + strconv.FormatInt(ts, 10) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// influxHandler serves the metrics of g in the InfluxDB line protocol. Like
+// promhttp.ContinueOnError, a failing collector is logged and the metrics
+// gathered nonetheless are served.
+func influxHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		now := time.Now()
+		families, err := g.Gather()
+		if err != nil {
+			logger.Error().Msgf("error gathering metrics: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = encodeInflux(w, families, now)
+	})
+}
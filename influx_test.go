@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeInflux(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "zfs_pool_disk_status", Help: "Status."}, []string{"disk", "pool", "state"})
+	status.WithLabelValues("/dev/disk/by-id/ata-WDC_WD40EFRX-68N32N0_WD-WCC7K1234567-part1", "tank/raidz1-0", "online").Set(1)
+	status.WithLabelValues("/dev/disk/by-id/ata-WDC_WD40EFRX-68N32N0_WD-WCC7K1234567-part1", "tank/raidz1-0", "faulted").Set(0)
+
+	errs := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "zfs_pool_errors_total", Help: "Errors."}, []string{"pool", "type"})
+	errs.WithLabelValues("tank", "read").Add(3)
+
+	escaped := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "zfs_snapshot_count", Help: "Count."}, []string{"dataset", "site"})
+	escaped.WithLabelValues("tank/my data,v=1", "").Set(2)
+	escaped.WithLabelValues("tank/nan", "ams1").Set(math.NaN())
+
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "zfs_exporter_duration_seconds", Help: "Duration.", Buckets: []float64{0.5, 1}})
+	duration.Observe(0.25)
+	duration.Observe(2)
+
+	reg.MustRegister(status, errs, escaped, duration)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, encodeInflux(&buf, families, time.Unix(1700000000, 0)))
+	require.Equal(t, strings.Join([]string{
+		"zfs_exporter_duration_seconds count=2,sum=2.25,0.5=1,1=1,+Inf=2 1700000000000000000",
+		"zfs_pool_disk_status,disk=/dev/disk/by-id/ata-WDC_WD40EFRX-68N32N0_WD-WCC7K1234567-part1,pool=tank/raidz1-0,state=faulted gauge=0 1700000000000000000",
+		"zfs_pool_disk_status,disk=/dev/disk/by-id/ata-WDC_WD40EFRX-68N32N0_WD-WCC7K1234567-part1,pool=tank/raidz1-0,state=online gauge=1 1700000000000000000",
+		"zfs_pool_errors_total,pool=tank,type=read counter=3 1700000000000000000",
+		`zfs_snapshot_count,dataset=tank/my\ data\,v\=1 gauge=2 1700000000000000000`,
+		"",
+	}, "\n"), buf.String())
+}
+
+func TestInfluxHandler(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_exporter_ready", Help: "Ready."}))
+
+	rec := httptest.NewRecorder()
+	influxHandler(reg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Regexp(t, `^zfs_exporter_ready gauge=0 \d+\n$`, rec.Body.String())
+
+	// a failing collector only leaves out its metrics
+	failing := prometheus.Gatherers{reg, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("zpool status failed")
+	})}
+	rec = httptest.NewRecorder()
+	influxHandler(failing).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Regexp(t, `^zfs_exporter_ready gauge=0 \d+\n$`, rec.Body.String())
+}
+
+func TestOnceInflux(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_TEXT_FILE_FORMAT", textFileFormatInflux)
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Regexp(t, `(?m)^zfs_snapshot_count,dataset=pool/data gauge=2 \d+$`, out)
+	require.Regexp(t, `(?m)^zfs_pool_status,pool=pool,state=online gauge=1 \d+$`, out)
+}
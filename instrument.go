@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// instrumentedCollector wraps a collector and reports the duration and success
+// of its Collect calls. A collection is considered failed, when the collector
+// sends an invalid metric or panics. Panics are recovered, so they don't affect
+// the other collectors. Invalid metrics are passed on, the metrics handler
+// leaves them out and serves the other collectors.
+type instrumentedCollector struct {
+	name      string
+	collector prometheus.Collector
+	now       func() time.Time
+
+	descDuration *prometheus.Desc
+	descSuccess  *prometheus.Desc
+	metricPanics prometheus.Counter
+}
+
+func newInstrumentedCollector(name string, c prometheus.Collector) *instrumentedCollector {
+	// the collector name is a constant label, so the descriptors of multiple
+	// wrapped collectors don't collide in a registry
+	labels := prometheus.Labels{"collector": name}
+	return &instrumentedCollector{
+		name:      name,
+		collector: c,
+		now:       time.Now,
+		descDuration: prometheus.NewDesc(
+			"zfs_exporter_collector_duration_seconds",
+			"Duration of the last collection of a collector.",
+			nil, labels,
+		),
+		descSuccess: prometheus.NewDesc(
+			"zfs_exporter_collector_success",
+			"Whether the last collection of a collector succeeded.",
+			nil, labels,
+		),
+		metricPanics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "zfs_exporter_collector_panics_total",
+			Help:        "Total count of recovered panics of a collector.",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+func (i *instrumentedCollector) Describe(ch chan<- *prometheus.Desc) {
+	i.collector.Describe(ch)
+	ch <- i.descDuration
+	ch <- i.descSuccess
+	i.metricPanics.Describe(ch)
+}
+
+// collect calls Collect of the wrapped collector and reports whether it
+// returned without panicking.
+func (i *instrumentedCollector) collect(ch chan<- prometheus.Metric) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			i.metricPanics.Inc()
+			logger.Error().
+				Str("collector", i.name).
+				Str("panic", fmt.Sprint(r)).
+				Str("stack", string(debug.Stack())).
+				Msg("recovered panic in collector")
+		}
+	}()
+	i.collector.Collect(ch)
+	return true
+}
+
+func (i *instrumentedCollector) Collect(ch chan<- prometheus.Metric) {
+	var (
+		start   = i.now()
+		success = 1.0
+		inner   = make(chan prometheus.Metric)
+		done    = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+		var m dto.Metric
+		for metric := range inner {
+			if err := metric.Write(&m); err != nil {
+				success = 0
+			}
+			m.Reset()
+			ch <- metric
+		}
+	}()
+
+	ok := i.collect(inner)
+	close(inner)
+	<-done
+	if !ok {
+		success = 0
+	}
+
+	ch <- prometheus.MustNewConstMetric(i.descDuration, prometheus.GaugeValue, i.now().Sub(start).Seconds())
+	ch <- prometheus.MustNewConstMetric(i.descSuccess, prometheus.GaugeValue, success)
+	i.metricPanics.Collect(ch)
+}
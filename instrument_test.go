@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCollector takes a fixed time to collect and optionally fails.
+type fakeCollector struct {
+	desc  *prometheus.Desc
+	now   time.Time
+	sleep time.Duration
+	err   error
+}
+
+func (f *fakeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.desc
+}
+
+func (f *fakeCollector) Collect(ch chan<- prometheus.Metric) {
+	f.now = f.now.Add(f.sleep)
+	if f.err != nil {
+		ch <- prometheus.NewInvalidMetric(f.desc, f.err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(f.desc, prometheus.GaugeValue, 1)
+}
+
+func TestInstrumentedCollector(t *testing.T) {
+	var (
+		fake = &fakeCollector{
+			desc:  prometheus.NewDesc("zfs_pool_status", "Status of ZFS pool", nil, nil),
+			sleep: 1500 * time.Millisecond,
+		}
+		fast = &fakeCollector{
+			desc: prometheus.NewDesc("zfs_snapshot_count", "Count of existing ZFS snapshots.", nil, nil),
+		}
+		reg = prometheus.NewPedanticRegistry()
+	)
+	for name, c := range map[string]*fakeCollector{"pool": fake, "snapshot": fast} {
+		c := c
+		i := newInstrumentedCollector(name, c)
+		// the fake collector advances its own clock while collecting
+		i.now = func() time.Time { return c.now }
+		reg.MustRegister(i)
+	}
+
+	expected := func(success string) string {
+		return `
+# HELP zfs_exporter_collector_duration_seconds Duration of the last collection of a collector.
+# TYPE zfs_exporter_collector_duration_seconds gauge
+zfs_exporter_collector_duration_seconds{collector="pool"} 1.5
+zfs_exporter_collector_duration_seconds{collector="snapshot"} 0
+# HELP zfs_exporter_collector_success Whether the last collection of a collector succeeded.
+# TYPE zfs_exporter_collector_success gauge
+zfs_exporter_collector_success{collector="pool"} ` + success + `
+zfs_exporter_collector_success{collector="snapshot"} 1
+`
+	}
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected("1")),
+		"zfs_exporter_collector_duration_seconds", "zfs_exporter_collector_success"))
+
+	// the invalid metric is still passed on, so the gather fails as before
+	fake.err = errors.New("zpool status failed")
+	err := testutil.GatherAndCompare(reg, strings.NewReader(expected("0")),
+		"zfs_exporter_collector_duration_seconds", "zfs_exporter_collector_success")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "zpool status failed")
+
+	families, _ := reg.Gather()
+	var success map[string]float64
+	for _, f := range families {
+		if f.GetName() != "zfs_exporter_collector_success" {
+			continue
+		}
+		success = make(map[string]float64)
+		for _, m := range f.GetMetric() {
+			success[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	require.Equal(t, map[string]float64{"pool": 0, "snapshot": 1}, success)
+}
+
+// panickingCollector sends a metric and panics afterwards.
+type panickingCollector struct {
+	desc *prometheus.Desc
+}
+
+func (p *panickingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *panickingCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, 1)
+	var status map[string]int
+	status["tank"] = 1
+}
+
+func TestInstrumentedCollectorPanic(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(
+		newInstrumentedCollector("pool", &panickingCollector{
+			desc: prometheus.NewDesc("zfs_pool_status", "Status of ZFS pool", nil, nil),
+		}),
+		newInstrumentedCollector("snapshot", &fakeCollector{
+			desc: prometheus.NewDesc("zfs_snapshot_count", "Count of existing ZFS snapshots.", nil, nil),
+		}),
+	)
+	h, _ := newMetricsHandler(reg, 0)
+
+	for i := 1; i <= 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		body := rec.Body.String()
+		require.Contains(t, body, "zfs_snapshot_count 1\n")
+		require.Contains(t, body, `zfs_exporter_collector_success{collector="pool"} 0`)
+		require.Contains(t, body, `zfs_exporter_collector_success{collector="snapshot"} 1`)
+		require.Contains(t, body, fmt.Sprintf(`zfs_exporter_collector_panics_total{collector="pool"} %d`, i))
+		require.Contains(t, body, `zfs_exporter_collector_panics_total{collector="snapshot"} 0`)
+	}
+}
+
+func TestMetricsHandlerCollectorError(t *testing.T) {
+	var (
+		pool = &fakeCollector{
+			desc: prometheus.NewDesc("zfs_pool_status", "Status of ZFS pool", nil, nil),
+			err:  errors.New("zpool status timed out"),
+		}
+		snapshot = &fakeCollector{
+			desc: prometheus.NewDesc("zfs_snapshot_count", "Count of existing ZFS snapshots.", nil, nil),
+		}
+		reg = prometheus.NewPedanticRegistry()
+	)
+	reg.MustRegister(newInstrumentedCollector("pool", pool), newInstrumentedCollector("snapshot", snapshot))
+	h, _ := newMetricsHandler(reg, 0)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	require.Contains(t, body, "zfs_snapshot_count 1\n")
+	require.NotContains(t, body, "zfs_pool_status")
+	require.Contains(t, body, `zfs_exporter_collector_success{collector="pool"} 0`)
+	require.Contains(t, body, `zfs_exporter_collector_success{collector="snapshot"} 1`)
+
+	// the pool collector recovers with the next scrape
+	pool.err = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, rec.Body.String(), "zfs_pool_status 1\n")
+	require.Contains(t, rec.Body.String(), `zfs_exporter_collector_success{collector="pool"} 1`)
+}
+
+func TestMetricsHandlerNativeHistograms(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        "zfs_pool_txg_sync_seconds",
+		Help:                        "Time spent syncing the committed transaction groups of the pool.",
+		NativeHistogramBucketFactor: 1.1,
+	})
+	h.Observe(0.25)
+	h.Observe(1.5)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newInstrumentedCollector("txg", h))
+	handler, _ := newMetricsHandler(reg, 0)
+
+	// native histograms are only part of the protobuf exposition
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, expfmt.NewFormat(expfmt.TypeProtoDelim), expfmt.ResponseFormat(rec.Header()))
+
+	var found bool
+	dec := expfmt.NewDecoder(rec.Body, expfmt.ResponseFormat(rec.Header()))
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		if mf.GetName() != "zfs_pool_txg_sync_seconds" {
+			continue
+		}
+		found = true
+		hist := mf.GetMetric()[0].GetHistogram()
+		require.Equal(t, uint64(2), hist.GetSampleCount())
+		require.Equal(t, int32(3), hist.GetSchema())
+		require.NotEmpty(t, hist.GetPositiveSpan())
+		require.Empty(t, hist.GetBucket())
+	}
+	require.True(t, found)
+
+	// OpenMetrics is still negotiated, without the native buckets
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Header().Get("Content-Type"), "application/openmetrics-text")
+	require.Contains(t, rec.Body.String(), "zfs_pool_txg_sync_seconds_count 2\n")
+}
@@ -0,0 +1,236 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/dataset"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+// integrationPoolPrefix is the prefix of the pools created by the integration
+// tests, leftovers of killed runs are destroyed by scripts/integration-test.sh.
+const integrationPoolPrefix = "zfsexportertest"
+
+// integrationPoolSize is the size of the file backing a pool, zpool requires
+// at least 64 MiB.
+const integrationPoolSize = 128 << 20
+
+// zfsCmd runs a zfs or zpool command and fails the test, if it fails.
+func zfsCmd(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	require.NoError(t, err, "%s %v: %s", name, args, out)
+	return string(out)
+}
+
+// newIntegrationPool creates a pool backed by a file in a temporary directory
+// and returns its name. The test is skipped unless it runs as root on a host
+// with ZFS. The pool is destroyed once the test finished, even if it failed.
+func newIntegrationPool(t *testing.T) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests require root")
+	}
+	for _, name := range []string{"zfs", "zpool"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("integration tests require %s: %v", name, err)
+		}
+	}
+	if out, err := exec.Command("zpool", "list", "-H").CombinedOutput(); err != nil {
+		t.Skipf("integration tests require the ZFS kernel module: %s", out)
+	}
+
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(disk)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(integrationPoolSize))
+	require.NoError(t, f.Close())
+
+	// the pool isn't added to the cache file, so it isn't imported again
+	// after a reboot
+	name := fmt.Sprintf("%s%d", integrationPoolPrefix, os.Getpid())
+	zfsCmd(t, "zpool", "create", "-o", "cachefile=none", "-m", "none", name, disk)
+	t.Cleanup(func() {
+		if out, err := exec.Command("zpool", "destroy", "-f", name).CombinedOutput(); err != nil {
+			t.Errorf("failed to destroy pool %s: %v: %s", name, err, out)
+		}
+	})
+	return name
+}
+
+// newIntegrationCollectors creates the collectors against the live system,
+// following zpool events if follow is set.
+func newIntegrationCollectors(t *testing.T, ctx context.Context, follow bool) (*exporterCollectors, *prometheus.Registry) {
+	t.Helper()
+	runner := command.NewRunner(command.DefaultTimeout)
+	e, err := newExporterCollectors(ctx, runner, nil, offlineInputs{}, "zfs", func(_, _ string) bool { return true }, follow, 0, 0)
+	require.NoError(t, err)
+	e.poolCount = dataset.NewCountCollector(logger, runner, "zfs", time.Minute)
+	e.snapshot.Observe(e.poolCount.Notify)
+	return e, e.newRegistry(e.names())
+}
+
+// gatherValue returns the value of the metric name with labels, other labels
+// of the metric are ignored.
+func gatherValue(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+	families, err := g.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			values := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				values[l.GetName()] = l.GetValue()
+			}
+			for k, v := range labels {
+				if values[k] != v {
+					continue metrics
+				}
+			}
+			switch {
+			case m.Gauge != nil:
+				return m.GetGauge().GetValue(), true
+			case m.Counter != nil:
+				return m.GetCounter().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestIntegrationOnce(t *testing.T) {
+	pool := newIntegrationPool(t)
+	zfsCmd(t, "zfs", "create", pool+"/data")
+	zfsCmd(t, "zfs", "snapshot", pool+"/data@first")
+	zfsCmd(t, "zfs", "snapshot", pool+"/data@second")
+
+	_, reg := newIntegrationCollectors(t, context.Background(), false)
+
+	v, ok := gatherValue(t, reg, "zfs_pool_status", map[string]string{"pool": pool, "state": "online"})
+	require.True(t, ok)
+	require.Equal(t, 1.0, v)
+
+	v, ok = gatherValue(t, reg, "zfs_pool_disk_status", map[string]string{"pool": pool, "state": "online"})
+	require.True(t, ok)
+	require.Equal(t, 1.0, v)
+
+	v, ok = gatherValue(t, reg, "zfs_snapshot_count", map[string]string{"dataset": pool + "/data"})
+	require.True(t, ok)
+	require.Equal(t, 2.0, v)
+
+	v, ok = gatherValue(t, reg, "zfs_pool_filesystems", map[string]string{"pool": pool})
+	require.True(t, ok)
+	require.Equal(t, 2.0, v)
+
+	v, ok = gatherValue(t, reg, "zfs_up", nil)
+	require.True(t, ok)
+	require.Equal(t, 1.0, v)
+}
+
+func TestIntegrationEvents(t *testing.T) {
+	pool := newIntegrationPool(t)
+	zfsCmd(t, "zfs", "create", pool+"/data")
+	zfsCmd(t, "zfs", "snapshot", pool+"/data@initial")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e, reg := newIntegrationCollectors(t, ctx, true)
+	errCh := make(chan error, 1)
+	go func() { errCh <- e.snapshot.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-errCh)
+		e.snapshot.Wait()
+	})
+	require.Eventually(t, func() bool {
+		s := e.snapshot.Status()
+		return s.InitialListingDone && s.EventStreamUp
+	}, time.Minute, 100*time.Millisecond)
+
+	snapshots := func(dataset string) func() float64 {
+		return func() float64 {
+			v, _ := gatherValue(t, reg, "zfs_snapshot_count", map[string]string{"dataset": dataset})
+			return v
+		}
+	}
+	requireEventually := func(expected float64, value func() float64) {
+		t.Helper()
+		require.Eventually(t, func() bool { return value() == expected }, time.Minute, 100*time.Millisecond)
+	}
+	requireEventually(1, snapshots(pool+"/data"))
+
+	// snapshots taken while the exporter runs are only seen by following
+	// the events, as the snapshots are not listed again
+	zfsCmd(t, "zfs", "snapshot", pool+"/data@second")
+	requireEventually(2, snapshots(pool+"/data"))
+	zfsCmd(t, "zfs", "snapshot", "-r", pool+"@recursive")
+	requireEventually(3, snapshots(pool+"/data"))
+	requireEventually(1, snapshots(pool))
+
+	zfsCmd(t, "zfs", "destroy", pool+"/data@initial")
+	requireEventually(2, snapshots(pool+"/data"))
+
+	// the pool counts are listed again after snapshot events
+	requireEventually(3, func() float64 {
+		v, _ := gatherValue(t, reg, "zfs_pool_snapshots_total", map[string]string{"pool": pool})
+		return v
+	})
+
+	// the listing agrees with the events
+	out := zfsCmd(t, "zfs", "list", "-H", "-t", "snapshot", "-o", "name", "-r", pool+"/data")
+	require.Equal(t, pool+"/data@second\n"+pool+"/data@recursive\n", out)
+}
+
+func TestIntegrationSnapshotBackends(t *testing.T) {
+	libzfs, err := snapshot.NewLister(logger, snapshot.BackendLibZFS, nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	pool := newIntegrationPool(t)
+	zfsCmd(t, "zfs", "create", pool+"/data")
+	zfsCmd(t, "zfs", "create", "-V", "8M", pool+"/volume")
+	zfsCmd(t, "zfs", "snapshot", "-r", pool+"@first")
+	zfsCmd(t, "zfs", "snapshot", pool+"/data@second")
+
+	cmd, err := snapshot.NewLister(logger, snapshot.BackendExec, command.NewRunner(command.DefaultTimeout))
+	require.NoError(t, err)
+
+	// both backends list the same snapshots of the pool, for all datasets
+	// and a single one
+	list := func(l snapshot.Lister, datasets ...string) map[string][]snapshot.Snapshot {
+		result := make(map[string][]snapshot.Snapshot)
+		skipped, err := l.List(context.Background(), func(dataset string, snap snapshot.Snapshot) {
+			if dataset == pool || strings.HasPrefix(dataset, pool+"/") {
+				result[dataset] = append(result[dataset], snap)
+			}
+		}, datasets...)
+		require.NoError(t, err)
+		require.Equal(t, 0, skipped)
+		for _, snapshots := range result {
+			sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+		}
+		return result
+	}
+	expected := list(cmd)
+	require.Len(t, expected, 3)
+	require.Len(t, expected[pool+"/data"], 2)
+	require.Equal(t, expected, list(libzfs))
+	require.Equal(t, list(cmd, pool+"/data"), list(libzfs, pool+"/data"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jsonFloat is a sample value, NaN and infinite values are encoded as the
+// strings "NaN", "+Inf" and "-Inf" as JSON has no numbers for them.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
+
+// jsonPoint is a single sample of a family. Counters, gauges and untyped
+// metrics have a value, histograms and summaries a count, a sum and their
+// cumulative buckets or quantiles keyed by the upper bound or quantile.
+type jsonPoint struct {
+	Labels    map[string]string    `json:"labels"`
+	Value     *jsonFloat           `json:"value,omitempty"`
+	Count     *uint64              `json:"count,omitempty"`
+	Sum       *jsonFloat           `json:"sum,omitempty"`
+	Buckets   map[string]uint64    `json:"buckets,omitempty"`
+	Quantiles map[string]jsonFloat `json:"quantiles,omitempty"`
+}
+
+// jsonFamily is a metric family as served by /metrics.json.
+type jsonFamily struct {
+	Name   string      `json:"name"`
+	Help   string      `json:"help"`
+	Type   string      `json:"type"`
+	Points []jsonPoint `json:"points"`
+}
+
+func newJSONPoint(t dto.MetricType, m *dto.Metric) jsonPoint {
+	p := jsonPoint{Labels: make(map[string]string, len(m.GetLabel()))}
+	for _, l := range m.GetLabel() {
+		p.Labels[l.GetName()] = l.GetValue()
+	}
+	value := func(v float64) *jsonFloat {
+		f := jsonFloat(v)
+		return &f
+	}
+
+	switch t {
+	case dto.MetricType_COUNTER:
+		p.Value = value(m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		p.Value = value(m.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		p.Value = value(m.GetUntyped().GetValue())
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		h := m.GetHistogram()
+		count := h.GetSampleCount()
+		p.Count, p.Sum = &count, value(h.GetSampleSum())
+		p.Buckets = make(map[string]uint64, len(h.GetBucket())+1)
+		for _, b := range h.GetBucket() {
+			p.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = b.GetCumulativeCount()
+		}
+		p.Buckets["+Inf"] = count
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		count := s.GetSampleCount()
+		p.Count, p.Sum = &count, value(s.GetSampleSum())
+		p.Quantiles = make(map[string]jsonFloat, len(s.GetQuantile()))
+		for _, q := range s.GetQuantile() {
+			p.Quantiles[strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)] = jsonFloat(q.GetValue())
+		}
+	}
+	return p
+}
+
+func newJSONFamily(f *dto.MetricFamily) jsonFamily {
+	family := jsonFamily{
+		Name:   f.GetName(),
+		Help:   f.GetHelp(),
+		Type:   strings.ToLower(f.GetType().String()),
+		Points: make([]jsonPoint, 0, len(f.GetMetric())),
+	}
+	for _, m := range f.GetMetric() {
+		family.Points = append(family.Points, newJSONPoint(f.GetType(), m))
+	}
+	return family
+}
+
+// jsonMetricsHandler serves the metrics of g as a JSON array of families.
+// The families are encoded one by one, so the response is streamed instead
+// of building the whole document in memory.
+func jsonMetricsHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		families, err := g.Gather()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error gathering metrics: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if _, err := w.Write([]byte("[")); err != nil {
+			return
+		}
+		for i, f := range families {
+			if i > 0 {
+				if _, err := w.Write([]byte(",")); err != nil {
+					return
+				}
+			}
+			if err := enc.Encode(newJSONFamily(f)); err != nil {
+				logger.Error().Msgf("error encoding metrics as JSON: %v", err)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("]\n"))
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// countingRecorder counts the writes to the response.
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (r *countingRecorder) Write(p []byte) (int, error) {
+	r.writes++
+	return r.ResponseRecorder.Write(p)
+}
+
+func TestJSONMetricsHandler(t *testing.T) {
+	e := newFakeExporterCollectors(prometheus.Labels{"site": "ams1"})
+	e.pool.(*fakePoolCollector).Set(1)
+	reg := e.newRegistry(e.names())
+
+	errs := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "zfs_pool_errors_total", Help: "Errors."}, []string{"pool", "type"})
+	errs.WithLabelValues("tank", "read").Add(3)
+	stale := prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_exporter_data_stale_seconds", Help: "Age."})
+	stale.Set(math.Inf(1))
+	reg.MustRegister(errs, stale)
+
+	rec := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	jsonMetricsHandler(reg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var families []struct {
+		Name   string `json:"name"`
+		Help   string `json:"help"`
+		Type   string `json:"type"`
+		Points []struct {
+			Labels map[string]string `json:"labels"`
+			Value  interface{}       `json:"value"`
+		} `json:"points"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &families))
+
+	byName := make(map[string]int)
+	for i, f := range families {
+		byName[f.Name] = i
+	}
+
+	// every family is written on its own instead of a single document
+	require.Greater(t, rec.writes, len(families))
+
+	pool := families[byName["zfs_pool_status"]]
+	require.Equal(t, "gauge", pool.Type)
+	require.Len(t, pool.Points, 1)
+	require.Equal(t, map[string]string{"site": "ams1"}, pool.Points[0].Labels)
+	require.Equal(t, float64(1), pool.Points[0].Value)
+
+	counter := families[byName["zfs_pool_errors_total"]]
+	require.Equal(t, "counter", counter.Type)
+	require.Equal(t, "Errors.", counter.Help)
+	require.Equal(t, map[string]string{"pool": "tank", "type": "read"}, counter.Points[0].Labels)
+	require.Equal(t, float64(3), counter.Points[0].Value)
+
+	require.Equal(t, "+Inf", families[byName["zfs_exporter_data_stale_seconds"]].Points[0].Value)
+
+	success := families[byName["zfs_exporter_collector_success"]]
+	require.Len(t, success.Points, 2)
+	require.Equal(t, map[string]string{"collector": "pool", "site": "ams1"}, success.Points[0].Labels)
+}
+
+func TestJSONMetricsHandlerHistogram(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "zfs_exporter_command_duration_seconds", Help: "Duration.", Buckets: []float64{0.5, 1}})
+	h.Observe(0.25)
+	h.Observe(2)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(h)
+
+	rec := httptest.NewRecorder()
+	jsonMetricsHandler(reg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `[{
+		"name": "zfs_exporter_command_duration_seconds",
+		"help": "Duration.",
+		"type": "histogram",
+		"points": [{"labels": {}, "count": 2, "sum": 2.25, "buckets": {"0.5": 1, "1": 1, "+Inf": 2}}]
+	}]`, rec.Body.String())
+}
+
+func TestJSONMetricsHandlerError(t *testing.T) {
+	failing := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, errors.New("zpool status failed")
+	})
+	rec := httptest.NewRecorder()
+	jsonMetricsHandler(failing).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics.json", nil))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, rec.Body.String(), "zpool status failed")
+}
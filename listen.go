@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+const unixSocketPrefix = "unix://"
+
+// listen creates the listener for the metrics http server. Addresses with the
+// unix:// prefix create a unix domain socket with the given file mode,
+// everything else is treated as TCP host:port.
+func listen(addr string, socketMode fs.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixSocketPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("empty unix socket path in listen address %q", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// the socket file is removed again, when the listener is closed
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, socketMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error setting unix socket mode: %w", err)
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run. It
+// refuses to remove anything else than a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("refusing to replace %s, which is not a unix socket", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error removing stale unix socket: %w", err)
+	}
+	logger.Debug().Msgf("removed stale unix socket: %s", path)
+
+	return nil
+}
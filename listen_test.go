@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+
+	// leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	l, err := listen("unix://"+path, 0o600)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	srv := &http.Server{Handler: okHandler}
+	go func() { _ = srv.Serve(l) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "zfs_up 1\n", string(body))
+
+	// socket is cleaned up on shutdown
+	require.NoError(t, srv.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnixSocketRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o644))
+
+	_, err := listen("unix://"+path, 0o600)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a unix socket")
+}
+
+func TestListenTCP(t *testing.T) {
+	l, err := listen("127.0.0.1:0", 0o600)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, "tcp", l.Addr().Network())
+}
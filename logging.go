@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/urfave/cli/v2"
+)
+
+// reopenableFile is a log file, which can be reopened after it has been
+// rotated by logrotate.
+type reopenableFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// logFiles are the opened log files by path. A single SIGHUP handler reopens
+// all of them.
+var (
+	logFilesMu sync.Mutex
+	logFiles   map[string]*reopenableFile
+)
+
+// openLogFile opens the log file of path, unless it is already open. The first
+// log file installs the SIGHUP handler.
+func openLogFile(path string) (*reopenableFile, error) {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	if r, ok := logFiles[path]; ok {
+		return r, nil
+	}
+
+	r := &reopenableFile{path: path}
+	if err := r.Reopen(); err != nil {
+		return nil, err
+	}
+	if logFiles == nil {
+		logFiles = make(map[string]*reopenableFile)
+		reopenOnSIGHUP()
+	}
+	logFiles[path] = r
+	return r, nil
+}
+
+func (r *reopenableFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Write(p)
+}
+
+// Reopen opens the path again and closes the previous file.
+func (r *reopenableFile) Reopen() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		_ = r.f.Close()
+	}
+	r.f = f
+	return nil
+}
+
+// reopenOnSIGHUP reopens the log files, whenever the process receives SIGHUP.
+func reopenOnSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			reopenLogFiles()
+		}
+	}()
+}
+
+func reopenLogFiles() {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	for _, r := range logFiles {
+		if err := r.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "error reopening log file: %v\n", err)
+		}
+	}
+}
+
+func newLogger(format, output, level string) (zerolog.Logger, error) {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return zerolog.Logger{}, fmt.Errorf("invalid log level: %w", err)
+	}
+
+	var w io.Writer
+	switch output {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := openLogFile(output)
+		if err != nil {
+			return zerolog.Logger{}, err
+		}
+		w = f
+	}
+
+	switch format {
+	case "json":
+	case "console":
+		w = zerolog.ConsoleWriter{
+			Out:        w,
+			TimeFormat: time.RFC3339,
+			NoColor:    w != os.Stdout && w != os.Stderr,
+		}
+	default:
+		return zerolog.Logger{}, fmt.Errorf("invalid log format %q, expected json or console", format)
+	}
+
+	return zerolog.New(w).With().Timestamp().Logger().Level(lvl), nil
+}
+
+// setupLogger configures the package logger from the flags, before any command
+// is run.
+func setupLogger(c *cli.Context) error {
+	l, err := newLogger(c.String("log-format"), c.String("log-output"), c.String("log-level"))
+	if err != nil {
+		return err
+	}
+	logger = l
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestNewLoggerFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(dir, "json.log")
+		l, err := newLogger("json", path, "info")
+		require.NoError(t, err)
+		l.Info().Msg("hello")
+		l.Debug().Msg("filtered")
+
+		out := readFile(t, path)
+		require.True(t, strings.HasPrefix(out, `{"level":"info","time":`), out)
+		require.Contains(t, out, `"message":"hello"`)
+		require.NotContains(t, out, "filtered")
+	})
+
+	t.Run("console", func(t *testing.T) {
+		path := filepath.Join(dir, "console.log")
+		l, err := newLogger("console", path, "debug")
+		require.NoError(t, err)
+		l.Info().Msg("hello")
+
+		out := readFile(t, path)
+		require.NotContains(t, out, "{")
+		require.Contains(t, out, "INF hello")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newLogger("logfmt", "stdout", "info")
+		require.Error(t, err)
+		_, err = newLogger("json", "stdout", "verbose")
+		require.Error(t, err)
+	})
+}
+
+func TestNewLoggerReopenOnSIGHUP(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		paths = []string{filepath.Join(dir, "exporter.log"), filepath.Join(dir, "audit.log")}
+	)
+
+	// a single handler reopens all log files
+	var loggers []zerolog.Logger
+	for _, path := range paths {
+		l, err := newLogger("json", path, "info")
+		require.NoError(t, err)
+		l.Info().Msg("before rotation")
+		loggers = append(loggers, l)
+	}
+
+	// rotate like logrotate and signal the process
+	for _, path := range paths {
+		require.NoError(t, os.Rename(path, path+".1"))
+	}
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i, path := range paths {
+		loggers[i].Info().Msg("after rotation")
+
+		require.Contains(t, readFile(t, path+".1"), "before rotation")
+		require.NotContains(t, readFile(t, path+".1"), "after rotation")
+		require.Contains(t, readFile(t, path), "after rotation")
+	}
+}
+
+func TestOpenLogFileShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exporter.log")
+	a, err := openLogFile(path)
+	require.NoError(t, err)
+	b, err := openLogFile(path)
+	require.NoError(t, err)
+	require.Same(t, a, b)
+}
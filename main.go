@@ -1,17 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
+	"errors"
 	"fmt"
-	"hash"
-	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -21,6 +19,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/simonswine/zfs-event-exporter/zfs/kubernetes"
 	"github.com/simonswine/zfs-event-exporter/zfs/pool"
 	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
 )
@@ -29,127 +28,46 @@ var (
 	logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
 )
 
-type httpBuffer struct {
-	b          bytes.Buffer
-	h          hash.Hash
-	tee        io.Writer
-	statusCode int
-	headers    http.Header
-}
-
-func newHTTPBuffer() *httpBuffer {
-	b := &httpBuffer{
-		headers:    make(http.Header),
-		h:          sha256.New(),
-		statusCode: 200,
+// registerRuntimeCollectors registers the metrics about the exporter process
+// itself. They are only meant for the http endpoint, as node-exporter already
+// exposes process metrics under its own name for the text file output.
+func registerRuntimeCollectors(reg prometheus.Registerer, runtime, process bool) {
+	if runtime {
+		reg.MustRegister(collectors.NewGoCollector())
 	}
-	b.tee = io.MultiWriter(&b.b, b.h)
-	return b
-}
-
-func (b *httpBuffer) Header() http.Header {
-	return b.headers
-}
-
-func (b *httpBuffer) WriteHeader(statusCode int) {
-	b.statusCode = statusCode
-}
-
-func (b *httpBuffer) Write(p []byte) (int, error) {
-	return b.tee.Write(p)
-}
-
-func (b *httpBuffer) Read(p []byte) (int, error) {
-	return b.b.Read(p)
-}
-func (b *httpBuffer) Sum() string {
-	return string(b.h.Sum(nil))
-}
-
-func (b *httpBuffer) Reset() {
-	b.b.Reset()
-	b.h.Reset()
-	b.statusCode = 200
-	for k := range b.headers {
-		delete(b.headers, k)
+	if process {
+		reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	}
 }
 
-func runTextFileOutput(ctx context.Context, handler http.Handler, filename string) (func(), error) {
-	var (
-		ticker  = time.NewTicker(15 * time.Second)
-		buffer  = newHTTPBuffer()
-		oldHash = ""
-	)
-
-	run := func() error {
-		defer buffer.Reset()
-		req, err := http.NewRequest("GET", "/metrics", nil)
-		if err != nil {
-			return fmt.Errorf("error creating request: %w", err)
-		}
-		handler.ServeHTTP(buffer, req)
-		if (buffer.statusCode / 100) != 2 {
-			return fmt.Errorf("unexpected status code: %d", buffer.statusCode)
-		}
-
-		if hash := buffer.Sum(); hash == oldHash {
-			logger.Debug().Msg("no change in metrics")
-			return nil
-		} else {
-			oldHash = hash
-		}
-
-		f, err := os.Create(filename + ".$$")
-		if err != nil {
-			return fmt.Errorf("error creating text file: %w", err)
-		}
-
-		if _, err := io.Copy(f, buffer); err != nil {
-			return fmt.Errorf("error writing text file: %w", err)
-		}
-
-		if err := f.Close(); err != nil {
-			return fmt.Errorf("error closing text file: %w", err)
-		}
-
-		if err := os.Rename(filename+".$$", filename); err != nil {
-			return fmt.Errorf("error renaming text file: %w", err)
-		}
-		logger.Info().Msgf("wrote text file: %s", filename)
-
-		return nil
-	}
-
-	if err := run(); err != nil {
-		return nil, err
-	}
-
-	return func() {
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				if err := run(); err != nil {
-					logger.Error().Msgf("error writing text file: %v", err)
-				}
-			}
-		}
-	}, nil
-}
-
-func main() {
+func newApp() *cli.App {
 	app := &cli.App{
-		Name:   "zfs-event-exporter",
-		Usage:  "Prometheus metrics for pools and snapshots based on ZFS event history",
-		Action: run,
+		Name:    "zfs-event-exporter",
+		Version: version,
+		Usage:   "Prometheus metrics for pools and snapshots based on ZFS event history",
+		Before:  setupLogger,
+		Action:  run,
+		Commands: []*cli.Command{
+			watchEventsCommand,
+			watchCommand,
+			onceCommand,
+			checkCommand,
+			generateRulesCommand,
+			debugDumpCommand,
+			recordFixturesCommand,
+			healthcheckCommand,
+			parseStatusCommand,
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "listen-addr",
 				Value: ":9128",
-				Usage: "listen address for metrics http server",
+				Usage: "listen address for metrics http server, use unix:///path/to/socket for a unix domain socket or an empty value to disable it",
+			},
+			&cli.StringFlag{
+				Name:  "listen-socket-mode",
+				Value: "0660",
+				Usage: "octal file mode of the unix domain socket",
 			},
 			&cli.StringFlag{
 				Name:  "log-level",
@@ -157,120 +75,727 @@ func main() {
 				Usage: "log level for daemon",
 			},
 			&cli.StringFlag{
+				Name:  "log-format",
+				Value: "json",
+				Usage: "log format, either json or console",
+			},
+			&cli.StringFlag{
+				Name:  "log-output",
+				Value: "stdout",
+				Usage: "log destination, either stdout, stderr or a file path, which is reopened on SIGHUP",
+			},
+			&cli.StringFlag{
+				Name:  "web.config.file",
+				Value: "",
+				Usage: "path to a web configuration file enabling TLS and/or basic authentication",
+			},
+			&cli.BoolFlag{
+				Name:  "web.enable-runtime-metrics",
+				Value: true,
+				Usage: "expose Go runtime metrics of the exporter on the http endpoint",
+			},
+			&cli.BoolFlag{
+				Name:  "web.enable-process-metrics",
+				Value: true,
+				Usage: "expose process metrics of the exporter on the http endpoint",
+			},
+			&cli.BoolFlag{
+				Name:  "web.enable-debug-state",
+				Usage: "expose the internal state of the collectors as JSON on /debug/state",
+			},
+			&cli.BoolFlag{
+				Name:  "web.enable-json-metrics",
+				Usage: "expose the metrics as JSON on /metrics.json for consumers not parsing the Prometheus format",
+			},
+			&cli.BoolFlag{
+				Name:  "native-histograms",
+				Usage: "export latency histograms as native histograms instead of classic buckets and add native histograms to the request sizes, they require the protobuf exposition",
+			},
+			&cli.StringSliceFlag{
 				Name:  "text-file-output",
+				Usage: "file path for node-exporter text file, use collector=path to write only the metrics of a single collector (repeatable)",
+			},
+			&cli.DurationFlag{
+				Name:  "text-file-interval",
+				Value: 15 * time.Second,
+				Usage: "interval in which the text file output is updated",
+			},
+			&cli.StringFlag{
+				Name:  "text-file-mode",
+				Value: "0644",
+				Usage: "octal file mode of the text file output",
+			},
+			&cli.StringFlag{
+				Name:  "text-file-format",
+				Value: textFileFormatPrometheus,
+				Usage: "format of the text file output, either prometheus for the node-exporter text file collector or influx for the InfluxDB line protocol, e.g. for the file input of Telegraf",
+			},
+			&cli.StringFlag{
+				Name:  "text-file-group",
 				Value: "",
-				Usage: "file path for node-exporter text file",
+				Usage: "group name or id owning the text file output",
+			},
+			&cli.StringFlag{
+				Name:  "scrape-mode",
+				Value: scrapeModeLive,
+				Usage: "either live to collect on every scrape or cached to serve the result of a background collection",
+			},
+			&cli.IntFlag{
+				Name:  "max-concurrent-scrapes",
+				Value: 10,
+				Usage: "maximum number of concurrent scrapes, further scrapes are answered with 503, 0 disables the limit",
+			},
+			&cli.IntFlag{
+				Name:  "max-series",
+				Usage: "maximum number of series exported, the series beyond it are dropped in the order of their names and labels, 0 disables the limit",
+			},
+			&cli.DurationFlag{
+				Name:  "scrape.cache-interval",
+				Value: 15 * time.Second,
+				Usage: "interval of the background collection in the cached scrape mode",
+			},
+			&cli.DurationFlag{
+				Name:  "scrape.cache-timeout",
+				Value: 10 * time.Second,
+				Usage: "time after which a background collection is considered late and the cached data ages",
+			},
+			&cli.StringFlag{
+				Name:  "push.gateway-url",
+				Usage: "url of a Pushgateway the metrics are pushed to periodically",
+			},
+			&cli.StringFlag{
+				Name:  "push.job",
+				Value: "zfs_exporter",
+				Usage: "job name used for pushing to the Pushgateway",
+			},
+			&cli.DurationFlag{
+				Name:  "push.interval",
+				Value: time.Minute,
+				Usage: "interval in which the metrics are pushed to the Pushgateway",
+			},
+			&cli.StringSliceFlag{
+				Name:  "push.grouping-label",
+				Usage: "grouping label in the form key=value used for pushing to the Pushgateway (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "otlp.endpoint",
+				Usage: "http(s) URL of an OTLP receiver to export the metrics to",
+			},
+			&cli.StringFlag{
+				Name:  "otlp.protocol",
+				Value: otlpProtocolGRPC,
+				Usage: "protocol used for the OTLP export, one of grpc or http/protobuf",
+			},
+			&cli.StringSliceFlag{
+				Name:  "otlp.header",
+				Usage: "header in the form key=value sent with OTLP exports, e.g. for authentication (repeatable)",
+			},
+			&cli.DurationFlag{
+				Name:  "otlp.interval",
+				Value: time.Minute,
+				Usage: "interval in which the metrics are exported to the OTLP endpoint",
+			},
+			&cli.IntFlag{
+				Name:  "otlp.buffer-intervals",
+				Value: 5,
+				Usage: "number of intervals kept for retrying while the OTLP endpoint is unavailable",
+			},
+			&cli.DurationFlag{
+				Name:  "readiness.grace-period",
+				Value: time.Minute,
+				Usage: "time the zpool events stream may be down before the exporter reports as not ready",
+			},
+			&cli.StringFlag{
+				Name:  "metric-prefix",
+				Value: "zfs",
+				Usage: "prefix of all ZFS metric names",
+			},
+			&cli.StringSliceFlag{
+				Name:  "label",
+				Usage: "constant label in the form key=value added to all metrics (repeatable)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "command.timeout",
+				Usage: "timeout of zfs and zpool commands, either a duration for all commands or command=duration, e.g. \"zpool status=1m\" (repeatable)",
+			},
+			&cli.Float64Flag{
+				Name:  "command.rate-limit",
+				Usage: "maximum number of zfs and zpool commands started per second across all targets, 0 disables the limit",
+			},
+			&cli.StringSliceFlag{
+				Name:  "remote",
+				Usage: "collect from a remote host over SSH in the form ssh://user@host[:port], the metrics get a host label (repeatable)",
+			},
+			&cli.StringFlag{
+				Name:  "remote.identity-file",
+				Usage: "private key for SSH authentication, defaults to the key in ~/.ssh",
+			},
+			&cli.StringFlag{
+				Name:  "remote.known-hosts",
+				Usage: "known_hosts file to verify the SSH host keys, defaults to ~/.ssh/known_hosts",
+			},
+			&cli.DurationFlag{
+				Name:  "remote.keepalive-interval",
+				Value: 30 * time.Second,
+				Usage: "interval of SSH keepalives, a failing keepalive re-establishes the connection",
+			},
+			&cli.StringFlag{
+				Name:  "host-root",
+				Usage: "root file system of the host when running in a container, e.g. /host, zfs and zpool are executed in the namespaces of the host using nsenter",
+			},
+			&cli.StringFlag{
+				Name:  "pool-status-file",
+				Usage: "read the pool status from a file in the format of zpool status -pP on every collection instead of running zpool",
+			},
+			&cli.StringFlag{
+				Name:  "snapshot-list-file",
+				Usage: "list the snapshots from a file in the format of zfs list -H -p -t snapshot -o name,creation,used instead of running zfs",
+			},
+			&cli.StringFlag{
+				Name:  "snapshot-backend",
+				Value: snapshot.BackendExec,
+				Usage: "how snapshots are listed, exec runs zfs list, libzfs iterates them using libzfs on the local host and requires a build with the libzfs tag, program lists them atomically using a channel program on the local host",
+			},
+			&cli.StringFlag{
+				Name:  "events-file",
+				Usage: "replay events from a file in the format of zpool events -H -v instead of following zpool events, requires --snapshot-list-file",
+			},
+			&cli.StringFlag{
+				Name:  "event-source",
+				Value: eventSourceEvents,
+				Usage: "how changes of snapshots are followed, events follows zpool events, which requires root, history polls zpool history, which is permitted with delegated permissions",
+			},
+			&cli.DurationFlag{
+				Name:  "event-source.history-interval",
+				Value: time.Minute,
+				Usage: "interval of polling zpool history with --event-source=history",
+			},
+			&cli.StringFlag{
+				Name:  "collector.snapshot.mode",
+				Value: snapshotModeEvents,
+				Usage: "how the snapshot collector keeps track of snapshots, events follows the --event-source, poll only lists all snapshots periodically without following any events",
+			},
+			&cli.DurationFlag{
+				Name:  "collector.snapshot.poll-interval",
+				Value: 5 * time.Minute,
+				Usage: "interval of listing all snapshots with --collector.snapshot.mode=poll",
+			},
+			&cli.DurationFlag{
+				Name:  "collector.health.snapshot-max-age",
+				Usage: "age of the last snapshot of a dataset after which zfs_health reports a warning, 0 doesn't consider the snapshots",
+			},
+			&cli.StringFlag{
+				Name:  "collector.snapshot.cache-file",
+				Usage: "file the known snapshots are saved to, after a restart they are served from it until the initial listing completes",
+			},
+			&cli.DurationFlag{
+				Name:  "collector.snapshot.cache-interval",
+				Value: 10 * time.Minute,
+				Usage: "interval of saving the known snapshots to --collector.snapshot.cache-file",
+			},
+			&cli.StringFlag{
+				Name:  "on-background-failure",
+				Value: backgroundFailureLog,
+				Usage: "what to do when a background task like the snapshot event loop or a text file output fails: log, restart it with a backoff or exit with code 3",
+			},
+			&cli.DurationFlag{
+				Name:  "shutdown.grace-period",
+				Value: 10 * time.Second,
+				Usage: "time to wait for outstanding work to finish on shutdown",
+			},
+			&cli.BoolFlag{
+				Name:  "kubernetes-enrich",
+				Usage: "export zfs_dataset_kubernetes_info mapping the datasets of zfs-localpv persistent volumes to their claims",
+			},
+			&cli.StringFlag{
+				Name:  "kubernetes.kubeconfig",
+				Usage: "kubeconfig file used for --kubernetes-enrich, the service account of the pod is used when empty",
+			},
+			&cli.StringFlag{
+				Name:  "drop-privileges",
+				Usage: "switch to user[:group] once the listeners are bound and zpool events is running, requires starting as root",
 			},
 			&cli.StringSliceFlag{
 				Name:  "exclude-snapshot-name",
 				Usage: "exclude snapshots matching regular expression",
 			},
+			&cli.StringSliceFlag{
+				Name:  "exclude-dataset",
+				Usage: "exclude datasets matching regular expression from the dataset collector",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.l2arc.always",
+				Usage: "export the L2ARC metrics, even if no L2ARC is configured",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.dataset",
+				Usage: "export the properties of all datasets fetched with zfs get",
+			},
+			&cli.DurationFlag{
+				Name:  "collector.dataset.interval",
+				Value: time.Minute,
+				Usage: "minimum interval between two zfs get or zfs list of the dataset collectors, scrapes in between export the last result",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.dataset.keystatus.all",
+				Usage: "export the key status of every dataset, instead of only the encryption roots",
+			},
+			&cli.StringSliceFlag{
+				Name:  "collector.dataset.properties",
+				Usage: "additional properties exported by the dataset collector, e.g. recordsize,sync",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.dataset-io",
+				Usage: "export the I/O of all mounted datasets from their objset kstats",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.pool.queues",
+				Usage: "export the queued I/Os of the pools from zpool iostat -q",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.pool.request-sizes",
+				Usage: "export the histograms of the request sizes of the pools from zpool iostat -r",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.pool.capacity",
+				Usage: "export the size and allocated bytes of the pools from zpool list and project when they are full",
+			},
+			&cli.DurationFlag{
+				Name:  "collector.pool.capacity.window",
+				Value: pool.DefaultCapacityWindow,
+				Usage: "history of the allocated bytes kept in memory to calculate the fill rate of the pools from",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.pool.disks",
+				Usage: "export the I/O of the disks of the pools by following zpool iostat -v, not available in once mode",
+			},
+			&cli.DurationFlag{
+				Name:  "collector.pool.disks.interval",
+				Value: pool.DefaultDiskInterval,
+				Usage: "interval of the reports of zpool iostat the I/O of the disks is summed up from",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.pool.counts",
+				Usage: "export the number of filesystems, volumes and snapshots of the pools, listed at most once per --collector.dataset.interval",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.zfetch",
+				Usage: "export the prefetch statistics of zfetchstats",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.dbuf",
+				Usage: "export the dbuf cache statistics of dbufstats",
+			},
+			&cli.BoolFlag{
+				Name:  "collector.spl",
+				Usage: "export the memory of the SPL kmem caches and the ABD buffers",
+			},
+			&cli.IntFlag{
+				Name:  "collector.spl.top-caches",
+				Value: 15,
+				Usage: "number of the largest SPL kmem caches exported by name, the others are summed up as other",
+			},
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	setEnvVars("", app.Flags)
+	for _, cmd := range app.Commands {
+		setEnvVars(cmd.Name, cmd.Flags)
+	}
+	return app
+}
+
+func main() {
+	cli.VersionPrinter = printVersion
+
+	if err := newApp().Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func run(c *cli.Context) error {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(collectors.NewBuildInfoCollector())
+	interval := c.Duration("text-file-interval")
+	if interval < time.Second {
+		return fmt.Errorf("text file interval must be at least 1s, got %s", interval)
+	}
 
-	keep := func(_, _ string) bool {
-		return true
+	socketMode, err := parseFileMode(c.String("listen-socket-mode"))
+	if err != nil {
+		return err
 	}
 
-	if excludes := c.StringSlice("exclude-snapshot-name"); len(excludes) > 0 {
-		var match []*regexp.Regexp
-		for _, exclude := range excludes {
-			r, err := regexp.Compile(exclude)
-			if err != nil {
-				return fmt.Errorf("error compiling exclude regular expression: %w", err)
-			}
-			match = append(match, r)
+	textFileMode, err := parseFileMode(c.String("text-file-mode"))
+	if err != nil {
+		return err
+	}
+
+	textFileFormat := c.String("text-file-format")
+	if err := validateTextFileFormat(textFileFormat); err != nil {
+		return err
+	}
+
+	textFileGID := -1
+	if group := c.String("text-file-group"); group != "" {
+		if textFileGID, err = lookupGroupID(group); err != nil {
+			return err
 		}
+	}
+
+	scrapeMode := c.String("scrape-mode")
+	if err := validateScrapeMode(scrapeMode); err != nil {
+		return err
+	}
+	cacheInterval := c.Duration("scrape.cache-interval")
+	if scrapeMode == scrapeModeCached && cacheInterval < time.Second {
+		return fmt.Errorf("scrape cache interval must be at least 1s, got %s", cacheInterval)
+	}
+
+	pushURL := c.String("push.gateway-url")
+	pushInterval := c.Duration("push.interval")
+	if pushURL != "" && pushInterval < time.Second {
+		return fmt.Errorf("push interval must be at least 1s, got %s", pushInterval)
+	}
+	if pushURL != "" && c.String("push.job") == "" {
+		return fmt.Errorf("push job must not be empty")
+	}
+
+	pushGrouping, err := parseGroupingLabels(stringSlice(c, "push.grouping-label"))
+	if err != nil {
+		return err
+	}
 
-		keep = func(dataset, snapshot string) bool {
-			for _, r := range match {
-				if r.MatchString(dataset + "@" + snapshot) {
-					return false
-				}
+	otlpEndpoint := c.String("otlp.endpoint")
+	otlpInterval := c.Duration("otlp.interval")
+	if err := validateOTLPProtocol(c.String("otlp.protocol")); err != nil {
+		return err
+	}
+	if otlpEndpoint != "" && otlpInterval < time.Second {
+		return fmt.Errorf("OTLP interval must be at least 1s, got %s", otlpInterval)
+	}
+	if n := c.Int("otlp.buffer-intervals"); n < 1 {
+		return fmt.Errorf("OTLP buffer must hold at least 1 interval, got %d", n)
+	}
+	otlpHeaders, err := parseOTLPHeaders(stringSlice(c, "otlp.header"))
+	if err != nil {
+		return err
+	}
+
+	maxScrapes := c.Int("max-concurrent-scrapes")
+	if maxScrapes < 0 {
+		return fmt.Errorf("maximum of concurrent scrapes must not be negative, got %d", maxScrapes)
+	}
+
+	limit, err := parseSeriesLimit(c)
+	if err != nil {
+		return err
+	}
+
+	var dropTo *privileges
+	if value := c.String("drop-privileges"); value != "" {
+		if dropTo, err = parseDropPrivileges(value); err != nil {
+			return err
+		}
+		if c.String("host-root") != "" {
+			return fmt.Errorf("--drop-privileges can't be combined with --host-root, nsenter requires root")
+		}
+	}
+
+	backgroundFailure := c.String("on-background-failure")
+	if err := validateBackgroundFailurePolicy(backgroundFailure); err != nil {
+		return err
+	}
+
+	web, err := loadWebConfig(c.String("web.config.file"))
+	if err != nil {
+		return err
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	sup := newSupervisor(ctx, g, backgroundFailure)
+
+	zfsCollectors, err := newExporterTargets(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	// wait for zpool events to exit on shutdown
+	g.Go(func() error {
+		zfsCollectors.wait()
+		return nil
+	})
+
+	// scrapes and text file outputs running concurrently share the
+	// collections, reg holds the metrics about the exporter itself
+	shared := zfsCollectors.newSharedGatherers()
+	reg := prometheus.NewRegistry()
+	regWrapped := zfsCollectors.wrap(reg)
+	regWrapped.MustRegister(collectors.NewBuildInfoCollector(), sup.collector())
+	zfsCollectors.registerRunners(reg)
+	for _, e := range zfsCollectors {
+		name := "snapshot"
+		if e.host != "" {
+			name += ":" + e.host
+		}
+		sup.Go(name, e.snapshot.Run)
+		if e.poolDisks != nil {
+			name := "pool_disks"
+			if e.host != "" {
+				name += ":" + e.host
 			}
-			return true
+			sup.Go(name, e.poolDisks.Run)
+		}
+	}
+	registerRuntimeCollectors(regWrapped, c.Bool("web.enable-runtime-metrics"), c.Bool("web.enable-process-metrics"))
+	if c.Bool("kubernetes-enrich") {
+		client, err := kubernetes.NewClient(c.String("kubernetes.kubeconfig"))
+		if err != nil {
+			return err
 		}
+		// the mapping isn't part of the text file outputs, they are written
+		// per collector of the ZFS metrics
+		k8s := kubernetes.NewCollector(logger, client, c.String("metric-prefix"))
+		regWrapped.MustRegister(newInstrumentedCollector("kubernetes", k8s))
+		sup.Go("kubernetes", func(ctx context.Context) error {
+			k8s.Run(ctx)
+			return nil
+		})
+	}
+	// the metrics about the series limit are exported, even if it is hit
+	regLimit := prometheus.NewRegistry()
+	zfsCollectors.wrap(regLimit).MustRegister(limit.collectors()...)
+	allGatherer := prometheus.Gatherers{
+		limit.wrap(prometheus.Gatherers{zfsCollectors.gatherer(shared, zfsCollectors.names()), reg}),
+		regLimit,
 	}
 
-	collectorSnapshot, err := snapshot.NewCollector(ctx, logger, keep)
+	textFileOutputs, err := parseTextFileOutputs(stringSlice(c, "text-file-output"), zfsCollectors.byName())
 	if err != nil {
-		logger.Fatal().Msgf("error creating collector: %v", err)
+		return err
 	}
-	collectorPool := pool.NewCollector(logger)
-	reg.MustRegister(collectorSnapshot)
-	reg.MustRegister(collectorPool)
 
-	// setting log level appropriately
-	lvl, err := zerolog.ParseLevel(c.String("log-level"))
+	listeners, err := openListeners(c.String("listen-addr"), socketMode)
 	if err != nil {
-		logger.Fatal().Msgf("invalid log level: %v", err)
+		return err
+	}
+	if len(listeners) == 0 && pushURL == "" && otlpEndpoint == "" && len(textFileOutputs) == 0 {
+		return fmt.Errorf("no output configured, set at least one of --listen-addr, --push.gateway-url, --otlp.endpoint or --text-file-output")
 	}
-	logger = logger.Level(lvl)
 
-	g, ctx := errgroup.WithContext(ctx)
+	// the listeners are bound and zpool events is running, nothing else
+	// requires root
+	if dropTo != nil {
+		if err := dropTo.drop(); err != nil {
+			return err
+		}
+		logger.Info().Msgf("dropped privileges to %s", dropTo)
+	}
 
-	srv := &http.Server{Addr: c.String("listen-addr")}
+	srv := &http.Server{TLSConfig: web.tlsConfig()}
 	mux := http.NewServeMux()
-	srv.Handler = mux
+	srv.Handler = web.handler(recoverHandler(mux))
+
+	var gatherer prometheus.Gatherer = allGatherer
+	if scrapeMode == scrapeModeCached {
+		cache := newCachedGatherer(allGatherer, cacheInterval, c.Duration("scrape.cache-timeout"))
+		// the age of the cache is not part of the cached data itself
+		regCache := prometheus.NewRegistry()
+		zfsCollectors.wrap(regCache).MustRegister(cache.collector())
+		gatherer = prometheus.Gatherers{cache, regCache}
+		sup.Go("cache", func(ctx context.Context) error {
+			cache.run(ctx)
+			return nil
+		})
+	}
 
 	// Expose the registered metrics via HTTP.
-	metricsHandler := promhttp.HandlerFor(
-		reg,
-		promhttp.HandlerOpts{
-			// Opt into OpenMetrics to support exemplars.
-			EnableOpenMetrics: true,
-		},
-	)
+	metricsHandler, scrapesInflight := newMetricsHandler(gatherer, maxScrapes)
+	regWrapped.MustRegister(scrapesInflight)
 	mux.Handle("/metrics", metricsHandler)
+	if c.Bool("web.enable-json-metrics") {
+		mux.Handle("/metrics.json", jsonMetricsHandler(gatherer))
+	}
 
+	ready := newReadiness(zfsCollectors, c.Duration("readiness.grace-period"))
+	regWrapped.MustRegister(ready.collector())
+	g.Go(func() error {
+		primePoolStatus(ctx, shared["pool"], zfsCollectors, poolStatusRetryInterval)
+		return nil
+	})
+	mux.HandleFunc("/healthz", healthzHandler)
+	config := newEffectiveConfig(c, web)
+	regWrapped.MustRegister(config.collector())
+	mux.Handle("/config", configHandler(config))
+	mux.Handle("/readyz", ready)
+	if c.Bool("web.enable-debug-state") {
+		mux.Handle("/debug/state", debugStateHandler(zfsCollectors))
+	}
+
+	gracePeriod := c.Duration("shutdown.grace-period")
 	go func() {
 		<-ctx.Done()
 		logger.Debug().Msg("shutting down http server")
-		if err := srv.Shutdown(context.Background()); err != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
 			logger.Error().Msgf("error shutting down http server: %v", err)
 		}
 	}()
 
-	if filename := c.String("text-file-output"); filename != "" {
-		// create separate registry for text file output
-		regTextFile := prometheus.NewRegistry()
-		regTextFile.MustRegister(collectorSnapshot)
-		regTextFile.MustRegister(collectorPool)
-		metricsHandler := promhttp.HandlerFor(
-			regTextFile,
-			promhttp.HandlerOpts{
-				// Opt into OpenMetrics to support exemplars.
-				EnableOpenMetrics: true,
-			},
-		)
+	for _, o := range textFileOutputs {
+		metricsHandler := textFileHandler(limit.wrap(zfsCollectors.gatherer(shared, o.collectors)), textFileFormat)
+
+		// the text file output issues internal requests, which are exempt from
+		// authentication
+		out := newTextFileOutput(web.handler(metricsHandler), o.filename, interval)
+		out.format = textFileFormat
+		out.mode = textFileMode
+		out.gid = textFileGID
+		regWrapped.MustRegister(out.metricWriteErrors)
+		sup.Go("textfile:"+o.filename, func(ctx context.Context) error {
+			out.run(ctx)
+			return nil
+		})
+	}
+
+	if pushURL != "" {
+		out, err := newPushOutput(allGatherer, pushURL, c.String("push.job"), pushGrouping, pushInterval, web)
+		if err != nil {
+			return err
+		}
+		regWrapped.MustRegister(out.metricFailures)
+		sup.Go("push", func(ctx context.Context) error {
+			out.run(ctx)
+			return nil
+		})
+	}
 
-		f, err := runTextFileOutput(ctx, metricsHandler, filename)
+	if otlpEndpoint != "" {
+		exporter, err := newOTLPExporter(otlpEndpoint, c.String("otlp.protocol"), otlpHeaders, web)
 		if err != nil {
-			logger.Fatal().Msgf("error running text file output: %v", err)
+			return err
 		}
+		out := newOTLPOutput(allGatherer, exporter, otlpEndpoint, otlpInterval, c.Int("otlp.buffer-intervals"))
+		regWrapped.MustRegister(out.metricFailures, out.metricDropped, out.metricSkipped)
+		sup.Go("otlp", func(ctx context.Context) error {
+			out.run(ctx)
+			return nil
+		})
+	}
+
+	for _, l := range listeners {
+		l := l
+		g.Go(func() error {
+			return serveHTTP(web, srv, l)
+		})
+	}
+
+	// systemd considers the exporter started once it serves complete data
+	g.Go(func() error {
+		notifyReady(ctx, ready, time.Second)
+		return nil
+	})
+	if interval := sdWatchdogInterval(); interval > 0 {
 		g.Go(func() error {
-			f()
+			runSdWatchdog(ctx, interval)
 			return nil
 		})
 	}
+	defer func() {
+		_ = sdNotify("STOPPING=1")
+	}()
 
-	g.Go(srv.ListenAndServe)
+	err = waitShutdown(ctx, g, gracePeriod)
+	var taskErr *taskFailedError
+	if errors.As(err, &taskErr) {
+		// a distinct exit code lets the service manager restart the exporter
+		return cli.Exit(err, exitCodeBackgroundFailure)
+	}
+	return err
+}
 
-	if err := g.Wait(); err != nil {
-		return fmt.Errorf("error running: %w", err)
+// metricsErrorLogger logs the errors of gathering the metrics for a scrape.
+type metricsErrorLogger struct{}
+
+func (metricsErrorLogger) Println(v ...interface{}) {
+	logger.Error().Msg(fmt.Sprint(v...))
+}
+
+// newMetricsHandler serves the metrics of g. Scrapes beyond maxScrapes are
+// answered with 503, the returned gauge counts the scrapes in flight. A
+// failing collector doesn't fail the scrape, its metrics are left out and
+// reported by zfs_exporter_collector_success, while the metrics of the other
+// collectors are served.
+func newMetricsHandler(g prometheus.Gatherer, maxScrapes int) (http.Handler, prometheus.Gauge) {
+	inflight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "zfs_exporter_scrapes_inflight",
+		Help: "Number of scrapes of the metrics endpoint currently being served.",
+	})
+	h := promhttp.HandlerFor(
+		g,
+		promhttp.HandlerOpts{
+			// Opt into OpenMetrics to support exemplars.
+			EnableOpenMetrics: true,
+			ErrorHandling:     promhttp.ContinueOnError,
+			ErrorLog:          metricsErrorLogger{},
+		},
+	)
+	return promhttp.InstrumentHandlerInFlight(inflight, limitInFlight(maxScrapes, createdLinesHandler(g, h))), inflight
+}
+
+// openListeners returns the sockets passed by systemd or otherwise listens on
+// listenAddr. No listener is returned for an empty listenAddr.
+func openListeners(listenAddr string, socketMode os.FileMode) ([]net.Listener, error) {
+	listeners, err := systemdListeners(listenFDsStart)
+	if err != nil {
+		return nil, err
 	}
+	if len(listeners) > 0 {
+		logger.Info().Msgf("using %d socket(s) passed by systemd", len(listeners))
+		return listeners, nil
+	}
+	if listenAddr == "" {
+		return nil, nil
+	}
+	l, err := listen(listenAddr, socketMode)
+	if err != nil {
+		return nil, fmt.Errorf("error listening: %w", err)
+	}
+	return []net.Listener{l}, nil
+}
+
+// serveHTTP serves srv on l until it is shut down.
+func serveHTTP(web *webConfig, srv *http.Server, l net.Listener) error {
+	if err := web.serve(srv, l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
 
+// waitShutdown waits for g to finish. Once ctx is cancelled, the remaining
+// work has gracePeriod to complete.
+func waitShutdown(ctx context.Context, g *errgroup.Group, gracePeriod time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- g.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		logger.Info().Msg("shutting down")
+		timer := time.NewTimer(gracePeriod)
+		defer timer.Stop()
+		select {
+		case err = <-errCh:
+		case <-timer.C:
+			return fmt.Errorf("shutdown did not complete within %s", gracePeriod)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error running: %w", err)
+	}
 	return nil
 }
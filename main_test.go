@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func gatherNames(t *testing.T, g prometheus.Gatherer) map[string]bool {
+	t.Helper()
+
+	families, err := g.Gather()
+	require.NoError(t, err)
+	names := make(map[string]bool, len(families))
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	return names
+}
+
+func TestRegisterRuntimeCollectors(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		runtime, process bool
+	}{
+		{name: "http defaults", runtime: true, process: true},
+		{name: "text file", runtime: false, process: false},
+		{name: "runtime only", runtime: true, process: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			registerRuntimeCollectors(reg, tc.runtime, tc.process)
+
+			names := gatherNames(t, reg)
+			require.Equal(t, tc.runtime, names["go_goroutines"])
+			require.Equal(t, tc.process, names["process_start_time_seconds"])
+		})
+	}
+}
+
+func TestBuildInfoCollector(t *testing.T) {
+	oldVersion, oldRevision, oldBranch := version, revision, branch
+	defer func() { version, revision, branch = oldVersion, oldRevision, oldBranch }()
+	version, revision, branch = "1.2.3", "abcdef0", "main"
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newBuildInfoCollector())
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_exporter_build_info A metric with a constant '1' value labeled by version, revision, branch, and goversion from which the exporter was built.
+# TYPE zfs_exporter_build_info gauge
+zfs_exporter_build_info{branch="main",goversion="`+runtime.Version()+`",revision="abcdef0",version="1.2.3"} 1
+`)))
+}
+
+func TestPrintVersion(t *testing.T) {
+	oldVersion := version
+	defer func() { version = oldVersion }()
+	version = "1.2.3"
+
+	var out bytes.Buffer
+	app := &cli.App{Name: "zfs-event-exporter", Writer: &out}
+	printVersion(cli.NewContext(app, nil, nil))
+	require.Contains(t, out.String(), "zfs-event-exporter, version 1.2.3")
+	require.Contains(t, out.String(), "go version: "+runtime.Version())
+}
+
+// TestHelperProcess runs the exporter with the arguments following "--". It is
+// only used as a child process of other tests.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("ZFS_EXPORTER_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := []string{"zfs-event-exporter"}
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args = append(args, os.Args[i+1:]...)
+			break
+		}
+	}
+
+	if err := newApp().Run(args); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// syncBuffer is a buffer, which can be read while the output of a child
+// process is copied into it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startExporter runs the exporter with args as a child process, which listens
+// on a unix socket. It returns a function to request a path from it and the
+// output of the exporter.
+func startExporter(t *testing.T, args ...string) (func(path string) (int, string), *syncBuffer) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+
+	var out syncBuffer
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestHelperProcess$", "--",
+		"--listen-addr", "unix://" + socket,
+	}, args...)...)
+	cmd.Env = append(os.Environ(), "ZFS_EXPORTER_HELPER_PROCESS=1")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		_ = cmd.Wait()
+	})
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	return func(path string) (int, string) {
+		resp, err := client.Get("http://unix" + path)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}, &out
+}
+
+func TestShutdownOnSIGTERM(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": "printf '" + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = "events" ]; then exec sleep 3600; fi
+cat <<'EOF'
+` + fakeZpoolStatus + "EOF\n",
+	})
+
+	filename := filepath.Join(t.TempDir(), "zfs.prom")
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--",
+		"--listen-addr", "127.0.0.1:0",
+		"--text-file-output", filename,
+		"--shutdown.grace-period", "5s",
+	)
+	cmd.Env = append(os.Environ(), "ZFS_EXPORTER_HELPER_PROCESS=1")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	require.NoError(t, cmd.Start())
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// the final write on shutdown recreates the file
+	require.NoError(t, os.Remove(filename))
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- cmd.Wait() }()
+	select {
+	case err := <-errCh:
+		require.NoError(t, err, out.String())
+	case <-time.After(10 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatalf("exporter did not exit after SIGTERM: %s", out.String())
+	}
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `zfs_pool_status{pool="pool",state="online"} 1`)
+}
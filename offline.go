@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+// offlineInputs are captured outputs of zpool and zfs, which the collectors
+// read instead of running the commands, e.g. to replay a debug dump.
+type offlineInputs struct {
+	// poolStatusFile is read instead of running zpool status on every
+	// collection.
+	poolStatusFile string
+
+	// snapshotListFile is read instead of running zfs list.
+	snapshotListFile string
+
+	// eventsFile is replayed instead of following zpool events.
+	eventsFile string
+}
+
+// parseOfflineInputs returns the offline inputs and refuses combinations,
+// which would mix captured outputs with the commands of a live system.
+func parseOfflineInputs(c *cli.Context) (offlineInputs, error) {
+	inputs := offlineInputs{
+		poolStatusFile:   c.String("pool-status-file"),
+		snapshotListFile: c.String("snapshot-list-file"),
+		eventsFile:       c.String("events-file"),
+	}
+	if inputs == (offlineInputs{}) {
+		return inputs, nil
+	}
+
+	if len(stringSlice(c, "remote")) > 0 || c.String("host-root") != "" {
+		return inputs, fmt.Errorf("--pool-status-file, --snapshot-list-file and --events-file can't be combined with --remote or --host-root")
+	}
+	if inputs.eventsFile != "" && inputs.snapshotListFile == "" {
+		return inputs, fmt.Errorf("--events-file requires --snapshot-list-file, the snapshots of the events would be listed using zfs otherwise")
+	}
+
+	for _, filename := range []string{inputs.poolStatusFile, inputs.snapshotListFile, inputs.eventsFile} {
+		if filename == "" {
+			continue
+		}
+		if _, err := os.Stat(filename); err != nil {
+			return inputs, fmt.Errorf("error reading input file: %w", err)
+		}
+	}
+	return inputs, nil
+}
+
+// replayEvents sends the events of filename to the returned channel, if it is
+// not empty. The channel is closed once ctx is cancelled, so the event stream
+// stays attached after the file has been replayed.
+func replayEvents(ctx context.Context, filename string) (chan *events.Event, error) {
+	var f *os.File
+	if filename != "" {
+		var err error
+		if f, err = os.Open(filename); err != nil {
+			return nil, fmt.Errorf("error opening events file: %w", err)
+		}
+	}
+
+	ch := make(chan *events.Event)
+	go func() {
+		defer close(ch)
+		if f != nil {
+			err := events.Parse(f, ch, false)
+			_ = f.Close()
+			if err != nil {
+				logger.Error().Msgf("error replaying events file %s: %v", filename, err)
+			} else {
+				logger.Info().Msgf("replayed events file %s", filename)
+			}
+		}
+		<-ctx.Done()
+	}()
+	return ch, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPoolStatusFile   = "zfs/pool/testdata/simple.txt"
+	testSnapshotListFile = "zfs/snapshot/testdata/snapshots-simple.txt"
+)
+
+// failingCommands makes sure the offline inputs are used instead of zfs and
+// zpool.
+func failingCommands(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "echo unexpected zfs >&2; exit 1\n",
+		"zpool": "echo unexpected zpool >&2; exit 1\n",
+	})
+}
+
+func TestOfflineInputsInvalid(t *testing.T) {
+	failingCommands(t)
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+	}{
+		{
+			name: "events without snapshot list",
+			env:  map[string]string{"ZFS_EVENT_EXPORTER_EVENTS_FILE": "zfs/events/testdata/events-simple.txt"},
+		},
+		{
+			name: "remote",
+			env: map[string]string{
+				"ZFS_EVENT_EXPORTER_POOL_STATUS_FILE": testPoolStatusFile,
+				"ZFS_EVENT_EXPORTER_REMOTE":           "nas1.example.com",
+			},
+		},
+		{
+			name: "host root",
+			env: map[string]string{
+				"ZFS_EVENT_EXPORTER_SNAPSHOT_LIST_FILE": testSnapshotListFile,
+				"ZFS_EVENT_EXPORTER_HOST_ROOT":          "/host",
+			},
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"ZFS_EVENT_EXPORTER_POOL_STATUS_FILE": filepath.Join(t.TempDir(), "status.txt")},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, code := runOnceApp(t)
+			require.Equal(t, 1, code)
+		})
+	}
+}
+
+func TestOnceOffline(t *testing.T) {
+	failingCommands(t)
+	t.Setenv("ZFS_EVENT_EXPORTER_POOL_STATUS_FILE", testPoolStatusFile)
+	t.Setenv("ZFS_EVENT_EXPORTER_SNAPSHOT_LIST_FILE", testSnapshotListFile)
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code, out)
+	require.Contains(t, out, `zfs_pool_status{pool="pool",state="online"} 1`)
+	require.Contains(t, out, `zfs_snapshot_count{dataset="pool-nvme/data"} 2`)
+	require.Contains(t, out, `zfs_snapshot_count{dataset="pool-hdd/backup/pull/node-a/data"} 2`)
+	// the kstats of the live host are not mixed into the offline inputs
+	require.NotContains(t, out, `collector="l2arc"`)
+	require.NotContains(t, out, `collector="txg"`)
+}
+
+// testDestroyEvent destroys one of the snapshots of testSnapshotListFile.
+const testDestroyEvent = "Nov 23 2023 03:45:50.763089998\tsysevent.fs.zfs.history_event\n" +
+	"        class = \"sysevent.fs.zfs.history_event\"\n" +
+	"        pool = \"pool-nvme\"\n" +
+	"        history_dsname = \"pool-nvme/data@migrate_v1\"\n" +
+	"        history_internal_name = \"destroy\"\n" +
+	"\n"
+
+func TestOfflineExporter(t *testing.T) {
+	failingCommands(t)
+
+	eventsFile := filepath.Join(t.TempDir(), "events.txt")
+	require.NoError(t, os.WriteFile(eventsFile, []byte(testDestroyEvent), 0o644))
+
+	get, out := startExporter(t,
+		"--pool-status-file", testPoolStatusFile,
+		"--snapshot-list-file", testSnapshotListFile,
+		"--events-file", eventsFile,
+	)
+
+	// the destroy event is applied to the listing of the file
+	var metrics string
+	for i := 0; i < 100; i++ {
+		var code int
+		if code, metrics = get("/metrics"); code == http.StatusOK && strings.Contains(metrics, `zfs_snapshot_count{dataset="pool-nvme/data"} 1`) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Contains(t, metrics, `zfs_snapshot_count{dataset="pool-nvme/data"} 1`, out.String())
+	require.Contains(t, metrics, `zfs_snapshot_count{dataset="pool-hdd/backup/pull/node-a/data"} 2`)
+	require.Contains(t, metrics, `zfs_pool_status{pool="pool",state="online"} 1`)
+	require.Contains(t, metrics, `zfs_exporter_collector_success{collector="pool"} 1`)
+
+	// the event stream stays attached after the file has been replayed
+	code, body := get("/readyz")
+	require.Equal(t, http.StatusOK, code, body)
+}
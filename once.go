@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/urfave/cli/v2"
+)
+
+var onceCommand = &cli.Command{
+	Name:   "once",
+	Usage:  "gather all metrics once, print them in the OpenMetrics format, or the InfluxDB line protocol with --text-file-format=influx, and exit",
+	Action: runOnce,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "write the metrics atomically to a file instead of stdout",
+		},
+	},
+}
+
+// encodeOnce encodes families in the text file format, the prometheus format
+// is written as OpenMetrics.
+func encodeOnce(w io.Writer, format string, families []*dto.MetricFamily) error {
+	if err := validateTextFileFormat(format); err != nil {
+		return err
+	}
+	if format == textFileFormatInflux {
+		return encodeInflux(w, families, time.Now())
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeOpenMetrics))
+	for _, f := range families {
+		if err := enc.Encode(f); err != nil {
+			return fmt.Errorf("error encoding metrics: %w", err)
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("error encoding metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+func runOnce(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	zfsCollectors, err := newExporterTargets(ctx, c, false)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	limit, err := parseSeriesLimit(c)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	gatherers := prometheus.Gatherers{limit.wrap(zfsCollectors.newRegistry(zfsCollectors.names()))}
+	if limit.limit > 0 {
+		regLimit := prometheus.NewRegistry()
+		zfsCollectors.wrap(regLimit).MustRegister(limit.collectors()...)
+		gatherers = append(gatherers, regLimit)
+	}
+	families, err := gatherers.Gather()
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("error gathering metrics: %v", err), 1)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeOnce(&buf, c.String("text-file-format"), families); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	filename := c.String("output")
+	if filename == "" {
+		_, err := buf.WriteTo(c.App.Writer)
+		return err
+	}
+
+	textFileMode, err := parseFileMode(c.String("text-file-mode"))
+	if err != nil {
+		return err
+	}
+	out := newTextFileOutput(nil, filename, 0)
+	out.mode = textFileMode
+	if group := c.String("text-file-group"); group != "" {
+		if out.gid, err = lookupGroupID(group); err != nil {
+			return err
+		}
+	}
+	if err := out.writeFile(&buf); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
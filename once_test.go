@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+const (
+	fakeZpoolStatus = ` pool: pool
+ state: ONLINE
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	pool        ONLINE       0     0     0
+	  /dev/sda  ONLINE       0     0     0
+
+errors: No known data errors
+`
+	fakeZfsList = "pool/data@daily-1\t1700000000\t4096\npool/data@daily-2\t1700086400\t8192\n"
+)
+
+// fakeCommands puts fake zfs and zpool executables at the front of PATH.
+func fakeCommands(t *testing.T, scripts map[string]string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, script := range scripts {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0o755))
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func runOnceApp(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	var (
+		out, errOut bytes.Buffer
+		exitCode    int
+		oldExiter   = cli.OsExiter
+	)
+	cli.OsExiter = func(code int) { exitCode = code }
+	defer func() { cli.OsExiter = oldExiter }()
+
+	app := newApp()
+	app.Writer = &out
+	app.ErrWriter = &errOut
+	_ = app.Run(append([]string{"zfs-event-exporter", "once"}, args...))
+	return out.String(), exitCode
+}
+
+func TestOnce(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		out, code := runOnceApp(t)
+		require.Equal(t, 0, code)
+		require.Contains(t, out, `zfs_snapshot_count{dataset="pool/data"} 2`)
+		require.Contains(t, out, `zfs_snapshot_disk_used{dataset="pool/data"} 12288`)
+		require.Contains(t, out, `zfs_pool_status{pool="pool",state="online"} 1`)
+		// the kstats of the local host are collected as well
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="l2arc"} 1`)
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="dmu_tx"} 1`)
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="txg"} 1`)
+		require.NotContains(t, out, `collector="zfetch"`)
+		require.NotContains(t, out, `collector="dbuf"`)
+		require.NotContains(t, out, `collector="spl"`)
+		require.NotContains(t, out, `collector="dataset"`)
+		require.Contains(t, out, "# EOF\n")
+	})
+
+	t.Run("output file", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "zfs.prom")
+		out, code := runOnceApp(t, "--output", filename)
+		require.Equal(t, 0, code)
+		require.Empty(t, out)
+
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		require.Contains(t, string(data), `zfs_pool_status{pool="pool",state="online"} 1`)
+	})
+
+	t.Run("optional collectors", func(t *testing.T) {
+		t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_ZFETCH", "true")
+		t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_DBUF", "true")
+		t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_DATASET_IO", "true")
+		t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_SPL", "true")
+		out, code := runOnceApp(t)
+		require.Equal(t, 0, code)
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="dataset_io"} 1`)
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="zfetch"} 1`)
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="dbuf"} 1`)
+		require.Contains(t, out, `zfs_exporter_collector_success{collector="spl"} 1`)
+	})
+}
+
+func TestOnceDataset(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": `if [ "$1" = get ]; then
+	printf 'pool\tused\t1024\t-\npool\tquota\t4096\tlocal\npool/tmp\tcompressratio\t1.20x\t-\n'
+	exit 0
+fi
+printf '` + fakeZfsList + `'
+`,
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_DATASET", "true")
+	t.Setenv("ZFS_EVENT_EXPORTER_EXCLUDE_DATASET", "/tmp$")
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_exporter_collector_success{collector="dataset"} 1`)
+	require.Contains(t, out, `zfs_dataset_quota_bytes{dataset="pool"} 4096`)
+	require.Contains(t, out, `zfs_dataset_quota_used_ratio{dataset="pool"} 0.25`)
+	require.NotContains(t, out, `dataset="pool/tmp"`)
+}
+
+func TestOncePoolCounts(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": `if [ "$2" = -H ] && [ "$4" = name,type ]; then
+	printf 'pool\tfilesystem\npool/data\tfilesystem\npool/data@daily-1\tsnapshot\npool/data@daily-2\tsnapshot\npool/vol\tvolume\n'
+	exit 0
+fi
+printf '` + fakeZfsList + `'
+`,
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_COUNTS", "true")
+	// the counts aren't filtered
+	t.Setenv("ZFS_EVENT_EXPORTER_EXCLUDE_DATASET", "^pool/data$")
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_exporter_collector_success{collector="pool_count"} 1`)
+	require.Contains(t, out, `zfs_pool_filesystems{pool="pool"} 2`)
+	require.Contains(t, out, `zfs_pool_volumes{pool="pool"} 1`)
+	require.Contains(t, out, `zfs_pool_snapshots_total{pool="pool"} 2`)
+}
+
+func TestOncePoolQueues(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": "printf '" + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = iostat ]; then
+	printf '     syncq_write\npool  pend  activ\npool  3  1\n'
+	exit 0
+fi
+cat <<'EOF'
+` + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_QUEUES", "true")
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_exporter_collector_success{collector="pool_queue"} 1`)
+	require.Contains(t, out, `zfs_pool_queue_pending{pool="pool",queue="sync_write"} 3`)
+	require.Contains(t, out, `zfs_pool_status{pool="pool",state="online"} 1`)
+}
+
+func TestOncePoolRequestSizes(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": "printf '" + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = iostat ]; then
+	printf 'pool  sync_write\nreq_size  ind  agg\n---  ---  ---\n4096  12  0\n8192  3  1\n---\n'
+	exit 0
+fi
+cat <<'EOF'
+` + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_REQUEST_SIZES", "true")
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_exporter_collector_success{collector="pool_request_sizes"} 1`)
+	require.Contains(t, out, `zfs_pool_request_size_bytes_bucket{op="sync_write",pool="pool",type="ind",le="8192.0"} 12`)
+	require.Contains(t, out, `zfs_pool_request_size_bytes_bucket{op="sync_write",pool="pool",type="ind",le="16384.0"} 15`)
+	require.Contains(t, out, `zfs_pool_request_size_bytes_count{op="sync_write",pool="pool",type="agg"} 1`)
+}
+
+func TestOnceCollectorFailure(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "echo 'permission denied' >&2\nexit 1\n",
+	})
+
+	filename := filepath.Join(t.TempDir(), "zfs.prom")
+	out, code := runOnceApp(t, "--output", filename)
+	require.Equal(t, 1, code)
+	require.Empty(t, out)
+
+	// no partial output is written
+	_, err := os.Stat(filename)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOnceListingFailure(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "exit 1\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	_, code := runOnceApp(t)
+	require.Equal(t, 1, code)
+}
+
+func TestOnceSnapshotBackend(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	t.Setenv("ZFS_EVENT_EXPORTER_SNAPSHOT_BACKEND", "exec")
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_snapshot_count{dataset="pool/data"} 2`)
+
+	// the program backend falls back to zfs list, as the output of zfs
+	// program isn't valid
+	t.Setenv("ZFS_EVENT_EXPORTER_SNAPSHOT_BACKEND", snapshot.BackendProgram)
+	out, code = runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_snapshot_count{dataset="pool/data"} 2`)
+
+	// unknown backends and libzfs in builds without it are refused
+	backends := []string{"json"}
+	if _, err := snapshot.NewLister(logger, snapshot.BackendLibZFS, nil); err != nil {
+		backends = append(backends, snapshot.BackendLibZFS)
+	}
+	for _, backend := range backends {
+		t.Setenv("ZFS_EVENT_EXPORTER_SNAPSHOT_BACKEND", backend)
+		_, code = runOnceApp(t)
+		require.Equal(t, 1, code, backend)
+	}
+
+	// libzfs and channel programs only list the snapshots of the local host
+	t.Setenv("ZFS_EVENT_EXPORTER_SNAPSHOT_LIST_FILE", filepath.Join("zfs", "snapshot", "testdata", "snapshots-simple.txt"))
+	for _, backend := range []string{snapshot.BackendLibZFS, snapshot.BackendProgram} {
+		t.Setenv("ZFS_EVENT_EXPORTER_SNAPSHOT_BACKEND", backend)
+		_, code = runOnceApp(t)
+		require.Equal(t, 1, code, backend)
+	}
+}
+
+func TestOnceEventSource(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	// zpool history is only polled when following changes
+	t.Setenv("ZFS_EVENT_EXPORTER_EVENT_SOURCE", eventSourceHistory)
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_snapshot_count{dataset="pool/data"} 2`)
+
+	for name, env := range map[string]map[string]string{
+		"unknown source":     {"ZFS_EVENT_EXPORTER_EVENT_SOURCE": "poll"},
+		"no interval":        {"ZFS_EVENT_EXPORTER_EVENT_SOURCE_HISTORY_INTERVAL": "0s"},
+		"snapshot list file": {"ZFS_EVENT_EXPORTER_SNAPSHOT_LIST_FILE": filepath.Join("zfs", "snapshot", "testdata", "snapshots-simple.txt")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			_, code := runOnceApp(t)
+			require.Equal(t, 1, code)
+		})
+	}
+}
+
+func TestOnceSnapshotMode(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	events := filepath.Join(t.TempDir(), "events.txt")
+	require.NoError(t, os.WriteFile(events, nil, 0o600))
+
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_SNAPSHOT_MODE", snapshotModePoll)
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_snapshot_count{dataset="pool/data"} 2`)
+
+	for name, env := range map[string]map[string]string{
+		"unknown mode":   {"ZFS_EVENT_EXPORTER_COLLECTOR_SNAPSHOT_MODE": "history"},
+		"no interval":    {"ZFS_EVENT_EXPORTER_COLLECTOR_SNAPSHOT_POLL_INTERVAL": "0s"},
+		"history source": {"ZFS_EVENT_EXPORTER_EVENT_SOURCE": eventSourceHistory},
+		"events file":    {"ZFS_EVENT_EXPORTER_EVENTS_FILE": events},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			_, code := runOnceApp(t)
+			require.Equal(t, 1, code)
+		})
+	}
+}
+
+func TestOnceMaxSeries(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": "cat <<'EOF'\n" + fakeZpoolStatus + "EOF\n",
+	})
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "zfs_snapshot_count")
+	require.NotContains(t, out, "zfs_exporter_series_limit")
+
+	// the series beyond the limit are dropped in the order of their names,
+	// the metrics of the exporter and the pools are kept
+	t.Setenv("ZFS_EVENT_EXPORTER_MAX_SERIES", "1")
+	out, code = runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "zfs_exporter_series_limit 1")
+	require.Contains(t, out, "zfs_exporter_build_info")
+	require.Contains(t, out, "zfs_exporter_series_truncated_total ")
+	require.Contains(t, out, "zfs_exporter_collector_success")
+	require.Contains(t, out, "zfs_pool_status")
+	require.Contains(t, out, "zfs_snapshot_count")
+	require.NotContains(t, out, "zfs_snapshot_disk_used")
+
+	t.Setenv("ZFS_EVENT_EXPORTER_MAX_SERIES", "-1")
+	_, code = runOnceApp(t)
+	require.Equal(t, 1, code)
+}
+
+func TestOncePoolCapacity(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": "printf '" + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = list ]; then
+	printf 'pool\t1073741824\t536870912\n'
+	exit 0
+fi
+cat <<'EOF'
+` + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_CAPACITY", "true")
+
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, `zfs_exporter_collector_success{collector="pool_capacity"} 1`)
+	require.Contains(t, out, `zfs_pool_size_bytes{pool="pool"} 1.073741824e+09`)
+	require.Contains(t, out, `zfs_pool_allocated_bytes{pool="pool"} 5.36870912e+08`)
+	// a single collection has no history to project from
+	require.NotContains(t, out, "zfs_pool_seconds_until_full")
+
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_CAPACITY_WINDOW", "0s")
+	_, code = runOnceApp(t)
+	require.Equal(t, 1, code)
+}
+
+func TestOncePoolDisks(t *testing.T) {
+	fixture, err := filepath.Abs(filepath.Join("zfs", "pool", "testdata", "iostat", "disks.txt"))
+	require.NoError(t, err)
+	fakeCommands(t, map[string]string{
+		"zfs": "printf '" + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = iostat ]; then
+	cat ` + fixture + `
+	exit 0
+fi
+cat <<'EOF'
+` + fakeZpoolStatus + "EOF\n",
+	})
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_DISKS", "true")
+
+	// the disks are only summed up while zpool iostat is followed
+	out, code := runOnceApp(t)
+	require.Equal(t, 0, code)
+	require.NotContains(t, out, "zfs_pool_disk_read_ops_total")
+
+	c := pool.NewDiskCollector(logger, command.NewRunner(command.DefaultTimeout), "zfs", time.Second)
+	require.EqualError(t, c.Run(context.Background()), "zpool iostat exited")
+	require.Equal(t, 7, testutil.CollectAndCount(c, "zfs_pool_disk_read_ops_total"))
+
+	t.Setenv("ZFS_EVENT_EXPORTER_COLLECTOR_POOL_DISKS_INTERVAL", "0s")
+	_, code = runOnceApp(t)
+	require.Equal(t, 1, code)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// createdLinesHandler serves the OpenMetrics exposition of g including the
+// _created lines of counters, summaries and histograms, which promhttp leaves
+// out. They let Prometheus tell a counter reset from an exporter restart.
+// Scrapes negotiating other formats, which carry the created timestamps
+// themselves or not at all, are served by next. Like next, a failing
+// gather is logged and the gathered metrics are served.
+func createdLinesHandler(g prometheus.Gatherer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if format.FormatType() != expfmt.TypeOpenMetrics {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		families, err := g.Gather()
+		if err != nil {
+			logger.Error().Msgf("error gathering metrics: %v", err)
+		}
+
+		w.Header().Set("Content-Type", string(format))
+		var out io.Writer = w
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+
+		enc := expfmt.NewEncoder(out, format, expfmt.WithCreatedLines())
+		for _, f := range families {
+			if err := enc.Encode(f); err != nil {
+				logger.Error().Msgf("error encoding metrics: %v", err)
+				return
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logger.Error().Msgf("error encoding metrics: %v", err)
+			}
+		}
+	})
+}
+
+// acceptsGzip returns whether the client accepts a gzip compressed response.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(coding, ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		// a quality of 0 refuses the coding
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		quality, err := strconv.ParseFloat(q, 64)
+		return err != nil || quality > 0
+	}
+	return false
+}
+
+// limitInFlight answers requests beyond max requests in flight with 503. A
+// max of 0 doesn't limit the requests.
+func limitInFlight(max int, h http.Handler) http.Handler {
+	if max <= 0 {
+		return h
+	}
+	inFlight := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+		default:
+			http.Error(w, fmt.Sprintf("Limit of concurrent requests reached (%d), try again later.", max), http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+)
+
+const openMetricsAccept = "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// errorsCollector exports a counter read from zpool status, which was first
+// seen at created.
+type errorsCollector struct {
+	desc    *prometheus.Desc
+	created time.Time
+}
+
+func (c *errorsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *errorsCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(c.desc, prometheus.CounterValue, 3, c.created, "tank", "checksum")
+}
+
+func newCreatedHandler(t *testing.T) http.Handler {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(&errorsCollector{
+		desc:    prometheus.NewDesc("zfs_pool_errors_total", "Total count of ZFS pool errors", []string{"pool", "type"}, nil),
+		created: time.Unix(1700000000, 0),
+	})
+	h, _ := newMetricsHandler(reg, 0)
+	return h
+}
+
+func TestMetricsHandlerCreatedLines(t *testing.T) {
+	h := newCreatedHandler(t)
+
+	for _, encoding := range []string{"", "gzip"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", openMetricsAccept)
+		req.Header.Set("Accept-Encoding", encoding)
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), expfmt.OpenMetricsType), rec.Header().Get("Content-Type"))
+		require.Equal(t, encoding, rec.Header().Get("Content-Encoding"))
+
+		var body io.Reader = rec.Body
+		if encoding == "gzip" {
+			gz, err := gzip.NewReader(rec.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		require.Equal(t, `# HELP zfs_pool_errors Total count of ZFS pool errors
+# TYPE zfs_pool_errors counter
+zfs_pool_errors_total{pool="tank",type="checksum"} 3.0
+zfs_pool_errors_created{pool="tank",type="checksum"} 1.7e+09
+# EOF
+`, string(data))
+	}
+}
+
+func TestMetricsHandlerCreatedTimestamps(t *testing.T) {
+	h := newCreatedHandler(t)
+
+	// the protobuf exposition carries the created timestamp as a field
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, expfmt.TypeProtoDelim, expfmt.ResponseFormat(rec.Header()).FormatType())
+
+	var mf dto.MetricFamily
+	require.NoError(t, expfmt.NewDecoder(rec.Body, expfmt.ResponseFormat(rec.Header())).Decode(&mf))
+	require.Equal(t, "zfs_pool_errors_total", mf.GetName())
+	require.Equal(t, time.Unix(1700000000, 0).UTC(), mf.GetMetric()[0].GetCounter().GetCreatedTimestamp().AsTime())
+
+	// the text format has no place for it
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, expfmt.TypeTextPlain, expfmt.ResponseFormat(rec.Header()).FormatType())
+	require.Contains(t, rec.Body.String(), `zfs_pool_errors_total{pool="tank",type="checksum"} 3`)
+	require.NotContains(t, rec.Body.String(), "_created")
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for encoding, expected := range map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"deflate, gzip":      true,
+		"gzip;q=0.5, br":     true,
+		"gzip; q=0":          false,
+		"gzip;q=0.0":         false,
+		"identity":           false,
+		"x-gzip, identity;q": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		require.Equal(t, expected, acceptsGzip(req), encoding)
+	}
+}
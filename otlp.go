@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	otlpProtocolGRPC = "grpc"
+	otlpProtocolHTTP = "http/protobuf"
+
+	// otlpScope is the instrumentation scope of the exported metrics.
+	otlpScope = "github.com/simonswine/zfs-event-exporter"
+)
+
+func validateOTLPProtocol(protocol string) error {
+	switch protocol {
+	case otlpProtocolGRPC, otlpProtocolHTTP:
+		return nil
+	default:
+		return fmt.Errorf("invalid OTLP protocol %q, expected %s or %s", protocol, otlpProtocolGRPC, otlpProtocolHTTP)
+	}
+}
+
+// parseOTLPHeaders parses the key=value pairs of the --otlp.header flag.
+func parseOTLPHeaders(values []string) (map[string]string, error) {
+	headers := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected key=value", v)
+		}
+		key = strings.ToLower(key)
+		if _, ok := headers[key]; ok {
+			return nil, fmt.Errorf("duplicate OTLP header %q", key)
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+// otlpAttributes converts label pairs into OTLP attributes.
+func otlpAttributes(labels []*dto.LabelPair) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		attrs = append(attrs, &commonpb.KeyValue{
+			Key:   l.GetName(),
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: l.GetValue()}},
+		})
+	}
+	return attrs
+}
+
+// otlpHistogramBuckets converts cumulative Prometheus buckets into explicit
+// bounds and the counts per bucket. The last count is the +Inf bucket.
+func otlpHistogramBuckets(h *dto.Histogram) (bounds []float64, counts []uint64) {
+	var last uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, b.GetUpperBound())
+		counts = append(counts, b.GetCumulativeCount()-last)
+		last = b.GetCumulativeCount()
+	}
+	return bounds, append(counts, h.GetSampleCount()-last)
+}
+
+// otlpStartTime returns the created timestamp of a cumulative metric or
+// start, if it has none.
+func otlpStartTime(created *timestamppb.Timestamp, start uint64) uint64 {
+	if created == nil {
+		return start
+	}
+	return uint64(created.AsTime().UnixNano())
+}
+
+// otlpNativeOnly reports whether h is a native histogram without classic
+// buckets, which explicit bucket histograms can't represent.
+func otlpNativeOnly(h *dto.Histogram) bool {
+	return h.Schema != nil && len(h.GetBucket()) == 0
+}
+
+// otlpMetrics converts metric families into OTLP metrics. Labels become
+// attributes, counters become monotonic cumulative sums starting at their
+// created timestamp or start and untyped metrics become gauges. Native
+// histograms without classic buckets are skipped and their families returned
+// as skipped.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) (metrics []*metricspb.Metric, skipped []string) {
+	startNano := uint64(start.UnixNano())
+	metrics = make([]*metricspb.Metric, 0, len(families))
+	for _, f := range families {
+		m := &metricspb.Metric{Name: f.GetName(), Description: f.GetHelp()}
+
+		var (
+			numbers    []*metricspb.NumberDataPoint
+			histograms []*metricspb.HistogramDataPoint
+			summaries  []*metricspb.SummaryDataPoint
+		)
+		for _, sample := range f.GetMetric() {
+			ts := uint64(now.UnixNano())
+			if sample.TimestampMs != nil {
+				ts = uint64(sample.GetTimestampMs()) * uint64(time.Millisecond)
+			}
+			attrs := otlpAttributes(sample.GetLabel())
+
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				numbers = append(numbers, &metricspb.NumberDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: otlpStartTime(sample.GetCounter().GetCreatedTimestamp(), startNano),
+					TimeUnixNano:      ts,
+					Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.GetCounter().GetValue()},
+				})
+			case dto.MetricType_GAUGE:
+				numbers = append(numbers, &metricspb.NumberDataPoint{
+					Attributes:   attrs,
+					TimeUnixNano: ts,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.GetGauge().GetValue()},
+				})
+			case dto.MetricType_UNTYPED:
+				numbers = append(numbers, &metricspb.NumberDataPoint{
+					Attributes:   attrs,
+					TimeUnixNano: ts,
+					Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.GetUntyped().GetValue()},
+				})
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := sample.GetHistogram()
+				if otlpNativeOnly(h) {
+					continue
+				}
+				bounds, counts := otlpHistogramBuckets(h)
+				sum := h.GetSampleSum()
+				histograms = append(histograms, &metricspb.HistogramDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: otlpStartTime(h.GetCreatedTimestamp(), startNano),
+					TimeUnixNano:      ts,
+					Count:             h.GetSampleCount(),
+					Sum:               &sum,
+					BucketCounts:      counts,
+					ExplicitBounds:    bounds,
+				})
+			case dto.MetricType_SUMMARY:
+				s := sample.GetSummary()
+				quantiles := make([]*metricspb.SummaryDataPoint_ValueAtQuantile, 0, len(s.GetQuantile()))
+				for _, q := range s.GetQuantile() {
+					quantiles = append(quantiles, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					})
+				}
+				summaries = append(summaries, &metricspb.SummaryDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: otlpStartTime(s.GetCreatedTimestamp(), startNano),
+					TimeUnixNano:      ts,
+					Count:             s.GetSampleCount(),
+					Sum:               s.GetSampleSum(),
+					QuantileValues:    quantiles,
+				})
+			}
+		}
+
+		switch f.GetType() {
+		case dto.MetricType_COUNTER:
+			m.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				DataPoints:             numbers,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			m.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: numbers}}
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			if len(histograms) < len(f.GetMetric()) {
+				skipped = append(skipped, f.GetName())
+			}
+			if len(histograms) == 0 {
+				continue
+			}
+			m.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				DataPoints:             histograms,
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}}
+		case dto.MetricType_SUMMARY:
+			m.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: summaries}}
+		default:
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, skipped
+}
+
+// otlpRequest wraps metrics into an export request of the exporter resource.
+func otlpRequest(metrics []*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	attr := func(k, v string) *commonpb.KeyValue {
+		return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+	}
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				attr("service.name", "zfs-event-exporter"),
+				attr("service.version", version),
+			}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: otlpScope, Version: version},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+// otlpExporter sends export requests to an OTLP receiver.
+type otlpExporter interface {
+	export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error
+	close() error
+}
+
+type otlpGRPCExporter struct {
+	conn    *grpc.ClientConn
+	client  colmetricspb.MetricsServiceClient
+	headers metadata.MD
+}
+
+func (e *otlpGRPCExporter) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	if len(e.headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, e.headers)
+	}
+	_, err := e.client.Export(ctx, req)
+	return err
+}
+
+func (e *otlpGRPCExporter) close() error {
+	return e.conn.Close()
+}
+
+type otlpHTTPExporter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func (e *otlpHTTPExporter) export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (e *otlpHTTPExporter) close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// newOTLPExporter creates an exporter for the endpoint, which is an http or
+// https URL. The TLS settings are taken from the http client config of the
+// web config.
+func newOTLPExporter(endpoint, protocol string, headers map[string]string, web *webConfig) (otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected http(s)://host[:port]", endpoint)
+	}
+
+	if protocol == otlpProtocolHTTP {
+		client, err := web.httpClient()
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		return &otlpHTTPExporter{client: client, url: u.String(), headers: headers}, nil
+	}
+
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		cfg, err := web.clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if cfg == nil {
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		creds = credentials.NewTLS(cfg)
+	}
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to OTLP endpoint %s: %w", endpoint, err)
+	}
+	return &otlpGRPCExporter{
+		conn:    conn,
+		client:  colmetricspb.NewMetricsServiceClient(conn),
+		headers: metadata.New(headers),
+	}, nil
+}
+
+type otlpOutput struct {
+	gatherer    prometheus.Gatherer
+	exporter    otlpExporter
+	endpoint    string
+	interval    time.Duration
+	maxBuffered int
+	start       time.Time
+	now         func() time.Time
+
+	// buffer holds the requests of intervals, which couldn't be exported yet
+	buffer []*colmetricspb.ExportMetricsServiceRequest
+
+	// warned are the skipped families, which have been logged already
+	warned map[string]bool
+
+	metricFailures prometheus.Counter
+	metricDropped  prometheus.Counter
+	metricSkipped  prometheus.Counter
+}
+
+// newOTLPOutput creates an output exporting the metrics of g every interval.
+// Up to maxBuffered intervals are retried, once the receiver is unavailable.
+func newOTLPOutput(g prometheus.Gatherer, exporter otlpExporter, endpoint string, interval time.Duration, maxBuffered int) *otlpOutput {
+	return &otlpOutput{
+		gatherer:    g,
+		exporter:    exporter,
+		endpoint:    endpoint,
+		interval:    interval,
+		maxBuffered: maxBuffered,
+		start:       time.Now(),
+		now:         time.Now,
+		warned:      make(map[string]bool),
+		metricFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zfs_exporter_otlp_export_failures_total",
+			Help: "Total count of failed exports to the OTLP endpoint.",
+		}),
+		metricDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zfs_exporter_otlp_dropped_intervals_total",
+			Help: "Total count of intervals dropped, as the OTLP export buffer was full.",
+		}),
+		metricSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zfs_exporter_otlp_skipped_families_total",
+			Help: "Total count of metric families left out of OTLP exports, as they are native histograms without classic buckets.",
+		}),
+	}
+}
+
+func (o *otlpOutput) exportOrLog(ctx context.Context) {
+	families, err := o.gatherer.Gather()
+	if err != nil {
+		logger.Error().Msgf("error gathering metrics for OTLP export: %v", err)
+	}
+	if len(families) > 0 {
+		metrics, skipped := otlpMetrics(families, o.start, o.now())
+		o.metricSkipped.Add(float64(len(skipped)))
+		for _, name := range skipped {
+			if !o.warned[name] {
+				o.warned[name] = true
+				logger.Warn().Msgf("native histogram %s has no classic buckets and is left out of the OTLP export", name)
+			}
+		}
+		o.buffer = append(o.buffer, otlpRequest(metrics))
+	}
+	if len(o.buffer) > o.maxBuffered {
+		dropped := len(o.buffer) - o.maxBuffered
+		o.buffer = o.buffer[dropped:]
+		o.metricDropped.Add(float64(dropped))
+	}
+
+	// export the buffered intervals oldest first
+	for len(o.buffer) > 0 {
+		exportCtx, cancel := context.WithTimeout(ctx, o.interval)
+		err := o.exporter.export(exportCtx, o.buffer[0])
+		cancel()
+		if err != nil {
+			// an export interrupted by the shutdown is not a failure
+			if ctx.Err() != nil {
+				return
+			}
+			o.metricFailures.Inc()
+			logger.Error().Msgf("error exporting metrics to %s, %d interval(s) buffered: %v", o.endpoint, len(o.buffer), err)
+			return
+		}
+		o.buffer[0] = nil
+		o.buffer = o.buffer[1:]
+	}
+	logger.Debug().Msgf("exported metrics to %s", o.endpoint)
+}
+
+// run exports the metrics every interval until ctx is cancelled.
+func (o *otlpOutput) run(ctx context.Context) {
+	defer func() {
+		if err := o.exporter.close(); err != nil {
+			logger.Warn().Msgf("error closing OTLP exporter: %v", err)
+		}
+	}()
+
+	o.exportOrLog(ctx)
+
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.exportOrLog(ctx)
+		}
+	}
+}
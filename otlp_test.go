@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeOTLPReceiver records the received export requests and their headers.
+type fakeOTLPReceiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+
+	mtx      sync.Mutex
+	fail     bool
+	requests []*colmetricspb.ExportMetricsServiceRequest
+	headers  []map[string]string
+}
+
+func (r *fakeOTLPReceiver) receive(req *colmetricspb.ExportMetricsServiceRequest, headers map[string]string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.fail {
+		return errors.New("receiver unavailable")
+	}
+	r.requests = append(r.requests, req)
+	r.headers = append(r.headers, headers)
+	return nil
+}
+
+func (r *fakeOTLPReceiver) setFail(fail bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.fail = fail
+}
+
+func (r *fakeOTLPReceiver) received() ([]*colmetricspb.ExportMetricsServiceRequest, []map[string]string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.requests, r.headers
+}
+
+func (r *fakeOTLPReceiver) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	headers := make(map[string]string)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, v := range md {
+		headers[k] = v[0]
+	}
+	if err := r.receive(req, headers); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func newFakeOTLPGRPCReceiver(t *testing.T) (*fakeOTLPReceiver, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	r := &fakeOTLPReceiver{}
+	srv := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(srv, r)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+	return r, "http://" + l.Addr().String()
+}
+
+func newFakeOTLPHTTPReceiver(t *testing.T) (*fakeOTLPReceiver, string) {
+	t.Helper()
+
+	r := &fakeOTLPReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/metrics" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("error reading export body: %v", err)
+			return
+		}
+		var export colmetricspb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &export); err != nil {
+			t.Errorf("error decoding export body: %v", err)
+			return
+		}
+		if err := r.receive(&export, map[string]string{"authorization": req.Header.Get("Authorization")}); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv.URL
+}
+
+func testOTLPRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "zfs_pool_status", Help: "Pool status."}, []string{"pool", "state"})
+	status.WithLabelValues("tank", "online").Set(1)
+	events := prometheus.NewCounter(prometheus.CounterOpts{Name: "zfs_events_total", Help: "Events."})
+	events.Add(3)
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "zfs_duration_seconds", Help: "Duration.", Buckets: []float64{1, 10}})
+	for _, v := range []float64{0.5, 2, 5, 20} {
+		duration.Observe(v)
+	}
+	// native histograms without classic buckets are left out
+	txg := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "zfs_txg_sync_seconds", Help: "Sync.", NativeHistogramBucketFactor: 1.1})
+	txg.Observe(0.2)
+	reg.MustRegister(status, events, duration, txg)
+	return reg
+}
+
+func metricsByName(req *colmetricspb.ExportMetricsServiceRequest) map[string]*metricspb.Metric {
+	metrics := make(map[string]*metricspb.Metric)
+	for _, rm := range req.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				metrics[m.GetName()] = m
+			}
+		}
+	}
+	return metrics
+}
+
+func stringAttr(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+func requireOTLPDatapoints(t *testing.T, req *colmetricspb.ExportMetricsServiceRequest, start, now time.Time) {
+	t.Helper()
+
+	metrics := metricsByName(req)
+	require.Len(t, metrics, 3)
+
+	gauge := metrics["zfs_pool_status"].GetGauge()
+	require.NotNil(t, gauge)
+	require.Len(t, gauge.GetDataPoints(), 1)
+	p := gauge.GetDataPoints()[0]
+	require.True(t, proto.Equal(stringAttr("pool", "tank"), p.GetAttributes()[0]))
+	require.True(t, proto.Equal(stringAttr("state", "online"), p.GetAttributes()[1]))
+	require.Equal(t, 1.0, p.GetAsDouble())
+	require.Equal(t, uint64(now.UnixNano()), p.GetTimeUnixNano())
+
+	sum := metrics["zfs_events_total"].GetSum()
+	require.NotNil(t, sum)
+	require.True(t, sum.GetIsMonotonic())
+	require.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, sum.GetAggregationTemporality())
+	require.Equal(t, 3.0, sum.GetDataPoints()[0].GetAsDouble())
+	// the counter starts when it was created, not at the start of the output
+	require.Greater(t, sum.GetDataPoints()[0].GetStartTimeUnixNano(), uint64(start.UnixNano()))
+
+	hist := metrics["zfs_duration_seconds"].GetHistogram()
+	require.NotNil(t, hist)
+	h := hist.GetDataPoints()[0]
+	require.Equal(t, uint64(4), h.GetCount())
+	require.Equal(t, 27.5, h.GetSum())
+	require.Equal(t, []float64{1, 10}, h.GetExplicitBounds())
+	require.Equal(t, []uint64{1, 2, 1}, h.GetBucketCounts())
+}
+
+func newTestOTLPOutput(t *testing.T, endpoint, protocol string, maxBuffered int) *otlpOutput {
+	t.Helper()
+
+	exporter, err := newOTLPExporter(endpoint, protocol, map[string]string{"authorization": "Bearer secret"}, &webConfig{})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = exporter.close() })
+
+	out := newOTLPOutput(testOTLPRegistry(), exporter, endpoint, 5*time.Second, maxBuffered)
+	out.start = time.Unix(1700000000, 0)
+	out.now = func() time.Time { return time.Unix(1700000060, 0) }
+	return out
+}
+
+func TestOTLPOutput(t *testing.T) {
+	for _, tc := range []struct {
+		protocol string
+		receiver func(*testing.T) (*fakeOTLPReceiver, string)
+	}{
+		{protocol: otlpProtocolGRPC, receiver: newFakeOTLPGRPCReceiver},
+		{protocol: otlpProtocolHTTP, receiver: newFakeOTLPHTTPReceiver},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			r, endpoint := tc.receiver(t)
+			out := newTestOTLPOutput(t, endpoint, tc.protocol, 5)
+
+			out.exportOrLog(context.Background())
+
+			requests, headers := r.received()
+			require.Len(t, requests, 1)
+			require.Equal(t, "Bearer secret", headers[0]["authorization"])
+			requireOTLPDatapoints(t, requests[0], out.start, out.now())
+			require.Equal(t, float64(0), testutil.ToFloat64(out.metricFailures))
+			require.Equal(t, float64(1), testutil.ToFloat64(out.metricSkipped))
+		})
+	}
+}
+
+func TestOTLPOutputBuffer(t *testing.T) {
+	r, endpoint := newFakeOTLPGRPCReceiver(t)
+	out := newTestOTLPOutput(t, endpoint, otlpProtocolGRPC, 2)
+
+	r.setFail(true)
+	for i := 0; i < 3; i++ {
+		out.exportOrLog(context.Background())
+	}
+	require.Equal(t, float64(3), testutil.ToFloat64(out.metricFailures))
+	require.Equal(t, float64(1), testutil.ToFloat64(out.metricDropped))
+	require.Len(t, out.buffer, 2)
+
+	// the buffered intervals are sent once the receiver recovers, the full
+	// buffer drops the oldest one again
+	r.setFail(false)
+	out.exportOrLog(context.Background())
+	requests, _ := r.received()
+	require.Len(t, requests, 2)
+	require.Empty(t, out.buffer)
+	require.Equal(t, float64(2), testutil.ToFloat64(out.metricDropped))
+	require.Equal(t, float64(3), testutil.ToFloat64(out.metricFailures))
+}
+
+func TestOTLPMetricsStartTime(t *testing.T) {
+	var (
+		start   = time.Unix(1700000000, 0)
+		now     = time.Unix(1700000060, 0)
+		created = timestamppb.New(time.Unix(1690000000, 0))
+	)
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("zfs_created_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Counter: &dto.Counter{Value: proto.Float64(1), CreatedTimestamp: created}},
+				{Counter: &dto.Counter{Value: proto.Float64(2)}},
+			},
+		},
+		{
+			Name:   proto.String("zfs_histogram_seconds"),
+			Type:   dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{SampleCount: proto.Uint64(1), CreatedTimestamp: created}}},
+		},
+		{
+			Name:   proto.String("zfs_summary_seconds"),
+			Type:   dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{Summary: &dto.Summary{SampleCount: proto.Uint64(1), CreatedTimestamp: created}}},
+		},
+	}
+
+	metrics, skipped := otlpMetrics(families, start, now)
+	require.Empty(t, skipped)
+	require.Len(t, metrics, 3)
+	counters := metrics[0].GetSum().GetDataPoints()
+	require.Equal(t, uint64(created.AsTime().UnixNano()), counters[0].GetStartTimeUnixNano())
+	// without a created timestamp the counter starts with the output
+	require.Equal(t, uint64(start.UnixNano()), counters[1].GetStartTimeUnixNano())
+	require.Equal(t, uint64(created.AsTime().UnixNano()), metrics[1].GetHistogram().GetDataPoints()[0].GetStartTimeUnixNano())
+	require.Equal(t, uint64(created.AsTime().UnixNano()), metrics[2].GetSummary().GetDataPoints()[0].GetStartTimeUnixNano())
+}
+
+func TestNewOTLPExporter(t *testing.T) {
+	for _, invalid := range []string{"collector:4317", "ftp://collector", "http://"} {
+		_, err := newOTLPExporter(invalid, otlpProtocolGRPC, nil, &webConfig{})
+		require.Error(t, err, invalid)
+	}
+
+	e, err := newOTLPExporter("https://collector:4318", otlpProtocolHTTP, nil, &webConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "https://collector:4318/v1/metrics", e.(*otlpHTTPExporter).url)
+
+	e, err = newOTLPExporter("https://collector:4318/otlp/v1/metrics", otlpProtocolHTTP, nil, &webConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "https://collector:4318/otlp/v1/metrics", e.(*otlpHTTPExporter).url)
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	headers, err := parseOTLPHeaders([]string{"Authorization=Bearer a=b", "x-scope-orgid=zfs"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"authorization": "Bearer a=b", "x-scope-orgid": "zfs"}, headers)
+
+	for _, invalid := range [][]string{{"authorization"}, {"=value"}, {"a=1", "A=2"}} {
+		_, err := parseOTLPHeaders(invalid)
+		require.Error(t, err, "%v", invalid)
+	}
+}
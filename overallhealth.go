@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+)
+
+// healthLevel is the overall health exported as zfs_health.
+type healthLevel int
+
+const (
+	healthOK healthLevel = iota
+	healthWarning
+	healthCritical
+)
+
+// The decision table of the overall health. Every condition found in the
+// state of the collectors has a level, the worst condition is the overall
+// health.
+//
+//	condition                                  level
+//	zpool status failed or is stuck            warning
+//	pool ONLINE                                ok
+//	pool DEGRADED                              warning
+//	pool FAULTED, UNAVAIL, SUSPENDED, REMOVED,
+//	  OFFLINE or any other state               critical
+//	vdev or disk ONLINE                        ok
+//	vdev or disk in any other state            warning
+//	data errors of a pool                      critical
+//	I/O errors of a pool, vdev or disk         warning
+//	upgrade of a pool available                warning
+//	last snapshot older than the max age       warning
+//
+// While zpool status fails, the pools are evaluated as last seen, but the
+// health is at least a warning, as their current state is unknown.
+// The data errors are the ones of the errors line of zpool status, which
+// affect the data itself. The read, write and checksum errors of the config
+// are I/O errors, which redundancy may have corrected.
+// The vdevs of a pool, e.g. tank/mirror-0, are part of the pools of the zpool
+// status. Their state is reflected by the state of the pool.
+var (
+	poolHealthLevels = map[string]healthLevel{
+		"ONLINE":   healthOK,
+		"DEGRADED": healthWarning,
+	}
+	diskHealthLevels = map[string]healthLevel{
+		"ONLINE": healthOK,
+	}
+)
+
+const (
+	poolStatusFailedHealth = healthWarning
+	poolHealthDefault      = healthCritical
+	diskHealthDefault      = healthWarning
+	dataErrorsHealth       = healthCritical
+	ioErrorsHealth         = healthWarning
+	upgradeHealth          = healthWarning
+	snapshotOverdueHealth  = healthWarning
+)
+
+// healthPoolMaxAge is the age of a zpool status, which the health reuses. The
+// health is gathered right after the pool collector, so both share the
+// zpool status of a collection.
+const healthPoolMaxAge = time.Second
+
+// healthCondition is a condition contributing to the overall health.
+type healthCondition struct {
+	level  healthLevel
+	reason string
+}
+
+// worse replaces c with the condition of level and the formatted reason, if
+// it is worse. Of conditions with the same level, the first one is kept.
+func (c *healthCondition) worse(level healthLevel, reason string, args ...interface{}) {
+	if level > c.level {
+		c.level = level
+		c.reason = fmt.Sprintf(reason, args...)
+	}
+}
+
+func hasErrors(e pool.Errors) bool {
+	return e.Read > 0 || e.Write > 0 || e.Checksum > 0
+}
+
+// evaluateHealth returns the worst condition of the pools and disks and of
+// the last snapshots of the datasets. With a positive maxAge, datasets, whose
+// last snapshot is older than maxAge at now, are overdue.
+func evaluateHealth(pools pool.State, lastCreated map[string]time.Time, maxAge time.Duration, now time.Time) healthCondition {
+	result := healthCondition{level: healthOK, reason: "ok"}
+
+	if pools.LastError != "" {
+		result.worse(poolStatusFailedHealth, "zpool status failed: %s", pools.LastError)
+	}
+	for _, p := range pools.Pools {
+		if strings.Contains(p.Name, "/") {
+			level, ok := diskHealthLevels[p.Health]
+			if !ok {
+				level = diskHealthDefault
+			}
+			result.worse(level, "vdev %s is %s", p.Name, p.Health)
+			if hasErrors(p.Errors) {
+				result.worse(ioErrorsHealth, "vdev %s has errors", p.Name)
+			}
+			continue
+		}
+		level, ok := poolHealthLevels[p.Health]
+		if !ok {
+			level = poolHealthDefault
+		}
+		result.worse(level, "pool %s is %s", p.Name, p.Health)
+		if p.DataErrors > 0 {
+			result.worse(dataErrorsHealth, "pool %s has data errors", p.Name)
+		}
+		if hasErrors(p.Errors) {
+			result.worse(ioErrorsHealth, "pool %s has errors", p.Name)
+		}
+		if p.UpgradeAvailable {
+			result.worse(upgradeHealth, "pool %s can be upgraded", p.Name)
+		}
+	}
+	for _, d := range pools.Disks {
+		level, ok := diskHealthLevels[d.Health]
+		if !ok {
+			level = diskHealthDefault
+		}
+		result.worse(level, "disk %s of pool %s is %s", d.Name, d.Pool, d.Health)
+		if hasErrors(d.Errors) {
+			result.worse(ioErrorsHealth, "disk %s of pool %s has errors", d.Name, d.Pool)
+		}
+	}
+
+	if maxAge > 0 {
+		datasets := make([]string, 0, len(lastCreated))
+		for dataset := range lastCreated {
+			datasets = append(datasets, dataset)
+		}
+		sort.Strings(datasets)
+		for _, dataset := range datasets {
+			if now.Sub(lastCreated[dataset]) > maxAge {
+				result.worse(snapshotOverdueHealth, "dataset %s has no snapshot newer than %s", dataset, maxAge)
+			}
+		}
+	}
+
+	return result
+}
+
+type lastCreatedSource interface {
+	LastCreated() map[string]time.Time
+}
+
+type poolRefresher interface {
+	Refresh(maxAge time.Duration) pool.State
+}
+
+// healthCollector exports the overall health of the pools and snapshots of a
+// target. It reuses the zpool status just parsed by the pool collector or
+// parses it itself, so it is current without the pool collector as well.
+type healthCollector struct {
+	pool     poolRefresher
+	snapshot lastCreatedSource
+	maxAge   time.Duration
+	now      func() time.Time
+
+	descHealth *prometheus.Desc
+	descReason *prometheus.Desc
+}
+
+// newHealthCollector creates the collector of the overall health, the
+// snapshots are only considered with --collector.health.snapshot-max-age.
+// It is nil, if the collectors don't expose their state.
+func newHealthCollector(c *cli.Context, e *exporterCollectors) (prometheus.Collector, error) {
+	maxAge := c.Duration("collector.health.snapshot-max-age")
+	if maxAge < 0 {
+		return nil, fmt.Errorf("invalid --collector.health.snapshot-max-age %s, it must not be negative", maxAge)
+	}
+	poolState, ok := e.pool.(poolRefresher)
+	if !ok {
+		return nil, nil
+	}
+	lastCreated, _ := e.snapshot.(lastCreatedSource)
+
+	prefix := c.String("metric-prefix")
+	return &healthCollector{
+		pool:     poolState,
+		snapshot: lastCreated,
+		maxAge:   maxAge,
+		now:      time.Now,
+		descHealth: prometheus.NewDesc(
+			prometheus.BuildFQName(prefix, "", "health"),
+			"Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.",
+			nil, nil,
+		),
+		descReason: prometheus.NewDesc(
+			prometheus.BuildFQName(prefix, "health", "reason_info"),
+			"The worst condition contributing to the overall health.",
+			[]string{"reason"}, nil,
+		),
+	}, nil
+}
+
+func (h *healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.descHealth
+	ch <- h.descReason
+}
+
+func (h *healthCollector) Collect(ch chan<- prometheus.Metric) {
+	pools := h.pool.Refresh(healthPoolMaxAge)
+	// without any zpool status, all pools would look healthy
+	if pools.LastSuccess.IsZero() && pools.LastError == "" {
+		return
+	}
+	var lastCreated map[string]time.Time
+	if h.snapshot != nil && h.maxAge > 0 {
+		lastCreated = h.snapshot.LastCreated()
+	}
+
+	result := evaluateHealth(pools, lastCreated, h.maxAge, h.now())
+	ch <- prometheus.MustNewConstMetric(h.descHealth, prometheus.GaugeValue, float64(result.level))
+	ch <- prometheus.MustNewConstMetric(h.descReason, prometheus.GaugeValue, 1, result.reason)
+}
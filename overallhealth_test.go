@@ -0,0 +1,298 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+)
+
+func TestEvaluateHealth(t *testing.T) {
+	var (
+		now         = time.Unix(1700000000, 0)
+		online      = pool.PoolState{Name: "tank", Health: "ONLINE"}
+		onlineDisk  = pool.DiskState{Name: "/dev/sda", Pool: "tank", Health: "ONLINE"}
+		lastCreated = map[string]time.Time{
+			"tank/data": now.Add(-time.Hour),
+			"tank/home": now.Add(-48 * time.Hour),
+			"tank/logs": now.Add(-30 * time.Hour),
+		}
+	)
+
+	for _, tc := range []struct {
+		name        string
+		pools       []pool.PoolState
+		disks       []pool.DiskState
+		lastError   string
+		lastCreated map[string]time.Time
+		maxAge      time.Duration
+		level       healthLevel
+		reason      string
+	}{
+		{
+			name:   "no pools",
+			level:  healthOK,
+			reason: "ok",
+		},
+		{
+			name:   "all online",
+			pools:  []pool.PoolState{online, {Name: "tank/mirror-0", Health: "ONLINE"}},
+			disks:  []pool.DiskState{onlineDisk},
+			level:  healthOK,
+			reason: "ok",
+		},
+		{
+			name:   "degraded pool",
+			pools:  []pool.PoolState{online, {Name: "backup", Health: "DEGRADED"}},
+			level:  healthWarning,
+			reason: "pool backup is DEGRADED",
+		},
+		{
+			name:   "faulted pool",
+			pools:  []pool.PoolState{{Name: "backup", Health: "DEGRADED"}, {Name: "tank", Health: "FAULTED"}},
+			level:  healthCritical,
+			reason: "pool tank is FAULTED",
+		},
+		{
+			name:   "unavailable pool",
+			pools:  []pool.PoolState{{Name: "tank", Health: "UNAVAIL"}},
+			level:  healthCritical,
+			reason: "pool tank is UNAVAIL",
+		},
+		{
+			name:   "suspended pool",
+			pools:  []pool.PoolState{{Name: "tank", Health: "SUSPENDED"}},
+			level:  healthCritical,
+			reason: "pool tank is SUSPENDED",
+		},
+		{
+			name:   "unknown pool state",
+			pools:  []pool.PoolState{{Name: "tank", Health: "SPLIT"}},
+			level:  healthCritical,
+			reason: "pool tank is SPLIT",
+		},
+		{
+			name:      "zpool status failed",
+			pools:     []pool.PoolState{online},
+			lastError: "failed to get zpool status: command is stuck",
+			level:     healthWarning,
+			reason:    "zpool status failed: failed to get zpool status: command is stuck",
+		},
+		{
+			name:      "zpool status failed with a faulted pool",
+			pools:     []pool.PoolState{{Name: "tank", Health: "FAULTED"}},
+			lastError: "failed to get zpool status: exit status 1",
+			level:     healthCritical,
+			reason:    "pool tank is FAULTED",
+		},
+		{
+			name:   "data errors",
+			pools:  []pool.PoolState{{Name: "tank", Health: "ONLINE", DataErrors: 2}},
+			level:  healthCritical,
+			reason: "pool tank has data errors",
+		},
+		{
+			name:   "pool errors",
+			pools:  []pool.PoolState{{Name: "tank", Health: "ONLINE", Errors: pool.Errors{Checksum: 2}}},
+			level:  healthWarning,
+			reason: "pool tank has errors",
+		},
+		{
+			name:   "upgrade available",
+			pools:  []pool.PoolState{online, {Name: "backup", Health: "ONLINE", UpgradeAvailable: true}},
+			level:  healthWarning,
+			reason: "pool backup can be upgraded",
+		},
+		{
+			name:   "faulted vdev",
+			pools:  []pool.PoolState{{Name: "tank", Health: "DEGRADED"}, {Name: "tank/raidz1-0", Health: "FAULTED"}},
+			level:  healthWarning,
+			reason: "pool tank is DEGRADED",
+		},
+		{
+			name:   "vdev errors",
+			pools:  []pool.PoolState{online, {Name: "tank/mirror-0", Health: "ONLINE", Errors: pool.Errors{Read: 1}}},
+			level:  healthWarning,
+			reason: "vdev tank/mirror-0 has errors",
+		},
+		{
+			name:   "offline disk",
+			pools:  []pool.PoolState{online},
+			disks:  []pool.DiskState{onlineDisk, {Name: "/dev/sdb", Pool: "tank", Health: "OFFLINE"}},
+			level:  healthWarning,
+			reason: "disk /dev/sdb of pool tank is OFFLINE",
+		},
+		{
+			name:   "disk errors",
+			pools:  []pool.PoolState{online},
+			disks:  []pool.DiskState{{Name: "/dev/sda", Pool: "tank", Health: "ONLINE", Errors: pool.Errors{Write: 3}}},
+			level:  healthWarning,
+			reason: "disk /dev/sda of pool tank has errors",
+		},
+		{
+			name:        "snapshots without max age",
+			pools:       []pool.PoolState{online},
+			lastCreated: lastCreated,
+			level:       healthOK,
+			reason:      "ok",
+		},
+		{
+			name:        "overdue snapshots",
+			pools:       []pool.PoolState{online},
+			lastCreated: lastCreated,
+			maxAge:      24 * time.Hour,
+			level:       healthWarning,
+			reason:      "dataset tank/home has no snapshot newer than 24h0m0s",
+		},
+		{
+			name:        "recent snapshots",
+			pools:       []pool.PoolState{online},
+			lastCreated: lastCreated,
+			maxAge:      72 * time.Hour,
+			level:       healthOK,
+			reason:      "ok",
+		},
+		{
+			name:        "the worst condition wins",
+			pools:       []pool.PoolState{{Name: "backup", Health: "DEGRADED"}, {Name: "tank", Health: "ONLINE", Errors: pool.Errors{Read: 1}, DataErrors: 1}},
+			disks:       []pool.DiskState{{Name: "/dev/sdb", Pool: "backup", Health: "FAULTED"}},
+			lastCreated: lastCreated,
+			maxAge:      24 * time.Hour,
+			level:       healthCritical,
+			reason:      "pool tank has data errors",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := evaluateHealth(pool.State{LastError: tc.lastError, Pools: tc.pools, Disks: tc.disks}, tc.lastCreated, tc.maxAge, now)
+			require.Equal(t, healthCondition{level: tc.level, reason: tc.reason}, result)
+		})
+	}
+}
+
+type fakeLastCreated map[string]time.Time
+
+func (f fakeLastCreated) LastCreated() map[string]time.Time {
+	return f
+}
+
+// fakeRefreshPoolCollector returns its state on every refresh.
+type fakeRefreshPoolCollector struct {
+	state     pool.State
+	refreshes int
+}
+
+func (f *fakeRefreshPoolCollector) Refresh(time.Duration) pool.State {
+	f.refreshes++
+	return f.state
+}
+
+func TestHealthCollector(t *testing.T) {
+	var (
+		now   = time.Unix(1700000000, 0)
+		pools = &fakeRefreshPoolCollector{}
+		h     = &healthCollector{
+			pool:       pools,
+			snapshot:   fakeLastCreated{"tank/data": now.Add(-25 * time.Hour)},
+			maxAge:     24 * time.Hour,
+			now:        func() time.Time { return now },
+			descHealth: prometheus.NewDesc("zfs_health", "Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.", nil, nil),
+			descReason: prometheus.NewDesc("zfs_health_reason_info", "The worst condition contributing to the overall health.", []string{"reason"}, nil),
+		}
+		reg = prometheus.NewPedanticRegistry()
+	)
+	reg.MustRegister(h)
+
+	// nothing is known before zpool status has been parsed
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader("")))
+	require.Equal(t, 1, pools.refreshes)
+
+	pools.state = pool.State{LastSuccess: now, Pools: []pool.PoolState{{Name: "tank", Health: "ONLINE"}}}
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_health Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.
+# TYPE zfs_health gauge
+zfs_health 1
+# HELP zfs_health_reason_info The worst condition contributing to the overall health.
+# TYPE zfs_health_reason_info gauge
+zfs_health_reason_info{reason="dataset tank/data has no snapshot newer than 24h0m0s"} 1
+`)))
+
+	pools.state.Pools[0].Health = "SUSPENDED"
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_health Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.
+# TYPE zfs_health gauge
+zfs_health 2
+# HELP zfs_health_reason_info The worst condition contributing to the overall health.
+# TYPE zfs_health_reason_info gauge
+zfs_health_reason_info{reason="pool tank is SUSPENDED"} 1
+`)))
+
+	// a failing zpool status doesn't keep reporting the last evaluation
+	pools.state = pool.State{LastSuccess: now, LastError: "failed to get zpool status: exit status 1", Pools: []pool.PoolState{{Name: "tank", Health: "ONLINE"}}}
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_health Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.
+# TYPE zfs_health gauge
+zfs_health 1
+# HELP zfs_health_reason_info The worst condition contributing to the overall health.
+# TYPE zfs_health_reason_info gauge
+zfs_health_reason_info{reason="zpool status failed: failed to get zpool status: exit status 1"} 1
+`)))
+
+	// neither does one, which never succeeded
+	pools.state = pool.State{LastError: "failed to get zpool status: exit status 1"}
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_health Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.
+# TYPE zfs_health gauge
+zfs_health 1
+# HELP zfs_health_reason_info The worst condition contributing to the overall health.
+# TYPE zfs_health_reason_info gauge
+zfs_health_reason_info{reason="zpool status failed: failed to get zpool status: exit status 1"} 1
+`)))
+}
+
+func TestHealthCollectorPoolStatus(t *testing.T) {
+	status := "  pool: tank\n state: ONLINE\nconfig:\n\n\tNAME        STATE     READ WRITE CKSUM\n\ttank        ONLINE       0     0     0\n\n"
+	var runs int
+	pools := pool.NewStatusCollector(zerolog.Nop(), func() ([]byte, error) {
+		runs++
+		return []byte(status + "errors: " + strconv.Itoa(runs) + " data errors, use '-v' for a list\n"), nil
+	}, "zfs")
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(&healthCollector{
+		pool:       pools,
+		now:        time.Now,
+		descHealth: prometheus.NewDesc("zfs_health", "Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.", nil, nil),
+		descReason: prometheus.NewDesc("zfs_health_reason_info", "The worst condition contributing to the overall health.", []string{"reason"}, nil),
+	})
+
+	// without the pool collector, the health parses zpool status itself
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_health Overall health of the pools and snapshots, 0 is ok, 1 warning and 2 critical.
+# TYPE zfs_health gauge
+zfs_health 2
+# HELP zfs_health_reason_info The worst condition contributing to the overall health.
+# TYPE zfs_health_reason_info gauge
+zfs_health_reason_info{reason="pool tank has data errors"} 1
+`)))
+	require.Equal(t, 1, runs)
+
+	// the zpool status just parsed by the pool collector is reused
+	testutil.CollectAndCount(pools)
+	require.Equal(t, 2, runs)
+	_, err := reg.Gather()
+	require.NoError(t, err)
+	require.Equal(t, 2, runs)
+	require.Equal(t, uint64(2), pools.State().Pools[0].DataErrors)
+}
+
+func TestGatherOrder(t *testing.T) {
+	require.Equal(t, []string{"arcstats", "pool", "health", "snapshot"}, gatherOrder([]string{"arcstats", "health", "pool", "snapshot"}))
+	require.Equal(t, []string{"health", "snapshot"}, gatherOrder([]string{"health", "snapshot"}))
+	require.Equal(t, []string{"pool"}, gatherOrder([]string{"pool"}))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+)
+
+const (
+	parseStatusFormatPrometheus = "prometheus"
+	parseStatusFormatJSON       = "json"
+)
+
+var parseStatusCommand = &cli.Command{
+	Name:   "parse-status",
+	Usage:  "convert the output of zpool status -pP read from stdin into the metrics the exporter would expose, without running any command",
+	Action: runParseStatus,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "read the zpool status output from a file instead of stdin",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Value: parseStatusFormatPrometheus,
+			Usage: "output format, prometheus for the metrics in the OpenMetrics format or json for the parsed pools and disks",
+		},
+	},
+}
+
+// parsedStatus is the JSON output of parse-status.
+type parsedStatus struct {
+	Pools []pool.PoolState `json:"pools"`
+	Disks []pool.DiskState `json:"disks"`
+}
+
+func runParseStatus(c *cli.Context) error {
+	format := c.String("format")
+	if format != parseStatusFormatPrometheus && format != parseStatusFormatJSON {
+		return cli.Exit(fmt.Sprintf("invalid format %q, expected %s or %s", format, parseStatusFormatPrometheus, parseStatusFormatJSON), 1)
+	}
+
+	prefix := c.String("metric-prefix")
+	if !metricPrefixRegexp.MatchString(prefix) {
+		return cli.Exit(fmt.Sprintf("invalid metric prefix %q", prefix), 1)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if filename := c.String("file"); filename != "" {
+		data, err = os.ReadFile(filename)
+	} else {
+		data, err = io.ReadAll(c.App.Reader)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("error reading zpool status: %v", err), 1)
+	}
+
+	// the collector parses the status exactly like it does when running zpool
+	collector := pool.NewStatusCollector(logger, func() ([]byte, error) { return data, nil }, prefix)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var buf bytes.Buffer
+	if format == parseStatusFormatJSON {
+		state := collector.State()
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(parsedStatus{Pools: state.Pools, Disks: state.Disks}); err != nil {
+			return cli.Exit(err, 1)
+		}
+	} else if err := encodeOnce(&buf, textFileFormatPrometheus, families); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	_, err = buf.WriteTo(c.App.Writer)
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func runParseStatusApp(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+
+	var (
+		out, errOut bytes.Buffer
+		exitCode    int
+		oldExiter   = cli.OsExiter
+	)
+	cli.OsExiter = func(code int) { exitCode = code }
+	defer func() { cli.OsExiter = oldExiter }()
+
+	app := newApp()
+	app.Reader = strings.NewReader(stdin)
+	app.Writer = &out
+	app.ErrWriter = &errOut
+	_ = app.Run(append([]string{"zfs-event-exporter", "parse-status"}, args...))
+	return out.String(), exitCode
+}
+
+func TestParseStatus(t *testing.T) {
+	files, err := filepath.Glob("zfs/pool/testdata/*.txt")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			out, code := runParseStatusApp(t, "", "--file", file)
+			require.Equal(t, 0, code)
+			require.Contains(t, out, "# TYPE zfs_pool_status gauge\n")
+			require.Regexp(t, `(?m)^zfs_pool_status\{pool="[^"]+",state="[a-z]+"\} 1\.0$`, out)
+			require.True(t, strings.HasSuffix(out, "# EOF\n"))
+
+			// stdin is read without --file
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			stdinOut, code := runParseStatusApp(t, string(data))
+			require.Equal(t, 0, code)
+			require.Equal(t, out, stdinOut)
+		})
+	}
+
+	t.Run("raidz", func(t *testing.T) {
+		out, code := runParseStatusApp(t, "", "--file", "zfs/pool/testdata/raidz.txt")
+		require.Equal(t, 0, code)
+		require.Contains(t, out, "zfs_exporter_tracked_pools 2.0\n")
+		require.Contains(t, out, "zfs_exporter_tracked_disks 4.0\n")
+	})
+
+	t.Run("metric prefix", func(t *testing.T) {
+		var out bytes.Buffer
+		app := newApp()
+		app.Reader = strings.NewReader("")
+		app.Writer = &out
+		require.NoError(t, app.Run([]string{"zfs-event-exporter", "--metric-prefix", "tank", "parse-status", "--file", "zfs/pool/testdata/simple.txt"}))
+		require.Contains(t, out.String(), "tank_pool_status{pool=\"pool\",state=\"online\"} 1.0\n")
+		require.NotContains(t, out.String(), "zfs_pool_")
+	})
+}
+
+func TestParseStatusJSON(t *testing.T) {
+	out, code := runParseStatusApp(t, "", "--file", "zfs/pool/testdata/simple-errors.txt", "--format", "json")
+	require.Equal(t, 0, code)
+
+	var status parsedStatus
+	require.NoError(t, json.Unmarshal([]byte(out), &status))
+	require.Len(t, status.Pools, 1)
+	require.Len(t, status.Disks, 1)
+	require.Equal(t, "pool", status.Disks[0].Pool)
+}
+
+func TestParseStatusErrors(t *testing.T) {
+	_, code := runParseStatusApp(t, "", "--format", "yaml")
+	require.Equal(t, 1, code)
+
+	_, code = runParseStatusApp(t, "", "--file", filepath.Join(t.TempDir(), "missing.txt"))
+	require.Equal(t, 1, code)
+
+	// lines with counters, which are not numbers, are skipped and counted
+	invalid := " pool: tank\nconfig:\n\n\tNAME        STATE     READ WRITE CKSUM\n\ttank        ONLINE       x     0     0\n"
+	out, code := runParseStatusApp(t, invalid)
+	require.Equal(t, 0, code)
+	require.Contains(t, out, "zfs_exporter_skipped_lines_total{parser=\"zpool_status\"} 1.0\n")
+}
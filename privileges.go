@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// privileges are the credentials the exporter switches to after its
+// privileged setup.
+type privileges struct {
+	name     string
+	uid, gid int
+}
+
+func (p *privileges) String() string {
+	return fmt.Sprintf("%s (uid=%d gid=%d)", p.name, p.uid, p.gid)
+}
+
+// parseDropPrivileges parses a --drop-privileges value in the form
+// user[:group]. Without a group the primary group of the user is used.
+func parseDropPrivileges(value string) (*privileges, error) {
+	name, group, hasGroup := strings.Cut(value, ":")
+	if name == "" || (hasGroup && group == "") {
+		return nil, fmt.Errorf("invalid value %q for dropping privileges, expected user[:group]", value)
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	p := &privileges{name: u.Username}
+	if p.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, fmt.Errorf("invalid uid of user %q: %w", name, err)
+	}
+	if p.uid == 0 {
+		return nil, fmt.Errorf("refusing to drop privileges to root")
+	}
+
+	if hasGroup {
+		p.gid, err = lookupGroupID(group)
+	} else {
+		p.gid, err = strconv.Atoi(u.Gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// drop switches the process permanently to the unprivileged user. On Linux
+// Go applies the credentials to all threads since Go 1.16, on FreeBSD they
+// belong to the process anyway.
+func (p *privileges) drop() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("dropping privileges requires running as root")
+	}
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("error clearing supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(p.gid); err != nil {
+		return fmt.Errorf("error setting gid %d: %w", p.gid, err)
+	}
+	if err := syscall.Setuid(p.uid); err != nil {
+		return fmt.Errorf("error setting uid %d: %w", p.uid, err)
+	}
+
+	// make sure there is no way back
+	if err := syscall.Setuid(0); err == nil {
+		return fmt.Errorf("privileges could be regained after dropping them")
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDropPrivileges(t *testing.T) {
+	p, err := parseDropPrivileges("nobody")
+	if err != nil {
+		t.Skipf("user nobody missing: %v", err)
+	}
+	require.Equal(t, "nobody", p.name)
+	require.NotZero(t, p.uid)
+
+	p, err = parseDropPrivileges(strconv.Itoa(p.uid) + ":0")
+	require.NoError(t, err)
+	require.Equal(t, "nobody", p.name)
+	require.Equal(t, 0, p.gid)
+
+	for _, invalid := range []string{"", ":root", "nobody:", "root", "0", "no-such-user", "nobody:no-such-group"} {
+		_, err := parseDropPrivileges(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+// procStatusIDs returns the real, effective, saved and filesystem ids of the
+// given kind (Uid or Gid) from /proc.
+func procStatusIDs(t *testing.T, pid int, kind string) string {
+	t.Helper()
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	require.NoError(t, err)
+	for _, line := range strings.Split(string(data), "\n") {
+		if v, ok := strings.CutPrefix(line, kind+":"); ok {
+			return strings.Join(strings.Fields(v), " ")
+		}
+	}
+	t.Fatalf("%s missing in status of %d", kind, pid)
+	return ""
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inspecting the credentials requires procfs")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	p, err := parseDropPrivileges("nobody")
+	if err != nil {
+		t.Skipf("user nobody missing: %v", err)
+	}
+
+	fakeCommands(t, map[string]string{
+		"zfs":   "printf '" + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = "events" ]; then exec sleep 3600; fi` + "\n",
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--",
+		"--listen-addr", addr,
+		"--drop-privileges", "nobody",
+	)
+	cmd.Env = append(os.Environ(), "ZFS_EXPORTER_HELPER_PROCESS=1")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		if t.Failed() {
+			t.Logf("exporter output: %s", out.String())
+		}
+	}()
+
+	// the listener bound as root keeps serving after dropping privileges
+	for i := 0; ; i++ {
+		resp, err := http.Get("http://" + addr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		require.Less(t, i, 500, "exporter not serving")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ids := fmt.Sprintf("%d %d %d %d", p.uid, p.uid, p.uid, p.uid)
+	require.Equal(t, ids, procStatusIDs(t, cmd.Process.Pid, "Uid"))
+	ids = fmt.Sprintf("%d %d %d %d", p.gid, p.gid, p.gid, p.gid)
+	require.Equal(t, ids, procStatusIDs(t, cmd.Process.Pid, "Gid"))
+
+	// zpool events was started before and keeps running as root
+	tasks, err := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", cmd.Process.Pid))
+	require.NoError(t, err)
+	var children []string
+	for _, task := range tasks {
+		data, err := os.ReadFile(task)
+		if err != nil {
+			t.Skipf("listing child processes unsupported: %v", err)
+		}
+		children = append(children, strings.Fields(string(data))...)
+	}
+	var found bool
+	for _, f := range children {
+		pid, err := strconv.Atoi(f)
+		require.NoError(t, err)
+		if procStatusIDs(t, pid, "Uid") == "0 0 0 0" {
+			found = true
+		}
+	}
+	require.True(t, found, "zpool events not running as root: %v", children)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+}
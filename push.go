@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// parseGroupingLabels parses the key=value pairs of the --push.grouping-label
+// flag. In contrast to constant labels, instance is allowed, as it is the usual
+// way to distinguish pushing hosts.
+func parseGroupingLabels(values []string) (prometheus.Labels, error) {
+	labels := make(prometheus.Labels, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid grouping label %q, expected key=value", v)
+		}
+		if !labelNameRegexp.MatchString(key) || strings.HasPrefix(key, "__") {
+			return nil, fmt.Errorf("invalid grouping label name %q", key)
+		}
+		if key == "job" {
+			return nil, fmt.Errorf("grouping label name %q is reserved, use --push.job instead", key)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("empty value for grouping label %q", key)
+		}
+		if _, ok := labels[key]; ok {
+			return nil, fmt.Errorf("duplicate grouping label name %q", key)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+type pushOutput struct {
+	pusher   *push.Pusher
+	url      string
+	interval time.Duration
+
+	metricFailures prometheus.Counter
+}
+
+// newPushOutput creates an output pushing the metrics of g to the Pushgateway
+// at url. The client and credentials are taken from the web config.
+func newPushOutput(g prometheus.Gatherer, url, job string, grouping prometheus.Labels, interval time.Duration, web *webConfig) (*pushOutput, error) {
+	client, err := web.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	// a hanging Pushgateway must not delay the next push
+	client.Timeout = interval
+
+	pusher := push.New(url, job).Gatherer(g).Client(client)
+	for k, v := range grouping {
+		pusher = pusher.Grouping(k, v)
+	}
+
+	user, password, ok, err := web.basicAuth()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		pusher = pusher.BasicAuth(user, password)
+	}
+
+	return &pushOutput{
+		pusher:   pusher,
+		url:      url,
+		interval: interval,
+		metricFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zfs_exporter_push_failures_total",
+			Help: "Total count of failed pushes to the Pushgateway.",
+		}),
+	}, nil
+}
+
+func (p *pushOutput) pushOrLog(ctx context.Context) {
+	if err := p.pusher.PushContext(ctx); err != nil {
+		// a push interrupted by the shutdown is not a failure
+		if ctx.Err() != nil {
+			return
+		}
+		p.metricFailures.Inc()
+		logger.Error().Msgf("error pushing metrics to %s: %v", p.url, err)
+		return
+	}
+	logger.Debug().Msgf("pushed metrics to %s", p.url)
+}
+
+// run pushes the metrics every interval until ctx is cancelled.
+func (p *pushOutput) run(ctx context.Context) {
+	p.pushOrLog(ctx)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.pushOrLog(ctx)
+		}
+	}
+}
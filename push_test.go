@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+)
+
+type pushRequest struct {
+	method, path string
+	user         string
+	families     []string
+}
+
+func newFakePushgateway(t *testing.T, status int) (*httptest.Server, <-chan pushRequest) {
+	t.Helper()
+
+	ch := make(chan pushRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := pushRequest{method: r.Method, path: r.URL.Path}
+		req.user, _, _ = r.BasicAuth()
+
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("error decoding push body: %v", err)
+				break
+			}
+			req.families = append(req.families, mf.GetName())
+		}
+
+		ch <- req
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, ch
+}
+
+func testPushRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newBuildInfoCollector())
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_up"})
+	up.Set(1)
+	reg.MustRegister(up)
+	return reg
+}
+
+func TestPushOutput(t *testing.T) {
+	srv, ch := newFakePushgateway(t, http.StatusOK)
+
+	out, err := newPushOutput(testPushRegistry(), srv.URL, "zfs_exporter", prometheus.Labels{"instance": "edge-1"}, time.Minute, &webConfig{})
+	require.NoError(t, err)
+
+	out.pushOrLog(context.Background())
+
+	req := <-ch
+	require.Equal(t, http.MethodPut, req.method)
+	require.Equal(t, "/metrics/job/zfs_exporter/instance/edge-1", req.path)
+	require.ElementsMatch(t, []string{"zfs_exporter_build_info", "zfs_up"}, req.families)
+	require.Equal(t, float64(0), testutil.ToFloat64(out.metricFailures))
+}
+
+func TestPushOutputBasicAuth(t *testing.T) {
+	srv, ch := newFakePushgateway(t, http.StatusOK)
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0o600))
+	filename := filepath.Join(dir, "web.yml")
+	require.NoError(t, os.WriteFile(filename, []byte(`http_client_config:
+  basic_auth:
+    username: edge
+    password_file: `+passwordFile+"\n"), 0o600))
+
+	web, err := loadWebConfig(filename)
+	require.NoError(t, err)
+
+	user, password, ok, err := web.basicAuth()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "edge", user)
+	require.Equal(t, "secret", password)
+
+	out, err := newPushOutput(testPushRegistry(), srv.URL, "zfs_exporter", nil, time.Minute, web)
+	require.NoError(t, err)
+
+	out.pushOrLog(context.Background())
+	require.Equal(t, "edge", (<-ch).user)
+}
+
+func TestPushOutputFailure(t *testing.T) {
+	srv, ch := newFakePushgateway(t, http.StatusInternalServerError)
+
+	out, err := newPushOutput(testPushRegistry(), srv.URL, "zfs_exporter", nil, time.Minute, &webConfig{})
+	require.NoError(t, err)
+
+	out.pushOrLog(context.Background())
+	<-ch
+	out.pushOrLog(context.Background())
+	<-ch
+	require.Equal(t, float64(2), testutil.ToFloat64(out.metricFailures))
+}
+
+func TestPushOutputTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	out, err := newPushOutput(testPushRegistry(), srv.URL, "zfs_exporter", nil, 100*time.Millisecond, &webConfig{})
+	require.NoError(t, err)
+
+	// the push is given up after the interval
+	start := time.Now()
+	out.pushOrLog(context.Background())
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, float64(1), testutil.ToFloat64(out.metricFailures))
+}
+
+func TestParseGroupingLabels(t *testing.T) {
+	labels, err := parseGroupingLabels([]string{"instance=edge-1", "site=berlin"})
+	require.NoError(t, err)
+	require.Equal(t, prometheus.Labels{"instance": "edge-1", "site": "berlin"}, labels)
+
+	for _, value := range []string{"instance", "job=zfs", "instance=", "__name__=x", "1x=y"} {
+		_, err := parseGroupingLabels([]string{value})
+		require.Error(t, err, value)
+	}
+
+	_, err = parseGroupingLabels([]string{"site=a", "site=b"})
+	require.Error(t, err)
+}
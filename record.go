@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/fixture"
+)
+
+var recordFixturesCommand = &cli.Command{
+	Name:   "record-fixtures",
+	Usage:  "record the output of the commands used by the collectors as test fixtures",
+	Hidden: true,
+	Action: runRecordFixtures,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Usage:    "directory the fixtures are written to, remote targets get a subdirectory each",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "sanitize",
+			Usage: "replace the names of pools, datasets, snapshots and devices with consistent hashes",
+		},
+	},
+}
+
+// commandOutput returns the trimmed output of a command or an empty string,
+// if it failed.
+func commandOutput(ctx context.Context, runner commandRunner, name string, args ...string) string {
+	out, err := runner.Output(ctx, name, args...)
+	if err != nil {
+		logger.Warn().Err(err).Msgf("error running %s", name)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// recordFixture records the output of the collector commands to dir.
+func recordFixture(ctx context.Context, runner commandRunner, dir string, s *sanitizer, now time.Time) error {
+	files, failed := captureCommands(ctx, runner, s)
+	for filename, err := range failed {
+		logger.Warn().Err(err).Msgf("error recording %s", filename)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no command succeeded")
+	}
+	if s != nil {
+		for name, data := range files {
+			files[name] = s.sanitize(data)
+		}
+	}
+
+	return fixture.Write(dir, fixture.Manifest{
+		Date:            now.UTC(),
+		ExporterVersion: version,
+		ZFSVersion:      commandOutput(ctx, runner, "zfs", "version"),
+		Kernel:          commandOutput(ctx, runner, "uname", "-sr"),
+		Sanitized:       s != nil,
+	}, files)
+}
+
+func runRecordFixtures(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	remotes, err := newCommandTargets(c)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	limiter, err := newCommandLimiter(c.Float64("command.rate-limit"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	for _, r := range remotes {
+		runner, err := newCommandRunner(stringSlice(c, "command.timeout"), r.executor, limiter)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		var s *sanitizer
+		if c.Bool("sanitize") {
+			if s, err = newRandomSanitizer(); err != nil {
+				return err
+			}
+		}
+
+		dir := filepath.Join(c.String("output"), r.host)
+		if err := recordFixture(ctx, runner, dir, s, time.Now()); err != nil {
+			return cli.Exit(fmt.Sprintf("error recording fixture in %s: %v", dir, err), 1)
+		}
+		fmt.Fprintf(c.App.Writer, "recorded fixture in %s\n", dir)
+	}
+	return nil
+}
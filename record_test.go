@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/fixture"
+)
+
+func TestRecordFixtures(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs": `case "$1" in
+version) printf 'zfs-2.1.5-1\nzfs-kmod-2.1.5-1\n';;
+list) printf '` + fakeZfsList + `';;
+esac
+`,
+		"zpool": `case "$1" in
+status) cat <<'EOF'
+` + fakeZpoolStatus + `EOF
+;;
+*) exit 1;;
+esac
+`,
+		"uname": "echo Linux 6.1.0-13-amd64\n",
+	})
+
+	for _, sanitize := range []bool{false, true} {
+		dir := t.TempDir()
+		args := []string{"zfs-event-exporter", "record-fixtures", "--output", dir}
+		if sanitize {
+			args = append(args, "--sanitize")
+		}
+		var out bytes.Buffer
+		app := newApp()
+		app.Writer = &out
+		require.NoError(t, app.Run(args))
+		require.Equal(t, "recorded fixture in "+dir+"\n", out.String())
+
+		f, err := fixture.Load(dir)
+		require.NoError(t, err)
+		require.Equal(t, "zfs-2.1.5-1\nzfs-kmod-2.1.5-1", f.Manifest.ZFSVersion)
+		require.Equal(t, "Linux 6.1.0-13-amd64", f.Manifest.Kernel)
+		require.Equal(t, version, f.Manifest.ExporterVersion)
+		require.Equal(t, sanitize, f.Manifest.Sanitized)
+		require.False(t, f.Manifest.Date.IsZero())
+		// zpool events failed and is missing
+		require.Equal(t, []string{fixture.SnapshotsList, fixture.ZFSList, fixture.ZpoolStatus}, f.Manifest.Files)
+
+		snapshots, err := f.Read(fixture.SnapshotsList)
+		require.NoError(t, err)
+		status, err := os.ReadFile(filepath.Join(dir, fixture.ZpoolStatus))
+		require.NoError(t, err)
+		if !sanitize {
+			require.Equal(t, fakeZfsList, string(snapshots))
+			require.Equal(t, fakeZpoolStatus, string(status))
+			continue
+		}
+
+		pool, _, ok := strings.Cut(string(snapshots), "/")
+		require.True(t, ok)
+		require.NotEqual(t, "pool", pool)
+		require.Contains(t, string(status), " pool: "+pool+"\n")
+		require.Contains(t, string(status), "\t"+pool+"        ONLINE")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// remote is a host, which commands are executed on.
+type remote struct {
+	host     string
+	executor command.Executor
+}
+
+// parseRemote parses a --remote value in the form ssh://user@host[:port]. The
+// returned host is used as label value.
+func parseRemote(value string) (user, addr, host string, err error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid remote %q: %w", value, err)
+	}
+	if u.Scheme != "ssh" {
+		return "", "", "", fmt.Errorf("invalid remote %q, expected ssh://user@host[:port]", value)
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", "", fmt.Errorf("invalid remote %q, user is missing", value)
+	}
+	if u.Hostname() == "" {
+		return "", "", "", fmt.Errorf("invalid remote %q, host is missing", value)
+	}
+	if _, ok := u.User.Password(); ok || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return "", "", "", fmt.Errorf("invalid remote %q, expected ssh://user@host[:port]", value)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	return u.User.Username(), net.JoinHostPort(u.Hostname(), port), u.Host, nil
+}
+
+// defaultIdentityFile returns the first existing default SSH key.
+func defaultIdentityFile(home string) string {
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(home, ".ssh", "id_ed25519")
+}
+
+// newSSHClientConfig creates the client config for key authentication, which
+// verifies host keys against a known_hosts file.
+func newSSHClientConfig(user, identityFile, knownHostsFile string) (*ssh.ClientConfig, error) {
+	key, err := os.ReadFile(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing identity file %s: %w", identityFile, err)
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading known hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         command.DefaultTimeout,
+	}, nil
+}
+
+// newRemotes creates an SSH executor for every --remote value.
+func newRemotes(c *cli.Context) ([]remote, error) {
+	values := stringSlice(c, "remote")
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	identityFile := c.String("remote.identity-file")
+	knownHostsFile := c.String("remote.known-hosts")
+	if identityFile == "" || knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("error finding SSH configuration: %w", err)
+		}
+		if identityFile == "" {
+			identityFile = defaultIdentityFile(home)
+		}
+		if knownHostsFile == "" {
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+	}
+
+	var (
+		remotes = make([]remote, 0, len(values))
+		hosts   = make(map[string]bool, len(values))
+	)
+	for _, v := range values {
+		user, addr, host, err := parseRemote(v)
+		if err != nil {
+			return nil, err
+		}
+		if hosts[host] {
+			return nil, fmt.Errorf("duplicate remote host %q", host)
+		}
+		hosts[host] = true
+
+		config, err := newSSHClientConfig(user, identityFile, knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote{
+			host:     host,
+			executor: command.NewSSHExecutor(addr, config, c.Duration("remote.keepalive-interval")),
+		})
+	}
+	return remotes, nil
+}
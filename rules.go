@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+const (
+	rulesFormatPrometheus = "prometheus"
+	rulesFormatVMAlert    = "vmalert"
+)
+
+var generateRulesCommand = &cli.Command{
+	Name:   "generate-rules",
+	Usage:  "print recommended alerting and recording rules for the exported metrics",
+	Action: runGenerateRules,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "format",
+			Value: rulesFormatPrometheus,
+			Usage: "format of the rule file, one of prometheus or vmalert",
+		},
+		&cli.DurationFlag{
+			Name:  "for",
+			Value: 15 * time.Minute,
+			Usage: "time a condition has to hold before an alert fires",
+		},
+		&cli.DurationFlag{
+			Name:  "snapshot-max-age",
+			Value: 24 * time.Hour,
+			Usage: "age of the last snapshot of a dataset after which an alert fires",
+		},
+	},
+}
+
+// exporterRules returns the recommended rules for the metrics about the
+// exporter itself.
+func exporterRules(cfg rules.Config) []rules.Rule {
+	return []rules.Rule{
+		{
+			Alert:   "ZFSExporterNotReady",
+			Expr:    `zfs_exporter_ready == 0`,
+			For:     model.Duration(cfg.For),
+			Labels:  map[string]string{"severity": "warning"},
+			Metrics: []string{"zfs_exporter_ready"},
+			Annotations: map[string]string{
+				"summary":     "ZFS exporter on {{ $labels.instance }} is not ready",
+				"description": "The exporter on {{ $labels.instance }} has not been ready for more than " + model.Duration(cfg.For).String() + ", its metrics might be outdated.",
+			},
+		},
+		{
+			Alert:   "ZFSExporterCollectorFailing",
+			Expr:    `zfs_exporter_collector_success == 0`,
+			For:     model.Duration(cfg.For),
+			Labels:  map[string]string{"severity": "warning"},
+			Metrics: []string{"zfs_exporter_collector_success"},
+			Annotations: map[string]string{
+				"summary":     "ZFS exporter collector {{ $labels.collector }} is failing",
+				"description": "The collector {{ $labels.collector }} on {{ $labels.instance }} has been failing for more than " + model.Duration(cfg.For).String() + ".",
+			},
+		},
+	}
+}
+
+// generateRules returns the rule file in the given format.
+func generateRules(format string, cfg rules.Config) (*rules.File, error) {
+	var groupType string
+	switch format {
+	case rulesFormatPrometheus:
+	case rulesFormatVMAlert:
+		groupType = "prometheus"
+	default:
+		return nil, fmt.Errorf("invalid rules format %q, expected %s or %s", format, rulesFormatPrometheus, rulesFormatVMAlert)
+	}
+	if cfg.SnapshotMaxAge <= 0 {
+		return nil, fmt.Errorf("snapshot max age must be positive")
+	}
+
+	return &rules.File{Groups: []rules.Group{
+		{Name: "zfs-pool", Type: groupType, Rules: pool.Rules(cfg)},
+		{Name: "zfs-snapshot", Type: groupType, Rules: snapshot.Rules(cfg)},
+		{Name: "zfs-exporter", Type: groupType, Rules: append(exporterRules(cfg), command.Rules(cfg)...)},
+	}}, nil
+}
+
+func runGenerateRules(c *cli.Context) error {
+	prefix := c.String("metric-prefix")
+	if !metricPrefixRegexp.MatchString(prefix) {
+		return cli.Exit(fmt.Sprintf("invalid metric prefix %q", prefix), 1)
+	}
+
+	f, err := generateRules(c.String("format"), rules.Config{
+		Namespace:      prefix,
+		For:            c.Duration("for"),
+		SnapshotMaxAge: c.Duration("snapshot-max-age"),
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	out, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = c.App.Writer.Write(out)
+	return err
+}
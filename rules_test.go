@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+)
+
+func TestExporterRules(t *testing.T) {
+	targets := exporterTargets{newFakeExporterCollectors(nil)}
+	reg := targets.newRegistry(targets.names())
+	reg.MustRegister(newReadiness(targets, time.Minute).collector())
+
+	require.NoError(t, rules.Verify(reg, exporterRules(rules.Config{For: 15 * time.Minute})))
+}
+
+func TestGenerateRules(t *testing.T) {
+	for _, tc := range []struct {
+		args      []string
+		groupType string
+	}{
+		{},
+		{args: []string{"--format", "vmalert"}, groupType: "prometheus"},
+	} {
+		var out bytes.Buffer
+		app := newApp()
+		app.Writer = &out
+		require.NoError(t, app.Run(append([]string{"zfs-event-exporter", "generate-rules"}, tc.args...)))
+
+		var f rules.File
+		require.NoError(t, yaml.UnmarshalStrict(out.Bytes(), &f))
+		require.Len(t, f.Groups, 3)
+		for _, g := range f.Groups {
+			require.Equal(t, tc.groupType, g.Type)
+			require.NotEmpty(t, g.Rules)
+		}
+	}
+
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	require.NoError(t, app.Run([]string{"zfs-event-exporter", "--metric-prefix", "storage_zfs", "generate-rules", "--snapshot-max-age", "2h", "--for", "5m"}))
+	require.Contains(t, out.String(), "expr: time() - storage_zfs_snapshot_last_unixtime > 7200\n")
+	require.Contains(t, out.String(), "for: 5m\n")
+
+	_, err := generateRules("alertmanager", rules.Config{SnapshotMaxAge: time.Hour})
+	require.Error(t, err)
+	_, err = generateRules(rulesFormatPrometheus, rules.Config{})
+	require.Error(t, err)
+}
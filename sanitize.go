@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var (
+	// sanitizeWordRegexp matches the characters allowed in the components of
+	// ZFS names and in device names.
+	sanitizeWordRegexp = regexp.MustCompile(`[A-Za-z0-9_.:+\-]+`)
+
+	// sanitizeEventRegexp matches the device paths and IDs and the host names
+	// of zpool events.
+	sanitizeEventRegexp = regexp.MustCompile(`^\s*(?:vdev_(?:path|devid|physpath)|history_hostname) = "([^"]*)"`)
+)
+
+// jsonFieldNames adds the JSON field names of the struct type t and the types
+// it contains to names.
+func jsonFieldNames(t reflect.Type, names map[string]bool) {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map:
+		jsonFieldNames(t.Elem(), names)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+				names[name] = true
+			}
+			jsonFieldNames(f.Type, names)
+		}
+	}
+}
+
+// sanitizeJSONKeys are the JSON keys of the debug state, which are kept even
+// if a name is equal to them.
+var sanitizeJSONKeys = func() map[string]bool {
+	names := make(map[string]bool)
+	jsonFieldNames(reflect.TypeOf(debugState{}), names)
+	return names
+}()
+
+// sanitizer replaces the names of pools, datasets, snapshots and devices with
+// tokens derived from a keyed hash. The same name is replaced by the same
+// token in all files, so the structure of the data is kept.
+type sanitizer struct {
+	key   []byte
+	names map[string]string
+}
+
+func newSanitizer(key []byte) *sanitizer {
+	return &sanitizer{
+		key:   key,
+		names: make(map[string]string),
+	}
+}
+
+// newRandomSanitizer creates a sanitizer with a random key, which prevents
+// recovering names by hashing guesses.
+func newRandomSanitizer() (*sanitizer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return newSanitizer(key), nil
+}
+
+// token returns the replacement of name. It starts with a letter like
+// ZFS names have to.
+func (s *sanitizer) token(name string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(name))
+	return "n" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// add registers a sensitive name.
+func (s *sanitizer) add(name string) {
+	if name == "" || name == "-" {
+		return
+	}
+	if _, ok := s.names[name]; !ok {
+		s.names[name] = s.token(name)
+	}
+}
+
+// addWords registers every word of value as sensitive name.
+func (s *sanitizer) addWords(value string) {
+	for _, w := range sanitizeWordRegexp.FindAllString(value, -1) {
+		s.add(w)
+	}
+}
+
+// learnZFSList registers the components of the dataset and snapshot names
+// in the first column of zfs list -H output.
+func (s *sanitizer) learnZFSList(data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name, _, _ := strings.Cut(scanner.Text(), "\t")
+		s.addWords(name)
+	}
+}
+
+// learnZpoolStatus registers the names of the devices in the configuration
+// of zpool status -P output.
+func (s *sanitizer) learnZpoolStatus(data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "pool:") && len(fields) > 1 {
+			s.addWords(fields[1])
+		}
+		if strings.HasPrefix(fields[0], "/") {
+			s.addWords(path.Base(fields[0]))
+		}
+	}
+}
+
+// learnZpoolEvents registers the device paths and IDs of zpool events -v
+// output.
+func (s *sanitizer) learnZpoolEvents(data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if m := sanitizeEventRegexp.FindStringSubmatch(scanner.Text()); m != nil {
+			s.addWords(path.Base(m[1]))
+		}
+	}
+}
+
+// isKey reports whether the word at data[start:end] is a key rather than a
+// value. These are label names and the keys of zpool events followed by =
+// and the keys of the debug state JSON.
+func isKey(data []byte, start, end int) bool {
+	if bytes.HasPrefix(bytes.TrimLeft(data[end:], " "), []byte("=")) {
+		return true
+	}
+	return start > 0 && data[start-1] == '"' &&
+		bytes.HasPrefix(data[end:], []byte(`":`)) &&
+		sanitizeJSONKeys[string(data[start:end])]
+}
+
+// sanitize replaces all registered names, which occur as whole words in data.
+func (s *sanitizer) sanitize(data []byte) []byte {
+	var (
+		result bytes.Buffer
+		last   int
+	)
+	for _, loc := range sanitizeWordRegexp.FindAllIndex(data, -1) {
+		t, ok := s.names[string(data[loc[0]:loc[1]])]
+		if !ok || isKey(data, loc[0], loc[1]) {
+			continue
+		}
+		result.Write(data[last:loc[0]])
+		result.WriteString(t)
+		last = loc[1]
+	}
+	result.Write(data[last:])
+	return result.Bytes()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	sanitizeZpoolStatus = `  pool: tank
+ state: ONLINE
+config:
+
+	NAME                                                     STATE     READ WRITE CKSUM
+	tank                                                     ONLINE       0     0     0
+	  mirror-0                                               ONLINE       0     0     0
+	    /dev/disk/by-id/ata-WDC_WD40EFRX_WD-WCC7K1234567-part1  ONLINE       0     0     0
+	    /dev/disk/by-id/ata-WDC_WD40EFRX_WD-WCC7K7654321-part1  ONLINE       0     0     0
+
+errors: No known data errors
+`
+	sanitizeZFSList = "tank\tfilesystem\t1700000000\t0\n" +
+		"tank/home\tfilesystem\t1700000000\t0\n" +
+		"tank/home@daily-1\tsnapshot\t1700000000\t4096\n"
+	sanitizeZpoolEvents = `Nov 23 2023 03:45:50.763089998	ereport.fs.zfs.checksum
+        class = "ereport.fs.zfs.checksum"
+        pool = "tank"
+        vdev_path = "/dev/disk/by-id/ata-WDC_WD40EFRX_WD-WCC7K1234567-part1"
+        vdev_devid = "ata-WDC_WD40EFRX_WD-WCC7K1234567-part1"
+        history_hostname = "nas1"
+`
+	sanitizeMetrics = `zfs_pool_status{pool="tank",state="online"} 1
+zfs_pool_disk_status{disk="/dev/disk/by-id/ata-WDC_WD40EFRX_WD-WCC7K1234567-part1",pool="tank/mirror-0",state="online"} 1
+zfs_snapshot_count{dataset="tank/home"} 1
+`
+	sanitizeState = `{"targets":[{"pool":{"pools":[{"name":"tank"}]},"snapshot":{"datasets":{"tank/home":[{"name":"daily-1"}]}}}]}`
+)
+
+func newTestSanitizer() *sanitizer {
+	s := newSanitizer([]byte("key"))
+	s.learnZpoolStatus([]byte(sanitizeZpoolStatus))
+	s.learnZFSList([]byte(sanitizeZFSList))
+	s.learnZpoolEvents([]byte(sanitizeZpoolEvents))
+	return s
+}
+
+func TestSanitizer(t *testing.T) {
+	var (
+		s      = newTestSanitizer()
+		tank   = s.token("tank")
+		home   = s.token("home")
+		daily  = s.token("daily-1")
+		serial = s.token("ata-WDC_WD40EFRX_WD-WCC7K1234567-part1")
+	)
+	require.NotEqual(t, tank, home)
+	require.Equal(t, tank, newTestSanitizer().token("tank"), "tokens are stable for a key")
+	require.NotEqual(t, tank, newSanitizer([]byte("other")).token("tank"), "tokens depend on the key")
+
+	files := map[string]string{
+		"zpool-status.txt": string(s.sanitize([]byte(sanitizeZpoolStatus))),
+		"zfs-list.txt":     string(s.sanitize([]byte(sanitizeZFSList))),
+		"zpool-events.txt": string(s.sanitize([]byte(sanitizeZpoolEvents))),
+		"metrics.txt":      string(s.sanitize([]byte(sanitizeMetrics))),
+		"debug-state.json": string(s.sanitize([]byte(sanitizeState))),
+	}
+	for name, data := range files {
+		for _, leaked := range []string{"tank", "home", "daily-1", "WCC7K", "nas1"} {
+			require.NotContains(t, data, leaked, name)
+		}
+		require.Contains(t, data, tank, name)
+	}
+
+	require.Contains(t, files["zpool-status.txt"], "  pool: "+tank+"\n")
+	require.Contains(t, files["zpool-status.txt"], "/dev/disk/by-id/"+serial+"  ONLINE")
+	require.Contains(t, files["zpool-status.txt"], "  mirror-0  ")
+	require.Contains(t, files["zfs-list.txt"], tank+"/"+home+"@"+daily+"\tsnapshot\t1700000000\t4096\n")
+	require.Contains(t, files["zpool-events.txt"], `vdev_devid = "`+serial+`"`)
+	require.Contains(t, files["metrics.txt"], `zfs_pool_disk_status{disk="/dev/disk/by-id/`+serial+`",pool="`+tank+`/mirror-0",state="online"} 1`)
+	require.Contains(t, files["metrics.txt"], `zfs_snapshot_count{dataset="`+tank+"/"+home+`"} 1`)
+	require.Contains(t, files["debug-state.json"], `"datasets":{"`+tank+"/"+home+`":[{"name":"`+daily+`"}]}`)
+}
+
+func TestSanitizerKeys(t *testing.T) {
+	// names equal to label names, event keys or JSON keys
+	s := newSanitizer([]byte("key"))
+	s.learnZFSList([]byte("pool/name@state\n"))
+	var (
+		pool  = s.token("pool")
+		name  = s.token("name")
+		state = s.token("state")
+	)
+
+	require.Equal(t,
+		`zfs_pool_status{pool="`+pool+`",state="online"} 1`,
+		string(s.sanitize([]byte(`zfs_pool_status{pool="pool",state="online"} 1`))))
+	require.Equal(t,
+		`        pool = "`+pool+`"`,
+		string(s.sanitize([]byte(`        pool = "pool"`))))
+	require.Equal(t,
+		`{"pools":[{"name":"`+pool+`"}],"datasets":{"`+pool+"/"+name+`":[{"name":"`+state+`"}]}}`,
+		string(s.sanitize([]byte(`{"pools":[{"name":"pool"}],"datasets":{"pool/name":[{"name":"state"}]}}`))))
+	require.Equal(t, pool+"/"+name+"@"+state, string(s.sanitize([]byte("pool/name@state"))))
+}
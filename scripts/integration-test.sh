@@ -0,0 +1,24 @@
+#!/bin/sh
+# Runs the integration tests in a privileged container with the ZFS userland
+# tools, so they don't need to be installed on the host. The host has to have
+# the ZFS kernel module loaded, its version should match the tools in the
+# image. Pools left over by killed test runs are destroyed afterwards.
+set -eu
+
+runtime=${CONTAINER_RUNTIME:-docker}
+image=${IMAGE:-docker.io/library/golang:1.21-bookworm}
+root=$(cd "$(dirname "$0")/.." && pwd)
+
+exec "$runtime" run --rm --privileged \
+	-v "$root:/src" -w /src \
+	-v /dev:/dev \
+	"$image" sh -ec '
+		cleanup() {
+			zpool list -H -o name | grep "^zfsexportertest" | xargs -r -n 1 zpool destroy -f
+		}
+		trap cleanup EXIT
+		sed -i "s/^Components: main$/Components: main contrib/" /etc/apt/sources.list.d/debian.sources
+		apt-get update -qq
+		apt-get install -y -qq --no-install-recommends zfsutils-linux >/dev/null
+		go test -tags integration -count=1 -run Integration -v .
+	'
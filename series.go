@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/urfave/cli/v2"
+)
+
+// seriesLimit caps the number of series of every gather, so a runaway number
+// of datasets or snapshots can't overwhelm Prometheus. The series beyond the
+// limit are dropped and counted.
+type seriesLimit struct {
+	limit  int
+	prefix string
+
+	metricTruncated prometheus.Counter
+	metricLimit     prometheus.Gauge
+}
+
+// newSeriesLimit creates a limit of max series, 0 disables it. prefix is the
+// prefix of the ZFS metric names.
+func newSeriesLimit(max int, prefix string) *seriesLimit {
+	l := &seriesLimit{
+		limit:  max,
+		prefix: prefix,
+		metricTruncated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "zfs_exporter_series_truncated_total",
+			Help: "Number of series dropped from gathers, as they exceeded --max-series.",
+		}),
+		metricLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zfs_exporter_series_limit",
+			Help: "Maximum number of series exported by a gather, 0 if there is no limit.",
+		}),
+	}
+	l.metricLimit.Set(float64(max))
+	return l
+}
+
+// parseSeriesLimit returns the limit of the --max-series flag.
+func parseSeriesLimit(c *cli.Context) (*seriesLimit, error) {
+	max := c.Int("max-series")
+	if max < 0 {
+		return nil, fmt.Errorf("maximum of series must not be negative, got %d", max)
+	}
+	return newSeriesLimit(max, c.String("metric-prefix")), nil
+}
+
+// exempt reports whether the family name is never truncated: the metrics of
+// the exporter itself, of the availability and health of ZFS and of the
+// pools. They show that something is wrong, e.g. while a tool creates
+// thousands of datasets.
+func (l *seriesLimit) exempt(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "zfs_exporter_"):
+		return true
+	case name == l.prefix+"_up", name == l.prefix+"_health":
+		return true
+	case strings.HasPrefix(name, l.prefix+"_health_"), strings.HasPrefix(name, l.prefix+"_pool_"):
+		return true
+	}
+	return false
+}
+
+// collectors returns the metrics about the limit, they are not subject to it.
+func (l *seriesLimit) collectors() []prometheus.Collector {
+	return []prometheus.Collector{l.metricTruncated, l.metricLimit}
+}
+
+// wrap returns a gatherer, which limits the series gathered from g. Without a
+// limit, g is returned.
+func (l *seriesLimit) wrap(g prometheus.Gatherer) prometheus.Gatherer {
+	if l.limit == 0 {
+		return g
+	}
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		return l.truncate(families), err
+	})
+}
+
+// truncate keeps the families and metrics in their order until the limit is
+// reached and drops all after. Gatherers return them sorted by name and
+// labels, so the same series are kept on every gather. The exempt families are
+// always kept and don't count towards the limit. The families are shared by
+// concurrent gathers, they are copied instead of being modified.
+func (l *seriesLimit) truncate(families []*dto.MetricFamily) []*dto.MetricFamily {
+	var (
+		result    = make([]*dto.MetricFamily, 0, len(families))
+		series    int
+		truncated int
+	)
+	for _, f := range families {
+		if l.exempt(f.GetName()) {
+			result = append(result, f)
+			continue
+		}
+		kept := len(f.GetMetric())
+		for i, m := range f.GetMetric() {
+			n := metricSeries(f.GetType(), m)
+			// once a series is dropped, all following ones are dropped
+			if truncated > 0 || series+n > l.limit {
+				if i < kept {
+					kept = i
+				}
+				truncated += n
+				continue
+			}
+			series += n
+		}
+		switch {
+		case kept == len(f.GetMetric()):
+			result = append(result, f)
+		case kept > 0:
+			result = append(result, &dto.MetricFamily{
+				Name:   f.Name,
+				Help:   f.Help,
+				Type:   f.Type,
+				Metric: f.GetMetric()[:kept],
+			})
+		}
+	}
+
+	if truncated > 0 {
+		logger.Warn().Int("limit", l.limit).Int("truncated", truncated).Msg("dropped series exceeding --max-series")
+		l.metricTruncated.Add(float64(truncated))
+	}
+	return result
+}
+
+// metricSeries returns the number of series m is exposed as, e.g. a
+// histogram has a series per bucket in addition to its sum and count.
+func metricSeries(t dto.MetricType, m *dto.Metric) int {
+	switch t {
+	case dto.MetricType_SUMMARY:
+		return len(m.GetSummary().GetQuantile()) + 2
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		buckets := m.GetHistogram().GetBucket()
+		// the +Inf bucket is added on exposition, if it is missing
+		if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+			return len(buckets) + 3
+		}
+		return len(buckets) + 2
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// datasetsCollector exports a series per dataset in a random order, like a
+// collector of many datasets received at once.
+type datasetsCollector struct {
+	desc     *prometheus.Desc
+	datasets int
+}
+
+func (c *datasetsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *datasetsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, i := range rand.Perm(c.datasets) {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, fmt.Sprintf("tank/recv-%03d", i))
+	}
+}
+
+// seriesNames returns the series of families in the form name{labels}.
+func seriesNames(families []*dto.MetricFamily) []string {
+	var result []string
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			result = append(result, f.GetName()+"{"+strings.Join(labels, ",")+"}")
+		}
+	}
+	return result
+}
+
+func TestSeriesLimit(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&datasetsCollector{
+		desc:     prometheus.NewDesc("zfs_dataset_info", "Test info.", []string{"dataset"}, nil),
+		datasets: 100,
+	})
+	// a histogram is exported as 5 series, with the +Inf bucket
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "zfs_a_latency_seconds",
+		Help:    "Test latency.",
+		Buckets: []float64{0.1, 1},
+	})
+	h.Observe(0.5)
+	reg.MustRegister(h)
+
+	limit := newSeriesLimit(10, "zfs")
+	g := limit.wrap(reg)
+
+	families, err := g.Gather()
+	require.NoError(t, err)
+	kept := seriesNames(families)
+	require.Equal(t, []string{
+		"zfs_a_latency_seconds{}",
+		"zfs_dataset_info{dataset=tank/recv-000}",
+		"zfs_dataset_info{dataset=tank/recv-001}",
+		"zfs_dataset_info{dataset=tank/recv-002}",
+		"zfs_dataset_info{dataset=tank/recv-003}",
+		"zfs_dataset_info{dataset=tank/recv-004}",
+	}, kept)
+
+	// the same series are kept on every gather
+	for i := 0; i < 10; i++ {
+		families, err := g.Gather()
+		require.NoError(t, err)
+		require.Equal(t, kept, seriesNames(families))
+	}
+
+	// the truncated series are counted on every gather
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(limit.collectors()...)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_exporter_series_limit Maximum number of series exported by a gather, 0 if there is no limit.
+# TYPE zfs_exporter_series_limit gauge
+zfs_exporter_series_limit 10
+# HELP zfs_exporter_series_truncated_total Number of series dropped from gathers, as they exceeded --max-series.
+# TYPE zfs_exporter_series_truncated_total counter
+zfs_exporter_series_truncated_total 1045
+`)))
+}
+
+func TestSeriesLimitExempt(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		&datasetsCollector{
+			desc:     prometheus.NewDesc("zfs_dataset_info", "Test info.", []string{"dataset"}, nil),
+			datasets: 100,
+		},
+		&datasetsCollector{
+			desc:     prometheus.NewDesc("zfs_pool_info", "Test info.", []string{"dataset"}, nil),
+			datasets: 1,
+		},
+		&datasetsCollector{
+			desc:     prometheus.NewDesc("zfs_snapshot_info", "Test info.", []string{"dataset"}, nil),
+			datasets: 1,
+		},
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_up", Help: "Test up."}),
+		prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_health", Help: "Test health."}),
+	)
+	limit := newSeriesLimit(2, "zfs")
+	reg.MustRegister(limit.collectors()...)
+
+	// a burst of datasets sorted before them doesn't drop the metrics
+	// showing that something is wrong
+	families, err := limit.wrap(reg).Gather()
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"zfs_dataset_info{dataset=tank/recv-000}",
+		"zfs_dataset_info{dataset=tank/recv-001}",
+		"zfs_exporter_series_limit{}",
+		"zfs_exporter_series_truncated_total{}",
+		"zfs_health{}",
+		"zfs_pool_info{dataset=tank/recv-000}",
+		"zfs_up{}",
+	}, seriesNames(families))
+	require.Equal(t, 99.0, testutil.ToFloat64(limit.metricTruncated))
+}
+
+func TestSeriesLimitShared(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&datasetsCollector{
+		desc:     prometheus.NewDesc("zfs_dataset_info", "Test info.", []string{"dataset"}, nil),
+		datasets: 5,
+	})
+	other := prometheus.NewRegistry()
+	other.MustRegister(&datasetsCollector{
+		desc:     prometheus.NewDesc("zfs_snapshot_info", "Test info.", []string{"dataset"}, nil),
+		datasets: 1,
+	})
+	families, err := prometheus.Gatherers{reg, other}.Gather()
+	require.NoError(t, err)
+
+	// the families of shared gathers are not modified
+	limit := newSeriesLimit(2, "zfs")
+	truncated := limit.truncate(families)
+	require.Len(t, truncated, 1)
+	require.Len(t, truncated[0].GetMetric(), 2)
+	require.Len(t, families[0].GetMetric(), 5)
+	require.Len(t, families[1].GetMetric(), 1)
+
+	// families within the limit are returned as they are
+	require.Equal(t, families, newSeriesLimit(6, "zfs").truncate(families))
+	// without a limit, the gatherer isn't wrapped
+	require.Equal(t, prometheus.Gatherer(reg), newSeriesLimit(0, "zfs").wrap(reg))
+}
+
+func TestMetricSeries(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		metric prometheus.Metric
+		series int
+	}{
+		{
+			name:   "gauge",
+			metric: prometheus.MustNewConstMetric(prometheus.NewDesc("g", "g", nil, nil), prometheus.GaugeValue, 1),
+			series: 1,
+		},
+		{
+			name:   "summary",
+			metric: prometheus.MustNewConstSummary(prometheus.NewDesc("s", "s", nil, nil), 1, 1, map[float64]float64{0.5: 1, 0.9: 1}),
+			series: 4,
+		},
+		{
+			name:   "histogram",
+			metric: prometheus.MustNewConstHistogram(prometheus.NewDesc("h", "h", nil, nil), 1, 1, map[float64]uint64{1: 1, 2: 1}),
+			series: 5,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m dto.Metric
+			require.NoError(t, tc.metric.Write(&m))
+			typ := dto.MetricType_GAUGE
+			switch {
+			case m.Summary != nil:
+				typ = dto.MetricType_SUMMARY
+			case m.Histogram != nil:
+				typ = dto.MetricType_HISTOGRAM
+			}
+			require.Equal(t, tc.series, metricSeries(typ, &m))
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/sync/singleflight"
+)
+
+// sharedGatherer lets concurrent gathers share a single collection, so
+// scrapes of HA Prometheus pairs and the text file output don't each fork
+// zfs and zpool.
+type sharedGatherer struct {
+	gatherer prometheus.Gatherer
+	group    singleflight.Group
+}
+
+func newSharedGatherer(g prometheus.Gatherer) *sharedGatherer {
+	return &sharedGatherer{gatherer: g}
+}
+
+// Gather returns the result of the gather in flight or starts a new one. The
+// returned families are shared and must not be modified.
+func (s *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	v, err, _ := s.group.Do("", func() (interface{}, error) {
+		return s.gatherer.Gather()
+	})
+	families, _ := v.([]*dto.MetricFamily)
+	return families, err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+)
+
+// slowCollector is a pool collector, which counts its collections. They block
+// until released.
+type slowCollector struct {
+	desc     *prometheus.Desc
+	release  chan struct{}
+	collects int32
+}
+
+func newSlowCollector() *slowCollector {
+	return &slowCollector{
+		desc:    prometheus.NewDesc("zfs_pool_status", "Test status.", nil, nil),
+		release: make(chan struct{}),
+	}
+}
+
+func (c *slowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *slowCollector) Status() pool.Status {
+	return pool.Status{InitialParseDone: true}
+}
+
+func (c *slowCollector) Collect(ch chan<- prometheus.Metric) {
+	atomic.AddInt32(&c.collects, 1)
+	<-c.release
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1)
+}
+
+// scrapeParallel issues n scrapes of h at once and returns their status codes.
+func scrapeParallel(h http.Handler, n int) []int {
+	var (
+		wg    sync.WaitGroup
+		codes = make([]int, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+	return codes
+}
+
+func TestSharedGatherer(t *testing.T) {
+	var (
+		slow    = newSlowCollector()
+		e       = newFakeExporterCollectors(nil)
+		targets = exporterTargets{e}
+	)
+	e.pool = slow
+	shared := targets.newSharedGatherers()
+
+	// scrapes and a text file output covering only the pool collector
+	h, inflight := newMetricsHandler(targets.gatherer(shared, targets.names()), 0)
+	textFile, _ := newMetricsHandler(targets.gatherer(shared, []string{"pool"}), 0)
+
+	done := make(chan []int)
+	go func() { done <- scrapeParallel(h, 5) }()
+	go func() { done <- scrapeParallel(textFile, 1) }()
+
+	for i := 0; testutil.ToFloat64(inflight) < 5; i++ {
+		require.Less(t, i, 500, "scrapes not in flight")
+		time.Sleep(10 * time.Millisecond)
+	}
+	// give the text file output a moment to join the collection in flight
+	time.Sleep(50 * time.Millisecond)
+	close(slow.release)
+
+	for i := 0; i < 2; i++ {
+		for _, code := range <-done {
+			require.Equal(t, http.StatusOK, code)
+		}
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&slow.collects))
+	require.Equal(t, float64(0), testutil.ToFloat64(inflight))
+
+	// a later gather collects again
+	families, err := shared["pool"].Gather()
+	require.NoError(t, err)
+	require.NotEmpty(t, families)
+	require.Equal(t, int32(2), atomic.LoadInt32(&slow.collects))
+}
+
+func TestMaxConcurrentScrapes(t *testing.T) {
+	slow := newSlowCollector()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(slow)
+	h, inflight := newMetricsHandler(newSharedGatherer(reg), 2)
+
+	done := make(chan []int)
+	go func() { done <- scrapeParallel(h, 2) }()
+	for i := 0; testutil.ToFloat64(inflight) < 2; i++ {
+		require.Less(t, i, 500, "scrapes not in flight")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the limit is reached
+	require.Equal(t, []int{http.StatusServiceUnavailable}, scrapeParallel(h, 1))
+
+	close(slow.release)
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, <-done)
+	require.Equal(t, int32(1), atomic.LoadInt32(&slow.collects))
+}
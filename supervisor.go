@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	backgroundFailureLog     = "log"
+	backgroundFailureRestart = "restart"
+	backgroundFailureExit    = "exit"
+)
+
+// exitCodeBackgroundFailure is the exit code of the exporter, when a
+// background task fails with --on-background-failure=exit.
+const exitCodeBackgroundFailure = 3
+
+func validateBackgroundFailurePolicy(policy string) error {
+	switch policy {
+	case backgroundFailureLog, backgroundFailureRestart, backgroundFailureExit:
+		return nil
+	}
+	return fmt.Errorf("invalid background failure policy %q, expected %s, %s or %s", policy, backgroundFailureLog, backgroundFailureRestart, backgroundFailureExit)
+}
+
+// taskFailedError is returned by the errgroup of a supervisor, when a task
+// fails with the exit policy.
+type taskFailedError struct {
+	task string
+	err  error
+}
+
+func (e *taskFailedError) Error() string {
+	return fmt.Sprintf("background task %s failed: %v", e.task, e.err)
+}
+
+func (e *taskFailedError) Unwrap() error {
+	return e.err
+}
+
+// errTaskStopped is the failure of a task, which returned before ctx was
+// cancelled without an error.
+var errTaskStopped = errors.New("stopped unexpectedly")
+
+// supervisor runs the long running background tasks of the exporter and
+// handles their failures according to its policy: log only logs the failure,
+// restart runs the task again after a backoff and exit stops the exporter.
+type supervisor struct {
+	ctx    context.Context
+	g      *errgroup.Group
+	policy string
+
+	// the backoff between restarts doubles from minBackoff up to maxBackoff,
+	// it is reset once a task ran for maxBackoff
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	metricTaskUp *prometheus.GaugeVec
+}
+
+func newSupervisor(ctx context.Context, g *errgroup.Group, policy string) *supervisor {
+	return &supervisor{
+		ctx:        ctx,
+		g:          g,
+		policy:     policy,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		metricTaskUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zfs_exporter_task_up",
+			Help: "Whether a background task of the exporter is running.",
+		}, []string{"task"}),
+	}
+}
+
+func (s *supervisor) collector() prometheus.Collector {
+	return s.metricTaskUp
+}
+
+// runTask runs task once. A panic is returned as error and so is returning
+// before ctx is cancelled.
+func runTask(ctx context.Context, task func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			logger.Error().Str("stack", string(debug.Stack())).Msgf("recovered panic in background task: %v", r)
+		}
+	}()
+	err = task(ctx)
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		err = errTaskStopped
+	}
+	return err
+}
+
+// Go runs task named name until the context of the supervisor is cancelled. A
+// task is expected to run until then, returning earlier or panicking is a
+// failure.
+func (s *supervisor) Go(name string, task func(context.Context) error) {
+	up := s.metricTaskUp.WithLabelValues(name)
+	s.g.Go(func() error {
+		backoff := s.minBackoff
+		for {
+			up.Set(1)
+			started := time.Now()
+			err := runTask(s.ctx, task)
+			if err == nil {
+				return nil
+			}
+			up.Set(0)
+
+			switch s.policy {
+			case backgroundFailureExit:
+				logger.Error().Msgf("background task %s failed, exiting: %v", name, err)
+				return &taskFailedError{task: name, err: err}
+			case backgroundFailureRestart:
+				if time.Since(started) >= s.maxBackoff {
+					backoff = s.minBackoff
+				}
+				logger.Error().Msgf("background task %s failed, restarting in %s: %v", name, backoff, err)
+				select {
+				case <-s.ctx.Done():
+					return nil
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > s.maxBackoff {
+					backoff = s.maxBackoff
+				}
+			default:
+				logger.Error().Msgf("background task %s failed: %v", name, err)
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func newTestSupervisor(policy string) (*supervisor, *errgroup.Group, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g, ctx := errgroup.WithContext(ctx)
+	s := newSupervisor(ctx, g, policy)
+	s.minBackoff = time.Millisecond
+	s.maxBackoff = 4 * time.Millisecond
+	return s, g, cancel
+}
+
+// failingTask fails the first failures runs and runs until ctx is cancelled
+// afterwards.
+func failingTask(failures int32, calls *int32) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if atomic.AddInt32(calls, 1) <= failures {
+			return errors.New("event loop failed")
+		}
+		<-ctx.Done()
+		return nil
+	}
+}
+
+func TestSupervisorLog(t *testing.T) {
+	s, g, cancel := newTestSupervisor(backgroundFailureLog)
+	defer cancel()
+
+	var calls int32
+	s.Go("snapshot", failingTask(1, &calls))
+	s.Go("push", failingTask(0, new(int32)))
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metricTaskUp.WithLabelValues("snapshot")) == 0
+	}, time.Second, time.Millisecond)
+
+	// the failed task isn't restarted, the other tasks keep running
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Equal(t, 1.0, testutil.ToFloat64(s.metricTaskUp.WithLabelValues("push")))
+
+	cancel()
+	require.NoError(t, g.Wait())
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	s, g, cancel := newTestSupervisor(backgroundFailureRestart)
+	defer cancel()
+
+	var calls int32
+	s.Go("snapshot", failingTask(3, &calls))
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 4
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1.0, testutil.ToFloat64(s.metricTaskUp.WithLabelValues("snapshot")))
+
+	cancel()
+	require.NoError(t, g.Wait())
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestSupervisorExit(t *testing.T) {
+	s, g, cancel := newTestSupervisor(backgroundFailureExit)
+	defer cancel()
+
+	var otherStopped int32
+	s.Go("push", func(ctx context.Context) error {
+		<-ctx.Done()
+		atomic.StoreInt32(&otherStopped, 1)
+		return nil
+	})
+	s.Go("snapshot", failingTask(1, new(int32)))
+
+	err := g.Wait()
+	var taskErr *taskFailedError
+	require.ErrorAs(t, err, &taskErr)
+	require.Equal(t, "snapshot", taskErr.task)
+	require.EqualError(t, err, "background task snapshot failed: event loop failed")
+
+	// the other tasks are stopped
+	require.Equal(t, int32(1), atomic.LoadInt32(&otherStopped))
+	require.Equal(t, 0.0, testutil.ToFloat64(s.metricTaskUp.WithLabelValues("snapshot")))
+}
+
+func TestSupervisorPanicAndStop(t *testing.T) {
+	s, g, cancel := newTestSupervisor(backgroundFailureExit)
+	defer cancel()
+
+	s.Go("textfile:/var/lib/node_exporter/zfs.prom", func(context.Context) error {
+		var m map[string]int
+		m["pool"]++
+		return nil
+	})
+	err := g.Wait()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "panic: assignment to entry in nil map")
+
+	// returning without an error before the shutdown is a failure as well
+	s, g, cancel = newTestSupervisor(backgroundFailureExit)
+	defer cancel()
+	s.Go("cache", func(context.Context) error { return nil })
+	require.ErrorIs(t, g.Wait(), errTaskStopped)
+}
+
+func TestValidateBackgroundFailurePolicy(t *testing.T) {
+	for _, policy := range []string{"log", "restart", "exit"} {
+		require.NoError(t, validateBackgroundFailurePolicy(policy))
+	}
+	require.Error(t, validateBackgroundFailurePolicy("ignore"))
+}
+
+// testSnapshotEvent creates a snapshot, which requires listing the dataset.
+const testSnapshotEvent = "Nov 23 2023 03:45:50.763089998\tsysevent.fs.zfs.history_event\n" +
+	"        class = \"sysevent.fs.zfs.history_event\"\n" +
+	"        pool = \"pool\"\n" +
+	"        history_dsname = \"pool/data@daily-3\"\n" +
+	"        history_internal_name = \"snapshot\"\n" +
+	"\n"
+
+func TestBackgroundFailureExitCode(t *testing.T) {
+	// listing a single dataset fails, so the event loop fails on the
+	// snapshot event
+	fakeCommands(t, map[string]string{
+		"zfs": `if [ -n "$8" ]; then echo "dataset does not exist" >&2; exit 1; fi
+printf '` + fakeZfsList + "'\n",
+		"zpool": `if [ "$1" = "events" ]; then
+cat <<'EOF'
+` + testSnapshotEvent + `EOF
+exec sleep 3600
+fi
+cat <<'EOF'
+` + fakeZpoolStatus + "EOF\n",
+	})
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$", "--",
+		"--listen-addr", "",
+		"--text-file-output", t.TempDir()+"/zfs.prom",
+		"--on-background-failure", "exit",
+		"--shutdown.grace-period", "5s",
+	)
+	cmd.Env = append(os.Environ(), "ZFS_EXPORTER_HELPER_PROCESS=1")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	require.NoError(t, cmd.Start())
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- cmd.Wait() }()
+	select {
+	case err := <-errCh:
+		var exitErr *exec.ExitError
+		require.ErrorAs(t, err, &exitErr, out.String())
+		require.Equal(t, exitCodeBackgroundFailure, exitErr.ExitCode(), out.String())
+		require.Contains(t, out.String(), "background task snapshot failed")
+	case <-time.After(10 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatalf("exporter did not exit after the event loop failed: %s", out.String())
+	}
+}
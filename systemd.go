@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation, if
+// there are any. The environment is cleared so child processes don't inherit
+// them.
+func systemdListeners(startFD int) ([]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := startFD; fd < startFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener duplicates the file descriptor
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error using socket from systemd: %w", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// sdNotify sends a state notification to systemd. It is a no-op when not
+// running under a Type=notify service.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	// abstract namespace socket
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("error connecting to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("error writing to notify socket: %w", err)
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns the interval in which systemd expects watchdog
+// keepalives, which is half of the configured WatchdogSec. It returns zero when
+// the watchdog is disabled.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runSdWatchdog sends watchdog keepalives until ctx is cancelled.
+func runSdWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Warn().Msgf("error sending watchdog keepalive: %v", err)
+			}
+		}
+	}
+}
+
+// notifyReady tells systemd about readiness once r reports ready. Until then
+// the reason is sent as status, which shows up in systemctl status.
+func notifyReady(ctx context.Context, r *readiness, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last string
+	for {
+		err := r.check()
+		if err == nil {
+			if err := sdNotify("READY=1\nSTATUS=ready"); err != nil {
+				logger.Warn().Msgf("error notifying systemd: %v", err)
+			}
+			return
+		}
+		if msg := err.Error(); msg != last {
+			last = msg
+			if err := sdNotify("STATUS=" + msg); err != nil {
+				logger.Warn().Msgf("error notifying systemd: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	addr := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr)
+
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 256)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Run("without socket", func(t *testing.T) {
+		t.Setenv("NOTIFY_SOCKET", "")
+		require.NoError(t, sdNotify("READY=1"))
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		conn := listenNotifySocket(t)
+		require.NoError(t, sdNotify("READY=1"))
+		require.Equal(t, "READY=1", readNotification(t, conn))
+	})
+
+	t.Run("watchdog", func(t *testing.T) {
+		conn := listenNotifySocket(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go runSdWatchdog(ctx, 10*time.Millisecond)
+		require.Equal(t, "WATCHDOG=1", readNotification(t, conn))
+		require.Equal(t, "WATCHDOG=1", readNotification(t, conn))
+	})
+}
+
+// poolPendingSource is ready once the pool status has been parsed.
+type poolPendingSource struct {
+	mtx    sync.Mutex
+	parsed bool
+}
+
+func (s *poolPendingSource) Status() snapshot.Status {
+	return snapshot.Status{InitialListingDone: true, EventStreamUp: true}
+}
+
+func (s *poolPendingSource) PoolStatus() pool.Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return pool.Status{InitialParseDone: s.parsed}
+}
+
+func TestNotifyReady(t *testing.T) {
+	var (
+		conn   = listenNotifySocket(t)
+		source = &poolPendingSource{}
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		notifyReady(context.Background(), newReadiness(source, time.Minute), 10*time.Millisecond)
+	}()
+
+	// the status is only sent when it changes
+	require.Equal(t, "STATUS=initial pool status has not been parsed", readNotification(t, conn))
+	source.mtx.Lock()
+	source.parsed = true
+	source.mtx.Unlock()
+	require.Equal(t, "READY=1\nSTATUS=ready", readNotification(t, conn))
+	<-done
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	t.Setenv("WATCHDOG_PID", "")
+	require.Equal(t, time.Duration(0), sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	require.Equal(t, 15*time.Second, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	require.Equal(t, 15*time.Second, sdWatchdogInterval())
+
+	// watchdog is meant for another process
+	t.Setenv("WATCHDOG_PID", "1")
+	require.Equal(t, time.Duration(0), sdWatchdogInterval())
+}
+
+func TestSystemdListeners(t *testing.T) {
+	t.Run("not activated", func(t *testing.T) {
+		t.Setenv("LISTEN_PID", "")
+		t.Setenv("LISTEN_FDS", "")
+		listeners, err := systemdListeners(listenFDsStart)
+		require.NoError(t, err)
+		require.Empty(t, listeners)
+	})
+
+	t.Run("activated", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		// ownership of the raw file descriptor is passed to systemdListeners
+		fd, err := syscall.Dup(int(f.Fd()))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		t.Setenv("LISTEN_FDS", "1")
+		listeners, err := systemdListeners(fd)
+		require.NoError(t, err)
+		require.Len(t, listeners, 1)
+		require.Empty(t, os.Getenv("LISTEN_FDS"))
+
+		srv := &http.Server{Handler: okHandler}
+		go func() { _ = srv.Serve(listeners[0]) }()
+		defer srv.Close()
+
+		resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type httpBuffer struct {
+	b          bytes.Buffer
+	statusCode int
+	headers    http.Header
+}
+
+func newHTTPBuffer() *httpBuffer {
+	return &httpBuffer{
+		headers:    make(http.Header),
+		statusCode: 200,
+	}
+}
+
+func (b *httpBuffer) Header() http.Header {
+	return b.headers
+}
+
+func (b *httpBuffer) WriteHeader(statusCode int) {
+	b.statusCode = statusCode
+}
+
+func (b *httpBuffer) Write(p []byte) (int, error) {
+	return b.b.Write(p)
+}
+
+func (b *httpBuffer) Read(p []byte) (int, error) {
+	return b.b.Read(p)
+}
+
+func (b *httpBuffer) Reset() {
+	b.b.Reset()
+	b.statusCode = 200
+	for k := range b.headers {
+		delete(b.headers, k)
+	}
+}
+
+// volatileSeries change on every collection without the state of ZFS
+// changing, they are ignored when detecting changes of the text file output.
+var volatileSeries = map[string]bool{
+	"zfs_exporter_collector_duration_seconds": true,
+	"zfs_exporter_data_stale_seconds":         true,
+	"zfs_exporter_event_queue_length":         true,
+}
+
+// seriesName returns the metric name of a sample line in the Prometheus text
+// format or the measurement of a line in the InfluxDB line protocol.
+func seriesName(line string) string {
+	if i := strings.IndexAny(line, "{ ,"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// contentHash returns the hex encoded digest of the normalized text file
+// content: the lines are sorted, volatile series are left out and the
+// timestamps of the InfluxDB line protocol, which are set to the time of the
+// collection, are removed.
+func contentHash(content []byte, format string) string {
+	lines := strings.Split(string(content), "\n")
+	normalized := lines[:0]
+	for _, line := range lines {
+		if line == "" || volatileSeries[seriesName(line)] {
+			continue
+		}
+		if format == textFileFormatInflux {
+			if i := strings.LastIndexByte(line, ' '); i >= 0 {
+				line = line[:i]
+			}
+		}
+		normalized = append(normalized, line)
+	}
+	sort.Strings(normalized)
+
+	h := sha256.New()
+	for _, line := range normalized {
+		_, _ = io.WriteString(h, line+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type textFileOutputConfig struct {
+	filename   string
+	collectors []string
+}
+
+// parseTextFileOutputs parses the values of --text-file-output. A value is
+// either a path, which receives the metrics of all collectors, or a
+// collector=path mapping. Mappings to the same path are merged.
+func parseTextFileOutputs(values []string, collectors map[string]prometheus.Collector) ([]textFileOutputConfig, error) {
+	all := make([]string, 0, len(collectors))
+	for name := range collectors {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+
+	var (
+		result []textFileOutputConfig
+		index  = make(map[string]int)
+	)
+	for _, v := range values {
+		var (
+			filename = v
+			names    = all
+		)
+		if idx := strings.IndexByte(v, '='); idx > 0 && !strings.ContainsRune(v[:idx], filepath.Separator) {
+			name := v[:idx]
+			if _, ok := collectors[name]; !ok {
+				return nil, fmt.Errorf("unknown collector %q in text file output %q, expected one of %s", name, v, strings.Join(all, ", "))
+			}
+			filename = v[idx+1:]
+			names = []string{name}
+		}
+		if filename == "" {
+			return nil, fmt.Errorf("empty path in text file output %q", v)
+		}
+
+		i, ok := index[filename]
+		if !ok {
+			index[filename] = len(result)
+			result = append(result, textFileOutputConfig{filename: filename})
+			i = len(result) - 1
+		}
+	names:
+		for _, name := range names {
+			for _, existing := range result[i].collectors {
+				if existing == name {
+					continue names
+				}
+			}
+			result[i].collectors = append(result[i].collectors, name)
+		}
+	}
+
+	return result, nil
+}
+
+// textFileHandler serves the metrics of g for a text file output in format.
+// Like the scrapes, a failing collector only leaves out its metrics, the file
+// is still written with the metrics of the other collectors.
+func textFileHandler(g prometheus.Gatherer, format string) http.Handler {
+	if format == textFileFormatInflux {
+		return influxHandler(g)
+	}
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		// Opt into OpenMetrics to support exemplars.
+		EnableOpenMetrics: true,
+		ErrorHandling:     promhttp.ContinueOnError,
+		ErrorLog:          metricsErrorLogger{},
+	})
+}
+
+type textFileOutput struct {
+	handler  http.Handler
+	filename string
+	interval time.Duration
+	format   string
+
+	mode            fs.FileMode
+	gid             int
+	warnedOwnership bool
+
+	buffer  *httpBuffer
+	oldHash string
+
+	metricWriteErrors prometheus.Counter
+}
+
+func newTextFileOutput(handler http.Handler, filename string, interval time.Duration) *textFileOutput {
+	return &textFileOutput{
+		handler:  handler,
+		filename: filename,
+		interval: interval,
+		format:   textFileFormatPrometheus,
+		mode:     0o644,
+		gid:      -1,
+		buffer:   newHTTPBuffer(),
+		metricWriteErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "zfs_exporter_textfile_write_errors_total",
+			Help:        "Total count of errors writing the text file output.",
+			ConstLabels: prometheus.Labels{"file": filename},
+		}),
+	}
+}
+
+// parseFileMode parses an octal file mode like 0640.
+func parseFileMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: %w", s, err)
+	}
+	if mode&^uint64(fs.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid file mode %q: only permission bits are allowed", s)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// lookupGroupID resolves a group name or numeric id.
+func lookupGroupID(s string) (int, error) {
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		if g, err = user.LookupGroupId(s); err != nil {
+			return 0, fmt.Errorf("unknown group %q", s)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// tempPattern returns the pattern of temporary files, which are created next to
+// the output file. They don't end in .prom so node-exporter ignores them.
+func (t *textFileOutput) tempPattern() string {
+	return "." + filepath.Base(t.filename) + ".*.tmp"
+}
+
+// removeStaleTempFiles removes temporary files left behind by a previous run.
+func (t *textFileOutput) removeStaleTempFiles() error {
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(t.filename), t.tempPattern()))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error removing stale temporary file: %w", err)
+		}
+		logger.Debug().Msgf("removed stale temporary file: %s", m)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFile atomically replaces the output file with the content of r.
+func (t *textFileOutput) writeFile(r io.Reader) (err error) {
+	dir := filepath.Dir(t.filename)
+
+	// the temporary file is created in the same directory, so the rename
+	// happens within the same filesystem
+	f, err := os.CreateTemp(dir, t.tempPattern())
+	if err != nil {
+		return fmt.Errorf("error creating text file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("error writing text file: %w", err)
+	}
+
+	if err := f.Chmod(t.mode); err != nil {
+		return fmt.Errorf("error setting text file mode: %w", err)
+	}
+
+	if t.gid >= 0 {
+		if err := f.Chown(-1, t.gid); err != nil && !t.warnedOwnership {
+			// not being allowed to change the group is not fatal, but only
+			// warn once to not spam the log every interval
+			t.warnedOwnership = true
+			logger.Warn().Msgf("unable to change group of text file to %d: %v", t.gid, err)
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing text file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing text file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), t.filename); err != nil {
+		return fmt.Errorf("error renaming text file: %w", err)
+	}
+
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("error syncing text file directory: %w", err)
+	}
+
+	return nil
+}
+
+func (t *textFileOutput) write(ctx context.Context) error {
+	defer t.buffer.Reset()
+	req, err := newInternalRequest(ctx, "GET", "/metrics")
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	t.handler.ServeHTTP(t.buffer, req)
+	if (t.buffer.statusCode / 100) != 2 {
+		return fmt.Errorf("unexpected status code: %d", t.buffer.statusCode)
+	}
+
+	hash := contentHash(t.buffer.b.Bytes(), t.format)
+	if hash == t.oldHash {
+		// node-exporter considers the file stale based on its modification
+		// time, so it is refreshed even without a change
+		now := time.Now()
+		err := os.Chtimes(t.filename, now, now)
+		if err == nil {
+			logger.Debug().Msgf("no change in metrics, refreshed modification time of %s", t.filename)
+			return nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error refreshing modification time of text file: %w", err)
+		}
+		// the file has been removed, write it again
+	}
+
+	if err := t.writeFile(t.buffer); err != nil {
+		return err
+	}
+	t.oldHash = hash
+	logger.Info().Msgf("wrote text file: %s", t.filename)
+
+	return nil
+}
+
+func (t *textFileOutput) writeOrLog(ctx context.Context) {
+	if err := t.write(ctx); err != nil {
+		t.metricWriteErrors.Inc()
+		logger.Error().Msgf("error writing text file: %v", err)
+	}
+}
+
+// run writes the text file output every interval until ctx is cancelled. A
+// final write on the way out makes sure the file reflects the last known state.
+func (t *textFileOutput) run(ctx context.Context) {
+	if err := t.removeStaleTempFiles(); err != nil {
+		logger.Warn().Msgf("error removing stale temporary files: %v", err)
+	}
+
+	// a failure at start up is not fatal, as zfs might not be ready yet
+	t.writeOrLog(ctx)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.oldHash = ""
+			t.writeOrLog(context.Background())
+			return
+		case <-ticker.C:
+			t.writeOrLog(ctx)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextFileOutput(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		filename = filepath.Join(dir, "zfs.prom")
+		stale    = filepath.Join(dir, ".zfs.prom.123456.tmp")
+		out      = newTextFileOutput(okHandler, filename, time.Minute)
+	)
+
+	require.NoError(t, os.WriteFile(stale, []byte("partial"), 0o644))
+	require.NoError(t, out.removeStaleTempFiles())
+	_, err := os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, out.write(context.Background()))
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, "zfs_up 1\n", string(data))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestTextFileOutputFailedRename(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		filename = filepath.Join(dir, "zfs.prom")
+		out      = newTextFileOutput(okHandler, filename, time.Minute)
+	)
+
+	// a non-empty directory under the final name makes the rename fail
+	require.NoError(t, os.MkdirAll(filepath.Join(filename, "blocker"), 0o755))
+
+	out.writeOrLog(context.Background())
+	require.Equal(t, 1.0, testutil.ToFloat64(out.metricWriteErrors))
+
+	// no temporary file is left behind and the final name is untouched
+	matches, err := filepath.Glob(filepath.Join(dir, out.tempPattern()))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+	require.DirExists(t, filename)
+
+	// once the rename succeeds the unchanged content is written
+	require.NoError(t, os.RemoveAll(filename))
+	out.writeOrLog(context.Background())
+	require.Equal(t, 1.0, testutil.ToFloat64(out.metricWriteErrors))
+	require.FileExists(t, filename)
+}
+
+func TestTextFileOutputPermissions(t *testing.T) {
+	var (
+		filename = filepath.Join(t.TempDir(), "zfs.prom")
+		out      = newTextFileOutput(okHandler, filename, time.Minute)
+	)
+
+	mode, err := parseFileMode("0640")
+	require.NoError(t, err)
+	out.mode = mode
+	out.gid = os.Getgid()
+
+	require.NoError(t, out.write(context.Background()))
+
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	require.False(t, out.warnedOwnership)
+}
+
+func TestParseFileMode(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected os.FileMode
+		err      bool
+	}{
+		{input: "0644", expected: 0o644},
+		{input: "640", expected: 0o640},
+		{input: "0999", err: true},
+		{input: "4755", err: true},
+		{input: "rw-r--r--", err: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			mode, err := parseFileMode(tc.input)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, mode)
+		})
+	}
+}
+
+func TestParseTextFileOutputs(t *testing.T) {
+	collectors := map[string]prometheus.Collector{
+		"pool":     prometheus.NewGauge(prometheus.GaugeOpts{Name: "pool"}),
+		"snapshot": prometheus.NewGauge(prometheus.GaugeOpts{Name: "snapshot"}),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		values   []string
+		expected []textFileOutputConfig
+		err      string
+	}{
+		{
+			name:     "single path",
+			values:   []string{"/var/lib/node_exporter/zfs.prom"},
+			expected: []textFileOutputConfig{{filename: "/var/lib/node_exporter/zfs.prom", collectors: []string{"pool", "snapshot"}}},
+		},
+		{
+			name:   "per collector",
+			values: []string{"pool=/a/zfs_pool.prom", "snapshot=/b/zfs_snapshot.prom"},
+			expected: []textFileOutputConfig{
+				{filename: "/a/zfs_pool.prom", collectors: []string{"pool"}},
+				{filename: "/b/zfs_snapshot.prom", collectors: []string{"snapshot"}},
+			},
+		},
+		{
+			name:     "merged",
+			values:   []string{"snapshot=/a/zfs.prom", "pool=/a/zfs.prom", "snapshot=/a/zfs.prom"},
+			expected: []textFileOutputConfig{{filename: "/a/zfs.prom", collectors: []string{"snapshot", "pool"}}},
+		},
+		{
+			name:     "equal sign in path",
+			values:   []string{"/a/b=c/zfs.prom"},
+			expected: []textFileOutputConfig{{filename: "/a/b=c/zfs.prom", collectors: []string{"pool", "snapshot"}}},
+		},
+		{
+			name:   "unknown collector",
+			values: []string{"arc=/a/zfs.prom"},
+			err:    `unknown collector "arc"`,
+		},
+		{
+			name:   "empty path",
+			values: []string{"pool="},
+			err:    `empty path`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := parseTextFileOutputs(tc.values, collectors)
+			if tc.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestTextFileOutputPartial(t *testing.T) {
+	var (
+		reg     = prometheus.NewRegistry()
+		failing = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return nil, errors.New("zpool status failed")
+		})
+		g = prometheus.Gatherers{reg, failing}
+	)
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_up", Help: "Up."}))
+
+	// a failing collector only leaves out its metrics, the file is written
+	// with the metrics of the other collectors
+	for format, expected := range map[string]string{
+		textFileFormatPrometheus: "zfs_up 0\n",
+		textFileFormatInflux:     "zfs_up gauge=0 ",
+	} {
+		t.Run(format, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "zfs.prom")
+			out := newTextFileOutput(textFileHandler(g, format), filename, time.Minute)
+			out.format = format
+			require.NoError(t, out.write(context.Background()))
+
+			data, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			require.Contains(t, string(data), expected)
+		})
+	}
+}
+
+func TestTextFileOutputsIndependent(t *testing.T) {
+	var (
+		dir       = t.TempDir()
+		poolGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_pool_test"})
+		snapGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_snapshot_test"})
+		newOutput = func(c prometheus.Collector, name string) *textFileOutput {
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+			return newTextFileOutput(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), filepath.Join(dir, name), time.Minute)
+		}
+		poolOutput = newOutput(poolGauge, "zfs_pool.prom")
+		snapOutput = newOutput(snapGauge, "zfs_snapshot.prom")
+		ctx        = context.Background()
+	)
+
+	require.NoError(t, poolOutput.write(ctx))
+	require.NoError(t, snapOutput.write(ctx))
+
+	// a rewrite replaces the file, so compare them to detect which ones get
+	// rewritten
+	poolBefore, err := os.Stat(poolOutput.filename)
+	require.NoError(t, err)
+	snapBefore, err := os.Stat(snapOutput.filename)
+	require.NoError(t, err)
+
+	snapGauge.Set(2)
+	require.NoError(t, poolOutput.write(ctx))
+	require.NoError(t, snapOutput.write(ctx))
+
+	poolAfter, err := os.Stat(poolOutput.filename)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(poolBefore, poolAfter), "unchanged pool output should not be rewritten")
+	snapAfter, err := os.Stat(snapOutput.filename)
+	require.NoError(t, err)
+	require.False(t, os.SameFile(snapBefore, snapAfter))
+
+	data, err := os.ReadFile(snapOutput.filename)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "zfs_snapshot_test 2")
+	require.NotContains(t, string(data), "zfs_pool_test")
+}
+
+func TestContentHash(t *testing.T) {
+	content := []byte(`# HELP zfs_pool_status Status of the pool.
+# TYPE zfs_pool_status gauge
+zfs_pool_status{pool="tank",state="online"} 1
+zfs_exporter_collector_duration_seconds{collector="pool"} 0.0123
+`)
+	hash := contentHash(content, textFileFormatPrometheus)
+	require.Regexp(t, `^[0-9a-f]{64}$`, hash)
+
+	// volatile series and the order of the lines don't matter
+	require.Equal(t, hash, contentHash([]byte(`zfs_exporter_collector_duration_seconds{collector="pool"} 0.456
+zfs_pool_status{pool="tank",state="online"} 1
+# TYPE zfs_pool_status gauge
+# HELP zfs_pool_status Status of the pool.
+`), textFileFormatPrometheus))
+
+	require.NotEqual(t, hash, contentHash([]byte(`# HELP zfs_pool_status Status of the pool.
+# TYPE zfs_pool_status gauge
+zfs_pool_status{pool="tank",state="online"} 0
+`), textFileFormatPrometheus))
+
+	// the timestamps of the line protocol are ignored
+	require.Equal(t,
+		contentHash([]byte("zfs_pool_status,pool=tank,state=online gauge=1 1700000000000000000\nzfs_exporter_collector_duration_seconds,collector=pool gauge=0.1 1700000000000000000\n"), textFileFormatInflux),
+		contentHash([]byte("zfs_pool_status,pool=tank,state=online gauge=1 1700000015000000000\nzfs_exporter_collector_duration_seconds,collector=pool gauge=0.2 1700000015000000000\n"), textFileFormatInflux),
+	)
+	require.NotEqual(t,
+		contentHash([]byte("zfs_pool_status,pool=tank,state=online gauge=1 1700000000000000000\n"), textFileFormatInflux),
+		contentHash([]byte("zfs_pool_status,pool=tank,state=online gauge=0 1700000015000000000\n"), textFileFormatInflux),
+	)
+}
+
+func TestTextFileOutputUnchanged(t *testing.T) {
+	var (
+		filename = filepath.Join(t.TempDir(), "zfs.prom")
+		duration = 0.1
+		handler  = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprintf(w, "zfs_up 1\nzfs_exporter_collector_duration_seconds{collector=\"pool\"} %g\n", duration)
+		})
+		out = newTextFileOutput(handler, filename, time.Minute)
+		ctx = context.Background()
+	)
+
+	require.NoError(t, out.write(ctx))
+	before, err := os.Stat(filename)
+	require.NoError(t, err)
+
+	// age the file, like it would after hours without a change
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filename, old, old))
+
+	// only a volatile series changed, the file is kept but touched
+	duration = 0.2
+	require.NoError(t, out.write(ctx))
+	after, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after), "unchanged output should not be rewritten")
+	require.True(t, after.ModTime().After(old.Add(time.Minute)), "modification time should be refreshed")
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "} 0.1\n")
+
+	// a removed file is written again
+	require.NoError(t, os.Remove(filename))
+	require.NoError(t, out.write(ctx))
+	data, err = os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "} 0.2\n")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+)
+
+// Build information, set via -ldflags "-X main.version=...".
+var (
+	version   = "unknown"
+	revision  = "unknown"
+	branch    = "unknown"
+	buildDate = "unknown"
+)
+
+func printVersion(c *cli.Context) {
+	writeVersion(c.App.Writer, c.App.Name)
+}
+
+// writeVersion writes the build information of the application name to w.
+func writeVersion(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s, version %s (branch: %s, revision: %s)\n", name, version, branch, revision)
+	fmt.Fprintf(w, "  build date: %s\n", buildDate)
+	fmt.Fprintf(w, "  go version: %s\n", runtime.Version())
+}
+
+func newBuildInfoCollector() prometheus.Collector {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "zfs_exporter_build_info",
+		Help: "A metric with a constant '1' value labeled by version, revision, branch, and goversion from which the exporter was built.",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"revision":  revision,
+			"branch":    branch,
+			"goversion": runtime.Version(),
+		},
+	})
+	g.Set(1)
+	return g
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+// watchSettle is the time the table waits after an event, so the snapshot
+// of a creation has been listed.
+const watchSettle = time.Second
+
+var watchCommand = &cli.Command{
+	Name:   "watch",
+	Usage:  "show the pools and the freshness of the snapshots of the datasets as a table refreshing in the terminal",
+	Action: runWatch,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "refresh",
+			Value: 5 * time.Second,
+			Usage: "interval of parsing zpool status and refreshing the table, events refresh it in between",
+		},
+		&cli.IntFlag{
+			Name:  "top",
+			Value: 10,
+			Usage: "number of datasets shown by the age of their last snapshot and by the space used by their snapshots",
+		},
+		&cli.BoolFlag{
+			Name:  "serve",
+			Usage: "serve the metrics on --listen-addr as well",
+		},
+	},
+}
+
+// watchDataset sums up the snapshots of a dataset, which are not excluded.
+type watchDataset struct {
+	host  string
+	name  string
+	count int
+	last  time.Time
+	used  uint64
+}
+
+func watchDatasets(state debugState) []watchDataset {
+	var result []watchDataset
+	for _, t := range state.Targets {
+		if t.Snapshot == nil {
+			continue
+		}
+		for name, snapshots := range t.Snapshot.Datasets {
+			d := watchDataset{host: t.Host, name: name}
+			for _, snap := range snapshots {
+				if snap.Excluded {
+					continue
+				}
+				d.count++
+				d.used += snap.Used
+				if snap.Creation.After(d.last) {
+					d.last = snap.Creation
+				}
+			}
+			if d.count > 0 {
+				result = append(result, d)
+			}
+		}
+	}
+	return result
+}
+
+// formatAge formats the age d, ages of a day or more only in days and hours.
+func formatAge(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), d%(24*time.Hour)/time.Hour)
+	}
+	return d.Truncate(time.Second).String()
+}
+
+// formatBytes formats b in binary units.
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// renderWatch writes the table of the pools and of the top datasets by the
+// age of their last snapshot and by the space used by their snapshots of
+// state at now. The host columns are only shown for remote targets.
+func renderWatch(w io.Writer, state debugState, now time.Time, top int) error {
+	var hosts bool
+	for _, t := range state.Targets {
+		if t.Host != "" {
+			hosts = true
+		}
+	}
+	row := func(tw io.Writer, host string, columns ...interface{}) {
+		if hosts {
+			fmt.Fprintf(tw, "%s\t", host)
+		}
+		for i, c := range columns {
+			sep := "\t"
+			if i == len(columns)-1 {
+				sep = "\n"
+			}
+			fmt.Fprintf(tw, "%v%s", c, sep)
+		}
+	}
+
+	fmt.Fprintf(w, "zfs-event-exporter watch at %s\n\n", now.Format(time.RFC3339))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	row(tw, "HOST", "POOL", "HEALTH", "READ", "WRITE", "CKSUM", "LAST SCRUB")
+	for _, t := range state.Targets {
+		if t.Pool == nil {
+			continue
+		}
+		for _, p := range t.Pool.Pools {
+			scrub := "-"
+			if p.LastScrub != nil {
+				scrub = formatAge(now.Sub(*p.LastScrub)) + " ago"
+			}
+			row(tw, t.Host, p.Name, p.Health, p.Errors.Read, p.Errors.Write, p.Errors.Checksum, scrub)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, t := range state.Targets {
+		if t.Pool != nil && t.Pool.LastError != "" {
+			fmt.Fprintf(w, "%s\n", hostPrefix(t.Host, t.Pool.LastError))
+		}
+		if t.Snapshot != nil {
+			if status := watchSnapshotStatus(t.Snapshot.Status); status != "" {
+				fmt.Fprintf(w, "%s\n", hostPrefix(t.Host, status))
+			}
+		}
+	}
+
+	datasets := watchDatasets(state)
+	table := func(title string, less func(a, b watchDataset) bool) error {
+		sort.Slice(datasets, func(i, j int) bool {
+			if less(datasets[i], datasets[j]) {
+				return true
+			}
+			if less(datasets[j], datasets[i]) {
+				return false
+			}
+			if datasets[i].host != datasets[j].host {
+				return datasets[i].host < datasets[j].host
+			}
+			return datasets[i].name < datasets[j].name
+		})
+
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		row(tw, "HOST", title, "SNAPSHOTS", "LAST SNAPSHOT", "USED")
+		for i, d := range datasets {
+			if i >= top {
+				break
+			}
+			row(tw, d.host, d.name, d.count, formatAge(now.Sub(d.last))+" ago", formatBytes(d.used))
+		}
+		return tw.Flush()
+	}
+	if err := table("STALEST DATASETS", func(a, b watchDataset) bool { return a.last.Before(b.last) }); err != nil {
+		return err
+	}
+	return table("LARGEST DATASETS", func(a, b watchDataset) bool { return a.used > b.used })
+}
+
+func hostPrefix(host, s string) string {
+	if host == "" {
+		return s
+	}
+	return host + ": " + s
+}
+
+// watchSnapshotStatus describes why the snapshots might be incomplete or
+// outdated, it is empty while they are followed.
+func watchSnapshotStatus(s snapshot.Status) string {
+	switch {
+	case !s.InitialListingDone:
+		return "the initial snapshot listing has not completed"
+	case !s.EventStreamUp && s.Mode == snapshot.ModePoll:
+		return fmt.Sprintf("polling snapshots is failing since %s", s.EventStreamChanged.Format(time.RFC3339))
+	case !s.EventStreamUp:
+		return fmt.Sprintf("zpool events stream is down since %s", s.EventStreamChanged.Format(time.RFC3339))
+	}
+	return ""
+}
+
+func runWatch(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	refresh := c.Duration("refresh")
+	if refresh < time.Second {
+		return fmt.Errorf("refresh interval must be at least 1s, got %s", refresh)
+	}
+	top := c.Int("top")
+	if top < 1 {
+		return fmt.Errorf("number of datasets must be at least 1, got %d", top)
+	}
+
+	targets, err := newExporterTargets(ctx, c, true)
+	if err != nil {
+		return err
+	}
+	shared := targets.newSharedGatherers()
+
+	var wg sync.WaitGroup
+	defer func() {
+		stop()
+		wg.Wait()
+		targets.wait()
+	}()
+
+	if c.Bool("serve") {
+		if err := serveWatch(ctx, c, targets, shared, &wg); err != nil {
+			return err
+		}
+	}
+
+	// events refresh the table, once they have been applied
+	changed := make(chan struct{}, 1)
+	for _, e := range targets {
+		e := e
+		e.snapshot.Observe(func(*events.Event) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.snapshot.Run(ctx); err != nil {
+				logger.Error().Err(err).Msg("snapshot collector failed")
+			}
+		}()
+	}
+
+	w := c.App.Writer
+	f, ok := w.(*os.File)
+	tty := ok && term.IsTerminal(int(f.Fd()))
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	// events only change the snapshots, so zpool status only runs initially
+	// and on every refresh
+	gatherPools := true
+	for {
+		// the pool collectors only parse zpool status when they are
+		// collected
+		if gatherPools {
+			if _, err := shared["pool"].Gather(); err != nil {
+				logger.Debug().Err(err).Msg("failed to gather the pool status")
+			}
+		}
+
+		if tty {
+			// move to the top left and clear the screen
+			fmt.Fprint(w, "\x1b[H\x1b[2J")
+		} else {
+			fmt.Fprintln(w)
+		}
+		if err := renderWatch(w, newDebugState(targets, ""), time.Now(), top); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			gatherPools = true
+		case <-changed:
+			gatherPools = false
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(watchSettle):
+			}
+		}
+	}
+}
+
+// serveWatch serves the metrics of targets on --listen-addr until ctx is
+// cancelled.
+func serveWatch(ctx context.Context, c *cli.Context, targets exporterTargets, shared map[string]prometheus.Gatherer, wg *sync.WaitGroup) error {
+	socketMode, err := parseFileMode(c.String("listen-socket-mode"))
+	if err != nil {
+		return err
+	}
+	web, err := loadWebConfig(c.String("web.config.file"))
+	if err != nil {
+		return err
+	}
+	listeners, err := openListeners(c.String("listen-addr"), socketMode)
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("--serve requires --listen-addr")
+	}
+
+	mux := http.NewServeMux()
+	metricsHandler, _ := newMetricsHandler(targets.gatherer(shared, targets.names()), 0)
+	mux.Handle("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	srv := &http.Server{TLSConfig: web.tlsConfig(), Handler: web.handler(recoverHandler(mux))}
+
+	for _, l := range listeners {
+		l := l
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveHTTP(web, srv, l); err != nil {
+				logger.Error().Msgf("error serving http: %v", err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.Duration("shutdown.grace-period"))
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Error().Msgf("error shutting down http server: %v", err)
+		}
+	}()
+	return nil
+}
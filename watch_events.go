@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+var watchEventsCommand = &cli.Command{
+	Name:   "watch-events",
+	Usage:  "print parsed ZFS events as JSON lines to stdout",
+	Action: watchEvents,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "events-file",
+			Usage: "read events from a file in the format of `zpool events -H -v` instead of following zpool events",
+		},
+		&cli.StringSliceFlag{
+			Name:  "class",
+			Usage: "only print events with a class matching the pattern (e.g. sysevent.fs.zfs.history_event or ereport.*)",
+		},
+		&cli.BoolFlag{
+			Name:  "raw",
+			Usage: "include all fields of the event",
+		},
+	},
+}
+
+type watchEvent struct {
+	Time                time.Time         `json:"time"`
+	Class               string            `json:"class"`
+	Pool                string            `json:"pool,omitempty"`
+	HistoryInternalName string            `json:"history_internal_name,omitempty"`
+	HistoryDSName       string            `json:"history_dsname,omitempty"`
+	Fields              map[string]string `json:"fields,omitempty"`
+}
+
+func matchClass(patterns []string, class string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, class); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeEvents(w io.Writer, ch <-chan *events.Event, classes []string) error {
+	enc := json.NewEncoder(w)
+	for e := range ch {
+		if !matchClass(classes, e.Class) {
+			continue
+		}
+		if err := enc.Encode(&watchEvent{
+			Time:                e.Time.UTC(),
+			Class:               e.Class,
+			Pool:                e.Pool,
+			HistoryInternalName: e.HistoryInternalName,
+			HistoryDSName:       e.HistoryDSName,
+			Fields:              e.Fields,
+		}); err != nil {
+			return fmt.Errorf("error writing event: %w", err)
+		}
+	}
+	return nil
+}
+
+func watchEvents(c *cli.Context) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var (
+		ch      = make(chan *events.Event)
+		errCh   = make(chan error, 1)
+		classes = stringSlice(c, "class")
+		raw     = c.Bool("raw")
+	)
+
+	for _, p := range classes {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid class pattern %q: %w", p, err)
+		}
+	}
+
+	if filename := c.String("events-file"); filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf("error opening events file: %w", err)
+		}
+		defer f.Close()
+
+		go func() {
+			defer close(ch)
+			errCh <- events.Parse(f, ch, raw)
+		}()
+	} else {
+		follower, err := events.StartFollow(ctx, command.NewRunner(command.DefaultTimeout))
+		if err != nil {
+			return fmt.Errorf("failed to start zpool events: %w", err)
+		}
+		go func() {
+			errCh <- follower.Run(ch, raw)
+		}()
+	}
+
+	if err := writeEvents(c.App.Writer, ch, classes); err != nil {
+		return err
+	}
+
+	// the process gets killed on interrupt, which is not an error
+	if err := <-errCh; err != nil && ctx.Err() == nil {
+		return fmt.Errorf("error reading events: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+const testEvents = `Nov 23 2023 03:45:52.593086010	sysevent.fs.zfs.history_event
+        class = "sysevent.fs.zfs.history_event"
+        pool = "pool-hdd"
+        history_dsname = "pool-hdd/backup/var@zrepl_20231122_231701_000"
+        history_internal_name = "snapshot"
+        time = 0x655ecaf0 0x235a1d7a 
+
+Nov 23 2023 03:46:01.000000000	ereport.fs.zfs.checksum
+        class = "ereport.fs.zfs.checksum"
+        pool = "pool-hdd"
+        vdev_path = "/dev/sda"
+        time = 0x655ecaf9 0x0 
+
+`
+
+func runWatchEvents(t *testing.T, args ...string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "events.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(testEvents), 0o644))
+
+	var out bytes.Buffer
+	app := &cli.App{
+		Writer:   &out,
+		Commands: []*cli.Command{watchEventsCommand},
+	}
+	require.NoError(t, app.Run(append([]string{"zfs-event-exporter", "watch-events", "--events-file", filename}, args...)))
+	return out.String()
+}
+
+func TestWatchEvents(t *testing.T) {
+	t.Run("all events", func(t *testing.T) {
+		require.Equal(t, `{"time":"2023-11-23T03:45:52.593108346Z","class":"sysevent.fs.zfs.history_event","pool":"pool-hdd","history_internal_name":"snapshot","history_dsname":"pool-hdd/backup/var@zrepl_20231122_231701_000"}
+{"time":"2023-11-23T03:46:01Z","class":"ereport.fs.zfs.checksum","pool":"pool-hdd"}
+`, runWatchEvents(t))
+	})
+
+	t.Run("class filter", func(t *testing.T) {
+		require.Equal(t, `{"time":"2023-11-23T03:46:01Z","class":"ereport.fs.zfs.checksum","pool":"pool-hdd"}
+`, runWatchEvents(t, "--class", "ereport.*"))
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		require.Equal(t, `{"time":"2023-11-23T03:46:01Z","class":"ereport.fs.zfs.checksum","pool":"pool-hdd","fields":{"class":"ereport.fs.zfs.checksum","pool":"pool-hdd","time":"0x655ecaf9 0x0","vdev_path":"/dev/sda"}}
+`, runWatchEvents(t, "--class", "ereport.fs.zfs.checksum", "--raw"))
+	})
+}
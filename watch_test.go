@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/pool"
+	"github.com/simonswine/zfs-event-exporter/zfs/snapshot"
+)
+
+func TestRenderWatch(t *testing.T) {
+	var (
+		now   = time.Date(2023, 11, 23, 12, 0, 0, 0, time.UTC)
+		scrub = now.Add(-50 * time.Hour)
+	)
+	state := debugState{Targets: []debugTargetState{{
+		Pool: &pool.State{
+			LastSuccess: now,
+			Pools: []pool.PoolState{
+				{Name: "tank", Health: "ONLINE", LastScrub: &scrub},
+				{Name: "tank/mirror-0", Health: "ONLINE"},
+				{Name: "backup", Health: "DEGRADED", Errors: pool.Errors{Checksum: 3}},
+			},
+		},
+		Snapshot: &snapshot.State{
+			Status: snapshot.Status{Mode: snapshot.ModeEvents, InitialListingDone: true, EventStreamUp: true},
+			Datasets: map[string][]snapshot.Snapshot{
+				"tank/data": {
+					{Name: "a", Creation: now.Add(-2 * time.Hour), Used: 1024},
+					{Name: "b", Creation: now.Add(-time.Hour), Used: 2048},
+				},
+				"tank/home": {
+					{Name: "a", Creation: now.Add(-30 * time.Hour), Used: 3 << 30},
+				},
+				"tank/logs": {
+					{Name: "a", Creation: now.Add(-90 * time.Minute), Used: 1 << 20},
+					{Name: "manual", Creation: now.Add(-time.Minute), Used: 10 << 30, Excluded: true},
+				},
+				"tank/tmp": {
+					{Name: "manual", Creation: now, Excluded: true},
+				},
+			},
+		},
+	}}}
+
+	t.Run("all datasets", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, renderWatch(&out, state, now, 10))
+		require.Equal(t, `zfs-event-exporter watch at 2023-11-23T12:00:00Z
+
+POOL           HEALTH    READ  WRITE  CKSUM  LAST SCRUB
+tank           ONLINE    0     0      0      2d2h ago
+tank/mirror-0  ONLINE    0     0      0      -
+backup         DEGRADED  0     0      3      -
+
+STALEST DATASETS  SNAPSHOTS  LAST SNAPSHOT  USED
+tank/home         1          1d6h ago       3.0GiB
+tank/logs         1          1h30m0s ago    1.0MiB
+tank/data         2          1h0m0s ago     3.0KiB
+
+LARGEST DATASETS  SNAPSHOTS  LAST SNAPSHOT  USED
+tank/home         1          1d6h ago       3.0GiB
+tank/logs         1          1h30m0s ago    1.0MiB
+tank/data         2          1h0m0s ago     3.0KiB
+`, out.String())
+	})
+
+	t.Run("top datasets", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, renderWatch(&out, state, now, 1))
+		require.Contains(t, out.String(), `
+STALEST DATASETS  SNAPSHOTS  LAST SNAPSHOT  USED
+tank/home         1          1d6h ago       3.0GiB
+
+LARGEST DATASETS  SNAPSHOTS  LAST SNAPSHOT  USED
+tank/home         1          1d6h ago       3.0GiB
+`)
+	})
+
+	t.Run("remote targets", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, renderWatch(&out, debugState{Targets: []debugTargetState{
+			{
+				Host:     "nas1",
+				Pool:     &pool.State{LastError: "error running zpool status: exit status 1"},
+				Snapshot: &snapshot.State{Status: snapshot.Status{Mode: snapshot.ModeEvents}},
+			},
+			{
+				Host: "nas2",
+				Pool: &pool.State{Pools: []pool.PoolState{{Name: "tank", Health: "ONLINE"}}},
+				Snapshot: &snapshot.State{
+					Status: snapshot.Status{Mode: snapshot.ModePoll, InitialListingDone: true, EventStreamChanged: now.Add(-time.Minute)},
+					Datasets: map[string][]snapshot.Snapshot{
+						"tank/data": {{Name: "a", Creation: now.Add(-time.Hour), Used: 512}},
+					},
+				},
+			},
+		}}, now, 10))
+		require.Equal(t, `zfs-event-exporter watch at 2023-11-23T12:00:00Z
+
+HOST  POOL  HEALTH  READ  WRITE  CKSUM  LAST SCRUB
+nas2  tank  ONLINE  0     0      0      -
+nas1: error running zpool status: exit status 1
+nas1: the initial snapshot listing has not completed
+nas2: polling snapshots is failing since 2023-11-23T11:59:00Z
+
+HOST  STALEST DATASETS  SNAPSHOTS  LAST SNAPSHOT  USED
+nas2  tank/data         1          1h0m0s ago     512B
+
+HOST  LARGEST DATASETS  SNAPSHOTS  LAST SNAPSHOT  USED
+nas2  tank/data         1          1h0m0s ago     512B
+`, out.String())
+	})
+}
+
+func TestFormatAge(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		-time.Second:                   "0s",
+		1500 * time.Millisecond:        "1s",
+		90 * time.Minute:               "1h30m0s",
+		24 * time.Hour:                 "1d0h",
+		50*time.Hour + 59*time.Minute:  "2d2h",
+		400*24*time.Hour + 5*time.Hour: "400d5h",
+	} {
+		require.Equal(t, expected, formatAge(d), d.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for b, expected := range map[uint64]string{
+		0:          "0B",
+		1023:       "1023B",
+		1024:       "1.0KiB",
+		1536 << 20: "1.5GiB",
+		5 << 40:    "5.0TiB",
+		1<<64 - 1:  "16.0EiB",
+	} {
+		require.Equal(t, expected, formatBytes(b))
+	}
+}
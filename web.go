@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the content of the file passed via --web.config.file. Its
+// format follows the Prometheus exporter-toolkit web configuration.
+type webConfig struct {
+	TLSServerConfig *tlsServerConfig  `yaml:"tls_server_config" json:"tls_server_config,omitempty"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users" json:"basic_auth_users,omitempty"`
+
+	// HTTPClientConfig is used for requests issued by the exporter, like
+	// pushes to a Pushgateway. It is not part of the exporter-toolkit format.
+	HTTPClientConfig *httpClientConfig `yaml:"http_client_config" json:"http_client_config,omitempty"`
+}
+
+type tlsServerConfig struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
+
+type httpClientConfig struct {
+	BasicAuth *basicAuth       `yaml:"basic_auth" json:"basic_auth,omitempty"`
+	TLSConfig *tlsClientConfig `yaml:"tls_config" json:"tls_config,omitempty"`
+}
+
+type basicAuth struct {
+	Username     string `yaml:"username" json:"username"`
+	Password     string `yaml:"password" json:"password,omitempty"`
+	PasswordFile string `yaml:"password_file" json:"password_file,omitempty"`
+}
+
+type tlsClientConfig struct {
+	CAFile             string `yaml:"ca_file" json:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file" json:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file" json:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name" json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+var (
+	dummyPasswordHashOnce sync.Once
+	dummyPasswordHashData []byte
+)
+
+// dummyPasswordHash is used to spend the same time on unknown users as on
+// known ones. It is only computed once the first unknown user needs it, so
+// exporters without basic auth don't pay for it at start up.
+func dummyPasswordHash() []byte {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHashData, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+	})
+	return dummyPasswordHashData
+}
+
+func loadWebConfig(filename string) (*webConfig, error) {
+	cfg := new(webConfig)
+	if filename == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading web config: %w", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing web config: %w", err)
+	}
+
+	if t := cfg.TLSServerConfig; t != nil {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, fmt.Errorf("tls_server_config requires cert_file and key_file")
+		}
+	}
+
+	for user, hash := range cfg.BasicAuthUsers {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for user %q: %w", user, err)
+		}
+	}
+
+	if c := cfg.HTTPClientConfig; c != nil {
+		if b := c.BasicAuth; b != nil && b.Password != "" && b.PasswordFile != "" {
+			return nil, fmt.Errorf("basic_auth accepts only one of password and password_file")
+		}
+		if t := c.TLSConfig; t != nil && (t.CertFile == "") != (t.KeyFile == "") {
+			return nil, fmt.Errorf("tls_config requires both cert_file and key_file")
+		}
+	}
+
+	return cfg, nil
+}
+
+// redacted returns a copy of the web config with the password hashes of the
+// users and the password of the HTTP client replaced by redactedValue.
+func (w *webConfig) redacted() *webConfig {
+	result := *w
+	if w.BasicAuthUsers != nil {
+		result.BasicAuthUsers = make(map[string]string, len(w.BasicAuthUsers))
+		for user := range w.BasicAuthUsers {
+			result.BasicAuthUsers[user] = redactedValue
+		}
+	}
+	if c := w.HTTPClientConfig; c != nil && c.BasicAuth != nil {
+		clientConfig := *c
+		auth := *c.BasicAuth
+		if auth.Password != "" {
+			auth.Password = redactedValue
+		}
+		clientConfig.BasicAuth = &auth
+		result.HTTPClientConfig = &clientConfig
+	}
+	return &result
+}
+
+func (w *webConfig) tlsConfig() *tls.Config {
+	if w.TLSServerConfig == nil {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// serve accepts connections on l with TLS, if it is configured.
+func (w *webConfig) serve(srv *http.Server, l net.Listener) error {
+	if w.TLSServerConfig == nil {
+		return srv.Serve(l)
+	}
+	return srv.ServeTLS(l, w.TLSServerConfig.CertFile, w.TLSServerConfig.KeyFile)
+}
+
+// basicAuth returns the credentials of the http client config.
+func (w *webConfig) basicAuth() (user, password string, ok bool, err error) {
+	if w.HTTPClientConfig == nil || w.HTTPClientConfig.BasicAuth == nil {
+		return "", "", false, nil
+	}
+	b := w.HTTPClientConfig.BasicAuth
+	if b.PasswordFile == "" {
+		return b.Username, b.Password, true, nil
+	}
+	data, err := os.ReadFile(b.PasswordFile)
+	if err != nil {
+		return "", "", false, fmt.Errorf("error reading password file: %w", err)
+	}
+	return b.Username, strings.TrimSpace(string(data)), true, nil
+}
+
+// httpClient returns a client for requests issued by the exporter, using the
+// TLS settings of the http client config.
+func (w *webConfig) httpClient() (*http.Client, error) {
+	cfg, err := w.clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return &http.Client{}, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport}, nil
+}
+
+// clientTLSConfig returns the TLS settings of the http client config or nil,
+// if there are none.
+func (w *webConfig) clientTLSConfig() (*tls.Config, error) {
+	if w.HTTPClientConfig == nil || w.HTTPClientConfig.TLSConfig == nil {
+		return nil, nil
+	}
+	t := w.HTTPClientConfig.TLSConfig
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (w *webConfig) authenticate(user, password string) bool {
+	hash, ok := w.BasicAuthUsers[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+type internalRequestKey struct{}
+
+// newInternalRequest creates a request, which is issued by the exporter
+// itself (e.g. for the text file output) and is exempt from authentication.
+func newInternalRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	return http.NewRequestWithContext(context.WithValue(ctx, internalRequestKey{}, true), method, url, nil)
+}
+
+func isInternalRequest(r *http.Request) bool {
+	v, _ := r.Context().Value(internalRequestKey{}).(bool)
+	return v
+}
+
+// handler wraps next with the basic authentication configured.
+func (w *webConfig) handler(next http.Handler) http.Handler {
+	if len(w.BasicAuthUsers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok || !w.authenticate(user, password) {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="zfs-event-exporter", charset="UTF-8"`)
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// recoverHandler recovers panics of next, logs them with their stack and
+// responds with 500.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logger.Error().
+				Str("path", r.URL.Path).
+				Str("panic", fmt.Sprint(err)).
+				Str("stack", string(debug.Stack())).
+				Msg("recovered panic in HTTP handler")
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testWebConfigFile writes a web config, which requires the user prometheus
+// with password secret.
+func testWebConfigFile(t *testing.T) string {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	filename := filepath.Join(t.TempDir(), "web.yml")
+	require.NoError(t, os.WriteFile(filename, []byte("basic_auth_users:\n  prometheus: "+string(hash)+"\n"), 0o600))
+	return filename
+}
+
+func testWebConfig(t *testing.T) *webConfig {
+	t.Helper()
+
+	cfg, err := loadWebConfig(testWebConfigFile(t))
+	require.NoError(t, err)
+	return cfg
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("zfs_up 1\n"))
+})
+
+func TestWebConfigBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(testWebConfig(t).handler(okHandler))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name           string
+		user, password string
+		expectedStatus int
+	}{
+		{name: "no credentials", expectedStatus: http.StatusUnauthorized},
+		{name: "valid credentials", user: "prometheus", password: "secret", expectedStatus: http.StatusOK},
+		{name: "wrong password", user: "prometheus", password: "wrong", expectedStatus: http.StatusUnauthorized},
+		{name: "unknown user", user: "grafana", password: "secret", expectedStatus: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", srv.URL+"/metrics", nil)
+			require.NoError(t, err)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus == http.StatusUnauthorized {
+				require.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+			}
+		})
+	}
+}
+
+func TestWebConfigTextFileBypass(t *testing.T) {
+	handler := testWebConfig(t).handler(okHandler)
+
+	// a request which is not marked as internal needs authentication
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	filename := filepath.Join(t.TempDir(), "zfs.prom")
+	require.NoError(t, newTextFileOutput(handler, filename, time.Minute).write(context.Background()))
+
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, "zfs_up 1\n", string(data))
+}
+
+func TestWebConfigInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "web.yml")
+	require.NoError(t, os.WriteFile(filename, []byte("basic_auth_users:\n  prometheus: plaintext\n"), 0o600))
+
+	_, err := loadWebConfig(filename)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid bcrypt hash for user "prometheus"`)
+}
+
+func TestRecoverHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) {
+		panic("handler bug")
+	})
+	mux.HandleFunc("/healthz", healthzHandler)
+	h := recoverHandler(mux)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// aborted responses are passed on to the HTTP server
+	mux.HandleFunc("/abort", func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+	})
+}
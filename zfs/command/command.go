@@ -0,0 +1,604 @@
+// Package command runs the zfs and zpool executables and records metrics about
+// their invocations.
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultTimeout is used for commands without a specific timeout.
+	DefaultTimeout = 30 * time.Second
+
+	// maxStderr limits the amount of stderr kept for error messages.
+	maxStderr = 4096
+
+	// waitDelay bounds the time to wait for a process to exit after it has
+	// been asked to terminate.
+	waitDelay = 5 * time.Second
+)
+
+// Failure reasons used for the failures metric.
+const (
+	ReasonStart    = "start"
+	ReasonExit     = "exit"
+	ReasonTimeout  = "timeout"
+	ReasonCanceled = "canceled"
+	ReasonStuck    = "stuck"
+)
+
+// ErrPermission is returned for commands, which failed due to missing
+// permissions.
+var ErrPermission = errors.New("insufficient permissions, run as root or check access to /dev/zfs")
+
+// ErrStuck is returned for commands, which didn't exit after being killed,
+// e.g. as they are blocked in uninterruptible sleep on a suspended pool. Until
+// the process exits, the command isn't started again.
+var ErrStuck = errors.New("process did not exit after being killed")
+
+// ErrUnavailable is returned for commands, which failed as ZFS is not
+// available, e.g. because the kernel module is not loaded or zfs and zpool are
+// not installed.
+var ErrUnavailable = errors.New("ZFS is not available, the kernel module is not loaded")
+
+// permissionMessages are the stderr messages of zfs and zpool about missing
+// permissions.
+var permissionMessages = []string{
+	"permission denied",
+	"operation not permitted",
+	"must be root",
+}
+
+// isPermissionDenied reports whether stderr indicates missing permissions.
+func isPermissionDenied(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, m := range permissionMessages {
+		if strings.Contains(stderr, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// unavailableMessages are the stderr messages of zfs and zpool, when the
+// kernel module is not loaded.
+var unavailableMessages = []string{
+	"the zfs modules are not loaded",
+	"the zfs modules cannot be auto-loaded",
+	"/dev/zfs and /proc/self/mounts are required",
+}
+
+// isUnavailable reports whether stderr indicates that ZFS is not available.
+func isUnavailable(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, m := range unavailableMessages {
+		if strings.Contains(stderr, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandRunner runs zfs and zpool commands. The collectors depend on it
+// rather than on Runner, so tests can run them against scripted output.
+type CommandRunner interface {
+	// Run runs a command to completion and returns its stdout.
+	Run(ctx context.Context, name string, args ...string) (io.Reader, error)
+	// Start starts a long running command.
+	Start(ctx context.Context, name string, args ...string) (*Process, error)
+}
+
+// Output runs a command using runner and returns all of its stdout.
+func Output(ctx context.Context, runner CommandRunner, name string, args ...string) ([]byte, error) {
+	r, err := runner.Run(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// Runner runs commands with timeouts and records their duration, failures and
+// the number of commands in flight. It keeps track of processes, which didn't
+// exit after being killed. Identical commands running concurrently share a
+// single process and all commands can be limited to a rate.
+type Runner struct {
+	executor  Executor
+	waitDelay time.Duration
+	group     singleflight.Group
+
+	mtx            sync.Mutex
+	defaultTimeout time.Duration
+	timeouts       map[string]time.Duration
+	stuck          map[string]int
+	// unavailable is set, while the last finished command failed with
+	// ErrUnavailable
+	unavailable bool
+	limiter     *rate.Limiter
+
+	metricDuration     *prometheus.HistogramVec
+	metricFailures     *prometheus.CounterVec
+	metricInflight     *prometheus.GaugeVec
+	metricStuck        *prometheus.GaugeVec
+	metricDeduplicated *prometheus.CounterVec
+	metricThrottled    *prometheus.CounterVec
+}
+
+var _ CommandRunner = (*Runner)(nil)
+
+// Cmd is a command prepared by an Executor.
+type Cmd interface {
+	// Start starts the command and returns its stdout.
+	Start() (io.Reader, error)
+	// Wait waits for the command to exit, after stdout has been read.
+	Wait() error
+	// Kill stops the command immediately.
+	Kill() error
+}
+
+// Executor prepares commands, which are terminated once ctx is cancelled.
+type Executor interface {
+	Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd
+}
+
+// NewRunner creates a runner for local commands, which applies defaultTimeout
+// to all commands without a specific timeout.
+func NewRunner(defaultTimeout time.Duration) *Runner {
+	return NewRunnerWithExecutor(LocalExecutor{}, defaultTimeout)
+}
+
+// NewRunnerWithExecutor creates a runner, which uses executor to run the
+// commands.
+func NewRunnerWithExecutor(executor Executor, defaultTimeout time.Duration) *Runner {
+	return &Runner{
+		executor:       executor,
+		waitDelay:      waitDelay,
+		defaultTimeout: defaultTimeout,
+		timeouts:       make(map[string]time.Duration),
+		stuck:          make(map[string]int),
+		metricDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "zfs_exporter_command_duration_seconds",
+			Help:    "Duration of executed commands.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60},
+		}, []string{"command"}),
+		metricFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zfs_exporter_command_failures_total",
+			Help: "Total count of failed commands by reason.",
+		}, []string{"command", "reason"}),
+		metricInflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zfs_exporter_commands_inflight",
+			Help: "Number of commands currently running.",
+		}, []string{"command"}),
+		metricStuck: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "zfs_exporter_commands_stuck",
+			Help: "Number of processes, which outlived their deadline and did not exit after being killed.",
+		}, []string{"command"}),
+		metricDeduplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zfs_exporter_commands_deduplicated_total",
+			Help: "Total count of commands, which were not started as an identical command was already running.",
+		}, []string{"command"}),
+		metricThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zfs_exporter_commands_throttled_total",
+			Help: "Total count of commands, which were delayed by the rate limit.",
+		}, []string{"command"}),
+	}
+}
+
+// SetRateLimit limits the rate commands are started at. The limiter may be
+// shared by several runners, e.g. to bound the commands of all targets. A nil
+// limiter removes the limit.
+func (r *Runner) SetRateLimit(limiter *rate.Limiter) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.limiter = limiter
+}
+
+// wait waits until the rate limit allows to start command. It fails once ctx
+// is done before.
+func (r *Runner) wait(ctx context.Context, command string) error {
+	r.mtx.Lock()
+	limiter := r.limiter
+	r.mtx.Unlock()
+	if limiter == nil {
+		return nil
+	}
+
+	reservation := limiter.Reserve()
+	if !reservation.OK() {
+		return fmt.Errorf("%s not started, the rate limit doesn't allow any command", command)
+	}
+	delay := reservation.Delay()
+	if delay <= 0 {
+		return nil
+	}
+	r.metricThrottled.WithLabelValues(command).Inc()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		r.metricFailures.WithLabelValues(command, ReasonCanceled).Inc()
+		return fmt.Errorf("%s not started, waiting for the rate limit: %w", command, ctx.Err())
+	}
+}
+
+// SetTimeout sets the timeout of a command, which is identified by the
+// executable and its first argument, e.g. "zpool status".
+func (r *Runner) SetTimeout(command string, timeout time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.timeouts[command] = timeout
+}
+
+func (r *Runner) timeout(command string) time.Duration {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if t, ok := r.timeouts[command]; ok {
+		return t
+	}
+	return r.defaultTimeout
+}
+
+// isStuck reports whether a previous invocation of command is stuck.
+func (r *Runner) isStuck(command string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.stuck[command] > 0
+}
+
+// addStuck records a change of the number of stuck processes of command.
+func (r *Runner) addStuck(command string, delta int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.stuck[command] += delta
+	if r.stuck[command] == 0 {
+		delete(r.stuck, command)
+	}
+	r.metricStuck.WithLabelValues(command).Add(float64(delta))
+}
+
+// Name returns the name of a command as used in the metrics and for timeouts.
+func Name(name string, args ...string) string {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return name
+	}
+	return name + " " + args[0]
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if n := b.max - b.buf.Len(); n > 0 {
+		if len(p) > n {
+			b.buf.Write(p[:n])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return strings.TrimSpace(b.buf.String())
+}
+
+// LocalExecutor runs commands on the local host.
+type LocalExecutor struct{}
+
+type localCmd struct {
+	cmd *exec.Cmd
+}
+
+// Command prepares a command in its own process group, so children of wrapper
+// scripts are terminated as well. The C locale is forced, so the output can
+// be parsed regardless of the locale of the exporter.
+func (LocalExecutor) Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = waitDelay
+	cmd.Stderr = stderr
+	return &localCmd{cmd: cmd}
+}
+
+func (c *localCmd) Start() (io.Reader, error) {
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return stdout, nil
+}
+
+func (c *localCmd) Wait() error {
+	return c.cmd.Wait()
+}
+
+func (c *localCmd) Kill() error {
+	return syscall.Kill(-c.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func (r *Runner) setUnavailable(unavailable bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.unavailable = unavailable
+}
+
+// Available reports whether ZFS is available. It is false, while the last
+// finished command failed with ErrUnavailable, and true before any command
+// finished.
+func (r *Runner) Available() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return !r.unavailable
+}
+
+// finish records the metrics of a finished command and adds context to err.
+// Unless started is set, the command failed to start.
+func (r *Runner) finish(ctx context.Context, command string, start time.Time, started bool, err error, stderr *limitedBuffer) error {
+	var reason string
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		reason = ReasonTimeout
+		err = fmt.Errorf("timed out: %w", err)
+	case errors.Is(ctx.Err(), context.Canceled):
+		reason = ReasonCanceled
+	case !started:
+		reason = ReasonStart
+	default:
+		reason = ReasonExit
+	}
+
+	// a command which couldn't be started has no meaningful duration
+	if started {
+		r.metricDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	}
+	if err == nil {
+		r.setUnavailable(false)
+		return nil
+	}
+	r.metricFailures.WithLabelValues(command, reason).Inc()
+
+	if reason == ReasonStart && errors.Is(err, exec.ErrNotFound) {
+		r.setUnavailable(true)
+		return fmt.Errorf("%s failed: %w: %w", command, err, ErrUnavailable)
+	}
+	if s := stderr.String(); s != "" {
+		if reason == ReasonExit && isUnavailable(s) {
+			r.setUnavailable(true)
+			return fmt.Errorf("%s failed: %w: %s: %w", command, err, strings.TrimSpace(s), ErrUnavailable)
+		}
+		if reason == ReasonExit && isPermissionDenied(s) {
+			return fmt.Errorf("%s failed: %w: %s: %w", command, err, strings.TrimSpace(s), ErrPermission)
+		}
+		return fmt.Errorf("%s failed: %w: %s", command, err, s)
+	}
+	return fmt.Errorf("%s failed: %w", command, err)
+}
+
+// output is the result of a command run by Output.
+type output struct {
+	stdout []byte
+	err    error
+}
+
+// await waits for the result of cmd. Once ctx is done, the process gets
+// waitDelay to terminate before it is killed and another waitDelay to exit.
+// It returns false for a process, which is stuck.
+func (r *Runner) await(ctx context.Context, cmd Cmd, done <-chan output) (output, bool) {
+	select {
+	case out := <-done:
+		return out, true
+	case <-ctx.Done():
+	}
+
+	select {
+	case out := <-done:
+		return out, true
+	case <-time.After(r.waitDelay):
+	}
+
+	_ = cmd.Kill()
+	select {
+	case out := <-done:
+		return out, true
+	case <-time.After(r.waitDelay):
+		return output{}, false
+	}
+}
+
+// Run runs a command like Output and returns a reader of its stdout.
+func (r *Runner) Run(ctx context.Context, name string, args ...string) (io.Reader, error) {
+	out, err := r.Output(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// Output runs a command with its timeout and returns its stdout. While a
+// previous invocation of the command is stuck, it fails with ErrStuck without
+// starting another process.
+//
+// Callers running the same command with the same arguments concurrently share
+// a single process and its result. The context of the first caller governs the
+// shared process.
+func (r *Runner) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var (
+		key    = strings.Join(append([]string{name}, args...), "\x00")
+		leader bool
+	)
+	v, err, shared := r.group.Do(key, func() (interface{}, error) {
+		leader = true
+		return r.output(ctx, name, args...)
+	})
+	if !leader {
+		r.metricDeduplicated.WithLabelValues(Name(name, args...)).Inc()
+	}
+	out, _ := v.([]byte)
+	if shared {
+		// every caller owns its output
+		out = append([]byte(nil), out...)
+	}
+	return out, err
+}
+
+// output runs a command for Output.
+func (r *Runner) output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	command := Name(name, args...)
+	if r.isStuck(command) {
+		r.metricFailures.WithLabelValues(command, ReasonStuck).Inc()
+		return nil, fmt.Errorf("%s not started, a previous invocation is stuck: %w", command, ErrStuck)
+	}
+	// the timeout only starts once the command may be started
+	if err := r.wait(ctx, command); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout(command))
+	defer cancel()
+
+	inflight := r.metricInflight.WithLabelValues(command)
+	inflight.Inc()
+	defer inflight.Dec()
+
+	var (
+		start  = time.Now()
+		stderr = &limitedBuffer{max: maxStderr}
+		cmd    = r.executor.Command(ctx, stderr, name, args...)
+	)
+	stdout, err := cmd.Start()
+	if err != nil {
+		return nil, r.finish(ctx, command, start, false, err, stderr)
+	}
+
+	done := make(chan output, 1)
+	go func() {
+		out, readErr := io.ReadAll(stdout)
+		err := cmd.Wait()
+		if err == nil {
+			err = readErr
+		}
+		done <- output{stdout: out, err: err}
+	}()
+
+	out, ok := r.await(ctx, cmd, done)
+	if !ok {
+		// stop waiting, but keep track of the process until it exits
+		r.addStuck(command, 1)
+		go func() {
+			<-done
+			r.addStuck(command, -1)
+		}()
+		r.metricFailures.WithLabelValues(command, ReasonStuck).Inc()
+		return nil, fmt.Errorf("%s stuck: %w", command, ErrStuck)
+	}
+	return out.stdout, r.finish(ctx, command, start, true, out.err, stderr)
+}
+
+// Process is a long running command started by Start.
+type Process struct {
+	Stdout io.Reader
+
+	ctx      context.Context
+	cmd      Cmd
+	stderr   *limitedBuffer
+	runner   *Runner
+	command  string
+	start    time.Time
+	waitOnce sync.Once
+	err      error
+}
+
+// Start starts a long running command, which isn't subject to a timeout. It is
+// terminated once ctx is cancelled. It is subject to the rate limit, but never
+// shares a process with other callers.
+func (r *Runner) Start(ctx context.Context, name string, args ...string) (*Process, error) {
+	command := Name(name, args...)
+	if err := r.wait(ctx, command); err != nil {
+		return nil, err
+	}
+	var (
+		start  = time.Now()
+		stderr = &limitedBuffer{max: maxStderr}
+		cmd    = r.executor.Command(ctx, stderr, name, args...)
+	)
+	stdout, err := cmd.Start()
+	if err != nil {
+		return nil, r.finish(ctx, command, start, false, err, stderr)
+	}
+	r.metricInflight.WithLabelValues(command).Inc()
+
+	return &Process{
+		Stdout:  stdout,
+		ctx:     ctx,
+		cmd:     cmd,
+		stderr:  stderr,
+		runner:  r,
+		command: command,
+		start:   start,
+	}, nil
+}
+
+// Kill kills the process immediately.
+func (p *Process) Kill() error {
+	return p.cmd.Kill()
+}
+
+// Wait waits for the process to exit and records its metrics.
+func (p *Process) Wait() error {
+	p.waitOnce.Do(func() {
+		err := p.cmd.Wait()
+		p.runner.metricInflight.WithLabelValues(p.command).Dec()
+		p.err = p.runner.finish(p.ctx, p.command, p.start, true, err, p.stderr)
+	})
+	return p.err
+}
+
+func (r *Runner) Describe(ch chan<- *prometheus.Desc) {
+	r.metricDuration.Describe(ch)
+	r.metricFailures.Describe(ch)
+	r.metricInflight.Describe(ch)
+	r.metricStuck.Describe(ch)
+	r.metricDeduplicated.Describe(ch)
+	r.metricThrottled.Describe(ch)
+}
+
+func (r *Runner) Collect(ch chan<- prometheus.Metric) {
+	r.metricDuration.Collect(ch)
+	r.metricFailures.Collect(ch)
+	r.metricInflight.Collect(ch)
+	r.metricStuck.Collect(ch)
+	r.metricDeduplicated.Collect(ch)
+	r.metricThrottled.Collect(ch)
+}
@@ -0,0 +1,430 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// fakeCommands puts fake executables at the front of PATH.
+func fakeCommands(t *testing.T, scripts map[string]string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, script := range scripts {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0o755))
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+const fakeZpool = `case "$1" in
+status) echo "pool: tank";;
+events) echo "events"; exec sleep 3600;;
+*) echo "unrecognized command '$1'" >&2; exit 2;;
+esac
+`
+
+func TestName(t *testing.T) {
+	require.Equal(t, "zpool status", Name("zpool", "status", "-pP"))
+	require.Equal(t, "zfs list", Name("zfs", "list", "-H"))
+	require.Equal(t, "zfs", Name("zfs", "-V"))
+	require.Equal(t, "zfs", Name("zfs"))
+}
+
+func TestRunnerOutput(t *testing.T) {
+	fakeCommands(t, map[string]string{"zpool": fakeZpool})
+	r := NewRunner(time.Minute)
+
+	out, err := r.Output(context.Background(), "zpool", "status", "-pP")
+	require.NoError(t, err)
+	require.Equal(t, "pool: tank\n", string(out))
+
+	_, err = r.Output(context.Background(), "zpool", "scrub")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "zpool scrub failed")
+	require.Contains(t, err.Error(), "unrecognized command 'scrub'")
+
+	_, err = r.Output(context.Background(), "zfs-missing", "list")
+	require.Error(t, err)
+
+	require.Equal(t, 2, testutil.CollectAndCount(r, "zfs_exporter_command_duration_seconds"))
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zpool scrub", ReasonExit)))
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zfs-missing list", ReasonStart)))
+	require.Equal(t, float64(0), testutil.ToFloat64(r.metricInflight.WithLabelValues("zpool status")))
+}
+
+func TestRunnerPermissionDenied(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "echo \"cannot open 'tank': Permission denied\" >&2; exit 1\n",
+		"zpool": fakeZpool,
+	})
+	r := NewRunner(time.Minute)
+
+	_, err := r.Output(context.Background(), "zfs", "list", "tank")
+	require.True(t, errors.Is(err, ErrPermission), "%v", err)
+	require.Contains(t, err.Error(), "zfs list failed: exit status 1: cannot open 'tank': Permission denied: insufficient permissions")
+
+	_, err = r.Output(context.Background(), "zpool", "scrub")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrPermission))
+}
+
+func TestRunnerUnavailable(t *testing.T) {
+	fakeCommands(t, map[string]string{
+		"zfs":   "echo 'The ZFS modules are not loaded.' >&2\necho \"Try running '/sbin/modprobe zfs' as root to load them.\" >&2\nexit 1\n",
+		"zpool": fakeZpool,
+	})
+	r := NewRunner(time.Minute)
+	require.True(t, r.Available())
+
+	_, err := r.Output(context.Background(), "zfs", "list")
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.False(t, r.Available())
+
+	// other failures don't change the availability
+	_, err = r.Output(context.Background(), "zpool", "scrub")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrUnavailable))
+	require.False(t, r.Available())
+
+	_, err = r.Output(context.Background(), "zpool", "status")
+	require.NoError(t, err)
+	require.True(t, r.Available())
+
+	// missing executables count as unavailable as well
+	_, err = r.Output(context.Background(), "zfs-missing", "list")
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.False(t, r.Available())
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	fakeCommands(t, map[string]string{"zfs": "exec sleep 3600\n"})
+	r := NewRunner(time.Minute)
+	r.SetTimeout("zfs list", 50*time.Millisecond)
+
+	start := time.Now()
+	_, err := r.Output(context.Background(), "zfs", "list")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+	require.Less(t, int64(time.Since(start)), int64(waitDelay))
+
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zfs list", ReasonTimeout)))
+}
+
+func TestRunnerIgnoringSIGTERM(t *testing.T) {
+	// the wrapper and its child ignore SIGTERM and keep stdout open
+	fakeCommands(t, map[string]string{"zfs": "trap '' TERM\nsleep 3600 &\necho $!\nwait\n"})
+	r := NewRunner(time.Minute)
+	r.SetTimeout("zfs list", 50*time.Millisecond)
+	r.waitDelay = 50 * time.Millisecond
+
+	start := time.Now()
+	out, err := r.Output(context.Background(), "zfs", "list")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+	require.Less(t, int64(time.Since(start)), int64(waitDelay))
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zfs list", ReasonTimeout)))
+	require.Equal(t, float64(0), testutil.ToFloat64(r.metricStuck.WithLabelValues("zfs list")))
+
+	// the child has been killed with its process group
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	require.NoError(t, err)
+	if runtime.GOOS == "linux" {
+		for i := 0; ; i++ {
+			stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+			if err != nil || strings.Contains(string(stat), ") Z ") {
+				break
+			}
+			require.Less(t, i, 100, "child %d still running", pid)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// stuckExecutor prepares commands, which don't exit until released, even
+// after being killed.
+type stuckExecutor struct {
+	release  chan struct{}
+	commands int32
+}
+
+type stuckCmd struct {
+	release chan struct{}
+}
+
+func (e *stuckExecutor) Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd {
+	atomic.AddInt32(&e.commands, 1)
+	return &stuckCmd{release: e.release}
+}
+
+func (c *stuckCmd) Start() (io.Reader, error) {
+	return strings.NewReader(""), nil
+}
+
+func (c *stuckCmd) Wait() error {
+	<-c.release
+	return nil
+}
+
+func (c *stuckCmd) Kill() error {
+	return nil
+}
+
+func TestRunnerStuck(t *testing.T) {
+	e := &stuckExecutor{release: make(chan struct{})}
+	r := NewRunnerWithExecutor(e, 50*time.Millisecond)
+	r.waitDelay = 10 * time.Millisecond
+
+	_, err := r.Output(context.Background(), "zpool", "status")
+	require.True(t, errors.Is(err, ErrStuck), "%v", err)
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricStuck.WithLabelValues("zpool status")))
+
+	// no further process is started while the previous one is stuck
+	_, err = r.Output(context.Background(), "zpool", "status")
+	require.True(t, errors.Is(err, ErrStuck), "%v", err)
+	require.Contains(t, err.Error(), "not started")
+	require.Equal(t, int32(1), atomic.LoadInt32(&e.commands))
+	require.Equal(t, float64(2), testutil.ToFloat64(r.metricFailures.WithLabelValues("zpool status", ReasonStuck)))
+
+	close(e.release)
+	for i := 0; r.isStuck("zpool status"); i++ {
+		require.Less(t, i, 100, "process still stuck")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, float64(0), testutil.ToFloat64(r.metricStuck.WithLabelValues("zpool status")))
+
+	_, err = r.Output(context.Background(), "zpool", "status")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&e.commands))
+}
+
+func TestRunnerStart(t *testing.T) {
+	fakeCommands(t, map[string]string{"zpool": fakeZpool})
+	r := NewRunner(50 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := r.Start(ctx, "zpool", "events", "-f")
+	require.NoError(t, err)
+
+	// long running commands are not subject to the timeout
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricInflight.WithLabelValues("zpool events")))
+
+	line := make([]byte, 7)
+	_, err = io.ReadFull(p.Stdout, line)
+	require.NoError(t, err)
+	require.Equal(t, "events\n", string(line))
+
+	cancel()
+	require.Error(t, p.Wait())
+	require.Equal(t, float64(0), testutil.ToFloat64(r.metricInflight.WithLabelValues("zpool events")))
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zpool events", ReasonCanceled)))
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{max: 8}
+	n, err := b.Write([]byte(strings.Repeat("x", 6)))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	n, err = b.Write([]byte("yyyy"))
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Equal(t, "xxxxxxyy", b.String())
+}
+
+func TestRunnerLocale(t *testing.T) {
+	t.Setenv("LC_ALL", "de_DE.UTF-8")
+	fakeCommands(t, map[string]string{"zfs": "echo \"$LC_ALL\"\n"})
+	r := NewRunner(time.Minute)
+
+	out, err := Output(context.Background(), r, "zfs", "list")
+	require.NoError(t, err)
+	require.Equal(t, "C\n", string(out))
+}
+
+func TestRunnerSingleflight(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.On("zpool status", FakeCommand{Stdout: "pool: tank\n", Delay: 50 * time.Millisecond})
+	fake.On("zpool list", FakeCommand{Stdout: "tank\n", Delay: 50 * time.Millisecond})
+	r := fake.Runner()
+
+	var (
+		wg      sync.WaitGroup
+		outputs = make([][]byte, 8)
+	)
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			args := []string{"status", "-pP"}
+			if i%2 == 1 {
+				args = []string{"list"}
+			}
+			out, err := r.Output(context.Background(), "zpool", args...)
+			require.NoError(t, err)
+			outputs[i] = out
+		}(i)
+	}
+	wg.Wait()
+
+	// concurrent invocations of the same command share a process
+	require.Len(t, fake.Calls(), 2)
+	require.Equal(t, float64(3), testutil.ToFloat64(r.metricDeduplicated.WithLabelValues("zpool status")))
+	require.Equal(t, float64(3), testutil.ToFloat64(r.metricDeduplicated.WithLabelValues("zpool list")))
+	for i, out := range outputs {
+		if i%2 == 0 {
+			require.Equal(t, "pool: tank\n", string(out))
+		} else {
+			require.Equal(t, "tank\n", string(out))
+		}
+	}
+
+	// the output isn't shared between the callers
+	outputs[0][0] = 'x'
+	require.Equal(t, "pool: tank\n", string(outputs[2]))
+
+	// later invocations start another process
+	_, err := r.Output(context.Background(), "zpool", "status", "-pP")
+	require.NoError(t, err)
+	require.Len(t, fake.Calls(), 3)
+}
+
+func TestRunnerSingleflightError(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.On("zfs list", FakeCommand{Stderr: "cannot open 'tank': dataset does not exist", ExitCode: 1, Delay: 50 * time.Millisecond})
+	r := fake.Runner()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Output(context.Background(), "zfs", "list", "tank")
+			require.EqualError(t, err, "zfs list failed: exit status 1: cannot open 'tank': dataset does not exist")
+		}()
+	}
+	wg.Wait()
+	require.Len(t, fake.Calls(), 1)
+	// the failure is only counted once
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zfs list", ReasonExit)))
+}
+
+func TestRunnerRateLimit(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.On("zfs", FakeCommand{})
+
+	// the limiter is shared by the runners of all targets
+	limiter := rate.NewLimiter(rate.Every(50*time.Millisecond), 2)
+	runners := []*Runner{fake.Runner(), fake.Runner()}
+	for _, r := range runners {
+		r.SetRateLimit(limiter)
+	}
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := runners[i%2].Output(context.Background(), "zfs", "list", strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	// the burst starts immediately, the other 4 commands at the rate
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(4*50*time.Millisecond-10*time.Millisecond))
+	require.Len(t, fake.Calls(), 6)
+	throttled := testutil.ToFloat64(runners[0].metricThrottled.WithLabelValues("zfs list")) +
+		testutil.ToFloat64(runners[1].metricThrottled.WithLabelValues("zfs list"))
+	require.Equal(t, float64(4), throttled)
+
+	// long running commands are limited as well
+	fake.On("zpool events", FakeCommand{Follow: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start = time.Now()
+	p, err := runners[0].Start(ctx, "zpool", "events", "-f")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(40*time.Millisecond))
+	cancel()
+	require.Error(t, p.Wait())
+}
+
+func TestRunnerRateLimitCanceled(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.On("zfs", FakeCommand{})
+	r := fake.Runner()
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	r.SetRateLimit(limiter)
+
+	_, err := r.Output(context.Background(), "zfs", "list")
+	require.NoError(t, err)
+
+	// the command isn't started once the context is done while waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = r.Output(ctx, "zfs", "list")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Contains(t, err.Error(), "zfs list not started, waiting for the rate limit")
+	require.Len(t, fake.Calls(), 1)
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zfs list", ReasonCanceled)))
+
+	// the reservation of the canceled command is returned, so the next
+	// command may start within an hour
+	require.InDelta(t, 1, limiter.TokensAt(time.Now().Add(time.Hour)), 0.01)
+}
+
+func TestRunnerRateLimitTimeout(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.On("zfs", FakeCommand{Delay: 80 * time.Millisecond})
+	r := fake.Runner()
+	r.SetTimeout("zfs list", 100*time.Millisecond)
+	r.SetRateLimit(rate.NewLimiter(rate.Every(50*time.Millisecond), 1))
+
+	// the time waiting for the rate limit doesn't count towards the timeout
+	_, err := r.Output(context.Background(), "zfs", "list", "a")
+	require.NoError(t, err)
+	_, err = r.Output(context.Background(), "zfs", "list", "b")
+	require.NoError(t, err)
+}
+
+func TestFakeExecutor(t *testing.T) {
+	fake := NewFakeExecutor()
+	fake.On("zpool", FakeCommand{Stdout: "zpool\n"})
+	fake.On("zpool status", FakeCommand{Stdout: "status\n"})
+	fake.On("zpool status -pP", FakeCommand{Stdout: "status -pP\n"})
+	r := fake.Runner()
+
+	// the most specific script is run
+	for args, expected := range map[string]string{
+		"status -pP": "status -pP\n",
+		"status -x":  "status\n",
+		"list":       "zpool\n",
+	} {
+		out, err := Output(context.Background(), r, "zpool", strings.Fields(args)...)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(out), args)
+	}
+
+	// commands without a script aren't available
+	_, err := r.Output(context.Background(), "zfs", "list")
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.False(t, r.Available())
+	require.Equal(t, []string{"zfs", "list"}, fake.Calls()[3])
+
+	// a killed command exits without writing its output
+	fake.On("zfs", FakeCommand{Stdout: "never read\n"})
+	p, err := r.Start(context.Background(), "zfs", "list")
+	require.NoError(t, err)
+	require.NoError(t, p.Kill())
+	require.EqualError(t, p.Wait(), "zfs list failed: signal: killed")
+}
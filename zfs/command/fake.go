@@ -0,0 +1,170 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeCommand is the scripted behaviour of a command run by a FakeExecutor.
+type FakeCommand struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Delay is the time the command runs before it exits, unless it is
+	// killed or its context is cancelled before.
+	Delay time.Duration
+	// Follow keeps the command running after writing its stdout, until it
+	// is killed or its context is cancelled, like zpool events -f.
+	Follow bool
+}
+
+// FakeExecutor runs scripted commands instead of executables, so the
+// collectors can be tested against a Runner without ZFS. Commands, which
+// aren't scripted, fail to start like missing executables.
+type FakeExecutor struct {
+	mtx      sync.Mutex
+	commands map[string]FakeCommand
+	calls    [][]string
+}
+
+var _ Executor = (*FakeExecutor)(nil)
+
+// NewFakeExecutor creates an executor without any scripted commands.
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{commands: make(map[string]FakeCommand)}
+}
+
+// Runner creates a runner using the executor with the default timeout.
+func (e *FakeExecutor) Runner() *Runner {
+	return NewRunnerWithExecutor(e, DefaultTimeout)
+}
+
+// On scripts a command, which is either a complete command line, e.g.
+// "zpool status -pP", the name of a command, e.g. "zpool status", or an
+// executable. The most specific one matching an invocation is run. Scripting
+// a command again replaces it.
+func (e *FakeExecutor) On(command string, cmd FakeCommand) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.commands[command] = cmd
+}
+
+// Calls returns the executables and arguments of all commands started so far.
+func (e *FakeExecutor) Calls() [][]string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	result := make([][]string, len(e.calls))
+	for i, c := range e.calls {
+		result[i] = append([]string(nil), c...)
+	}
+	return result
+}
+
+// lookup records the invocation of a command and returns its script.
+func (e *FakeExecutor) lookup(name string, args []string) (FakeCommand, bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	argv := append([]string{name}, args...)
+	e.calls = append(e.calls, argv)
+	for _, key := range []string{strings.Join(argv, " "), Name(name, args...), name} {
+		if cmd, ok := e.commands[key]; ok {
+			return cmd, true
+		}
+	}
+	return FakeCommand{}, false
+}
+
+func (e *FakeExecutor) Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd {
+	return &fakeCmd{
+		executor: e,
+		ctx:      ctx,
+		stderr:   stderr,
+		name:     name,
+		args:     args,
+		killed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+type fakeCmd struct {
+	executor *FakeExecutor
+	ctx      context.Context
+	stderr   io.Writer
+	name     string
+	args     []string
+
+	killOnce sync.Once
+	killed   chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+func (c *fakeCmd) Start() (io.Reader, error) {
+	cmd, ok := c.executor.lookup(c.name, c.args)
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", c.name, exec.ErrNotFound)
+	}
+	_, _ = io.WriteString(c.stderr, cmd.Stderr)
+
+	stdout, w := io.Pipe()
+	go func() {
+		defer close(c.done)
+		// closing the pipe unblocks the write of a killed command
+		defer w.Close()
+
+		// a command following its output never exits by itself
+		exited := make(chan struct{})
+		if !cmd.Follow {
+			t := time.AfterFunc(cmd.Delay, func() { close(exited) })
+			defer t.Stop()
+		}
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			_, _ = io.WriteString(w, cmd.Stdout)
+		}()
+
+		if c.err = c.await(written); c.err != nil {
+			return
+		}
+		if c.err = c.await(exited); c.err != nil {
+			return
+		}
+		if cmd.ExitCode != 0 {
+			c.err = fmt.Errorf("exit status %d", cmd.ExitCode)
+		}
+	}()
+	return stdout, nil
+}
+
+// await waits for ch to be closed. It fails once the command is killed or
+// its context is cancelled before.
+func (c *fakeCmd) await(ch <-chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-c.killed:
+		return errors.New("signal: killed")
+	case <-c.ctx.Done():
+		return errors.New("signal: terminated")
+	}
+}
+
+func (c *fakeCmd) Wait() error {
+	<-c.done
+	return c.err
+}
+
+func (c *fakeCmd) Kill() error {
+	c.killOnce.Do(func() { close(c.killed) })
+	return nil
+}
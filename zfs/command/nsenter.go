@@ -0,0 +1,34 @@
+package command
+
+import (
+	"context"
+	"io"
+)
+
+// nsenterArgs enter the mount, UTS, IPC, network and PID namespaces of the
+// host's init process.
+var nsenterArgs = []string{"-t", "1", "-m", "-u", "-i", "-n", "-p", "--"}
+
+// NsenterExecutor runs commands in the namespaces of the host, when the
+// exporter itself runs in a container sharing the host's PID namespace.
+type NsenterExecutor struct {
+	// Executor runs the nsenter command, it defaults to a LocalExecutor.
+	Executor Executor
+}
+
+func (e NsenterExecutor) Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd {
+	executor := e.Executor
+	if executor == nil {
+		executor = LocalExecutor{}
+	}
+	return executor.Command(ctx, stderr, "nsenter", NsenterArgs(name, args...)...)
+}
+
+// NsenterArgs returns the arguments of nsenter to run the given command in
+// the host's namespaces.
+func NsenterArgs(name string, args ...string) []string {
+	argv := make([]string, 0, len(nsenterArgs)+1+len(args))
+	argv = append(argv, nsenterArgs...)
+	argv = append(argv, name)
+	return append(argv, args...)
+}
@@ -0,0 +1,43 @@
+package command
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingExecutor records the commands and runs them locally.
+type recordingExecutor struct {
+	argv [][]string
+}
+
+func (e *recordingExecutor) Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd {
+	e.argv = append(e.argv, append([]string{name}, args...))
+	return LocalExecutor{}.Command(ctx, stderr, "echo", args...)
+}
+
+func TestNsenterExecutor(t *testing.T) {
+	var (
+		recorder = &recordingExecutor{}
+		r        = NewRunnerWithExecutor(NsenterExecutor{Executor: recorder}, time.Minute)
+	)
+
+	out, err := r.Output(context.Background(), "zpool", "status", "-p")
+	require.NoError(t, err)
+	require.Equal(t, "-t 1 -m -u -i -n -p -- zpool status -p\n", string(out))
+	require.Equal(t, [][]string{
+		{"nsenter", "-t", "1", "-m", "-u", "-i", "-n", "-p", "--", "zpool", "status", "-p"},
+	}, recorder.argv)
+
+	// metrics and timeouts refer to the command run in the host
+	require.NoError(t, testutil.CollectAndCompare(r.metricInflight, strings.NewReader(`
+# HELP zfs_exporter_commands_inflight Number of commands currently running.
+# TYPE zfs_exporter_commands_inflight gauge
+zfs_exporter_commands_inflight{command="zpool status"} 0
+`)))
+}
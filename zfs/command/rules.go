@@ -0,0 +1,21 @@
+package command
+
+import (
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+)
+
+// Rules returns the recommended rules for the command metrics.
+func Rules(rules.Config) []rules.Rule {
+	return []rules.Rule{
+		{
+			Alert:   "ZFSCommandStuck",
+			Expr:    `zfs_exporter_commands_stuck > 0`,
+			Labels:  map[string]string{"severity": "critical"},
+			Metrics: []string{"zfs_exporter_commands_stuck"},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.command }} is stuck on {{ $labels.instance }}",
+				"description": "{{ $labels.command }} did not exit after being killed, a pool might be suspended.",
+			},
+		},
+	}
+}
@@ -0,0 +1,20 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+)
+
+func TestRules(t *testing.T) {
+	r := NewRunner(time.Minute)
+	r.metricStuck.WithLabelValues("zpool status")
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(r)
+
+	require.NoError(t, rules.Verify(reg, Rules(rules.Config{})))
+}
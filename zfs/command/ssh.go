@@ -0,0 +1,200 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHExecutor runs commands on a remote host. The connection is shared by all
+// commands, kept alive and re-established once it breaks.
+type SSHExecutor struct {
+	addr      string
+	config    *ssh.ClientConfig
+	keepalive time.Duration
+
+	mtx    sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSHExecutor creates an executor for the SSH server at addr. A keepalive
+// is sent every keepalive interval, a zero interval disables it.
+func NewSSHExecutor(addr string, config *ssh.ClientConfig, keepalive time.Duration) *SSHExecutor {
+	return &SSHExecutor{
+		addr:      addr,
+		config:    config,
+		keepalive: keepalive,
+	}
+}
+
+// getClient returns the shared client, it connects if necessary.
+func (e *SSHExecutor) getClient() (*ssh.Client, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if e.client != nil {
+		return e.client, nil
+	}
+
+	client, err := ssh.Dial("tcp", e.addr, e.config)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", e.addr, err)
+	}
+	e.client = client
+	if e.keepalive > 0 {
+		go e.runKeepalive(client)
+	}
+	return client, nil
+}
+
+// reset closes client, so the next command reconnects.
+func (e *SSHExecutor) reset(client *ssh.Client) {
+	e.mtx.Lock()
+	if e.client == client {
+		e.client = nil
+	}
+	e.mtx.Unlock()
+	_ = client.Close()
+}
+
+// runKeepalive sends keepalives until one fails or the connection is closed.
+func (e *SSHExecutor) runKeepalive(client *ssh.Client) {
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(e.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			e.reset(client)
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				e.reset(client)
+				return
+			}
+		}
+	}
+}
+
+// newSession opens a session. A broken connection is re-established once.
+func (e *SSHExecutor) newSession() (*ssh.Session, error) {
+	client, err := e.getClient()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	e.reset(client)
+	if client, err = e.getClient(); err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+// Close closes the connection.
+func (e *SSHExecutor) Close() error {
+	e.mtx.Lock()
+	client := e.client
+	e.client = nil
+	e.mtx.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+type sshCmd struct {
+	executor *SSHExecutor
+	ctx      context.Context
+	stderr   io.Writer
+	cmdline  string
+
+	session *ssh.Session
+	done    chan struct{}
+}
+
+// Command prepares a command for the remote shell, which forces the C locale
+// like the LocalExecutor.
+func (e *SSHExecutor) Command(ctx context.Context, stderr io.Writer, name string, args ...string) Cmd {
+	words := make([]string, 0, len(args)+2)
+	words = append(words, "LC_ALL=C")
+	for _, w := range append([]string{name}, args...) {
+		words = append(words, shellQuote(w))
+	}
+	return &sshCmd{
+		executor: e,
+		ctx:      ctx,
+		stderr:   stderr,
+		cmdline:  strings.Join(words, " "),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *sshCmd) Start() (io.Reader, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	session, err := c.executor.newSession()
+	if err != nil {
+		return nil, err
+	}
+	session.Stderr = c.stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	if err := session.Start(c.cmdline); err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	c.session = session
+
+	// terminate the remote command once ctx is cancelled, not every server
+	// supports signals, so the session is closed after a delay
+	go func() {
+		select {
+		case <-c.done:
+			return
+		case <-c.ctx.Done():
+		}
+		_ = session.Signal(ssh.SIGTERM)
+		select {
+		case <-c.done:
+		case <-time.After(waitDelay):
+			_ = session.Close()
+		}
+	}()
+
+	return stdout, nil
+}
+
+func (c *sshCmd) Wait() error {
+	defer close(c.done)
+	err := c.session.Wait()
+	_ = c.session.Close()
+	return err
+}
+
+func (c *sshCmd) Kill() error {
+	return c.session.Close()
+}
@@ -0,0 +1,237 @@
+package command
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshServerStub is an in-process SSH server, which answers exec requests with
+// the configured handlers.
+type sshServerStub struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	config   *ssh.ServerConfig
+	handlers map[string]func(ch ssh.Channel) uint32
+
+	mtx      sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+func newSSHServerStub(t *testing.T, clientKey ssh.PublicKey, handlers map[string]func(ch ssh.Channel) uint32) *sshServerStub {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &sshServerStub{
+		listener: l,
+		hostKey:  newTestSigner(t),
+		handlers: handlers,
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	s.config.AddHostKey(s.hostKey)
+
+	go s.serve()
+	t.Cleanup(func() {
+		_ = l.Close()
+		s.dropConnections()
+	})
+	return s
+}
+
+func (s *sshServerStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted++
+		s.mtx.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+func (s *sshServerStub) handleConn(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleSession(ch, reqs)
+	}
+}
+
+func (s *sshServerStub) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			cmdline := string(req.Payload[4:])
+			_ = req.Reply(true, nil)
+			handler, ok := s.handlers[cmdline]
+			status := uint32(127)
+			if ok {
+				status = handler(ch)
+			} else {
+				_, _ = ch.Stderr().Write([]byte("command not found: " + cmdline))
+			}
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, status)
+			_, _ = ch.SendRequest("exit-status", false, payload)
+			return
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *sshServerStub) dropConnections() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sshServerStub) connections() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.accepted
+}
+
+func newTestSSHExecutor(t *testing.T, s *sshServerStub, clientKey ssh.Signer, hostKey ssh.PublicKey) *SSHExecutor {
+	t.Helper()
+	e := NewSSHExecutor(s.listener.Addr().String(), &ssh.ClientConfig{
+		User:            "monitor",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         5 * time.Second,
+	}, time.Second)
+	t.Cleanup(func() { _ = e.Close() })
+	return e
+}
+
+func TestSSHExecutor(t *testing.T) {
+	clientKey := newTestSigner(t)
+	s := newSSHServerStub(t, clientKey.PublicKey(), map[string]func(ssh.Channel) uint32{
+		`LC_ALL=C 'zpool' 'status' '-pP'`: func(ch ssh.Channel) uint32 {
+			_, _ = ch.Write([]byte("pool: tank\n"))
+			return 0
+		},
+		`LC_ALL=C 'zfs' 'list' 'tank/it'\''s'`: func(ch ssh.Channel) uint32 {
+			_, _ = ch.Stderr().Write([]byte("permission denied"))
+			return 1
+		},
+	})
+	r := NewRunnerWithExecutor(newTestSSHExecutor(t, s, clientKey, s.hostKey.PublicKey()), time.Minute)
+
+	out, err := r.Output(context.Background(), "zpool", "status", "-pP")
+	require.NoError(t, err)
+	require.Equal(t, "pool: tank\n", string(out))
+
+	_, err = r.Output(context.Background(), "zfs", "list", "tank/it's")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission denied")
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zfs list", ReasonExit)))
+
+	// the connection is reused
+	_, err = r.Output(context.Background(), "zpool", "status", "-pP")
+	require.NoError(t, err)
+	require.Equal(t, 1, s.connections())
+
+	// a broken connection is re-established
+	s.dropConnections()
+	for i := 0; ; i++ {
+		_, err := r.Output(context.Background(), "zpool", "status", "-pP")
+		if err == nil {
+			break
+		}
+		require.Less(t, i, 100, "connection not re-established: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 2, s.connections())
+}
+
+func TestSSHExecutorHostKeyMismatch(t *testing.T) {
+	clientKey := newTestSigner(t)
+	s := newSSHServerStub(t, clientKey.PublicKey(), nil)
+	r := NewRunnerWithExecutor(newTestSSHExecutor(t, s, clientKey, newTestSigner(t).PublicKey()), time.Minute)
+
+	_, err := r.Output(context.Background(), "zpool", "status")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "host key mismatch")
+	require.Equal(t, float64(1), testutil.ToFloat64(r.metricFailures.WithLabelValues("zpool status", ReasonStart)))
+}
+
+func TestSSHExecutorStart(t *testing.T) {
+	var (
+		clientKey = newTestSigner(t)
+		release   = make(chan struct{})
+	)
+	s := newSSHServerStub(t, clientKey.PublicKey(), map[string]func(ssh.Channel) uint32{
+		`LC_ALL=C 'zpool' 'events' '-f'`: func(ch ssh.Channel) uint32 {
+			_, _ = ch.Write([]byte("event\n"))
+			<-release
+			return 0
+		},
+	})
+	r := NewRunnerWithExecutor(newTestSSHExecutor(t, s, clientKey, s.hostKey.PublicKey()), 10*time.Millisecond)
+
+	p, err := r.Start(context.Background(), "zpool", "events", "-f")
+	require.NoError(t, err)
+
+	// long running commands are not subject to the timeout
+	time.Sleep(50 * time.Millisecond)
+	line := make([]byte, 6)
+	_, err = io.ReadFull(p.Stdout, line)
+	require.NoError(t, err)
+	require.Equal(t, "event\n", string(line))
+
+	close(release)
+	_, _ = io.Copy(io.Discard, p.Stdout)
+	require.NoError(t, p.Wait())
+}
+
+func TestShellQuote(t *testing.T) {
+	require.Equal(t, `'tank/data'`, shellQuote("tank/data"))
+	require.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	require.Equal(t, `''`, shellQuote(""))
+}
@@ -0,0 +1,215 @@
+package dataset
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+// countEvents are the history events changing the number of datasets of a
+// pool. The ones of filesystems and volumes trigger a relisting on the next
+// collection, the snapshots are counted from the events themselves.
+var countEvents = map[string]bool{
+	"create":   true,
+	"clone":    true,
+	"snapshot": true,
+	"destroy":  true,
+	"rename":   true,
+}
+
+func zfsListTypesCmd(runner *command.Runner) func(context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		// the type is listed as well, as filesystems and volumes can't be
+		// told apart by their names
+		return runner.Output(ctx, "zfs", "list", "-H", "-o", "name,type", "-t", "filesystem,volume,snapshot")
+	}
+}
+
+// Counts are the numbers of datasets of a pool by type.
+type Counts struct {
+	Filesystems uint64
+	Volumes     uint64
+	Snapshots   uint64
+}
+
+// ParseCounts parses the output of zfs list -H -o name,type and counts the
+// datasets of every pool. Other types, e.g. bookmarks, are ignored.
+func ParseCounts(r io.Reader) (map[string]*Counts, error) {
+	var (
+		result  = make(map[string]*Counts)
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		name, typ, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+		pool, _, _ := strings.Cut(name, "/")
+		pool, _, _ = strings.Cut(pool, "@")
+		counts, ok := result[pool]
+		if !ok {
+			counts = new(Counts)
+			result[pool] = counts
+		}
+		switch typ {
+		case "filesystem":
+			counts.Filesystems++
+		case "volume":
+			counts.Volumes++
+		case "snapshot":
+			counts.Snapshots++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type countCollector struct {
+	logger   zerolog.Logger
+	list     func(context.Context) ([]byte, error)
+	interval time.Duration
+	now      func() time.Time
+
+	mtx         sync.Mutex
+	counts      map[string]*Counts
+	lastRefresh time.Time
+
+	descFilesystems *prometheus.Desc
+	descVolumes     *prometheus.Desc
+	descSnapshots   *prometheus.Desc
+}
+
+// NewCountCollector creates a collector for the number of filesystems,
+// volumes and snapshots of every pool, which runs zfs list using runner at
+// most once per interval. The counts aren't filtered, so they cover datasets
+// excluded from other collectors as well. All metric names are prefixed with
+// namespace.
+func NewCountCollector(logger zerolog.Logger, runner *command.Runner, namespace string, interval time.Duration) *countCollector {
+	return NewListCountCollector(logger, zfsListTypesCmd(runner), namespace, interval)
+}
+
+// NewListCountCollector is like NewCountCollector, but it lists the datasets
+// using list, which returns the output of zfs list -H -o name,type.
+func NewListCountCollector(logger zerolog.Logger, list func(context.Context) ([]byte, error), namespace string, interval time.Duration) *countCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "pool", name), help, []string{"pool"}, nil)
+	}
+	return &countCollector{
+		logger:   logger.With().Str("collector", "pool_count").Logger(),
+		list:     list,
+		interval: interval,
+		now:      time.Now,
+
+		descFilesystems: desc("filesystems", "Number of filesystems of a ZFS pool, including its root filesystem."),
+		descVolumes:     desc("volumes", "Number of volumes of a ZFS pool."),
+		descSnapshots:   desc("snapshots_total", "Number of snapshots of a ZFS pool."),
+	}
+}
+
+// refresh lists the datasets, unless they have been listed within the
+// interval. It returns a copy of the counts, as events update them.
+func (c *countCollector) refresh(ctx context.Context) (map[string]Counts, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.now()
+	if !c.lastRefresh.IsZero() && now.Sub(c.lastRefresh) < c.interval {
+		return c.copyCounts(), nil
+	}
+
+	data, err := c.list(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list datasets: %w", err)
+	}
+	counts, err := ParseCounts(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse datasets: %w", err)
+	}
+	c.counts = counts
+	c.lastRefresh = now
+	return c.copyCounts(), nil
+}
+
+func (c *countCollector) copyCounts() map[string]Counts {
+	result := make(map[string]Counts, len(c.counts))
+	for pool, counts := range c.counts {
+		result[pool] = *counts
+	}
+	return result
+}
+
+// Notify relists the datasets on the next collection, if event creates,
+// renames or destroys a filesystem or volume. The snapshots created or
+// destroyed are counted without relisting, so snapshot churn doesn't relist
+// all datasets on every collection. A nil event stands for a resync of the
+// event stream, after which the datasets are relisted as well.
+func (c *countCollector) Notify(event *events.Event) {
+	if event != nil && !countEvents[event.HistoryInternalName] {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if event != nil && strings.Contains(event.HistoryDSName, "@") {
+		pool, _, _ := strings.Cut(event.HistoryDSName, "@")
+		pool, _, _ = strings.Cut(pool, "/")
+		counts, ok := c.counts[pool]
+		switch {
+		case c.counts == nil:
+			// the first listing counts the snapshot
+		case !ok:
+			c.lastRefresh = time.Time{}
+		case event.HistoryInternalName == "snapshot":
+			counts.Snapshots++
+		case event.HistoryInternalName == "destroy" && counts.Snapshots > 0:
+			counts.Snapshots--
+		}
+		// renaming a snapshot doesn't change the count
+		return
+	}
+	c.lastRefresh = time.Time{}
+}
+
+func (c *countCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descFilesystems
+	ch <- c.descVolumes
+	ch <- c.descSnapshots
+}
+
+func (c *countCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.refresh(context.Background())
+	if errors.Is(err, command.ErrUnavailable) {
+		// there are no datasets without ZFS, this is reported by zfs_up
+		c.logger.Debug().Err(err).Msg("ZFS is not available")
+		return
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to count datasets")
+		ch <- prometheus.NewInvalidMetric(c.descFilesystems, err)
+		return
+	}
+
+	for pool, p := range counts {
+		ch <- prometheus.MustNewConstMetric(c.descFilesystems, prometheus.GaugeValue, float64(p.Filesystems), pool)
+		ch <- prometheus.MustNewConstMetric(c.descVolumes, prometheus.GaugeValue, float64(p.Volumes), pool)
+		ch <- prometheus.MustNewConstMetric(c.descSnapshots, prometheus.GaugeValue, float64(p.Snapshots), pool)
+	}
+}
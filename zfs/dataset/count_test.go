@@ -0,0 +1,89 @@
+package dataset
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+func TestParseCounts(t *testing.T) {
+	counts, err := ParseCounts(strings.NewReader("tank\tfilesystem\ntank@initial\tsnapshot\ntank/data#mark\tbookmark\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]*Counts{"tank": {Filesystems: 1, Snapshots: 1}}, counts)
+
+	_, err = ParseCounts(strings.NewReader("tank filesystem\n"))
+	require.Error(t, err)
+}
+
+func TestCountCollector(t *testing.T) {
+	calls := 0
+	c := NewListCountCollector(zerolog.Nop(), func(context.Context) ([]byte, error) {
+		calls++
+		return os.ReadFile(filepath.Join("testdata", "list-types.txt"))
+	}, "zfs", time.Minute)
+
+	expected := `
+# HELP zfs_pool_filesystems Number of filesystems of a ZFS pool, including its root filesystem.
+# TYPE zfs_pool_filesystems gauge
+zfs_pool_filesystems{pool="backup"} 1
+zfs_pool_filesystems{pool="rpool"} 3
+zfs_pool_filesystems{pool="tank"} 2
+# HELP zfs_pool_snapshots_total Number of snapshots of a ZFS pool.
+# TYPE zfs_pool_snapshots_total gauge
+zfs_pool_snapshots_total{pool="backup"} 0
+zfs_pool_snapshots_total{pool="rpool"} 2
+zfs_pool_snapshots_total{pool="tank"} 3
+# HELP zfs_pool_volumes Number of volumes of a ZFS pool.
+# TYPE zfs_pool_volumes gauge
+zfs_pool_volumes{pool="backup"} 0
+zfs_pool_volumes{pool="rpool"} 1
+zfs_pool_volumes{pool="tank"} 2
+`
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	require.Equal(t, 1, calls)
+
+	// the listing is reused within the interval
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	require.Equal(t, 1, calls)
+
+	// properties changes don't relist, new filesystems do
+	c.Notify(&events.Event{HistoryInternalName: "set", HistoryDSName: "tank/data"})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	require.Equal(t, 1, calls)
+	c.Notify(&events.Event{HistoryInternalName: "create", HistoryDSName: "tank/new"})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	require.Equal(t, 2, calls)
+
+	// snapshots are counted from their events without relisting
+	c.Notify(&events.Event{HistoryInternalName: "snapshot", HistoryDSName: "tank/data@a"})
+	c.Notify(&events.Event{HistoryInternalName: "snapshot", HistoryDSName: "tank@b"})
+	c.Notify(&events.Event{HistoryInternalName: "destroy", HistoryDSName: "rpool/ROOT@c"})
+	c.Notify(&events.Event{HistoryInternalName: "rename", HistoryDSName: "rpool/ROOT@d"})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(strings.NewReplacer(
+		`zfs_pool_snapshots_total{pool="rpool"} 2`, `zfs_pool_snapshots_total{pool="rpool"} 1`,
+		`zfs_pool_snapshots_total{pool="tank"} 3`, `zfs_pool_snapshots_total{pool="tank"} 5`,
+	).Replace(expected)), "zfs_pool_snapshots_total"))
+	require.Equal(t, 2, calls)
+
+	// a snapshot of an unknown pool relists
+	c.Notify(&events.Event{HistoryInternalName: "snapshot", HistoryDSName: "new@a"})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+	require.Equal(t, 3, calls)
+}
+
+func TestCountCollectorUnavailable(t *testing.T) {
+	c := NewListCountCollector(zerolog.Nop(), func(context.Context) ([]byte, error) {
+		return nil, command.ErrUnavailable
+	}, "zfs", time.Minute)
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+}
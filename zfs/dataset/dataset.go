@@ -0,0 +1,592 @@
+// Package dataset exports the properties of filesystems and volumes, which are
+// fetched in a single zfs get for all datasets and shared by the collectors.
+package dataset
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+// properties are fetched for every dataset.
+var properties = []string{
+	"type",
+	"volsize",
+	"used",
+	"usedbydataset",
+	"usedbysnapshots",
+	"usedbychildren",
+	"usedbyrefreservation",
+	"quota",
+	"refquota",
+	"reservation",
+	"refreservation",
+	"referenced",
+	"logicalused",
+	"logicalreferenced",
+	"compressratio",
+	"refcompressratio",
+	"encryption",
+	"encryptionroot",
+	"keystatus",
+	"mounted",
+	"canmount",
+	"mountpoint",
+	"origin",
+	"snapshot_limit",
+	"snapshot_count",
+	"filesystem_limit",
+	"filesystem_count",
+}
+
+// usedBySources are the properties breaking down the used space of a dataset,
+// by the source label of zfs_dataset_used_bytes. They sum up to used.
+var usedBySources = []struct {
+	property string
+	source   string
+}{
+	{"usedbydataset", "dataset"},
+	{"usedbysnapshots", "snapshots"},
+	{"usedbychildren", "children"},
+	{"usedbyrefreservation", "refreservation"},
+}
+
+// keyStatuses are the values of zfs_dataset_keystatus, none is used for
+// unencrypted datasets.
+var keyStatuses = []string{
+	"available",
+	"unavailable",
+	"none",
+}
+
+// refreshEvents are the history events changing the properties of a
+// dataset, they trigger a refresh on the next collection.
+var refreshEvents = map[string]bool{
+	"load-key":   true,
+	"unload-key": true,
+	"change-key": true,
+	"mount":      true,
+	"unmount":    true,
+	"clone":      true,
+	"promote":    true,
+	"destroy":    true,
+}
+
+func zfsGetCmd(runner *command.Runner) func(context.Context, []string) ([]byte, error) {
+	return func(ctx context.Context, props []string) ([]byte, error) {
+		return runner.Output(ctx, "zfs", "get", "-H", "-p", "-t", "filesystem,volume", "-o", "name,property,value,source", strings.Join(props, ","))
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Property is the value of a property of a dataset and where it is set, e.g.
+// local, default or inherited from pool/data.
+type Property struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Dataset is a filesystem or volume with its properties.
+type Dataset struct {
+	Name       string              `json:"name"`
+	Properties map[string]Property `json:"properties"`
+}
+
+// Uint returns the numeric value of a property. It is not ok for properties
+// without a value, e.g. "-" for the quota of a volume, or "none".
+func (d Dataset) Uint(name string) (uint64, bool) {
+	v, err := strconv.ParseUint(d.Properties[name].Value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// Ratio returns the value of a ratio property like compressratio. It is not ok
+// for properties without a value.
+func (d Dataset) Ratio(name string) (float64, bool) {
+	return ParseRatio(d.Properties[name].Value)
+}
+
+// ParseRatio parses a ratio like 1.85x, zfs get -p omits the x. It is not ok
+// for "-" and other values, which aren't ratios.
+func ParseRatio(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// IsVolume reports whether the dataset is a volume.
+func (d Dataset) IsVolume() bool {
+	return d.Properties["type"].Value == "volume"
+}
+
+// Pool returns the pool of the dataset.
+func (d Dataset) Pool() string {
+	pool, _, _ := strings.Cut(d.Name, "/")
+	return pool
+}
+
+// Parse parses the output of zfs get -H -p -o name,property,value,source. The
+// datasets are in the order of the output.
+func Parse(r io.Reader) ([]Dataset, error) {
+	var (
+		result  []Dataset
+		byName  = make(map[string]int)
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// values like mountpoints may contain spaces, the columns are
+		// separated by tabs
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+		idx, ok := byName[fields[0]]
+		if !ok {
+			idx = len(result)
+			byName[fields[0]] = idx
+			result = append(result, Dataset{Name: fields[0], Properties: make(map[string]Property)})
+		}
+		result[idx].Properties[fields[1]] = Property{Value: fields[2], Source: fields[3]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Options configure the dataset collector.
+type Options struct {
+	// Keep decides which datasets are exported, all are exported if it is
+	// nil.
+	Keep func(dataset string) bool
+
+	// AllKeyStatuses exports the key status of every dataset, instead of only
+	// the encryption roots.
+	AllKeyStatuses bool
+
+	// Properties are exported as zfs_dataset_property, if their values are
+	// numbers or sizes, and as zfs_dataset_property_info otherwise.
+	Properties []string
+}
+
+type datasetCollector struct {
+	logger  zerolog.Logger
+	fetcher *Fetcher
+	opts    Options
+
+	// kept are the datasets of generation of the fetcher, which are
+	// exported
+	mtx        sync.Mutex
+	kept       []Dataset
+	generation uint64
+
+	descQuota          *prometheus.Desc
+	descRefquota       *prometheus.Desc
+	descReservation    *prometheus.Desc
+	descRefreservation *prometheus.Desc
+	descQuotaUsedRatio *prometheus.Desc
+	descUsed           *prometheus.Desc
+
+	descCompressRatio     *prometheus.Desc
+	descRefcompressRatio  *prometheus.Desc
+	descPoolCompressRatio *prometheus.Desc
+
+	descLogicalUsed       *prometheus.Desc
+	descLogicalReferenced *prometheus.Desc
+	descSpaceSavingRatio  *prometheus.Desc
+
+	descSnapshotLimit          *prometheus.Desc
+	descSnapshotCount          *prometheus.Desc
+	descSnapshotLimitUsedRatio *prometheus.Desc
+	descFilesystemLimit        *prometheus.Desc
+	descFilesystemCount        *prometheus.Desc
+
+	descKeyStatus *prometheus.Desc
+	descMounted   *prometheus.Desc
+	descOrigin    *prometheus.Desc
+
+	descVolumeSize           *prometheus.Desc
+	descVolumeUsed           *prometheus.Desc
+	descVolumeReferenced     *prometheus.Desc
+	descVolumeRefreservation *prometheus.Desc
+	descVolumeThin           *prometheus.Desc
+
+	descProperty     *prometheus.Desc
+	descPropertyInfo *prometheus.Desc
+}
+
+// NewCollector creates a collector for the properties of all datasets, which
+// are fetched by fetcher. The built-in and the configured properties are
+// registered with the fetcher. All metric names are prefixed with namespace.
+func NewCollector(logger zerolog.Logger, fetcher *Fetcher, namespace string, opts Options) *datasetCollector {
+	if opts.Keep == nil {
+		opts.Keep = func(string) bool { return true }
+	}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "dataset", name), help, append([]string{"dataset"}, labels...), nil)
+	}
+	volumeDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "volume", name), help, []string{"dataset"}, nil)
+	}
+	fetcher.Register(properties...)
+	fetcher.Register(opts.Properties...)
+	return &datasetCollector{
+		logger:  logger.With().Str("collector", "dataset").Logger(),
+		fetcher: fetcher,
+		opts:    opts,
+
+		descQuota:          desc("quota_bytes", "Quota of a ZFS dataset and its descendants, 0 without a quota."),
+		descRefquota:       desc("refquota_bytes", "Quota of the space referenced by a ZFS dataset, 0 without a quota."),
+		descReservation:    desc("reservation_bytes", "Space reserved for a ZFS dataset and its descendants."),
+		descRefreservation: desc("refreservation_bytes", "Space reserved for the data referenced by a ZFS dataset."),
+		descQuotaUsedRatio: desc("quota_used_ratio", "Ratio of the space used by a ZFS dataset and its descendants to its quota, only datasets with a quota are exported."),
+		descUsed:           desc("used_bytes", "Space used by a ZFS dataset by source, the data of the dataset, its snapshots, its children and its refreservation. The sources sum up to the used space.", "source"),
+
+		descCompressRatio:    desc("compressratio", "Compression ratio achieved for the data of a ZFS dataset and its descendants."),
+		descRefcompressRatio: desc("refcompressratio", "Compression ratio achieved for the data referenced by a ZFS dataset."),
+		descPoolCompressRatio: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "compressratio"),
+			"Compression ratio of the datasets of a ZFS pool, weighted by their referenced bytes.",
+			[]string{"pool"}, nil,
+		),
+
+		descLogicalUsed:       desc("logicalused_bytes", "Logical size of the data of a ZFS dataset and its descendants, before compression."),
+		descLogicalReferenced: desc("logicalreferenced_bytes", "Logical size of the data referenced by a ZFS dataset, before compression."),
+		descSpaceSavingRatio:  desc("space_saving_ratio", "Ratio of the logical to the used space of a ZFS dataset and its descendants."),
+
+		descSnapshotLimit:          desc("snapshot_limit", "Limit of the snapshots of a ZFS dataset and its descendants, only datasets with a limit are exported."),
+		descSnapshotCount:          desc("snapshot_count_property", "Snapshots of a ZFS dataset and its descendants counted against its snapshot_limit, only datasets with a limit are exported."),
+		descSnapshotLimitUsedRatio: desc("snapshot_limit_used_ratio", "Ratio of the snapshots of a ZFS dataset and its descendants to its snapshot_limit, only datasets with a limit are exported."),
+		descFilesystemLimit:        desc("filesystem_limit", "Limit of the filesystems and volumes below a ZFS dataset, only datasets with a limit are exported."),
+		descFilesystemCount:        desc("filesystem_count_property", "Filesystems and volumes below a ZFS dataset counted against its filesystem_limit, only datasets with a limit are exported."),
+
+		descKeyStatus: desc("keystatus", "Whether the encryption key of a ZFS dataset is loaded, none for unencrypted datasets.", "status"),
+		descMounted:   desc("mounted", "Whether a ZFS filesystem is mounted, only filesystems mounted automatically are exported."),
+		descOrigin:    desc("origin_info", "A metric with a constant '1' value labeled by the snapshot a ZFS clone was created from.", "origin"),
+
+		descVolumeSize:           volumeDesc("size_bytes", "Logical size of a ZFS volume."),
+		descVolumeUsed:           volumeDesc("used_bytes", "Space used by a ZFS volume, including its snapshots and reservation."),
+		descVolumeReferenced:     volumeDesc("referenced_bytes", "Space referenced by the data of a ZFS volume."),
+		descVolumeRefreservation: volumeDesc("refreservation_bytes", "Space reserved for the data of a ZFS volume."),
+		descVolumeThin:           volumeDesc("thin_provisioned", "Whether less space is reserved for a ZFS volume than its size."),
+
+		descProperty:     desc("property", "Value of a numeric property of a ZFS dataset, sizes are in bytes.", "property"),
+		descPropertyInfo: desc("property_info", "A metric with a constant '1' value labeled by the value of a property of a ZFS dataset.", "property", "value"),
+	}
+}
+
+// Notify refreshes the properties of the fetcher on the next collection, if
+// event changes them.
+func (c *datasetCollector) Notify(event *events.Event) {
+	c.fetcher.Notify(event)
+}
+
+// refresh returns the exported datasets. They are only filtered again, if the
+// fetcher fetched them again.
+func (c *datasetCollector) refresh(ctx context.Context) ([]Dataset, error) {
+	datasets, generation, err := c.fetcher.Datasets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if generation != c.generation {
+		c.kept = nil
+		for _, d := range datasets {
+			if c.opts.Keep(d.Name) {
+				c.kept = append(c.kept, d)
+			}
+		}
+		c.generation = generation
+	}
+	return c.kept, nil
+}
+
+func (c *datasetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descQuota
+	ch <- c.descRefquota
+	ch <- c.descReservation
+	ch <- c.descRefreservation
+	ch <- c.descQuotaUsedRatio
+	ch <- c.descUsed
+	ch <- c.descCompressRatio
+	ch <- c.descRefcompressRatio
+	ch <- c.descPoolCompressRatio
+	ch <- c.descLogicalUsed
+	ch <- c.descLogicalReferenced
+	ch <- c.descSpaceSavingRatio
+	ch <- c.descSnapshotLimit
+	ch <- c.descSnapshotCount
+	ch <- c.descSnapshotLimitUsedRatio
+	ch <- c.descFilesystemLimit
+	ch <- c.descFilesystemCount
+	ch <- c.descKeyStatus
+	ch <- c.descMounted
+	ch <- c.descOrigin
+	ch <- c.descVolumeSize
+	ch <- c.descVolumeUsed
+	ch <- c.descVolumeReferenced
+	ch <- c.descVolumeRefreservation
+	ch <- c.descVolumeThin
+	ch <- c.descProperty
+	ch <- c.descPropertyInfo
+}
+
+func (c *datasetCollector) Collect(ch chan<- prometheus.Metric) {
+	datasets, err := c.refresh(context.Background())
+	if errors.Is(err, command.ErrUnavailable) {
+		// there are no datasets without ZFS, this is reported by zfs_up
+		c.logger.Debug().Err(err).Msg("ZFS is not available")
+		return
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to refresh datasets")
+		ch <- prometheus.NewInvalidMetric(c.descQuota, err)
+		return
+	}
+	for _, d := range datasets {
+		c.collectSpace(ch, d)
+		c.collectUsed(ch, d)
+		c.collectCompression(ch, d)
+		c.collectLogical(ch, d)
+		c.collectLimits(ch, d)
+		c.collectKeyStatus(ch, d)
+		c.collectMounted(ch, d)
+		if origin := d.Properties["origin"].Value; origin != "" && origin != "-" {
+			ch <- prometheus.MustNewConstMetric(c.descOrigin, prometheus.GaugeValue, 1, d.Name, origin)
+		}
+		if d.IsVolume() {
+			c.collectVolume(ch, d)
+		}
+		c.collectProperties(ch, d)
+	}
+	c.collectPoolCompression(ch, datasets)
+}
+
+// collectSpace exports the quotas and reservations of d. Properties without
+// a value, e.g. the quota of a volume, are left out.
+func (c *datasetCollector) collectSpace(ch chan<- prometheus.Metric, d Dataset) {
+	for _, p := range []struct {
+		desc *prometheus.Desc
+		name string
+	}{
+		{c.descQuota, "quota"},
+		{c.descRefquota, "refquota"},
+		{c.descReservation, "reservation"},
+		{c.descRefreservation, "refreservation"},
+	} {
+		if v, ok := d.Uint(p.name); ok {
+			ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, float64(v), d.Name)
+		}
+	}
+
+	// without a quota, which is 0 for none, there is nothing to relate to
+	quota, ok := d.Uint("quota")
+	if !ok || quota == 0 {
+		return
+	}
+	if used, ok := d.Uint("used"); ok {
+		ch <- prometheus.MustNewConstMetric(c.descQuotaUsedRatio, prometheus.GaugeValue, float64(used)/float64(quota), d.Name)
+	}
+}
+
+// collectUsed exports the breakdown of the space used by d.
+func (c *datasetCollector) collectUsed(ch chan<- prometheus.Metric, d Dataset) {
+	for _, s := range usedBySources {
+		if v, ok := d.Uint(s.property); ok {
+			ch <- prometheus.MustNewConstMetric(c.descUsed, prometheus.GaugeValue, float64(v), d.Name, s.source)
+		}
+	}
+}
+
+// collectCompression exports the compression ratios of d.
+func (c *datasetCollector) collectCompression(ch chan<- prometheus.Metric, d Dataset) {
+	if v, ok := d.Ratio("compressratio"); ok {
+		ch <- prometheus.MustNewConstMetric(c.descCompressRatio, prometheus.GaugeValue, v, d.Name)
+	}
+	if v, ok := d.Ratio("refcompressratio"); ok {
+		ch <- prometheus.MustNewConstMetric(c.descRefcompressRatio, prometheus.GaugeValue, v, d.Name)
+	}
+}
+
+// collectLogical exports the logical space of d and how much space is saved
+// by compression. The ratio is left out for empty datasets.
+func (c *datasetCollector) collectLogical(ch chan<- prometheus.Metric, d Dataset) {
+	logical, ok := d.Uint("logicalused")
+	if ok {
+		ch <- prometheus.MustNewConstMetric(c.descLogicalUsed, prometheus.GaugeValue, float64(logical), d.Name)
+	}
+	if v, ok := d.Uint("logicalreferenced"); ok {
+		ch <- prometheus.MustNewConstMetric(c.descLogicalReferenced, prometheus.GaugeValue, float64(v), d.Name)
+	}
+
+	if !ok {
+		return
+	}
+	used, ok := d.Uint("used")
+	if !ok || used == 0 {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.descSpaceSavingRatio, prometheus.GaugeValue, float64(logical)/float64(used), d.Name)
+}
+
+// collectPoolCompression exports the compression ratio of every pool. Every
+// byte referenced by a dataset of the pool counts once, so the ratio is the
+// logical size of the referenced data divided by its physical size.
+func (c *datasetCollector) collectPoolCompression(ch chan<- prometheus.Metric, datasets []Dataset) {
+	type sizes struct {
+		logical, physical float64
+	}
+	pools := make(map[string]*sizes)
+	for _, d := range datasets {
+		referenced, ok := d.Uint("referenced")
+		if !ok {
+			continue
+		}
+		ratio, ok := d.Ratio("refcompressratio")
+		if !ok {
+			continue
+		}
+		p, ok := pools[d.Pool()]
+		if !ok {
+			p = new(sizes)
+			pools[d.Pool()] = p
+		}
+		p.logical += float64(referenced) * ratio
+		p.physical += float64(referenced)
+	}
+	for pool, p := range pools {
+		// an empty pool doesn't compress anything
+		ratio := 1.0
+		if p.physical > 0 {
+			ratio = p.logical / p.physical
+		}
+		ch <- prometheus.MustNewConstMetric(c.descPoolCompressRatio, prometheus.GaugeValue, ratio, pool)
+	}
+}
+
+// collectLimits exports the snapshot and filesystem limits of d with the counts
+// they are enforced against. Limits which aren't set are none, or the largest
+// uint64 with zfs get -p on some releases, they are left out with their counts.
+func (c *datasetCollector) collectLimits(ch chan<- prometheus.Metric, d Dataset) {
+	if limit, ok := d.Uint("snapshot_limit"); ok && limit != math.MaxUint64 {
+		ch <- prometheus.MustNewConstMetric(c.descSnapshotLimit, prometheus.GaugeValue, float64(limit), d.Name)
+		if count, ok := d.Uint("snapshot_count"); ok {
+			ch <- prometheus.MustNewConstMetric(c.descSnapshotCount, prometheus.GaugeValue, float64(count), d.Name)
+			// a limit of 0 forbids snapshots, there is nothing to relate to
+			if limit > 0 {
+				ch <- prometheus.MustNewConstMetric(c.descSnapshotLimitUsedRatio, prometheus.GaugeValue, float64(count)/float64(limit), d.Name)
+			}
+		}
+	}
+	if limit, ok := d.Uint("filesystem_limit"); ok && limit != math.MaxUint64 {
+		ch <- prometheus.MustNewConstMetric(c.descFilesystemLimit, prometheus.GaugeValue, float64(limit), d.Name)
+		if count, ok := d.Uint("filesystem_count"); ok {
+			ch <- prometheus.MustNewConstMetric(c.descFilesystemCount, prometheus.GaugeValue, float64(count), d.Name)
+		}
+	}
+}
+
+// collectKeyStatus exports whether the key of d is loaded. Unless all key
+// statuses are exported, only encryption roots are, as the key status of
+// their descendants is the same.
+func (c *datasetCollector) collectKeyStatus(ch chan<- prometheus.Metric, d Dataset) {
+	root := d.Properties["encryptionroot"].Value
+	if !c.opts.AllKeyStatuses && root != d.Name {
+		return
+	}
+
+	status := d.Properties["keystatus"].Value
+	if encryption := d.Properties["encryption"].Value; encryption == "off" || status == "-" || status == "" {
+		status = "none"
+	}
+	for _, s := range keyStatuses {
+		value := 0.0
+		if s == status {
+			value = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(c.descKeyStatus, prometheus.GaugeValue, value, d.Name, s)
+	}
+}
+
+// collectMounted exports whether d is mounted. Only filesystems, which are
+// mounted by zfs mount -a, are exported, so a filesystem not mounted is an
+// error. Volumes, filesystems with canmount=noauto or off and legacy
+// mountpoints are left out.
+func (c *datasetCollector) collectMounted(ch chan<- prometheus.Metric, d Dataset) {
+	if d.Properties["canmount"].Value != "on" {
+		return
+	}
+	switch d.Properties["mountpoint"].Value {
+	case "legacy", "none", "-", "":
+		return
+	}
+
+	mounted := 0.0
+	if d.Properties["mounted"].Value == "yes" {
+		mounted = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.descMounted, prometheus.GaugeValue, mounted, d.Name)
+}
+
+// collectVolume exports the size and space of the volume d. A volume is thin
+// provisioned, when its refreservation doesn't cover its size, e.g. for
+// volumes created with zfs create -s.
+func (c *datasetCollector) collectVolume(ch chan<- prometheus.Metric, d Dataset) {
+	for _, p := range []struct {
+		desc *prometheus.Desc
+		name string
+	}{
+		{c.descVolumeSize, "volsize"},
+		{c.descVolumeUsed, "used"},
+		{c.descVolumeReferenced, "referenced"},
+		{c.descVolumeRefreservation, "refreservation"},
+	} {
+		if v, ok := d.Uint(p.name); ok {
+			ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, float64(v), d.Name)
+		}
+	}
+
+	size, ok := d.Uint("volsize")
+	if !ok {
+		return
+	}
+	refreservation, ok := d.Uint("refreservation")
+	if !ok {
+		return
+	}
+	thin := 0.0
+	if refreservation < size {
+		thin = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.descVolumeThin, prometheus.GaugeValue, thin, d.Name)
+}
@@ -0,0 +1,402 @@
+package dataset
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+// newFixtureCollector returns a collector reading its properties from the
+// fixture name and the number of calls to zfs get.
+func newFixtureCollector(t *testing.T, name string) (*datasetCollector, *int) {
+	t.Helper()
+	return newFixtureCollectorWithOptions(t, name, Options{})
+}
+
+func newFixtureCollectorWithOptions(t *testing.T, name string, opts Options) (*datasetCollector, *int) {
+	t.Helper()
+	calls := new(int)
+	c := NewCollector(zerolog.Nop(), NewGetFetcher(func(context.Context, []string) ([]byte, error) {
+		*calls++
+		return os.ReadFile(filepath.Join("testdata", name))
+	}, time.Minute), "zfs", opts)
+	return c, calls
+}
+
+func TestParse(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "get-space.txt"))
+	require.NoError(t, err)
+	datasets, err := Parse(strings.NewReader(string(data)))
+	require.NoError(t, err)
+	require.Len(t, datasets, 4)
+	require.Equal(t, "tank/home", datasets[1].Name)
+	require.Equal(t, Property{Value: "107374182400", Source: "local"}, datasets[1].Properties["quota"])
+
+	quota, ok := datasets[1].Uint("quota")
+	require.True(t, ok)
+	require.Equal(t, uint64(107374182400), quota)
+	_, ok = datasets[3].Uint("quota")
+	require.False(t, ok)
+	_, ok = datasets[3].Uint("missing")
+	require.False(t, ok)
+
+	// values may contain spaces
+	datasets, err = Parse(strings.NewReader("tank/media\tmountpoint\t/srv/my media\tlocal\n"))
+	require.NoError(t, err)
+	require.Equal(t, "/srv/my media", datasets[0].Properties["mountpoint"].Value)
+
+	_, err = Parse(strings.NewReader("tank used 1 -\n"))
+	require.Error(t, err)
+}
+
+func TestCollectorSpace(t *testing.T) {
+	c, _ := newFixtureCollector(t, "get-space.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_quota_bytes Quota of a ZFS dataset and its descendants, 0 without a quota.
+# TYPE zfs_dataset_quota_bytes gauge
+zfs_dataset_quota_bytes{dataset="tank"} 0
+zfs_dataset_quota_bytes{dataset="tank/home"} 1.073741824e+11
+zfs_dataset_quota_bytes{dataset="tank/home/alice"} 0
+# HELP zfs_dataset_quota_used_ratio Ratio of the space used by a ZFS dataset and its descendants to its quota, only datasets with a quota are exported.
+# TYPE zfs_dataset_quota_used_ratio gauge
+zfs_dataset_quota_used_ratio{dataset="tank/home"} 0.75
+# HELP zfs_dataset_refquota_bytes Quota of the space referenced by a ZFS dataset, 0 without a quota.
+# TYPE zfs_dataset_refquota_bytes gauge
+zfs_dataset_refquota_bytes{dataset="tank"} 0
+zfs_dataset_refquota_bytes{dataset="tank/home"} 0
+zfs_dataset_refquota_bytes{dataset="tank/home/alice"} 6.442450944e+10
+# HELP zfs_dataset_refreservation_bytes Space reserved for the data referenced by a ZFS dataset.
+# TYPE zfs_dataset_refreservation_bytes gauge
+zfs_dataset_refreservation_bytes{dataset="tank"} 0
+zfs_dataset_refreservation_bytes{dataset="tank/home"} 0
+zfs_dataset_refreservation_bytes{dataset="tank/home/alice"} 0
+zfs_dataset_refreservation_bytes{dataset="tank/vm-100-disk-0"} 3.4359738368e+10
+# HELP zfs_dataset_reservation_bytes Space reserved for a ZFS dataset and its descendants.
+# TYPE zfs_dataset_reservation_bytes gauge
+zfs_dataset_reservation_bytes{dataset="tank"} 0
+zfs_dataset_reservation_bytes{dataset="tank/home"} 1.073741824e+10
+zfs_dataset_reservation_bytes{dataset="tank/home/alice"} 0
+zfs_dataset_reservation_bytes{dataset="tank/vm-100-disk-0"} 0
+`)))
+}
+
+func TestCollectorUsed(t *testing.T) {
+	c, _ := newFixtureCollector(t, "get-usedby.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_used_bytes Space used by a ZFS dataset by source, the data of the dataset, its snapshots, its children and its refreservation. The sources sum up to the used space.
+# TYPE zfs_dataset_used_bytes gauge
+zfs_dataset_used_bytes{dataset="tank",source="children"} 1.14890375168e+11
+zfs_dataset_used_bytes{dataset="tank",source="dataset"} 98304
+zfs_dataset_used_bytes{dataset="tank",source="refreservation"} 0
+zfs_dataset_used_bytes{dataset="tank",source="snapshots"} 0
+zfs_dataset_used_bytes{dataset="tank/home",source="children"} 5.36870912e+10
+zfs_dataset_used_bytes{dataset="tank/home",source="dataset"} 2.147483648e+10
+zfs_dataset_used_bytes{dataset="tank/home",source="refreservation"} 0
+zfs_dataset_used_bytes{dataset="tank/home",source="snapshots"} 5.36870912e+09
+zfs_dataset_used_bytes{dataset="tank/home/alice",source="children"} 0
+zfs_dataset_used_bytes{dataset="tank/home/alice",source="dataset"} 4.294967296e+10
+zfs_dataset_used_bytes{dataset="tank/home/alice",source="refreservation"} 0
+zfs_dataset_used_bytes{dataset="tank/home/alice",source="snapshots"} 1.073741824e+10
+zfs_dataset_used_bytes{dataset="tank/vm-100-disk-0",source="children"} 0
+zfs_dataset_used_bytes{dataset="tank/vm-100-disk-0",source="dataset"} 8.589934592e+09
+zfs_dataset_used_bytes{dataset="tank/vm-100-disk-0",source="refreservation"} 2.4696061952e+10
+zfs_dataset_used_bytes{dataset="tank/vm-100-disk-0",source="snapshots"} 1.073741824e+09
+`), "zfs_dataset_used_bytes"))
+}
+
+// TestUsedBySum checks that the breakdown of every fixture sums up to used, as
+// it does for zfs.
+func TestUsedBySum(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "get-*.txt"))
+	require.NoError(t, err)
+	var checked int
+	for _, fixture := range fixtures {
+		data, err := os.ReadFile(fixture)
+		require.NoError(t, err)
+		datasets, err := Parse(strings.NewReader(string(data)))
+		require.NoError(t, err)
+		for _, d := range datasets {
+			if _, ok := d.Properties["usedbydataset"]; !ok {
+				continue
+			}
+			used, ok := d.Uint("used")
+			require.True(t, ok, "%s: %s", fixture, d.Name)
+			var sum uint64
+			for _, s := range usedBySources {
+				v, ok := d.Uint(s.property)
+				require.True(t, ok, "%s: %s %s", fixture, d.Name, s.property)
+				sum += v
+			}
+			require.Equal(t, used, sum, "%s: %s", fixture, d.Name)
+			checked++
+		}
+	}
+	require.NotZero(t, checked)
+}
+
+func TestCollectorLimits(t *testing.T) {
+	c, _ := newFixtureCollector(t, "get-limits.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_filesystem_count_property Filesystems and volumes below a ZFS dataset counted against its filesystem_limit, only datasets with a limit are exported.
+# TYPE zfs_dataset_filesystem_count_property gauge
+zfs_dataset_filesystem_count_property{dataset="tank/tenants"} 3
+# HELP zfs_dataset_filesystem_limit Limit of the filesystems and volumes below a ZFS dataset, only datasets with a limit are exported.
+# TYPE zfs_dataset_filesystem_limit gauge
+zfs_dataset_filesystem_limit{dataset="tank/tenants"} 20
+# HELP zfs_dataset_snapshot_count_property Snapshots of a ZFS dataset and its descendants counted against its snapshot_limit, only datasets with a limit are exported.
+# TYPE zfs_dataset_snapshot_count_property gauge
+zfs_dataset_snapshot_count_property{dataset="tank/tenants/alice"} 75
+zfs_dataset_snapshot_count_property{dataset="tank/tenants/bob"} 0
+# HELP zfs_dataset_snapshot_limit Limit of the snapshots of a ZFS dataset and its descendants, only datasets with a limit are exported.
+# TYPE zfs_dataset_snapshot_limit gauge
+zfs_dataset_snapshot_limit{dataset="tank/tenants/alice"} 100
+zfs_dataset_snapshot_limit{dataset="tank/tenants/bob"} 0
+# HELP zfs_dataset_snapshot_limit_used_ratio Ratio of the snapshots of a ZFS dataset and its descendants to its snapshot_limit, only datasets with a limit are exported.
+# TYPE zfs_dataset_snapshot_limit_used_ratio gauge
+zfs_dataset_snapshot_limit_used_ratio{dataset="tank/tenants/alice"} 0.75
+`), "zfs_dataset_snapshot_limit", "zfs_dataset_snapshot_count_property", "zfs_dataset_snapshot_limit_used_ratio", "zfs_dataset_filesystem_limit", "zfs_dataset_filesystem_count_property"))
+
+	// the largest uint64 is an unset limit as well
+	c = NewCollector(zerolog.Nop(), NewGetFetcher(func(context.Context, []string) ([]byte, error) {
+		return []byte("tank\tsnapshot_limit\t18446744073709551615\tdefault\ntank\tsnapshot_count\t12\t-\n"), nil
+	}, time.Minute), "zfs", Options{})
+	require.Equal(t, 0, testutil.CollectAndCount(c, "zfs_dataset_snapshot_limit", "zfs_dataset_snapshot_count_property"))
+}
+
+func TestParseRatio(t *testing.T) {
+	for in, expected := range map[string]float64{
+		"1.00x": 1,
+		"1.85x": 1.85,
+		"1.85":  1.85,
+		"12.5x": 12.5,
+	} {
+		v, ok := ParseRatio(in)
+		require.True(t, ok, in)
+		require.Equal(t, expected, v, in)
+	}
+	for _, in := range []string{"-", "", "x", "none", "-1.00x"} {
+		_, ok := ParseRatio(in)
+		require.False(t, ok, in)
+	}
+}
+
+func TestCollectorCompression(t *testing.T) {
+	// tank/scratch is excluded from the datasets and from the pool ratio
+	c, _ := newFixtureCollectorWithOptions(t, "get-compression.txt", Options{
+		Keep: func(dataset string) bool { return dataset != "tank/scratch" },
+	})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_compressratio Compression ratio achieved for the data of a ZFS dataset and its descendants.
+# TYPE zfs_dataset_compressratio gauge
+zfs_dataset_compressratio{dataset="backup"} 1
+zfs_dataset_compressratio{dataset="tank"} 1.52
+zfs_dataset_compressratio{dataset="tank/db"} 2.1
+zfs_dataset_compressratio{dataset="tank/logs"} 1.3
+# HELP zfs_dataset_refcompressratio Compression ratio achieved for the data referenced by a ZFS dataset.
+# TYPE zfs_dataset_refcompressratio gauge
+zfs_dataset_refcompressratio{dataset="tank"} 1
+zfs_dataset_refcompressratio{dataset="tank/db"} 2.1
+zfs_dataset_refcompressratio{dataset="tank/logs"} 1.3
+# HELP zfs_pool_compressratio Compression ratio of the datasets of a ZFS pool, weighted by their referenced bytes.
+# TYPE zfs_pool_compressratio gauge
+zfs_pool_compressratio{pool="tank"} 1.4999988555934396
+`), "zfs_dataset_compressratio", "zfs_dataset_refcompressratio", "zfs_pool_compressratio"))
+}
+
+func TestCollectorLogical(t *testing.T) {
+	c, _ := newFixtureCollector(t, "get-logical.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_logicalreferenced_bytes Logical size of the data referenced by a ZFS dataset, before compression.
+# TYPE zfs_dataset_logicalreferenced_bytes gauge
+zfs_dataset_logicalreferenced_bytes{dataset="tank/compressed"} 2.147483648e+09
+zfs_dataset_logicalreferenced_bytes{dataset="tank/dedup"} 4.294967296e+09
+zfs_dataset_logicalreferenced_bytes{dataset="tank/empty"} 0
+# HELP zfs_dataset_logicalused_bytes Logical size of the data of a ZFS dataset and its descendants, before compression.
+# TYPE zfs_dataset_logicalused_bytes gauge
+zfs_dataset_logicalused_bytes{dataset="tank/compressed"} 2.68435456e+09
+zfs_dataset_logicalused_bytes{dataset="tank/dedup"} 4.294967296e+09
+zfs_dataset_logicalused_bytes{dataset="tank/empty"} 0
+# HELP zfs_dataset_space_saving_ratio Ratio of the logical to the used space of a ZFS dataset and its descendants.
+# TYPE zfs_dataset_space_saving_ratio gauge
+zfs_dataset_space_saving_ratio{dataset="tank/compressed"} 2.5
+zfs_dataset_space_saving_ratio{dataset="tank/dedup"} 1
+`), "zfs_dataset_logicalused_bytes", "zfs_dataset_logicalreferenced_bytes", "zfs_dataset_space_saving_ratio"))
+}
+
+func TestCollectorRefresh(t *testing.T) {
+	c, calls := newFixtureCollector(t, "get-space.txt")
+	now := time.Unix(1700000000, 0)
+	c.fetcher.now = func() time.Time { return now }
+
+	testutil.CollectAndCount(c)
+	testutil.CollectAndCount(c)
+	require.Equal(t, 1, *calls)
+
+	now = now.Add(time.Minute)
+	testutil.CollectAndCount(c)
+	require.Equal(t, 2, *calls)
+}
+
+func TestCollectorOrigin(t *testing.T) {
+	fixture := "get-origin.txt"
+	c := NewCollector(zerolog.Nop(), NewGetFetcher(func(context.Context, []string) ([]byte, error) {
+		return os.ReadFile(filepath.Join("testdata", fixture))
+	}, time.Minute), "zfs", Options{})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_origin_info A metric with a constant '1' value labeled by the snapshot a ZFS clone was created from.
+# TYPE zfs_dataset_origin_info gauge
+zfs_dataset_origin_info{dataset="tank/clone",origin="tank/base@golden"} 1
+zfs_dataset_origin_info{dataset="tank/clone2",origin="tank/base@golden"} 1
+`), "zfs_dataset_origin_info"))
+
+	// zfs promote tank/clone swaps the edge, the snapshot moves to the clone
+	fixture = "get-origin-promoted.txt"
+	c.Notify(&events.Event{HistoryInternalName: "promote", HistoryDSName: "tank/clone"})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_origin_info A metric with a constant '1' value labeled by the snapshot a ZFS clone was created from.
+# TYPE zfs_dataset_origin_info gauge
+zfs_dataset_origin_info{dataset="tank/base",origin="tank/clone@golden"} 1
+zfs_dataset_origin_info{dataset="tank/clone2",origin="tank/clone@golden"} 1
+`), "zfs_dataset_origin_info"))
+
+	// destroying the former origin removes its edge
+	fixture = "get-origin-destroyed.txt"
+	c.Notify(&events.Event{HistoryInternalName: "destroy", HistoryDSName: "tank/base"})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_origin_info A metric with a constant '1' value labeled by the snapshot a ZFS clone was created from.
+# TYPE zfs_dataset_origin_info gauge
+zfs_dataset_origin_info{dataset="tank/clone2",origin="tank/clone@golden"} 1
+`), "zfs_dataset_origin_info"))
+}
+
+func TestCollectorErrors(t *testing.T) {
+	c := NewCollector(zerolog.Nop(), NewGetFetcher(func(context.Context, []string) ([]byte, error) {
+		return nil, command.ErrUnavailable
+	}, time.Minute), "zfs", Options{})
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	c = NewCollector(zerolog.Nop(), NewGetFetcher(func(context.Context, []string) ([]byte, error) {
+		return []byte("invalid\n"), nil
+	}, time.Minute), "zfs", Options{})
+	require.Error(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+}
+
+func TestCollectorKeyStatus(t *testing.T) {
+	// only the encryption roots are exported by default
+	c, _ := newFixtureCollector(t, "get-keystatus.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_keystatus Whether the encryption key of a ZFS dataset is loaded, none for unencrypted datasets.
+# TYPE zfs_dataset_keystatus gauge
+zfs_dataset_keystatus{dataset="tank/backup",status="available"} 0
+zfs_dataset_keystatus{dataset="tank/backup",status="none"} 0
+zfs_dataset_keystatus{dataset="tank/backup",status="unavailable"} 1
+zfs_dataset_keystatus{dataset="tank/secret",status="available"} 1
+zfs_dataset_keystatus{dataset="tank/secret",status="none"} 0
+zfs_dataset_keystatus{dataset="tank/secret",status="unavailable"} 0
+`), "zfs_dataset_keystatus"))
+
+	c, _ = newFixtureCollectorWithOptions(t, "get-keystatus.txt", Options{AllKeyStatuses: true})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_keystatus Whether the encryption key of a ZFS dataset is loaded, none for unencrypted datasets.
+# TYPE zfs_dataset_keystatus gauge
+zfs_dataset_keystatus{dataset="tank",status="available"} 0
+zfs_dataset_keystatus{dataset="tank",status="none"} 1
+zfs_dataset_keystatus{dataset="tank",status="unavailable"} 0
+zfs_dataset_keystatus{dataset="tank/backup",status="available"} 0
+zfs_dataset_keystatus{dataset="tank/backup",status="none"} 0
+zfs_dataset_keystatus{dataset="tank/backup",status="unavailable"} 1
+zfs_dataset_keystatus{dataset="tank/secret",status="available"} 1
+zfs_dataset_keystatus{dataset="tank/secret",status="none"} 0
+zfs_dataset_keystatus{dataset="tank/secret",status="unavailable"} 0
+zfs_dataset_keystatus{dataset="tank/secret/mail",status="available"} 1
+zfs_dataset_keystatus{dataset="tank/secret/mail",status="none"} 0
+zfs_dataset_keystatus{dataset="tank/secret/mail",status="unavailable"} 0
+`), "zfs_dataset_keystatus"))
+}
+
+func TestCollectorMounted(t *testing.T) {
+	// canmount=noauto and off, legacy mountpoints and volumes are left out
+	c, _ := newFixtureCollector(t, "get-mounted.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_mounted Whether a ZFS filesystem is mounted, only filesystems mounted automatically are exported.
+# TYPE zfs_dataset_mounted gauge
+zfs_dataset_mounted{dataset="tank"} 1
+zfs_dataset_mounted{dataset="tank/home"} 0
+zfs_dataset_mounted{dataset="tank/media"} 1
+`), "zfs_dataset_mounted"))
+}
+
+func TestCollectorVolumes(t *testing.T) {
+	// vm-101 is sparse, the empty volume reserves all of its zero bytes
+	c, _ := newFixtureCollector(t, "get-volumes.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_volume_referenced_bytes Space referenced by the data of a ZFS volume.
+# TYPE zfs_volume_referenced_bytes gauge
+zfs_volume_referenced_bytes{dataset="tank/empty"} 0
+zfs_volume_referenced_bytes{dataset="tank/vm-100-disk-0"} 1.2884901888e+10
+zfs_volume_referenced_bytes{dataset="tank/vm-101-disk-0"} 2.147483648e+10
+# HELP zfs_volume_refreservation_bytes Space reserved for the data of a ZFS volume.
+# TYPE zfs_volume_refreservation_bytes gauge
+zfs_volume_refreservation_bytes{dataset="tank/empty"} 0
+zfs_volume_refreservation_bytes{dataset="tank/vm-100-disk-0"} 3.5433480192e+10
+zfs_volume_refreservation_bytes{dataset="tank/vm-101-disk-0"} 0
+# HELP zfs_volume_size_bytes Logical size of a ZFS volume.
+# TYPE zfs_volume_size_bytes gauge
+zfs_volume_size_bytes{dataset="tank/empty"} 0
+zfs_volume_size_bytes{dataset="tank/vm-100-disk-0"} 3.4359738368e+10
+zfs_volume_size_bytes{dataset="tank/vm-101-disk-0"} 1.073741824e+11
+# HELP zfs_volume_thin_provisioned Whether less space is reserved for a ZFS volume than its size.
+# TYPE zfs_volume_thin_provisioned gauge
+zfs_volume_thin_provisioned{dataset="tank/empty"} 0
+zfs_volume_thin_provisioned{dataset="tank/vm-100-disk-0"} 0
+zfs_volume_thin_provisioned{dataset="tank/vm-101-disk-0"} 1
+# HELP zfs_volume_used_bytes Space used by a ZFS volume, including its snapshots and reservation.
+# TYPE zfs_volume_used_bytes gauge
+zfs_volume_used_bytes{dataset="tank/empty"} 0
+zfs_volume_used_bytes{dataset="tank/vm-100-disk-0"} 3.5433480192e+10
+zfs_volume_used_bytes{dataset="tank/vm-101-disk-0"} 2.147483648e+10
+`), "zfs_volume_referenced_bytes", "zfs_volume_refreservation_bytes", "zfs_volume_size_bytes", "zfs_volume_thin_provisioned", "zfs_volume_used_bytes"))
+}
+
+func TestCollectorNotify(t *testing.T) {
+	c, calls := newFixtureCollector(t, "get-keystatus.txt")
+	testutil.CollectAndCount(c)
+	require.Equal(t, 1, *calls)
+
+	// unrelated events don't refresh the properties
+	c.Notify(&events.Event{HistoryInternalName: "snapshot", HistoryDSName: "tank/secret@daily"})
+	testutil.CollectAndCount(c)
+	require.Equal(t, 1, *calls)
+
+	// neither do destroyed snapshots, only destroyed filesystems and volumes
+	c.Notify(&events.Event{HistoryInternalName: "destroy", HistoryDSName: "tank/secret@daily"})
+	testutil.CollectAndCount(c)
+	require.Equal(t, 1, *calls)
+
+	c.Notify(&events.Event{HistoryInternalName: "load-key", HistoryDSName: "tank/backup"})
+	testutil.CollectAndCount(c)
+	require.Equal(t, 2, *calls)
+
+	c.Notify(&events.Event{HistoryInternalName: "mount", HistoryDSName: "tank/backup"})
+	testutil.CollectAndCount(c)
+	require.Equal(t, 3, *calls)
+
+	c.Notify(&events.Event{HistoryInternalName: "destroy", HistoryDSName: "tank/backup"})
+	testutil.CollectAndCount(c)
+	require.Equal(t, 4, *calls)
+
+	// a resync might have missed events
+	c.Notify(nil)
+	testutil.CollectAndCount(c)
+	require.Equal(t, 5, *calls)
+}
@@ -0,0 +1,159 @@
+package dataset
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+// maxPropertiesLen bounds the length of the comma separated properties passed
+// to a single zfs get, well below the 128 KiB Linux allows for an argument.
+const maxPropertiesLen = 32 << 10
+
+// Fetcher fetches the properties of all filesystems and volumes for the
+// collectors sharing it. Every collector registers the properties it needs,
+// when it is created, and the union of them is fetched by a single zfs get at
+// most once per interval. Only if the properties exceed the length of an
+// argument, they are split across several zfs get.
+type Fetcher struct {
+	get      func(context.Context, []string) ([]byte, error)
+	interval time.Duration
+	now      func() time.Time
+	// maxPropertiesLen is the length of the properties of a zfs get
+	maxPropertiesLen int
+
+	mtx         sync.Mutex
+	props       []string
+	datasets    []Dataset
+	generation  uint64
+	lastRefresh time.Time
+}
+
+// NewFetcher creates a fetcher, which runs zfs get using runner at most once
+// per interval.
+func NewFetcher(runner *command.Runner, interval time.Duration) *Fetcher {
+	return NewGetFetcher(zfsGetCmd(runner), interval)
+}
+
+// NewGetFetcher is like NewFetcher, but it fetches the properties using get,
+// which returns the output of zfs get -H -p -o name,property,value,source for
+// the given properties.
+func NewGetFetcher(get func(context.Context, []string) ([]byte, error), interval time.Duration) *Fetcher {
+	return &Fetcher{
+		get:              get,
+		interval:         interval,
+		now:              time.Now,
+		maxPropertiesLen: maxPropertiesLen,
+	}
+}
+
+// Register adds props to the fetched properties. If any of them is new, the
+// properties are fetched again on the next call of Datasets.
+func (f *Fetcher) Register(props ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for _, p := range props {
+		if !contains(f.props, p) {
+			f.props = append(f.props, p)
+			f.lastRefresh = time.Time{}
+		}
+	}
+}
+
+// Properties returns the registered properties.
+func (f *Fetcher) Properties() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]string(nil), f.props...)
+}
+
+// Datasets returns the datasets with the registered properties, which are
+// fetched unless they have been fetched within the interval. The generation
+// is increased with every fetch, so callers can tell whether the datasets
+// changed since their last call.
+func (f *Fetcher) Datasets(ctx context.Context) ([]Dataset, uint64, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	now := f.now()
+	if !f.lastRefresh.IsZero() && now.Sub(f.lastRefresh) < f.interval {
+		return f.datasets, f.generation, nil
+	}
+
+	var (
+		datasets []Dataset
+		byName   = make(map[string]int)
+	)
+	for _, props := range chunkProperties(f.props, f.maxPropertiesLen) {
+		data, err := f.get(ctx, props)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get dataset properties: %w", err)
+		}
+		chunk, err := Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to parse dataset properties: %w", err)
+		}
+		// datasets created between two zfs get only have the properties of
+		// the later ones
+		for _, d := range chunk {
+			idx, ok := byName[d.Name]
+			if !ok {
+				byName[d.Name] = len(datasets)
+				datasets = append(datasets, d)
+				continue
+			}
+			for name, p := range d.Properties {
+				datasets[idx].Properties[name] = p
+			}
+		}
+	}
+	f.datasets = datasets
+	f.generation++
+	f.lastRefresh = now
+	return f.datasets, f.generation, nil
+}
+
+// Notify fetches the properties again on the next call of Datasets, if event
+// changes them. Snapshots aren't fetched, so their events are ignored. A nil
+// event stands for a resync of the event stream, after which the properties
+// are fetched again as well.
+func (f *Fetcher) Notify(event *events.Event) {
+	if event != nil && (!refreshEvents[event.HistoryInternalName] || strings.Contains(event.HistoryDSName, "@")) {
+		return
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.lastRefresh = time.Time{}
+}
+
+// chunkProperties splits props into chunks, whose comma separated length
+// doesn't exceed max. A single property longer than max is a chunk of its own.
+func chunkProperties(props []string, max int) [][]string {
+	var (
+		result [][]string
+		chunk  []string
+		length int
+	)
+	for _, p := range props {
+		// the length including the separating comma
+		if len(chunk) > 0 && length+1+len(p) > max {
+			result = append(result, chunk)
+			chunk, length = nil, 0
+		}
+		if len(chunk) > 0 {
+			length++
+		}
+		chunk = append(chunk, p)
+		length += len(p)
+	}
+	if len(chunk) > 0 {
+		result = append(result, chunk)
+	}
+	return result
+}
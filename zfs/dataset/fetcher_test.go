@@ -0,0 +1,128 @@
+package dataset
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+)
+
+// fakeGet returns the output of zfs get for datasets, every property has the
+// value of its name.
+func fakeGet(datasets []string, calls *[][]string) func(context.Context, []string) ([]byte, error) {
+	return func(_ context.Context, props []string) ([]byte, error) {
+		*calls = append(*calls, props)
+		var b strings.Builder
+		for _, d := range datasets {
+			for _, p := range props {
+				fmt.Fprintf(&b, "%s\t%s\t%s\tlocal\n", d, p, p)
+			}
+		}
+		return []byte(b.String()), nil
+	}
+}
+
+func TestFetcherShared(t *testing.T) {
+	var calls [][]string
+	f := NewGetFetcher(fakeGet([]string{"tank", "tank/db"}, &calls), time.Minute)
+	now := time.Unix(1700000000, 0)
+	f.now = func() time.Time { return now }
+
+	// the collectors of three targets with different properties
+	reg := prometheus.NewPedanticRegistry()
+	for i, props := range [][]string{nil, {"recordsize"}, {"recordsize", "sync"}} {
+		c := NewCollector(zerolog.Nop(), f, "zfs", Options{Properties: props})
+		prometheus.WrapRegistererWith(prometheus.Labels{"target": fmt.Sprint(i)}, reg).MustRegister(c)
+	}
+	_, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+	require.Equal(t, append(append([]string(nil), properties...), "recordsize", "sync"), calls[0])
+
+	_, err = reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+
+	// a refresh event of any collector refreshes all of them
+	f.Notify(&events.Event{HistoryInternalName: "snapshot"})
+	_, err = reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+	f.Notify(&events.Event{HistoryInternalName: "mount"})
+	_, err = reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+
+	now = now.Add(time.Minute)
+	_, err = reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, calls, 3)
+}
+
+func TestFetcherGeneration(t *testing.T) {
+	var calls [][]string
+	f := NewGetFetcher(fakeGet([]string{"tank"}, &calls), time.Minute)
+	f.Register("used")
+
+	_, first, err := f.Datasets(context.Background())
+	require.NoError(t, err)
+	_, generation, err := f.Datasets(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, first, generation)
+
+	// new properties are fetched right away
+	f.Register("used", "quota")
+	datasets, generation, err := f.Datasets(context.Background())
+	require.NoError(t, err)
+	require.Greater(t, generation, first)
+	require.Equal(t, "quota", datasets[0].Properties["quota"].Value)
+	require.Len(t, calls, 2)
+}
+
+func TestFetcherChunks(t *testing.T) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("tank/dataset-%04d", i)
+	}
+	var calls [][]string
+	f := NewGetFetcher(fakeGet(names, &calls), time.Minute)
+	f.maxPropertiesLen = 30
+	props := make([]string, 20)
+	for i := range props {
+		props[i] = fmt.Sprintf("prop%02d", i)
+	}
+	f.Register(props...)
+
+	datasets, _, err := f.Datasets(context.Background())
+	require.NoError(t, err)
+	// 4 properties of 6 characters and their commas fit into 30
+	require.Len(t, calls, 5)
+	var fetched []string
+	for _, chunk := range calls {
+		require.LessOrEqual(t, len(strings.Join(chunk, ",")), 30)
+		fetched = append(fetched, chunk...)
+	}
+	require.Equal(t, props, fetched)
+
+	// the chunks are merged into a dataset each
+	require.Len(t, datasets, len(names))
+	for i, d := range datasets {
+		require.Equal(t, names[i], d.Name)
+		require.Len(t, d.Properties, len(props))
+	}
+}
+
+func TestChunkProperties(t *testing.T) {
+	require.Empty(t, chunkProperties(nil, 10))
+	require.Equal(t, [][]string{{"used", "quota"}}, chunkProperties([]string{"used", "quota"}, 10))
+	require.Equal(t, [][]string{{"used"}, {"quota"}}, chunkProperties([]string{"used", "quota"}, 9))
+	// a property longer than the limit is passed on its own
+	require.Equal(t, [][]string{{"used"}, {"com.example:tier"}, {"quota"}}, chunkProperties([]string{"used", "com.example:tier", "quota"}, 10))
+}
@@ -0,0 +1,169 @@
+package dataset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// propertyKind decides how the value of a configured property is exported.
+type propertyKind int
+
+const (
+	// kindNumber values are exported as they are
+	kindNumber propertyKind = iota
+	// kindSize values are exported in bytes, they may have a suffix like
+	// 128K
+	kindSize
+	// kindEnum values are exported as labels of an info metric
+	kindEnum
+)
+
+// propertyKinds classifies known properties. Other properties are exported
+// as numbers, if their value is numeric, and as enums otherwise.
+var propertyKinds = map[string]propertyKind{
+	"available":            kindSize,
+	"used":                 kindSize,
+	"usedbysnapshots":      kindSize,
+	"usedbydataset":        kindSize,
+	"usedbychildren":       kindSize,
+	"usedbyrefreservation": kindSize,
+	"referenced":           kindSize,
+	"logicalused":          kindSize,
+	"logicalreferenced":    kindSize,
+	"written":              kindSize,
+	"quota":                kindSize,
+	"refquota":             kindSize,
+	"reservation":          kindSize,
+	"refreservation":       kindSize,
+	"recordsize":           kindSize,
+	"volsize":              kindSize,
+	"volblocksize":         kindSize,
+	"special_small_blocks": kindSize,
+
+	"copies":           kindNumber,
+	"filesystem_count": kindNumber,
+	"snapshot_count":   kindNumber,
+	"filesystem_limit": kindNumber,
+	"snapshot_limit":   kindNumber,
+
+	"aclinherit":         kindEnum,
+	"aclmode":            kindEnum,
+	"acltype":            kindEnum,
+	"atime":              kindEnum,
+	"canmount":           kindEnum,
+	"casesensitivity":    kindEnum,
+	"checksum":           kindEnum,
+	"compression":        kindEnum,
+	"dedup":              kindEnum,
+	"devices":            kindEnum,
+	"dnodesize":          kindEnum,
+	"encryption":         kindEnum,
+	"exec":               kindEnum,
+	"keyformat":          kindEnum,
+	"logbias":            kindEnum,
+	"normalization":      kindEnum,
+	"primarycache":       kindEnum,
+	"readonly":           kindEnum,
+	"redundant_metadata": kindEnum,
+	"relatime":           kindEnum,
+	"secondarycache":     kindEnum,
+	"setuid":             kindEnum,
+	"snapdev":            kindEnum,
+	"snapdir":            kindEnum,
+	"sync":               kindEnum,
+	"utf8only":           kindEnum,
+	"volmode":            kindEnum,
+	"xattr":              kindEnum,
+}
+
+// sizeRegexp matches sizes as printed by zfs without -p, e.g. 128K or 1.50M.
+var sizeRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([BKMGTPEZ]?)$`)
+
+// ParseSize parses a size in bytes, with or without the binary suffix used by
+// zfs, e.g. 131072 or 128K.
+func ParseSize(s string) (uint64, error) {
+	m := sizeRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if m[2] == "" || m[2] == "B" {
+		return strconv.ParseUint(m[1], 10, 64)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	v *= math.Pow(1024, float64(strings.Index("BKMGTPEZ", m[2])))
+	if v >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %q out of range", s)
+	}
+	return uint64(v), nil
+}
+
+// propertyNameRegexp matches native properties, user properties contain a
+// colon and may contain a few more characters.
+var propertyNameRegexp = regexp.MustCompile(`^([a-z0-9_]+|[a-z0-9_.:+-]+:[a-z0-9_.:+-]*)$`)
+
+// ValidateProperties checks the names of the properties to export and asks
+// zfs, run by runner, whether it knows them. This lists only bookmarks, so it
+// is cheap. Without ZFS or a runner, only the names are checked.
+func ValidateProperties(ctx context.Context, runner *command.Runner, props []string) error {
+	for _, p := range props {
+		if !propertyNameRegexp.MatchString(p) {
+			return fmt.Errorf("invalid property name %q", p)
+		}
+	}
+	if runner == nil || len(props) == 0 {
+		return nil
+	}
+	_, err := runner.Output(ctx, "zfs", "get", "-H", "-o", "property", "-t", "bookmark", strings.Join(props, ","))
+	if err == nil || errors.Is(err, command.ErrUnavailable) {
+		return nil
+	}
+	if msg := err.Error(); strings.Contains(msg, "bad property list") || strings.Contains(msg, "invalid property") {
+		return fmt.Errorf("properties not supported by zfs: %w", err)
+	}
+	return fmt.Errorf("failed to validate properties: %w", err)
+}
+
+// collectProperties exports the configured properties of d. Values without a
+// meaning, like "-", are left out.
+func (c *datasetCollector) collectProperties(ch chan<- prometheus.Metric, d Dataset) {
+	for _, name := range c.opts.Properties {
+		p, ok := d.Properties[name]
+		if !ok || p.Value == "-" || p.Value == "" {
+			continue
+		}
+
+		kind, known := propertyKinds[name]
+		switch {
+		case kind == kindSize:
+			v, err := ParseSize(p.Value)
+			if err != nil {
+				c.logger.Debug().Err(err).Str("dataset", d.Name).Msgf("skipping property %s", name)
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(c.descProperty, prometheus.GaugeValue, float64(v), d.Name, name)
+			continue
+		case kind == kindNumber || !known:
+			if v, err := strconv.ParseFloat(p.Value, 64); err == nil {
+				ch <- prometheus.MustNewConstMetric(c.descProperty, prometheus.GaugeValue, v, d.Name, name)
+				continue
+			}
+			if known {
+				// e.g. none for limits
+				continue
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.descPropertyInfo, prometheus.GaugeValue, 1, d.Name, name, p.Value)
+	}
+}
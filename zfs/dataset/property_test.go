@@ -0,0 +1,93 @@
+package dataset
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"0":      0,
+		"131072": 131072,
+		"512B":   512,
+		"128K":   128 << 10,
+		"1.50M":  3 << 19,
+		"16G":    16 << 30,
+		"2T":     2 << 40,
+		"1P":     1 << 50,
+		"4E":     4 << 60,
+	} {
+		v, err := ParseSize(s)
+		require.NoError(t, err, s)
+		require.Equal(t, expected, v, s)
+	}
+
+	for _, invalid := range []string{"", "-", "none", "128k", "K", "1.5", "-1", "1Z", "18446744073709551616"} {
+		_, err := ParseSize(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestCollectorProperties(t *testing.T) {
+	c, _ := newFixtureCollectorWithOptions(t, "get-properties.txt", Options{
+		Properties: []string{"recordsize", "sync", "atime", "copies", "com.example:tier"},
+	})
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_property Value of a numeric property of a ZFS dataset, sizes are in bytes.
+# TYPE zfs_dataset_property gauge
+zfs_dataset_property{dataset="tank",property="copies"} 1
+zfs_dataset_property{dataset="tank",property="recordsize"} 131072
+zfs_dataset_property{dataset="tank/db",property="com.example:tier"} 1
+zfs_dataset_property{dataset="tank/db",property="copies"} 2
+zfs_dataset_property{dataset="tank/db",property="recordsize"} 16384
+zfs_dataset_property{dataset="tank/vol",property="copies"} 1
+# HELP zfs_dataset_property_info A metric with a constant '1' value labeled by the value of a property of a ZFS dataset.
+# TYPE zfs_dataset_property_info gauge
+zfs_dataset_property_info{dataset="tank",property="atime",value="off"} 1
+zfs_dataset_property_info{dataset="tank",property="sync",value="standard"} 1
+zfs_dataset_property_info{dataset="tank/db",property="atime",value="off"} 1
+zfs_dataset_property_info{dataset="tank/db",property="sync",value="always"} 1
+zfs_dataset_property_info{dataset="tank/vol",property="com.example:tier",value="gold"} 1
+zfs_dataset_property_info{dataset="tank/vol",property="sync",value="disabled"} 1
+`), "zfs_dataset_property", "zfs_dataset_property_info"))
+}
+
+func TestCollectorPropertiesFetched(t *testing.T) {
+	var fetched []string
+	c := NewCollector(zerolog.Nop(), NewGetFetcher(func(_ context.Context, props []string) ([]byte, error) {
+		fetched = props
+		return nil, nil
+	}, time.Minute), "zfs", Options{Properties: []string{"used", "recordsize"}})
+	testutil.CollectAndCount(c)
+	// built-in properties are fetched once
+	require.Equal(t, append(append([]string(nil), properties...), "recordsize"), fetched)
+}
+
+func TestValidateProperties(t *testing.T) {
+	require.NoError(t, ValidateProperties(context.Background(), nil, []string{"recordsize", "com.example:tier"}))
+	require.Error(t, ValidateProperties(context.Background(), nil, []string{"record size"}))
+	require.Error(t, ValidateProperties(context.Background(), nil, []string{"Sync"}))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zfs"), []byte(`#!/bin/sh
+case "$7" in
+*foo*) echo "bad property list: invalid property 'foo'" >&2; exit 2 ;;
+esac
+`), 0o755))
+	t.Setenv("PATH", dir)
+	runner := command.NewRunner(time.Minute)
+
+	require.NoError(t, ValidateProperties(context.Background(), runner, []string{"recordsize", "sync"}))
+	err := ValidateProperties(context.Background(), runner, []string{"recordsize", "foo"})
+	require.ErrorContains(t, err, "invalid property 'foo'")
+}
@@ -0,0 +1,167 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// Event is a single entry of the ZFS event log as printed by `zpool events -H -v`.
+type Event struct {
+	Class               string
+	Pool                string
+	HistoryInternalName string
+	HistoryDSName       string
+	Time                time.Time
+
+	// Skipped is the number of lines and values of the event, which couldn't
+	// be parsed.
+	Skipped int `json:",omitempty"`
+
+	// Fields contains every key/value pair of the event, it is only populated
+	// when parsing in raw mode.
+	Fields map[string]string `json:",omitempty"`
+}
+
+// Follower is a running `zpool events -f` process.
+type Follower struct {
+	process *command.Process
+}
+
+// StartFollow starts following the ZFS event log using runner. The process is
+// terminated once ctx is cancelled.
+func StartFollow(ctx context.Context, runner command.CommandRunner) (*Follower, error) {
+	process, err := runner.Start(ctx,
+		"zpool",
+		"events",
+		"-f",
+		"-H",
+		"-v",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Follower{process: process}, nil
+}
+
+// Run parses the events of the follower into ch, until the process exits. ch
+// is closed once Run returns.
+func (f *Follower) Run(ch chan<- *Event, raw bool) error {
+	defer close(ch)
+
+	if err := Parse(f.process.Stdout, ch, raw); err != nil {
+		_ = f.process.Kill()
+		_ = f.process.Wait()
+		return err
+	}
+
+	return f.process.Wait()
+}
+
+func trimDoubleQuotes(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+
+	if s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	return s[1 : len(s)-1]
+}
+
+// maxLineSize is the longest line of an event, e.g. with the large arrays of
+// ereports.
+const maxLineSize = 1 << 20
+
+// Parse reads events in the format of `zpool events -H -v` from r and sends
+// them to ch. When raw is set, all fields of an event are retained. Lines
+// and values, which can't be parsed, are skipped and counted by the event, as
+// a single broken field shouldn't stop following the events. Only errors
+// reading r are returned.
+func Parse(r io.Reader, ch chan<- *Event, raw bool) error {
+	var (
+		scanner  = bufio.NewScanner(r)
+		lineno   = -1
+		newEvent = func() *Event {
+			e := new(Event)
+			if raw {
+				e.Fields = make(map[string]string)
+			}
+			return e
+		}
+		event = newEvent()
+	)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if line == "" {
+			ch <- event
+			event = newEvent()
+			lineno = -1
+			continue
+		}
+		if lineno == 0 {
+			// header line contains time and class separated by a tab
+			if idx := strings.LastIndexByte(line, '\t'); idx >= 0 {
+				event.Class = strings.TrimSpace(line[idx+1:])
+			}
+			continue
+		}
+		// find the separator between the key and the value
+		sep := strings.IndexByte(line, '=')
+		if sep < 1 || len(line) < sep+2 {
+			event.Skipped++
+			continue
+		}
+		key := strings.TrimSpace(line[:sep-1])
+		value := line[sep+2:]
+
+		if raw {
+			event.Fields[key] = trimDoubleQuotes(strings.TrimSpace(value))
+		}
+
+		switch key {
+		case "time":
+			// an invalid time leaves the time of the event unset
+			fields := strings.Fields(value)
+			if len(fields) < 2 {
+				event.Skipped++
+				break
+			}
+			secs, err := strconv.ParseInt(fields[0], 0, 64)
+			if err != nil {
+				event.Skipped++
+				break
+			}
+			nanos, err := strconv.ParseInt(fields[1], 0, 64)
+			if err != nil {
+				event.Skipped++
+				break
+			}
+			event.Time = time.Unix(secs, nanos)
+		case "class":
+			event.Class = trimDoubleQuotes(value)
+		case "pool":
+			event.Pool = trimDoubleQuotes(value)
+		case "history_internal_name":
+			event.HistoryInternalName = trimDoubleQuotes(value)
+		case "history_dsname":
+			event.HistoryDSName = trimDoubleQuotes(value)
+		default:
+			break
+		}
+	}
+	if scanner.Err() != nil {
+		return fmt.Errorf("scanner error: %w", scanner.Err())
+	}
+
+	return nil
+}
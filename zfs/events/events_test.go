@@ -0,0 +1,289 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParse(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "events-simple.txt"))
+	require.NoError(t, err)
+
+	var (
+		ch     = make(chan *Event)
+		done   = make(chan struct{})
+		events []*Event
+	)
+
+	go func() {
+		for e := range ch {
+			events = append(events, e)
+		}
+		close(done)
+	}()
+
+	require.NoError(t, Parse(bytes.NewReader(data), ch, false))
+	close(ch)
+
+	<-done
+
+	result, err := json.Marshal(events)
+	require.NoError(t, err)
+
+	require.JSONEq(t, `
+[
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "destroy",
+        "HistoryDSName": "pool-hdd/backup/data0/%recv",
+        "Time": "2023-11-23T03:45:50.763089998Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "hold",
+        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_230701_000",
+        "Time": "2023-11-23T03:45:51.005089471Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "release",
+        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_225701_000",
+        "Time": "2023-11-23T03:45:51.210089024Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "receive",
+        "HistoryDSName": "pool-hdd/backup/var/%recv",
+        "Time": "2023-11-23T03:45:52.374086487Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "finish receiving",
+        "HistoryDSName": "pool-hdd/backup/var/%recv",
+        "Time": "2023-11-23T03:45:52.591086014Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "clone swap",
+        "HistoryDSName": "pool-hdd/backup/var/%recv",
+        "Time": "2023-11-23T03:45:52.592086012Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "snapshot",
+        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231122_231701_000",
+        "Time": "2023-11-23T03:45:52.59308601Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "destroy",
+        "HistoryDSName": "pool-hdd/backup/var/%recv",
+        "Time": "2023-11-23T03:45:52.596086004Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "hold",
+        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231122_231701_000",
+        "Time": "2023-11-23T03:45:52.819085518Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "release",
+        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231122_230701_000",
+        "Time": "2023-11-23T03:45:52.999085125Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "receive",
+        "HistoryDSName": "pool-hdd/backup/data0/%recv",
+        "Time": "2023-11-23T03:45:54.156082603Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "finish receiving",
+        "HistoryDSName": "pool-hdd/backup/data0/%recv",
+        "Time": "2023-11-23T03:45:54.480081897Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "clone swap",
+        "HistoryDSName": "pool-hdd/backup/data0/%recv",
+        "Time": "2023-11-23T03:45:54.481081895Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "snapshot",
+        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_231701_000",
+        "Time": "2023-11-23T03:45:54.482081893Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "destroy",
+        "HistoryDSName": "pool-hdd/backup/data0/%recv",
+        "Time": "2023-11-23T03:45:54.486081884Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "hold",
+        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_231701_000",
+        "Time": "2023-11-23T03:45:54.801081197Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "release",
+        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_230701_000",
+        "Time": "2023-11-23T03:45:54.976080816Z"
+    },
+    {
+        "Class": "sysevent.fs.zfs.history_event",
+        "Pool": "pool-hdd",
+        "HistoryInternalName": "destroy",
+        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231120_095659_000",
+        "Time": "2023-11-23T03:47:36.814857739Z"
+    }
+]`, string(result))
+
+}
+
+func TestParseRaw(t *testing.T) {
+	input := `Nov 23 2023 03:47:36.814857739	sysevent.fs.zfs.history_event
+        class = "sysevent.fs.zfs.history_event"
+        pool = "pool-hdd"
+        history_dsname = "pool-hdd/backup/var@zrepl_20231120_095659_000"
+        history_internal_name = "destroy"
+        history_txg = 0x11b9580
+        time = 0x655ecb58 0x3091be0b 
+
+`
+
+	var (
+		ch     = make(chan *Event, 1)
+		events []*Event
+	)
+	require.NoError(t, Parse(strings.NewReader(input), ch, true))
+	close(ch)
+	for e := range ch {
+		events = append(events, e)
+	}
+
+	require.Len(t, events, 1)
+	require.Equal(t, map[string]string{
+		"class":                 "sysevent.fs.zfs.history_event",
+		"pool":                  "pool-hdd",
+		"history_dsname":        "pool-hdd/backup/var@zrepl_20231120_095659_000",
+		"history_internal_name": "destroy",
+		"history_txg":           "0x11b9580",
+		"time":                  "0x655ecb58 0x3091be0b",
+	}, events[0].Fields)
+	require.Equal(t, "sysevent.fs.zfs.history_event", events[0].Class)
+	require.Equal(t, "pool-hdd", events[0].Pool)
+}
+
+func TestParseInvalid(t *testing.T) {
+	input := `Nov 23 2023 03:47:36.814857739	sysevent.fs.zfs.history_event
+        pool = "pool-hdd"
+        time = 0x655ecb58 nanos
+        =
+        history_dsname = "` + strings.Repeat("a", 100000) + `"
+
+Nov 23 2023 03:47:37.814857739	sysevent.fs.zfs.history_event
+        pool = "pool-ssd"
+        time = 0x655ecb59 0x0
+
+`
+
+	ch := make(chan *Event, 2)
+	require.NoError(t, Parse(strings.NewReader(input), ch, false))
+	close(ch)
+
+	// the invalid time is skipped and lines longer than the default
+	// buffer of the scanner are read
+	first, second := <-ch, <-ch
+	require.Equal(t, "pool-hdd", first.Pool)
+	require.True(t, first.Time.IsZero())
+	require.Equal(t, 2, first.Skipped)
+	require.Len(t, first.HistoryDSName, 100000)
+	require.Equal(t, "pool-ssd", second.Pool)
+	require.Equal(t, int64(0x655ecb59), second.Time.Unix())
+	require.Equal(t, 0, second.Skipped)
+}
+
+func FuzzParse(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	require.NoError(f, err)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(f, err)
+		f.Add(data, false)
+		f.Add(data, true)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, raw bool) {
+		ch := make(chan *Event)
+		go func() {
+			for range ch {
+			}
+		}()
+		defer close(ch)
+
+		// reading from memory only fails for lines exceeding the buffer
+		err := Parse(bytes.NewReader(data), ch, raw)
+		if len(data) < maxLineSize {
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestFollower(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "events-simple.txt"))
+	require.NoError(t, err)
+
+	fake := command.NewFakeExecutor()
+	fake.On("zpool events", command.FakeCommand{Stdout: string(data), Follow: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := StartFollow(ctx, fake.Runner())
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"zpool", "events", "-f", "-H", "-v"}}, fake.Calls())
+
+	var (
+		ch   = make(chan *Event)
+		done = make(chan error, 1)
+	)
+	go func() { done <- f.Run(ch, false) }()
+	e := <-ch
+	require.Equal(t, "destroy", e.HistoryInternalName)
+
+	// the events are followed until ctx is cancelled
+	cancel()
+	for range ch {
+	}
+	require.EqualError(t, <-done, "zpool events failed: signal: terminated")
+}
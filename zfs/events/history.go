@@ -0,0 +1,336 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// historyClass is the class of the events created from the pool history, it is
+// the class of the same records in zpool events.
+const historyClass = "sysevent.fs.zfs.history_event"
+
+// historyTimeFormat is the format of the local time a record of zpool history
+// is prefixed with.
+const historyTimeFormat = "2006-01-02.15:04:05"
+
+// errPoolsChanged is returned by History.Run, once a pool has been imported or
+// exported. The snapshots of an imported pool are not known from its history.
+var errPoolsChanged = errors.New("the imported pools changed")
+
+// History polls the internal records of the pool history, which contain the
+// same changes as the history events of zpool events. Unlike following zpool
+// events, which requires root, zpool history is permitted for unprivileged
+// users, if the pool permissions are delegated.
+type History struct {
+	ctx      context.Context
+	runner   command.CommandRunner
+	interval time.Duration
+
+	// cursors contains the position of every imported pool in its history
+	cursors map[string]*historyCursor
+}
+
+// StartHistory reads the history of all pools using runner, the records
+// already in it are not sent by Run. ctx stops polling.
+func StartHistory(ctx context.Context, runner command.CommandRunner, interval time.Duration) (*History, error) {
+	h := &History{
+		ctx:      ctx,
+		runner:   runner,
+		interval: interval,
+		cursors:  make(map[string]*historyCursor),
+	}
+	pools, err := h.listPools()
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		records, err := h.read(pool, false)
+		if err != nil {
+			return nil, err
+		}
+		c := new(historyCursor)
+		if _, err := c.advance(records); err != nil {
+			return nil, err
+		}
+		h.cursors[pool] = c
+	}
+	return h, nil
+}
+
+// Run reads the history of all pools every interval and sends the records
+// added since the last read to ch, until ctx is cancelled or reading fails. It
+// fails as well once pools are imported or exported, or a pool is recreated,
+// as the changes in between are not in the history. ch is closed once Run
+// returns.
+func (h *History) Run(ch chan<- *Event, raw bool) error {
+	defer close(ch)
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return h.ctx.Err()
+		case <-ticker.C:
+		}
+		if err := h.poll(ch, raw); err != nil {
+			return err
+		}
+	}
+}
+
+func (h *History) poll(ch chan<- *Event, raw bool) error {
+	pools, err := h.listPools()
+	if err != nil {
+		return err
+	}
+	if len(pools) != len(h.cursors) {
+		return errPoolsChanged
+	}
+	for _, pool := range pools {
+		if _, ok := h.cursors[pool]; !ok {
+			return errPoolsChanged
+		}
+	}
+
+	for _, pool := range pools {
+		records, err := h.read(pool, raw)
+		if err != nil {
+			return err
+		}
+		records, err = h.cursors[pool].advance(records)
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", pool, err)
+		}
+		for _, r := range records {
+			ch <- r.event
+		}
+	}
+	return nil
+}
+
+// listPools returns the names of the imported pools, sorted.
+func (h *History) listPools() ([]string, error) {
+	r, err := h.runner.Run(h.ctx, "zpool", "list", "-H", "-o", "name")
+	if err != nil {
+		return nil, err
+	}
+	var pools []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if pool := scanner.Text(); pool != "" && pool != "no pools available" {
+			pools = append(pools, pool)
+		}
+	}
+	sort.Strings(pools)
+	return pools, scanner.Err()
+}
+
+func (h *History) read(pool string, raw bool) ([]historyRecord, error) {
+	r, err := h.runner.Run(h.ctx, "zpool", "history", "-il", pool)
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseHistory(r, pool, raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the history of pool %s: %w", pool, err)
+	}
+	return records, nil
+}
+
+// historyCursor is the position in the history of a pool. Records are ordered
+// by their txg, as their time is in seconds and follows the clock of the
+// host. As the records of the last txg might not have been complete when
+// read, the ones already seen are remembered.
+type historyCursor struct {
+	txg uint64
+	// seen counts the records of txg by their line, a record logged twice
+	// within a txg has the same line
+	seen map[string]int
+}
+
+// advance moves the cursor to the end of records, which is the complete
+// history of the pool, and returns the records after the cursor.
+func (c *historyCursor) advance(records []historyRecord) ([]historyRecord, error) {
+	var last uint64
+	for _, r := range records {
+		if r.txg > last {
+			last = r.txg
+		}
+	}
+	if last < c.txg {
+		return nil, fmt.Errorf("the history ends at txg %d before the last read txg %d, the pool has been recreated", last, c.txg)
+	}
+
+	var (
+		result []historyRecord
+		seen   = make(map[string]int)
+		// read counts the records of the txg of the cursor read so far
+		read = make(map[string]int)
+	)
+	for _, r := range records {
+		if r.txg < c.txg {
+			continue
+		}
+		if r.txg == last {
+			seen[r.line]++
+		}
+		if r.txg == c.txg {
+			read[r.line]++
+			if read[r.line] <= c.seen[r.line] {
+				continue
+			}
+		}
+		result = append(result, r)
+	}
+	c.txg = last
+	c.seen = seen
+	return result, nil
+}
+
+// historyRecord is an internal record of the pool history.
+type historyRecord struct {
+	txg   uint64
+	line  string
+	event *Event
+}
+
+// parseHistory reads the internal records of the history of pool in the format
+// of `zpool history -il`. The commands and ioctls logged aren't returned, they
+// lack a txg and their changes are logged as internal records as well. Lines,
+// which can't be parsed, are skipped. Only errors reading r are returned.
+//
+// The name of a record is separated from the dataset by finding the pool name,
+// as both might contain spaces. Records of the pool itself don't have a
+// dataset, the first word is used as their name. The time is parsed in the
+// local time zone, as zpool history doesn't print one.
+func parseHistory(r io.Reader, pool string, raw bool) ([]historyRecord, error) {
+	var (
+		scanner = bufio.NewScanner(r)
+		result  []historyRecord
+	)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) <= len(historyTimeFormat) || line[len(historyTimeFormat)] != ' ' {
+			continue
+		}
+		ts, err := time.ParseInLocation(historyTimeFormat, line[:len(historyTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		rest := line[len(historyTimeFormat)+1:]
+		if !strings.HasPrefix(rest, "[txg:") {
+			continue
+		}
+		end := strings.IndexByte(rest, ']')
+		if end < 0 {
+			continue
+		}
+		txg, err := strconv.ParseUint(rest[len("[txg:"):end], 10, 64)
+		if err != nil {
+			continue
+		}
+		rest = strings.TrimPrefix(rest[end+1:], " ")
+
+		// the user and host of the long format
+		var hostname string
+		if idx := strings.LastIndex(rest, " ["); idx >= 0 && strings.HasSuffix(rest, "]") {
+			long := rest[idx+2 : len(rest)-1]
+			if idx := strings.LastIndex(long, "on "); idx >= 0 {
+				hostname, _, _ = strings.Cut(long[idx+len("on "):], ":")
+			}
+			rest = rest[:idx]
+		}
+
+		event := &Event{
+			Class: historyClass,
+			Pool:  pool,
+			Time:  ts,
+		}
+		name, dsname, dsid, message, ok := splitDatasetRecord(rest, pool)
+		if ok {
+			event.HistoryInternalName = name
+			event.HistoryDSName = dsname
+			message = strings.TrimSpace(message)
+		} else {
+			name, msg, _ := strings.Cut(rest, " ")
+			event.HistoryInternalName = name
+			message = strings.TrimSpace(msg)
+		}
+		if event.HistoryInternalName == "" {
+			continue
+		}
+
+		if raw {
+			event.Fields = map[string]string{
+				"class":                 historyClass,
+				"pool":                  pool,
+				"history_internal_name": event.HistoryInternalName,
+				"history_txg":           strconv.FormatUint(txg, 10),
+				"history_time":          strconv.FormatInt(ts.Unix(), 10),
+			}
+			for key, value := range map[string]string{
+				"history_dsname":       event.HistoryDSName,
+				"history_dsid":         dsid,
+				"history_internal_str": message,
+				"history_hostname":     hostname,
+			} {
+				if value != "" {
+					event.Fields[key] = value
+				}
+			}
+		}
+
+		result = append(result, historyRecord{txg: txg, line: line, event: event})
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("scanner error: %w", scanner.Err())
+	}
+	return result, nil
+}
+
+// splitDatasetRecord splits a record of a dataset of pool in the form of
+// "<name> <dataset> (<id>) <message>". The dataset starts with the first word
+// being the pool or one of its datasets and ends with the first id after it.
+func splitDatasetRecord(record, pool string) (name, dataset, id, message string, ok bool) {
+	start := -1
+	for i := 1; i < len(record); i++ {
+		if record[i-1] != ' ' || !strings.HasPrefix(record[i:], pool) {
+			continue
+		}
+		if rest := record[i+len(pool):]; rest != "" && strings.ContainsRune("/@%# ", rune(rest[0])) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return "", "", "", "", false
+	}
+
+	for end := start + len(pool); end < len(record); {
+		idx := strings.Index(record[end:], " (")
+		if idx < 0 {
+			break
+		}
+		end += idx
+		id, rest, found := strings.Cut(record[end+2:], ")")
+		if !found {
+			break
+		}
+		if _, err := strconv.ParseUint(id, 10, 64); err == nil && (rest == "" || rest[0] == ' ') {
+			return record[:start-1], record[start:end], id, strings.TrimPrefix(rest, " "), true
+		}
+		end++
+	}
+	return "", "", "", "", false
+}
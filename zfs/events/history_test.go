@@ -0,0 +1,245 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParseHistory(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "history-simple.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	records, err := parseHistory(f, "pool-hdd", false)
+	require.NoError(t, err)
+
+	type record struct {
+		txg    uint64
+		name   string
+		dsname string
+	}
+	var result []record
+	for _, r := range records {
+		require.Equal(t, historyClass, r.event.Class)
+		require.Equal(t, "pool-hdd", r.event.Pool)
+		result = append(result, record{txg: r.txg, name: r.event.HistoryInternalName, dsname: r.event.HistoryDSName})
+	}
+	// commands and ioctls are skipped
+	require.Equal(t, []record{
+		{5, "create", "pool-hdd"},
+		{18585897, "destroy", "pool-hdd/backup/data0/%recv"},
+		{18585898, "hold", "pool-hdd/backup/data0@zrepl_20231122_230701_000"},
+		{18585899, "release", "pool-hdd/backup/data0@zrepl_20231122_225701_000"},
+		{18585901, "receive", "pool-hdd/backup/var/%recv"},
+		{18585902, "finish receiving", "pool-hdd/backup/var/%recv"},
+		{18585902, "clone swap", "pool-hdd/backup/var/%recv"},
+		{18585902, "snapshot", "pool-hdd/backup/var@zrepl_20231122_230701_000"},
+		{18585902, "destroy", "pool-hdd/backup/var/%recv"},
+		{18585984, "destroy", "pool-hdd/backup/var@zrepl_20231120_095659_000"},
+		{18585985, "set", "pool-hdd/backup/var"},
+		// records of the pool itself have no dataset
+		{18586012, "scan", ""},
+	}, result)
+	require.Equal(t, time.Date(2023, 11, 23, 3, 47, 36, 0, time.Local), records[9].event.Time)
+	require.Nil(t, records[0].event.Fields)
+}
+
+func TestParseHistoryRaw(t *testing.T) {
+	input := `History for 'pool hdd':
+2023-11-23.03:45:51 [txg:18585898] hold pool hdd/backup/data 0@zrepl_20231122_230701_000 (183670) tag=zrepl refs=1 [on pool:global]
+2023-11-23.03:50:02 [txg:18586012] scan setup func=1 mintxg=0 maxtxg=18586012
+`
+	records, err := parseHistory(strings.NewReader(input), "pool hdd", true)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	// pool and dataset names may contain spaces, the time is local
+	require.Equal(t, map[string]string{
+		"class":                 "sysevent.fs.zfs.history_event",
+		"pool":                  "pool hdd",
+		"history_dsname":        "pool hdd/backup/data 0@zrepl_20231122_230701_000",
+		"history_dsid":          "183670",
+		"history_internal_name": "hold",
+		"history_internal_str":  "tag=zrepl refs=1",
+		"history_hostname":      "pool",
+		"history_txg":           "18585898",
+		"history_time":          strconv.FormatInt(time.Date(2023, 11, 23, 3, 45, 51, 0, time.Local).Unix(), 10),
+	}, records[0].event.Fields)
+
+	// without the long format
+	require.Equal(t, map[string]string{
+		"class":                 "sysevent.fs.zfs.history_event",
+		"pool":                  "pool hdd",
+		"history_internal_name": "scan",
+		"history_internal_str":  "setup func=1 mintxg=0 maxtxg=18586012",
+		"history_txg":           "18586012",
+		"history_time":          strconv.FormatInt(time.Date(2023, 11, 23, 3, 50, 2, 0, time.Local).Unix(), 10),
+	}, records[1].event.Fields)
+}
+
+func TestParseHistoryInvalid(t *testing.T) {
+	input := `2023-11-23.03:45:51 [txg:x] snapshot tank/a@1 (1)  [on host]
+2023-13-23.03:45:51 [txg:1] snapshot tank/a@2 (1)  [on host]
+2023-11-23 03:45:51 [txg:1] snapshot tank/a@3 (1)  [on host]
+2023-11-23.03:45:51 [txg:1 snapshot tank/a@4 (1)  [on host]
+2023-11-23.03:45:51 [txg:1]
+2023-11-23.03:45:51
+2023-11-23.03:45:51 [txg:2] snapshot tank/a@5 (1) ` + strings.Repeat("a", 100000) + `
+`
+	// the invalid lines are skipped and lines longer than the default
+	// buffer of the scanner are read
+	records, err := parseHistory(strings.NewReader(input), "tank", false)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "tank/a@5", records[0].event.HistoryDSName)
+}
+
+func FuzzParseHistory(f *testing.F) {
+	data, err := os.ReadFile(filepath.Join("testdata", "history-simple.txt"))
+	require.NoError(f, err)
+	f.Add(data, "pool-hdd")
+	f.Add(data, "")
+
+	f.Fuzz(func(t *testing.T, data []byte, pool string) {
+		// reading from memory only fails for lines exceeding the buffer
+		records, err := parseHistory(bytes.NewReader(data), pool, true)
+		if len(data) < maxLineSize {
+			require.NoError(t, err)
+		}
+		for _, r := range records {
+			require.NotEmpty(t, r.event.HistoryInternalName)
+		}
+	})
+}
+
+// historyLines returns the records of the history as lines of zpool history
+// -il.
+func historyLines(records ...string) string {
+	var b strings.Builder
+	b.WriteString("History for 'tank':\n")
+	for _, r := range records {
+		b.WriteString(r + "\n")
+	}
+	return b.String()
+}
+
+func TestHistoryCursor(t *testing.T) {
+	parse := func(records ...string) []historyRecord {
+		result, err := parseHistory(strings.NewReader(historyLines(records...)), "tank", false)
+		require.NoError(t, err)
+		return result
+	}
+	names := func(records []historyRecord) []string {
+		var result []string
+		for _, r := range records {
+			result = append(result, r.event.HistoryDSName)
+		}
+		return result
+	}
+	const (
+		snap1 = "2023-11-23.03:45:51 [txg:10] snapshot tank/a@1 (1)  [on host]"
+		snap2 = "2023-11-23.03:45:51 [txg:11] snapshot tank/a@2 (1)  [on host]"
+		hold2 = "2023-11-23.03:45:51 [txg:11] hold tank/a@2 (1) tag=x [on host]"
+		snap3 = "2023-11-23.03:45:52 [txg:12] snapshot tank/a@3 (1)  [on host]"
+		// the clock of the host went back
+		snap4 = "2023-11-23.03:40:00 [txg:13] snapshot tank/a@4 (1)  [on host]"
+	)
+
+	c := new(historyCursor)
+	records, err := c.advance(parse(snap1, snap2))
+	require.NoError(t, err)
+	require.Equal(t, []string{"tank/a@1", "tank/a@2"}, names(records))
+
+	// nothing changed
+	records, err = c.advance(parse(snap1, snap2))
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	// the records of the last txg have only been partially read before
+	records, err = c.advance(parse(snap1, snap2, hold2, snap3))
+	require.NoError(t, err)
+	require.Equal(t, []string{"tank/a@2", "tank/a@3"}, names(records))
+	require.Equal(t, "hold", records[0].event.HistoryInternalName)
+
+	// the same record twice within a txg, the oldest records have been
+	// dropped from the history
+	records, err = c.advance(parse(snap3, snap3, snap4))
+	require.NoError(t, err)
+	require.Equal(t, []string{"tank/a@3", "tank/a@4"}, names(records))
+	records, err = c.advance(parse(snap3, snap3, snap4, snap4))
+	require.NoError(t, err)
+	require.Equal(t, []string{"tank/a@4"}, names(records))
+
+	// the pool has been recreated
+	_, err = c.advance(parse(snap1))
+	require.EqualError(t, err, "the history ends at txg 10 before the last read txg 13, the pool has been recreated")
+}
+
+func TestHistory(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	fake.On("zpool list", command.FakeCommand{Stdout: "tank\n"})
+	fake.On("zpool history", command.FakeCommand{Stdout: historyLines(
+		"2023-11-23.03:45:51 [txg:10] snapshot tank/a@1 (1)  [on host]",
+	)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := StartHistory(ctx, fake.Runner(), time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, [][]string{
+		{"zpool", "list", "-H", "-o", "name"},
+		{"zpool", "history", "-il", "tank"},
+	}, fake.Calls())
+
+	var (
+		ch   = make(chan *Event)
+		done = make(chan error, 1)
+	)
+	go func() { done <- h.Run(ch, false) }()
+
+	// the records already in the history are not sent
+	fake.On("zpool history", command.FakeCommand{Stdout: historyLines(
+		"2023-11-23.03:45:51 [txg:10] snapshot tank/a@1 (1)  [on host]",
+		"2023-11-23.03:45:52 [txg:11] destroy tank/a@1 (1)  [on host]",
+	)})
+	e := <-ch
+	require.Equal(t, "destroy", e.HistoryInternalName)
+	require.Equal(t, "tank/a@1", e.HistoryDSName)
+
+	// an imported pool stops polling, its snapshots are unknown
+	fake.On("zpool list", command.FakeCommand{Stdout: "tank\nbackup\n"})
+	for range ch {
+	}
+	require.ErrorIs(t, <-done, errPoolsChanged)
+}
+
+func TestHistoryCancel(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	fake.On("zpool list", command.FakeCommand{Stdout: "no pools available\n"})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h, err := StartHistory(ctx, fake.Runner(), time.Hour)
+	require.NoError(t, err)
+	ch := make(chan *Event)
+	done := make(chan error, 1)
+	go func() { done <- h.Run(ch, false) }()
+
+	cancel()
+	for range ch {
+	}
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	// without zpool there is no history to read
+	_, err = StartHistory(context.Background(), command.NewFakeExecutor().Runner(), time.Hour)
+	require.ErrorIs(t, err, command.ErrUnavailable)
+}
@@ -0,0 +1,115 @@
+// Package fixture reads and writes directories of recorded zfs and zpool
+// output, which are used as test data for the parsers.
+package fixture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Names of the recorded files.
+const (
+	ManifestFile  = "manifest.json"
+	ZpoolStatus   = "zpool-status.txt"
+	ZFSList       = "zfs-list.txt"
+	SnapshotsList = "zfs-list-snapshots.txt"
+	ZpoolEvents   = "zpool-events.txt"
+)
+
+// Manifest describes the system a fixture has been recorded on.
+type Manifest struct {
+	Date            time.Time `json:"date"`
+	ExporterVersion string    `json:"exporter_version"`
+	ZFSVersion      string    `json:"zfs_version"`
+	Kernel          string    `json:"kernel"`
+	Sanitized       bool      `json:"sanitized"`
+	Files           []string  `json:"files"`
+}
+
+// Fixture is a recorded directory.
+type Fixture struct {
+	Dir      string
+	Manifest Manifest
+}
+
+// Write writes the files and the manifest listing them to dir.
+func Write(dir string, m Manifest, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	m.Files = make([]string, 0, len(files))
+	for name, data := range files {
+		if name == ManifestFile || filepath.Base(name) != name {
+			return fmt.Errorf("invalid fixture file name %q", name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return err
+		}
+		m.Files = append(m.Files, name)
+	}
+	sort.Strings(m.Files)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), append(data, '\n'), 0o644)
+}
+
+// Load reads the manifest of the fixture in dir.
+func Load(dir string) (*Fixture, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	f := &Fixture{Dir: dir}
+	if err := json.Unmarshal(data, &f.Manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest of %s: %w", dir, err)
+	}
+	return f, nil
+}
+
+// LoadAll reads all fixtures in the subdirectories of dir.
+func LoadAll(dir string) ([]*Fixture, error) {
+	manifests, err := filepath.Glob(filepath.Join(dir, "*", ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Fixture, 0, len(manifests))
+	for _, m := range manifests {
+		f, err := Load(filepath.Dir(m))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+// Name returns the name of the fixture directory.
+func (f *Fixture) Name() string {
+	return filepath.Base(f.Dir)
+}
+
+// Has reports whether the fixture contains the named file.
+func (f *Fixture) Has(name string) bool {
+	for _, n := range f.Manifest.Files {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Read returns the content of a recorded file.
+func (f *Fixture) Read(name string) ([]byte, error) {
+	if !f.Has(name) {
+		return nil, fmt.Errorf("fixture %s doesn't contain %s", f.Name(), name)
+	}
+	return os.ReadFile(filepath.Join(f.Dir, name))
+}
@@ -0,0 +1,63 @@
+package fixture
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteLoad(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		m   = Manifest{
+			Date:            time.Date(2023, 11, 23, 3, 45, 50, 0, time.UTC),
+			ExporterVersion: "0.4.0",
+			ZFSVersion:      "zfs-2.1.5-1\nzfs-kmod-2.1.5-1",
+			Kernel:          "Linux 6.1.0-13-amd64",
+		}
+	)
+	require.NoError(t, Write(filepath.Join(dir, "debian-12"), m, map[string][]byte{
+		ZpoolStatus:   []byte("  pool: tank\n"),
+		SnapshotsList: []byte("tank@daily\t1700000000\t4096\n"),
+	}))
+	require.NoError(t, Write(filepath.Join(dir, "freebsd-14"), m, map[string][]byte{
+		ZpoolStatus: []byte("  pool: zroot\n"),
+	}))
+
+	fixtures, err := LoadAll(dir)
+	require.NoError(t, err)
+	require.Len(t, fixtures, 2)
+
+	f := fixtures[0]
+	require.Equal(t, "debian-12", f.Name())
+	require.Equal(t, m.Date, f.Manifest.Date)
+	require.Equal(t, m.ZFSVersion, f.Manifest.ZFSVersion)
+	require.Equal(t, []string{SnapshotsList, ZpoolStatus}, f.Manifest.Files)
+	require.True(t, f.Has(ZpoolStatus))
+	require.False(t, f.Has(ZpoolEvents))
+
+	data, err := f.Read(ZpoolStatus)
+	require.NoError(t, err)
+	require.Equal(t, "  pool: tank\n", string(data))
+	_, err = f.Read(ZpoolEvents)
+	require.Error(t, err)
+
+	require.False(t, fixtures[1].Has(SnapshotsList))
+}
+
+func TestWriteInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{ManifestFile, "../zpool-status.txt", "sub/zpool-status.txt"} {
+		require.Error(t, Write(dir, Manifest{}, map[string][]byte{name: nil}), name)
+	}
+
+	_, err := Load(dir)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ManifestFile), []byte("{"), 0o644))
+	_, err = Load(dir)
+	require.Error(t, err)
+}
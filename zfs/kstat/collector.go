@@ -0,0 +1,102 @@
+package kstat
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// nativeHistogramBucketFactor is the growth of native histogram
+	// buckets, 1.1 results in 8 buckets per power of two
+	nativeHistogramBucketFactor = 1.1
+	// nativeHistogramMaxBuckets bounds the buckets of a native histogram,
+	// beyond it the resolution is reduced
+	nativeHistogramMaxBuckets = 100
+)
+
+// metric maps a field of a kstat to a metric.
+type metric struct {
+	field     string
+	name      string
+	help      string
+	valueType prometheus.ValueType
+}
+
+// statsCollector exports the fields of a kstat as metrics. Fields missing in
+// the kstat, e.g. as they have been renamed between releases, are skipped.
+type statsCollector struct {
+	logger  zerolog.Logger
+	kstat   string
+	metrics []metric
+	descs   []*prometheus.Desc
+
+	provider Provider
+
+	// skip reports whether stats are not exported at all, e.g. as the
+	// feature isn't configured
+	skip func(Stats) bool
+
+	unsupported sync.Once
+	notNamed    sync.Once
+}
+
+func newStatsCollector(logger zerolog.Logger, provider Provider, namespace, subsystem, kstat string, metrics []metric) *statsCollector {
+	c := &statsCollector{
+		logger:   logger.With().Str("collector", subsystem).Logger(),
+		kstat:    kstat,
+		metrics:  metrics,
+		provider: provider,
+	}
+	for _, m := range metrics {
+		c.descs = append(c.descs, prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, m.name), m.help, nil, nil))
+	}
+	return c
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.provider.Read(context.Background(), c.kstat)
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		c.unsupported.Do(func() {
+			c.logger.Info().Msgf("%s is not supported on this platform, the collector is disabled", c.kstat)
+		})
+		return
+	case errors.Is(err, ErrNotNamed):
+		// tables with a row per object would produce a series per object
+		c.notNamed.Do(func() {
+			c.logger.Warn().Msgf("%s isn't a list of named values, the collector is disabled", c.kstat)
+		})
+		return
+	case errors.Is(err, fs.ErrNotExist):
+		// without the kernel module there are no kstats, this is reported
+		// by zfs_up
+		c.logger.Debug().Err(err).Msgf("%s not found", c.kstat)
+		return
+	case err != nil:
+		c.logger.Error().Err(err).Msgf("failed to read %s", c.kstat)
+		ch <- prometheus.NewInvalidMetric(c.descs[0], err)
+		return
+	}
+
+	if c.skip != nil && c.skip(stats) {
+		return
+	}
+	for i, m := range c.metrics {
+		v, ok := stats[m.field]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descs[i], m.valueType, v)
+	}
+}
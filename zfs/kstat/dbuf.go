@@ -0,0 +1,26 @@
+package kstat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// dbufMetrics are the fields of dbufstats.
+var dbufMetrics = []metric{
+	{field: "cache_count", name: "cache_buffers", help: "Number of buffers in the dbuf cache.", valueType: prometheus.GaugeValue},
+	{field: "cache_size_bytes", name: "cache_size_bytes", help: "Size of the dbuf cache.", valueType: prometheus.GaugeValue},
+	{field: "cache_size_bytes_max", name: "cache_size_max_bytes", help: "Largest size the dbuf cache reached.", valueType: prometheus.GaugeValue},
+	{field: "cache_target_bytes", name: "cache_target_bytes", help: "Target size of the dbuf cache, above it buffers are evicted.", valueType: prometheus.GaugeValue},
+	{field: "cache_total_evicts", name: "cache_evictions_total", help: "Total count of buffers evicted from the dbuf cache.", valueType: prometheus.CounterValue},
+	{field: "hash_hits", name: "hits_total", help: "Total count of lookups finding a dbuf.", valueType: prometheus.CounterValue},
+	{field: "hash_misses", name: "misses_total", help: "Total count of lookups not finding a dbuf.", valueType: prometheus.CounterValue},
+	{field: "metadata_cache_count", name: "metadata_cache_buffers", help: "Number of buffers in the dbuf metadata cache.", valueType: prometheus.GaugeValue},
+	{field: "metadata_cache_size_bytes", name: "metadata_cache_size_bytes", help: "Size of the dbuf metadata cache.", valueType: prometheus.GaugeValue},
+	{field: "metadata_cache_overflow", name: "metadata_cache_overflows_total", help: "Total count of times the dbuf metadata cache exceeded its limit.", valueType: prometheus.CounterValue},
+}
+
+// NewDbufCollector creates a collector for the dbuf cache statistics of
+// dbufstats. All metric names are prefixed with namespace.
+func NewDbufCollector(logger zerolog.Logger, provider Provider, namespace string) prometheus.Collector {
+	return newStatsCollector(logger, provider, namespace, "dbuf", "dbufstats", dbufMetrics)
+}
@@ -0,0 +1,60 @@
+package kstat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDbufCollector(t *testing.T, fixture string) prometheus.Collector {
+	return NewDbufCollector(zerolog.Nop(), newFixtureProvider(t, "dbufstats", fixture), "zfs")
+}
+
+func TestDbufCollector(t *testing.T) {
+	c := newTestDbufCollector(t, "dbufstats.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dbuf_cache_buffers Number of buffers in the dbuf cache.
+# TYPE zfs_dbuf_cache_buffers gauge
+zfs_dbuf_cache_buffers 1843
+# HELP zfs_dbuf_cache_evictions_total Total count of buffers evicted from the dbuf cache.
+# TYPE zfs_dbuf_cache_evictions_total counter
+zfs_dbuf_cache_evictions_total 5.312876e+06
+# HELP zfs_dbuf_cache_size_bytes Size of the dbuf cache.
+# TYPE zfs_dbuf_cache_size_bytes gauge
+zfs_dbuf_cache_size_bytes 9.8765824e+07
+# HELP zfs_dbuf_cache_size_max_bytes Largest size the dbuf cache reached.
+# TYPE zfs_dbuf_cache_size_max_bytes gauge
+zfs_dbuf_cache_size_max_bytes 1.34217728e+08
+# HELP zfs_dbuf_cache_target_bytes Target size of the dbuf cache, above it buffers are evicted.
+# TYPE zfs_dbuf_cache_target_bytes gauge
+zfs_dbuf_cache_target_bytes 1.3369344e+08
+# HELP zfs_dbuf_hits_total Total count of lookups finding a dbuf.
+# TYPE zfs_dbuf_hits_total counter
+zfs_dbuf_hits_total 2.147936541e+09
+# HELP zfs_dbuf_metadata_cache_buffers Number of buffers in the dbuf metadata cache.
+# TYPE zfs_dbuf_metadata_cache_buffers gauge
+zfs_dbuf_metadata_cache_buffers 12873
+# HELP zfs_dbuf_metadata_cache_overflows_total Total count of times the dbuf metadata cache exceeded its limit.
+# TYPE zfs_dbuf_metadata_cache_overflows_total counter
+zfs_dbuf_metadata_cache_overflows_total 0
+# HELP zfs_dbuf_metadata_cache_size_bytes Size of the dbuf metadata cache.
+# TYPE zfs_dbuf_metadata_cache_size_bytes gauge
+zfs_dbuf_metadata_cache_size_bytes 2.10763776e+08
+# HELP zfs_dbuf_misses_total Total count of lookups not finding a dbuf.
+# TYPE zfs_dbuf_misses_total counter
+zfs_dbuf_misses_total 3.1872645e+07
+`)))
+}
+
+func TestDbufCollectorTable(t *testing.T) {
+	// a table with a row per dbuf is neither exported nor an error
+	_, err := ParseProc(openFixture(t, "dbufs.txt"))
+	require.ErrorIs(t, err, ErrNotNamed)
+
+	c := newTestDbufCollector(t, "dbufs.txt")
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+}
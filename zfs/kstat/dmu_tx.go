@@ -0,0 +1,26 @@
+package kstat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// dmuTxMetrics are the fields of dmu_tx.
+var dmuTxMetrics = []metric{
+	{field: "dmu_tx_assigned", name: "assigned_total", help: "Total count of transactions assigned to a transaction group.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_delay", name: "delay_total", help: "Total count of transactions delayed, as the transaction group was full.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_error", name: "error_total", help: "Total count of transactions failing to be assigned.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_suspended", name: "suspended_total", help: "Total count of transactions delayed, as the pool was suspended.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_dirty_throttle", name: "dirty_throttle_total", help: "Total count of transactions throttled, as too much dirty data was outstanding.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_dirty_delay", name: "dirty_delay_total", help: "Total count of transactions delayed by the write throttle.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_dirty_over_max", name: "dirty_over_max_total", help: "Total count of transactions delayed, as the dirty data exceeded zfs_dirty_data_max.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_dirty_frees_delay", name: "dirty_frees_delay_total", help: "Total count of transactions delayed, as too many frees were outstanding.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_wrlog_delay", name: "wrlog_delay_total", help: "Total count of transactions delayed, as the write log was over its limit.", valueType: prometheus.CounterValue},
+	{field: "dmu_tx_quota", name: "quota_total", help: "Total count of transactions failing on a quota.", valueType: prometheus.CounterValue},
+}
+
+// NewDmuTxCollector creates a collector for the transaction statistics of
+// dmu_tx. All metric names are prefixed with namespace.
+func NewDmuTxCollector(logger zerolog.Logger, provider Provider, namespace string) prometheus.Collector {
+	return newStatsCollector(logger, provider, namespace, "dmu_tx", "dmu_tx", dmuTxMetrics)
+}
@@ -0,0 +1,261 @@
+// Package kstat reads the statistics the ZFS kernel module exports as kstats.
+// On Linux they are files below /proc/spl/kstat/zfs, on FreeBSD they are
+// sysctls below kstat.zfs. The collectors read them using a Provider, so they
+// are the same on every platform.
+package kstat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+const (
+	// DefaultProcPath is the location of the kstats on Linux.
+	DefaultProcPath = "/proc/spl/kstat/zfs"
+
+	// sysctlPrefix is the prefix of the kstat sysctls of the module on
+	// FreeBSD.
+	sysctlPrefix = "kstat.zfs.misc."
+
+	// sysctlPoolPrefix is the prefix of the kstat sysctls of the pools on
+	// FreeBSD, which are followed by the pool name.
+	sysctlPoolPrefix = "kstat.zfs."
+)
+
+// ErrUnsupported is returned on platforms without kstats. Collectors based on
+// kstats are expected to disable themselves with a log message.
+var ErrUnsupported = errors.New("kstats are not supported on this platform")
+
+// ErrNotNamed is returned for a kstat, which isn't a list of named values, but
+// e.g. a table with a row per object like dbufs on some kernels.
+var ErrNotNamed = errors.New("kstat is not a list of named values")
+
+// Stats are the named values of a kstat.
+type Stats map[string]float64
+
+// ProcProvider reads the kstats from the files of the Linux SPL.
+type ProcProvider struct {
+	procPath string
+	slabPath string
+}
+
+// NewProcProvider creates a provider for the kstat files of the host mounted
+// at root, e.g. /host when running in a container.
+func NewProcProvider(root string) *ProcProvider {
+	return &ProcProvider{
+		procPath: filepath.Join(root, DefaultProcPath),
+		slabPath: filepath.Join(root, DefaultSlabPath),
+	}
+}
+
+// Read reads a kstat file of the Linux SPL.
+func (p *ProcProvider) Read(_ context.Context, name string) (Stats, error) {
+	f, err := os.Open(filepath.Join(p.procPath, name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading kstat %s: %w", name, err)
+	}
+	defer f.Close()
+
+	stats, err := ParseProc(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kstat %s: %w", name, err)
+	}
+	return stats, nil
+}
+
+// SysctlProvider reads the kstats using the sysctl command of FreeBSD.
+type SysctlProvider struct {
+	runner *command.Runner
+}
+
+// NewSysctlProvider creates a provider, which runs sysctl using runner.
+func NewSysctlProvider(runner *command.Runner) *SysctlProvider {
+	return &SysctlProvider{runner: runner}
+}
+
+// Read reads a kstat of the module using sysctl.
+func (p *SysctlProvider) Read(ctx context.Context, name string) (Stats, error) {
+	out, err := p.runner.Output(ctx, "sysctl", "-e", sysctlPrefix+name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading kstat %s: %w", name, err)
+	}
+
+	stats, err := ParseSysctl(strings.NewReader(string(out)), sysctlPrefix+name+".")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kstat %s: %w", name, err)
+	}
+	return stats, nil
+}
+
+// ReadTXGs isn't supported, as the txgs kstats of the pools are tables, which
+// sysctl prints as multiple lines.
+func (p *SysctlProvider) ReadTXGs(context.Context) (map[string][]TXG, error) {
+	return nil, ErrUnsupported
+}
+
+// ReadObjsets reads the objset kstats of all pools using sysctl.
+func (p *SysctlProvider) ReadObjsets(ctx context.Context) ([]Objset, error) {
+	out, err := p.runner.Output(ctx, "sysctl", "-e", strings.TrimSuffix(sysctlPoolPrefix, "."))
+	if err != nil {
+		return nil, fmt.Errorf("error reading objset kstats: %w", err)
+	}
+
+	objsets, err := ParseSysctlObjsets(strings.NewReader(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing objset kstats: %w", err)
+	}
+	return objsets, nil
+}
+
+// ReadSlabs isn't supported, as the kmem caches are specific to the Linux SPL.
+func (p *SysctlProvider) ReadSlabs(context.Context) ([]Slab, error) {
+	return nil, ErrUnsupported
+}
+
+// ParseProc parses a named kstat in the format of the Linux SPL. After a
+// header line, the columns name, type and data follow. Other columns are
+// reported as ErrNotNamed.
+func ParseProc(r io.Reader) (Stats, error) {
+	stats, _, err := parseProc(r)
+	return stats, err
+}
+
+// parseProc is like ParseProc, but also returns the values, which aren't
+// numbers, e.g. the dataset_name of objset kstats.
+func parseProc(r io.Reader) (Stats, map[string]string, error) {
+	var (
+		stats   = make(Stats)
+		strs    = make(map[string]string)
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		// skip the kstat header
+		if line == 1 || len(fields) == 0 {
+			continue
+		}
+		if line == 2 {
+			if strings.Join(fields, " ") != "name type data" {
+				return nil, nil, ErrNotNamed
+			}
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, nil, fmt.Errorf("invalid line %d: %q", line, scanner.Text())
+		}
+		v, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || len(fields) > 3 {
+			// string values aren't statistics, they may contain spaces
+			strs[fields[0]] = strings.Join(fields[2:], " ")
+			continue
+		}
+		stats[fields[0]] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if line < 2 {
+		return nil, nil, errors.New("missing kstat header")
+	}
+	return stats, strs, nil
+}
+
+// ParseSysctl parses the output of sysctl -e. The prefix is removed from the
+// names, lines without it are ignored.
+func ParseSysctl(r io.Reader, prefix string) (Stats, error) {
+	var (
+		stats   = make(Stats)
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line: %q", line)
+		}
+		name := strings.TrimPrefix(key, prefix)
+		if name == key || strings.Contains(name, ".") {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		stats[name] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ParseSysctlObjsets parses the objset kstats in the output of sysctl -e
+// kstat.zfs, which are named kstat.zfs.<pool>.dataset.objset-<id>.<field>.
+// Other lines are ignored, objsets without a dataset name are left out, as
+// the dataset has been unmounted meanwhile.
+func ParseSysctlObjsets(r io.Reader) ([]Objset, error) {
+	const objsetInfix = ".dataset.objset-"
+	var (
+		result  []Objset
+		index   = make(map[string]int)
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || !strings.HasPrefix(key, sysctlPoolPrefix) {
+			continue
+		}
+		// pool names may contain dots, objset names don't
+		idx := strings.LastIndex(key, objsetInfix)
+		if idx <= len(sysctlPoolPrefix) {
+			continue
+		}
+		pool := key[len(sysctlPoolPrefix):idx]
+		objset, field, ok := strings.Cut(key[idx+len(".dataset."):], ".")
+		if !ok || field == "" {
+			continue
+		}
+
+		id := pool + "/" + objset
+		i, ok := index[id]
+		if !ok {
+			i = len(result)
+			index[id] = i
+			result = append(result, Objset{Pool: pool, Stats: make(Stats)})
+		}
+		if field == "dataset_name" {
+			result[i].Dataset = value
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		result[i].Stats[field] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	named := result[:0]
+	for _, o := range result {
+		if o.Dataset != "" {
+			named = append(named, o)
+		}
+	}
+	return named, nil
+}
@@ -0,0 +1,195 @@
+package kstat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+var expectedArcstats = Stats{
+	"hits":                   1229848217,
+	"misses":                 44011342,
+	"demand_data_hits":       1038452671,
+	"c":                      8332705792,
+	"c_max":                  16665411584,
+	"size":                   8329066568,
+	"memory_available_bytes": -2147483648,
+	"l2_hits":                0,
+	"l2_misses":              0,
+}
+
+func openFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// fakeProvider is a Provider backed by maps. Kstats missing in it don't exist,
+// like without the kernel module.
+type fakeProvider struct {
+	stats   map[string]Stats
+	txgs    map[string][]TXG
+	objsets []Objset
+	slabs   []Slab
+	// err is returned by all reads, if it is set
+	err error
+}
+
+func (p *fakeProvider) Read(_ context.Context, name string) (Stats, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	stats, ok := p.stats[name]
+	if !ok {
+		return nil, fmt.Errorf("error reading kstat %s: %w", name, fs.ErrNotExist)
+	}
+	return stats, nil
+}
+
+func (p *fakeProvider) ReadTXGs(context.Context) (map[string][]TXG, error) {
+	return p.txgs, p.err
+}
+
+func (p *fakeProvider) ReadObjsets(context.Context) ([]Objset, error) {
+	return p.objsets, p.err
+}
+
+func (p *fakeProvider) ReadSlabs(context.Context) ([]Slab, error) {
+	if p.err == nil && p.slabs == nil {
+		return nil, fmt.Errorf("error reading slabs: %w", fs.ErrNotExist)
+	}
+	return p.slabs, p.err
+}
+
+// newFixtureProvider returns a provider with the kstat name parsed from the
+// fixture in the format of the Linux SPL.
+func newFixtureProvider(t *testing.T, name, fixture string) *fakeProvider {
+	t.Helper()
+	stats, err := ParseProc(openFixture(t, fixture))
+	if errors.Is(err, ErrNotNamed) {
+		return &fakeProvider{err: err}
+	}
+	require.NoError(t, err)
+	return &fakeProvider{stats: map[string]Stats{name: stats}}
+}
+
+func TestParseProc(t *testing.T) {
+	stats, err := ParseProc(openFixture(t, "arcstats-linux.txt"))
+	require.NoError(t, err)
+	require.Equal(t, expectedArcstats, stats)
+
+	_, err = ParseProc(openFixture(t, "arcstats-freebsd.txt"))
+	require.Error(t, err)
+}
+
+func TestParseSysctl(t *testing.T) {
+	stats, err := ParseSysctl(openFixture(t, "arcstats-freebsd.txt"), "kstat.zfs.misc.arcstats.")
+	require.NoError(t, err)
+	require.Equal(t, expectedArcstats, stats)
+
+	// other kstats and nested names are ignored
+	stats, err = ParseSysctl(openFixture(t, "arcstats-freebsd.txt"), "kstat.zfs.misc.zfetchstats.")
+	require.NoError(t, err)
+	require.Empty(t, stats)
+}
+
+func TestProcProvider(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join("testdata", "arcstats-linux.txt"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "arcstats"), data, 0o644))
+
+	p := NewProcProvider("/")
+	p.procPath = dir
+
+	stats, err := p.Read(context.Background(), "arcstats")
+	require.NoError(t, err)
+	require.Equal(t, expectedArcstats, stats)
+
+	_, err = p.Read(context.Background(), "zfetchstats")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestNewProcProvider(t *testing.T) {
+	require.Equal(t, "/proc/spl/kstat/zfs", NewProcProvider("/").procPath)
+	require.Equal(t, "/host/proc/spl/kstat/zfs", NewProcProvider("/host").procPath)
+	require.Equal(t, "/host/proc/spl/kstat/zfs", NewProcProvider("/host/").procPath)
+}
+
+func TestNewProvider(t *testing.T) {
+	p := NewProvider(command.NewRunner(time.Minute), "/host")
+	switch runtime.GOOS {
+	case "linux":
+		require.Equal(t, "/host/proc/spl/kstat/zfs", p.(*ProcProvider).procPath)
+	case "freebsd":
+		require.IsType(t, &SysctlProvider{}, p)
+	default:
+		_, err := p.Read(context.Background(), "arcstats")
+		require.ErrorIs(t, err, ErrUnsupported)
+	}
+}
+
+func TestSysctlProvider(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		`[ "$1" = "-e" ] || exit 1` + "\n" +
+		`case "$2" in` + "\n" +
+		"kstat.zfs.misc.arcstats) cat " + filepath.Join("testdata", "arcstats-freebsd.txt") + " ;;\n" +
+		"kstat.zfs) cat " + filepath.Join("testdata", "objsets-freebsd.txt") + " ;;\n" +
+		`*) echo "sysctl: unknown oid '$2'" >&2; exit 1 ;;` + "\n" +
+		"esac\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sysctl"), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	p := NewSysctlProvider(command.NewRunner(time.Minute))
+
+	stats, err := p.Read(context.Background(), "arcstats")
+	require.NoError(t, err)
+	require.Equal(t, expectedArcstats, stats)
+
+	_, err = p.Read(context.Background(), "zfetchstats")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown oid")
+
+	objsets, err := p.ReadObjsets(context.Background())
+	require.NoError(t, err)
+	require.Len(t, objsets, 3)
+
+	_, err = p.ReadTXGs(context.Background())
+	require.ErrorIs(t, err, ErrUnsupported)
+	_, err = p.ReadSlabs(context.Background())
+	require.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestParseSysctlObjsets(t *testing.T) {
+	objsets, err := ParseSysctlObjsets(openFixture(t, "objsets-freebsd.txt"))
+	require.NoError(t, err)
+	// the objset without a name has been unmounted while listing
+	require.Len(t, objsets, 3)
+	require.Equal(t, Objset{
+		Pool:    "zroot",
+		Dataset: "zroot/ROOT/default",
+		Stats: Stats{
+			"writes":    1456723,
+			"nwritten":  19876543210,
+			"reads":     3456712,
+			"nread":     98765432101,
+			"nunlinks":  81234,
+			"nunlinked": 81230,
+		},
+	}, objsets[0])
+	// names may contain spaces and pool names dots
+	require.Equal(t, Objset{Pool: "tank.old", Dataset: "tank.old/media library", Stats: Stats{"reads": 912345}}, objsets[2])
+}
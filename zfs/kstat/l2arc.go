@@ -0,0 +1,39 @@
+package kstat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// l2arcMetrics are the L2ARC fields of arcstats.
+var l2arcMetrics = []metric{
+	{field: "l2_size", name: "size_bytes", help: "Size of the data cached in the L2ARC.", valueType: prometheus.GaugeValue},
+	{field: "l2_asize", name: "allocated_bytes", help: "Space allocated on the L2ARC devices, after compression.", valueType: prometheus.GaugeValue},
+	{field: "l2_hits", name: "hits_total", help: "Total count of reads served by the L2ARC.", valueType: prometheus.CounterValue},
+	{field: "l2_misses", name: "misses_total", help: "Total count of reads missing the L2ARC.", valueType: prometheus.CounterValue},
+	{field: "l2_read_bytes", name: "read_bytes_total", help: "Total bytes read from the L2ARC devices.", valueType: prometheus.CounterValue},
+	{field: "l2_write_bytes", name: "written_bytes_total", help: "Total bytes written to the L2ARC devices.", valueType: prometheus.CounterValue},
+	{field: "l2_cksum_bad", name: "checksum_errors_total", help: "Total count of reads from the L2ARC devices with a bad checksum.", valueType: prometheus.CounterValue},
+	{field: "l2_io_error", name: "io_errors_total", help: "Total count of failed reads from the L2ARC devices.", valueType: prometheus.CounterValue},
+}
+
+// NewL2ARCCollector creates a collector for the L2ARC statistics of arcstats.
+// Unless always is set, nothing is exported while no L2ARC is configured, i.e.
+// all its statistics are zero. All metric names are prefixed with namespace.
+func NewL2ARCCollector(logger zerolog.Logger, provider Provider, namespace string, always bool) prometheus.Collector {
+	c := newStatsCollector(logger, provider, namespace, "l2arc", "arcstats", l2arcMetrics)
+	if !always {
+		c.skip = l2arcUnconfigured
+	}
+	return c
+}
+
+// l2arcUnconfigured reports whether all L2ARC statistics are zero.
+func l2arcUnconfigured(stats Stats) bool {
+	for _, m := range l2arcMetrics {
+		if stats[m.field] != 0 {
+			return false
+		}
+	}
+	return true
+}
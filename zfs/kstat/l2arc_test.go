@@ -0,0 +1,79 @@
+package kstat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestL2ARCCollector(t *testing.T, fixture string, always bool) prometheus.Collector {
+	return NewL2ARCCollector(zerolog.Nop(), newFixtureProvider(t, "arcstats", fixture), "zfs", always)
+}
+
+func TestL2ARCCollector(t *testing.T) {
+	c := newTestL2ARCCollector(t, "arcstats-l2arc-linux.txt", false)
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_l2arc_allocated_bytes Space allocated on the L2ARC devices, after compression.
+# TYPE zfs_l2arc_allocated_bytes gauge
+zfs_l2arc_allocated_bytes 1.29862434816e+11
+# HELP zfs_l2arc_checksum_errors_total Total count of reads from the L2ARC devices with a bad checksum.
+# TYPE zfs_l2arc_checksum_errors_total counter
+zfs_l2arc_checksum_errors_total 3
+# HELP zfs_l2arc_hits_total Total count of reads served by the L2ARC.
+# TYPE zfs_l2arc_hits_total counter
+zfs_l2arc_hits_total 5.311204e+06
+# HELP zfs_l2arc_io_errors_total Total count of failed reads from the L2ARC devices.
+# TYPE zfs_l2arc_io_errors_total counter
+zfs_l2arc_io_errors_total 1
+# HELP zfs_l2arc_misses_total Total count of reads missing the L2ARC.
+# TYPE zfs_l2arc_misses_total counter
+zfs_l2arc_misses_total 3.8700138e+07
+# HELP zfs_l2arc_read_bytes_total Total bytes read from the L2ARC devices.
+# TYPE zfs_l2arc_read_bytes_total counter
+zfs_l2arc_read_bytes_total 9.8765172736e+10
+# HELP zfs_l2arc_size_bytes Size of the data cached in the L2ARC.
+# TYPE zfs_l2arc_size_bytes gauge
+zfs_l2arc_size_bytes 2.31928233984e+11
+# HELP zfs_l2arc_written_bytes_total Total bytes written to the L2ARC devices.
+# TYPE zfs_l2arc_written_bytes_total counter
+zfs_l2arc_written_bytes_total 4.12345675776e+11
+`)))
+}
+
+func TestL2ARCCollectorUnconfigured(t *testing.T) {
+	// all L2ARC statistics are zero without a cache device
+	c := newTestL2ARCCollector(t, "arcstats-linux.txt", false)
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	// unless forced, then the fields present are exported
+	c = newTestL2ARCCollector(t, "arcstats-linux.txt", true)
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_l2arc_hits_total Total count of reads served by the L2ARC.
+# TYPE zfs_l2arc_hits_total counter
+zfs_l2arc_hits_total 0
+# HELP zfs_l2arc_misses_total Total count of reads missing the L2ARC.
+# TYPE zfs_l2arc_misses_total counter
+zfs_l2arc_misses_total 0
+`)))
+}
+
+func TestStatsCollectorErrors(t *testing.T) {
+	p := new(fakeProvider)
+	c := NewL2ARCCollector(zerolog.Nop(), p, "zfs", true)
+
+	// without the kernel module nothing is exported
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	p.err = ErrUnsupported
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	// other failures fail the collection
+	_, p.err = ParseProc(strings.NewReader("13 1 0x01\nname type data\nhits 4\n"))
+	require.Error(t, p.err)
+	_, err := testutil.CollectAndLint(c)
+	require.Error(t, err)
+}
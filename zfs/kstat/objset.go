@@ -0,0 +1,141 @@
+package kstat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// Objset is the objset kstat of a mounted dataset, which counts its I/O.
+type Objset struct {
+	Pool    string
+	Dataset string
+	Stats   Stats
+}
+
+// ReadObjsets reads the objset files of all pools of the Linux SPL. As they
+// come and go with the datasets being mounted, the files are looked up on
+// every call.
+func (p *ProcProvider) ReadObjsets(context.Context) ([]Objset, error) {
+	paths, err := filepath.Glob(filepath.Join(p.procPath, "*", "objset-*"))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Objset, 0, len(paths))
+	for _, path := range paths {
+		objset, err := readObjsetFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the dataset has been unmounted meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading kstat %s: %w", path, err)
+		}
+		objset.Pool = filepath.Base(filepath.Dir(path))
+		result = append(result, objset)
+	}
+	return result, nil
+}
+
+func readObjsetFile(path string) (Objset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Objset{}, err
+	}
+	defer f.Close()
+
+	stats, strs, err := parseProc(f)
+	if err != nil {
+		return Objset{}, err
+	}
+	name, ok := strs["dataset_name"]
+	if !ok {
+		return Objset{}, errors.New("missing dataset_name")
+	}
+	return Objset{Dataset: name, Stats: stats}, nil
+}
+
+// objsetMetrics are the fields of the objset kstats.
+var objsetMetrics = []metric{
+	{field: "reads", name: "read_ops_total", help: "Total count of read operations of a ZFS dataset.", valueType: prometheus.CounterValue},
+	{field: "writes", name: "write_ops_total", help: "Total count of write operations of a ZFS dataset.", valueType: prometheus.CounterValue},
+	{field: "nread", name: "read_bytes_total", help: "Total bytes read from a ZFS dataset.", valueType: prometheus.CounterValue},
+	{field: "nwritten", name: "write_bytes_total", help: "Total bytes written to a ZFS dataset.", valueType: prometheus.CounterValue},
+}
+
+type objsetCollector struct {
+	logger      zerolog.Logger
+	provider    Provider
+	keep        func(dataset string) bool
+	descs       []*prometheus.Desc
+	descUnlinks *prometheus.Desc
+
+	unsupported sync.Once
+}
+
+// NewObjsetCollector creates a collector for the I/O of all mounted datasets,
+// for which keep returns true. All metric names are prefixed with namespace.
+func NewObjsetCollector(logger zerolog.Logger, provider Provider, namespace string, keep func(dataset string) bool) prometheus.Collector {
+	c := &objsetCollector{
+		logger:   logger.With().Str("collector", "dataset_io").Logger(),
+		provider: provider,
+		keep:     keep,
+		descUnlinks: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "dataset", "unlinked_queue"),
+			"Number of files of a ZFS dataset, which have been removed but not yet freed.",
+			[]string{"dataset"}, nil,
+		),
+	}
+	for _, m := range objsetMetrics {
+		c.descs = append(c.descs, prometheus.NewDesc(prometheus.BuildFQName(namespace, "dataset", m.name), m.help, []string{"dataset"}, nil))
+	}
+	return c
+}
+
+func (c *objsetCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+	ch <- c.descUnlinks
+}
+
+func (c *objsetCollector) Collect(ch chan<- prometheus.Metric) {
+	objsets, err := c.provider.ReadObjsets(context.Background())
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		c.unsupported.Do(func() {
+			c.logger.Info().Msg("objset kstats are not supported on this platform, the collector is disabled")
+		})
+		return
+	case err != nil:
+		c.logger.Error().Err(err).Msg("failed to read objset kstats")
+		ch <- prometheus.NewInvalidMetric(c.descs[0], err)
+		return
+	}
+
+	for _, o := range objsets {
+		if !c.keep(o.Dataset) {
+			continue
+		}
+		for i, m := range objsetMetrics {
+			if v, ok := o.Stats[m.field]; ok {
+				ch <- prometheus.MustNewConstMetric(c.descs[i], m.valueType, v, o.Dataset)
+			}
+		}
+		// files are unlinked when removed and counted again once freed
+		unlinks, ok := o.Stats["nunlinks"]
+		if !ok {
+			continue
+		}
+		if unlinked, ok := o.Stats["nunlinked"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.descUnlinks, prometheus.GaugeValue, unlinks-unlinked, o.Dataset)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package kstat
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestProcProvider() *ProcProvider {
+	p := NewProcProvider("/")
+	p.procPath = "testdata/proc"
+	return p
+}
+
+func TestProcProviderObjsets(t *testing.T) {
+	objsets, err := newTestProcProvider().ReadObjsets(context.Background())
+	require.NoError(t, err)
+	require.Len(t, objsets, 3)
+	require.Equal(t, Objset{
+		Pool:    "rpool",
+		Dataset: "rpool/ROOT/ubuntu",
+		Stats: Stats{
+			"writes":    1456723,
+			"nwritten":  19876543210,
+			"reads":     3456712,
+			"nread":     98765432101,
+			"nunlinks":  81234,
+			"nunlinked": 81230,
+		},
+	}, objsets[0])
+	// names may contain spaces
+	require.Equal(t, "tank/media library", objsets[1].Dataset)
+
+	// datasets come and go
+	p := NewProcProvider("/")
+	p.procPath = t.TempDir()
+	objsets, err = p.ReadObjsets(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, objsets)
+}
+
+func TestObjsetCollector(t *testing.T) {
+	c := NewObjsetCollector(zerolog.Nop(), newTestProcProvider(), "zfs", func(dataset string) bool {
+		return !strings.HasPrefix(dataset, "rpool/")
+	})
+
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_dataset_read_bytes_total Total bytes read from a ZFS dataset.
+# TYPE zfs_dataset_read_bytes_total counter
+zfs_dataset_read_bytes_total{dataset="tank/media library"} 1.23456789012e+11
+zfs_dataset_read_bytes_total{dataset="tank/scratch"} 0
+# HELP zfs_dataset_read_ops_total Total count of read operations of a ZFS dataset.
+# TYPE zfs_dataset_read_ops_total counter
+zfs_dataset_read_ops_total{dataset="tank/media library"} 912345
+zfs_dataset_read_ops_total{dataset="tank/scratch"} 0
+# HELP zfs_dataset_unlinked_queue Number of files of a ZFS dataset, which have been removed but not yet freed.
+# TYPE zfs_dataset_unlinked_queue gauge
+zfs_dataset_unlinked_queue{dataset="tank/media library"} 0
+zfs_dataset_unlinked_queue{dataset="tank/scratch"} 512
+# HELP zfs_dataset_write_bytes_total Total bytes written to a ZFS dataset.
+# TYPE zfs_dataset_write_bytes_total counter
+zfs_dataset_write_bytes_total{dataset="tank/media library"} 5.12345678e+08
+zfs_dataset_write_bytes_total{dataset="tank/scratch"} 4.4556677889e+10
+# HELP zfs_dataset_write_ops_total Total count of write operations of a ZFS dataset.
+# TYPE zfs_dataset_write_ops_total counter
+zfs_dataset_write_ops_total{dataset="tank/media library"} 5123
+zfs_dataset_write_ops_total{dataset="tank/scratch"} 998877
+`)))
+}
@@ -0,0 +1,47 @@
+package kstat
+
+import (
+	"context"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// Provider reads the kstats of a platform. The collectors only read kstats
+// using it, so they are written once for all platforms.
+type Provider interface {
+	// Read returns the kstat of the module with the given name, e.g.
+	// arcstats.
+	Read(ctx context.Context, name string) (Stats, error)
+	// ReadTXGs returns the recent transaction groups by pool.
+	ReadTXGs(ctx context.Context) (map[string][]TXG, error)
+	// ReadObjsets returns the objset kstats of all mounted datasets.
+	ReadObjsets(ctx context.Context) ([]Objset, error)
+	// ReadSlabs returns the kmem caches of the SPL.
+	ReadSlabs(ctx context.Context) ([]Slab, error)
+}
+
+// NewProvider returns the provider of the platform, which is selected by build
+// tags. On Linux the kstat files of the host mounted at root are read, on
+// FreeBSD sysctl is run using runner. Other platforms return ErrUnsupported.
+func NewProvider(runner *command.Runner, root string) Provider {
+	return newProvider(runner, root)
+}
+
+// unsupportedProvider is the provider of platforms without kstats.
+type unsupportedProvider struct{}
+
+func (unsupportedProvider) Read(context.Context, string) (Stats, error) {
+	return nil, ErrUnsupported
+}
+
+func (unsupportedProvider) ReadTXGs(context.Context) (map[string][]TXG, error) {
+	return nil, ErrUnsupported
+}
+
+func (unsupportedProvider) ReadObjsets(context.Context) ([]Objset, error) {
+	return nil, ErrUnsupported
+}
+
+func (unsupportedProvider) ReadSlabs(context.Context) ([]Slab, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,8 @@
+package kstat
+
+import "github.com/simonswine/zfs-event-exporter/zfs/command"
+
+// the sysctls are always the ones of the running kernel, so root isn't used
+func newProvider(runner *command.Runner, _ string) Provider {
+	return NewSysctlProvider(runner)
+}
@@ -0,0 +1,7 @@
+package kstat
+
+import "github.com/simonswine/zfs-event-exporter/zfs/command"
+
+func newProvider(_ *command.Runner, root string) Provider {
+	return NewProcProvider(root)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !freebsd
+
+package kstat
+
+import "github.com/simonswine/zfs-event-exporter/zfs/command"
+
+func newProvider(*command.Runner, string) Provider {
+	return unsupportedProvider{}
+}
@@ -0,0 +1,221 @@
+package kstat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultSlabPath is the location of the kmem caches of the Linux SPL.
+const DefaultSlabPath = "/proc/spl/kmem/slab"
+
+// OtherCaches is the cache label of the caches, which are not among the
+// largest ones.
+const OtherCaches = "other"
+
+// Slab is a kmem cache of the Linux SPL.
+type Slab struct {
+	Name string
+	// Size is the memory of the slabs of the cache, it is only known for
+	// caches managed by the SPL
+	Size uint64
+	// Alloc is the memory of the objects allocated from the cache
+	Alloc uint64
+	// Native is set for caches, which the SPL passes on to the Linux slab
+	// allocator, their size isn't known
+	Native bool
+}
+
+// Bytes returns the memory used by the cache, which is the size of its slabs
+// or the allocated objects for caches without a known size.
+func (s Slab) Bytes() uint64 {
+	if s.Native {
+		return s.Alloc
+	}
+	return s.Size
+}
+
+// ParseSlabs parses /proc/spl/kmem/slab. The table has a line with the groups
+// of the columns and a line with their names, the columns are looked up by
+// name. Caches on the Linux slab allocator have "-" for the values the SPL
+// doesn't track.
+func ParseSlabs(r io.Reader) ([]Slab, error) {
+	var (
+		result  []Slab
+		columns map[string]int
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "---"):
+			continue
+		case columns == nil:
+			columns = make(map[string]int)
+			for i, name := range fields {
+				// the first column of a name wins, e.g. alloc of the
+				// cache, not of the slabs
+				if _, ok := columns[name]; !ok {
+					columns[name] = i
+				}
+			}
+			for _, name := range []string{"name", "size", "alloc"} {
+				if _, ok := columns[name]; !ok {
+					return nil, fmt.Errorf("missing column %s", name)
+				}
+			}
+			continue
+		case len(fields) < len(columns):
+			return nil, fmt.Errorf("invalid line: %q", scanner.Text())
+		}
+
+		slab := Slab{Name: fields[columns["name"]]}
+		alloc, err := strconv.ParseUint(fields[columns["alloc"]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alloc of cache %s: %w", slab.Name, err)
+		}
+		slab.Alloc = alloc
+		if size := fields[columns["size"]]; size == "-" {
+			slab.Native = true
+		} else if slab.Size, err = strconv.ParseUint(size, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid size of cache %s: %w", slab.Name, err)
+		}
+		result = append(result, slab)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if columns == nil {
+		return nil, errors.New("missing column headers")
+	}
+	return result, nil
+}
+
+// ReadSlabs reads the kmem caches of the Linux SPL.
+func (p *ProcProvider) ReadSlabs(context.Context) ([]Slab, error) {
+	f, err := os.Open(p.slabPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", p.slabPath, err)
+	}
+	defer f.Close()
+
+	slabs, err := ParseSlabs(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", p.slabPath, err)
+	}
+	return slabs, nil
+}
+
+// abdMetrics are the fields of abdstats.
+var abdMetrics = []metric{
+	{field: "struct_size", name: "struct_bytes", help: "Memory used by the ABD structures.", valueType: prometheus.GaugeValue},
+	{field: "scatter_cnt", name: "scatter_buffers", help: "Number of scattered ABD buffers.", valueType: prometheus.GaugeValue},
+	{field: "scatter_data_size", name: "scatter_data_bytes", help: "Size of the data in scattered ABD buffers.", valueType: prometheus.GaugeValue},
+	{field: "scatter_chunk_waste", name: "scatter_chunk_waste_bytes", help: "Memory wasted by the last chunks of scattered ABD buffers.", valueType: prometheus.GaugeValue},
+	{field: "linear_cnt", name: "linear_buffers", help: "Number of linear ABD buffers.", valueType: prometheus.GaugeValue},
+	{field: "linear_data_size", name: "linear_data_bytes", help: "Size of the data in linear ABD buffers.", valueType: prometheus.GaugeValue},
+}
+
+type splCollector struct {
+	logger   zerolog.Logger
+	provider Provider
+	abd      *statsCollector
+	top      int
+
+	descSize      *prometheus.Desc
+	descAlloc     *prometheus.Desc
+	descCacheSize *prometheus.Desc
+
+	unsupported sync.Once
+}
+
+// NewSPLCollector creates a collector for the memory used by the SPL kmem
+// caches and the ABD buffers. Only the top largest caches are exported by
+// name, the others are summed up as other. All metric names are prefixed with
+// namespace.
+func NewSPLCollector(logger zerolog.Logger, provider Provider, namespace string, top int) prometheus.Collector {
+	return &splCollector{
+		logger:   logger.With().Str("collector", "spl").Logger(),
+		provider: provider,
+		abd:      newStatsCollector(logger, provider, namespace, "abd", "abdstats", abdMetrics),
+		top:      top,
+		descSize: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "spl", "slab_size_bytes"),
+			"Memory used by all SPL kmem caches.",
+			nil, nil,
+		),
+		descAlloc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "spl", "slab_allocated_bytes"),
+			"Memory of the objects allocated from all SPL kmem caches.",
+			nil, nil,
+		),
+		descCacheSize: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "spl", "slab_cache_size_bytes"),
+			"Memory used by a SPL kmem cache, only the largest caches are exported by name.",
+			[]string{"cache"}, nil,
+		),
+	}
+}
+
+func (c *splCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.abd.Describe(ch)
+	ch <- c.descSize
+	ch <- c.descAlloc
+	ch <- c.descCacheSize
+}
+
+func (c *splCollector) Collect(ch chan<- prometheus.Metric) {
+	c.abd.Collect(ch)
+
+	slabs, err := c.provider.ReadSlabs(context.Background())
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		c.unsupported.Do(func() {
+			c.logger.Info().Msg("SPL kmem caches are not supported on this platform")
+		})
+		return
+	case errors.Is(err, fs.ErrNotExist):
+		// without the kernel module there are no caches, this is reported
+		// by zfs_up
+		c.logger.Debug().Err(err).Msg("SPL kmem caches not found")
+		return
+	case err != nil:
+		c.logger.Error().Err(err).Msg("failed to read SPL kmem caches")
+		ch <- prometheus.NewInvalidMetric(c.descSize, err)
+		return
+	}
+
+	var size, alloc, other uint64
+	for _, s := range slabs {
+		size += s.Bytes()
+		alloc += s.Alloc
+	}
+	ch <- prometheus.MustNewConstMetric(c.descSize, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(c.descAlloc, prometheus.GaugeValue, float64(alloc))
+
+	sort.SliceStable(slabs, func(i, j int) bool {
+		if slabs[i].Bytes() != slabs[j].Bytes() {
+			return slabs[i].Bytes() > slabs[j].Bytes()
+		}
+		return slabs[i].Name < slabs[j].Name
+	})
+	for i, s := range slabs {
+		if i >= c.top || s.Name == OtherCaches {
+			other += s.Bytes()
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descCacheSize, prometheus.GaugeValue, float64(s.Bytes()), s.Name)
+	}
+	ch <- prometheus.MustNewConstMetric(c.descCacheSize, prometheus.GaugeValue, float64(other), OtherCaches)
+}
@@ -0,0 +1,95 @@
+package kstat
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSlabs(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "slab.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	slabs, err := ParseSlabs(f)
+	require.NoError(t, err)
+	require.Len(t, slabs, 15)
+	require.Equal(t, Slab{Name: "spl_vn_cache"}, slabs[0])
+	// caches on the Linux slab allocator only know their allocated objects
+	require.Equal(t, Slab{Name: "zio_cache", Alloc: 957440, Native: true}, slabs[4])
+	require.Equal(t, uint64(957440), slabs[4].Bytes())
+	require.Equal(t, Slab{Name: "zio_buf_comb_16384", Size: 37748736, Alloc: 31457280}, slabs[6])
+	require.Equal(t, uint64(37748736), slabs[6].Bytes())
+
+	for _, invalid := range []string{
+		"",
+		"name flags size\nzio_cache 0x08000 -\n",
+		"name flags size alloc\nzio_cache 0x08000 - -\n",
+		"name flags size alloc\nzio_cache 0x08000 1\n",
+	} {
+		_, err := ParseSlabs(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestSPLCollector(t *testing.T) {
+	slabs, err := ParseSlabs(openFixture(t, "slab.txt"))
+	require.NoError(t, err)
+	p := newFixtureProvider(t, "abdstats", "abdstats.txt")
+	p.slabs = slabs
+	c := NewSPLCollector(zerolog.Nop(), p, "zfs", 3)
+
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_abd_linear_buffers Number of linear ABD buffers.
+# TYPE zfs_abd_linear_buffers gauge
+zfs_abd_linear_buffers 25
+# HELP zfs_abd_linear_data_bytes Size of the data in linear ABD buffers.
+# TYPE zfs_abd_linear_data_bytes gauge
+zfs_abd_linear_data_bytes 1.28256e+06
+# HELP zfs_abd_scatter_buffers Number of scattered ABD buffers.
+# TYPE zfs_abd_scatter_buffers gauge
+zfs_abd_scatter_buffers 59727
+# HELP zfs_abd_scatter_chunk_waste_bytes Memory wasted by the last chunks of scattered ABD buffers.
+# TYPE zfs_abd_scatter_chunk_waste_bytes gauge
+zfs_abd_scatter_chunk_waste_bytes 1.6777216e+07
+# HELP zfs_abd_scatter_data_bytes Size of the data in scattered ABD buffers.
+# TYPE zfs_abd_scatter_data_bytes gauge
+zfs_abd_scatter_data_bytes 2.147483648e+09
+# HELP zfs_abd_struct_bytes Memory used by the ABD structures.
+# TYPE zfs_abd_struct_bytes gauge
+zfs_abd_struct_bytes 6.214272e+06
+# HELP zfs_spl_slab_allocated_bytes Memory of the objects allocated from all SPL kmem caches.
+# TYPE zfs_spl_slab_allocated_bytes gauge
+zfs_spl_slab_allocated_bytes 6.36654912e+08
+# HELP zfs_spl_slab_cache_size_bytes Memory used by a SPL kmem cache, only the largest caches are exported by name.
+# TYPE zfs_spl_slab_cache_size_bytes gauge
+zfs_spl_slab_cache_size_bytes{cache="arc_buf_hdr_t_full"} 1.0168e+08
+zfs_spl_slab_cache_size_bytes{cache="dnode_t"} 9.216e+07
+zfs_spl_slab_cache_size_bytes{cache="other"} 1.30339264e+08
+zfs_spl_slab_cache_size_bytes{cache="zio_buf_comb_131072"} 3.3554432e+08
+# HELP zfs_spl_slab_size_bytes Memory used by all SPL kmem caches.
+# TYPE zfs_spl_slab_size_bytes gauge
+zfs_spl_slab_size_bytes 6.59723584e+08
+`)))
+
+	// without the kernel module, there is nothing to export
+	c = NewSPLCollector(zerolog.Nop(), new(fakeProvider), "zfs", 3)
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	// the slabs are read from the files of the Linux SPL
+	pp := NewProcProvider("/")
+	pp.slabPath = filepath.Join("testdata", "slab.txt")
+	fromFile, err := pp.ReadSlabs(context.Background())
+	require.NoError(t, err)
+	require.Len(t, fromFile, 15)
+	pp.slabPath = filepath.Join(t.TempDir(), "slab")
+	_, err = pp.ReadSlabs(context.Background())
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,307 @@
+package kstat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// TXG is a row of the txgs kstat of a pool, which holds the recent transaction
+// groups. Its length is limited by the zfs_txg_history module parameter.
+type TXG struct {
+	ID    uint64
+	State string
+	// Written are the bytes written by the transaction group.
+	Written uint64
+	// Open, Quiesce, Wait and Sync are the durations spent in the states of
+	// the transaction group.
+	Open    time.Duration
+	Quiesce time.Duration
+	Wait    time.Duration
+	Sync    time.Duration
+}
+
+// TXGCommitted is the state of a transaction group, which has been synced.
+const TXGCommitted = "C"
+
+// ReadTXGs reads the txgs files of all pools of the Linux SPL.
+func (p *ProcProvider) ReadTXGs(context.Context) (map[string][]TXG, error) {
+	paths, err := filepath.Glob(filepath.Join(p.procPath, "*", "txgs"))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]TXG, len(paths))
+	for _, path := range paths {
+		pool := filepath.Base(filepath.Dir(path))
+		txgs, err := readTXGFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the pool has been exported meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading txgs of pool %s: %w", pool, err)
+		}
+		result[pool] = txgs
+	}
+	return result, nil
+}
+
+func readTXGFile(path string) ([]TXG, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTXGs(f)
+}
+
+// ParseTXGs parses the txgs kstat of a pool. After a header line, the column
+// names follow, the columns are looked up by name. Times are in nanoseconds.
+func ParseTXGs(r io.Reader) ([]TXG, error) {
+	var (
+		txgs    []TXG
+		columns map[string]int
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if line == 1 || len(fields) == 0 {
+			continue
+		}
+		if columns == nil {
+			columns = make(map[string]int, len(fields))
+			for i, name := range fields {
+				columns[name] = i
+			}
+			for _, name := range []string{"txg", "state", "stime"} {
+				if _, ok := columns[name]; !ok {
+					return nil, fmt.Errorf("missing column %s", name)
+				}
+			}
+			continue
+		}
+		if len(fields) != len(columns) {
+			return nil, fmt.Errorf("invalid line %d: %q", line, scanner.Text())
+		}
+
+		var (
+			txg  = TXG{State: fields[columns["state"]]}
+			errs []error
+		)
+		number := func(name string) uint64 {
+			i, ok := columns[name]
+			if !ok {
+				return 0
+			}
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			return v
+		}
+		txg.ID = number("txg")
+		txg.Written = number("nwritten")
+		txg.Open = time.Duration(number("otime"))
+		txg.Quiesce = time.Duration(number("qtime"))
+		txg.Wait = time.Duration(number("wtime"))
+		txg.Sync = time.Duration(number("stime"))
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("invalid line %d: %w", line, errors.Join(errs...))
+		}
+		txgs = append(txgs, txg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if columns == nil {
+		return nil, errors.New("missing kstat header")
+	}
+	return txgs, nil
+}
+
+// txgSyncBuckets are the buckets of the sync times, by default a transaction
+// group is synced at least every 5 seconds.
+var txgSyncBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// txgPool accumulates the committed transaction groups of a pool.
+type txgPool struct {
+	// last is the ID of the most recent transaction group accounted for
+	last    uint64
+	count   uint64
+	sum     time.Duration
+	buckets map[float64]uint64
+	written uint64
+}
+
+func newTXGPool() *txgPool {
+	p := &txgPool{buckets: make(map[float64]uint64, len(txgSyncBuckets))}
+	for _, b := range txgSyncBuckets {
+		p.buckets[b] = 0
+	}
+	return p
+}
+
+// add accounts for the committed transaction groups newer than the last one
+// seen and returns them. The kstat is a rolling window, so transaction groups
+// committed between two reads beyond its length are lost.
+func (p *txgPool) add(txgs []TXG) []TXG {
+	var (
+		last  = p.last
+		added []TXG
+	)
+	for _, txg := range txgs {
+		if txg.State != TXGCommitted || txg.ID <= p.last {
+			continue
+		}
+		added = append(added, txg)
+		seconds := txg.Sync.Seconds()
+		p.count++
+		p.sum += txg.Sync
+		for _, b := range txgSyncBuckets {
+			if seconds <= b {
+				p.buckets[b]++
+			}
+		}
+		p.written += txg.Written
+		if txg.ID > last {
+			last = txg.ID
+		}
+	}
+	p.last = last
+	return added
+}
+
+// reset reports whether the transaction groups belong to a different pool of
+// the same name, as the IDs of a pool never decrease.
+func (p *txgPool) reset(txgs []TXG) bool {
+	for _, txg := range txgs {
+		if txg.ID >= p.last {
+			return false
+		}
+	}
+	return len(txgs) > 0
+}
+
+type txgCollector struct {
+	logger      zerolog.Logger
+	provider    Provider
+	descSync    *prometheus.Desc
+	descWritten *prometheus.Desc
+
+	// native observes the sync times into native histograms, it is nil for
+	// classic buckets
+	native *prometheus.HistogramVec
+
+	mu    sync.Mutex
+	pools map[string]*txgPool
+
+	unsupported sync.Once
+}
+
+// NewTXGCollector creates a collector for the sync times of the transaction
+// groups of all pools. It turns the recent transaction groups of the txgs
+// kstats into counters, by remembering the last transaction group seen per
+// pool. With native set, the sync times are exported as a native histogram
+// instead of classic buckets. All metric names are prefixed with namespace.
+func NewTXGCollector(logger zerolog.Logger, provider Provider, namespace string, native bool) prometheus.Collector {
+	c := &txgCollector{
+		logger:   logger.With().Str("collector", "txg").Logger(),
+		provider: provider,
+		descSync: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "txg_sync_seconds"),
+			"Time spent syncing the committed transaction groups of the pool.",
+			[]string{"pool"}, nil,
+		),
+		descWritten: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "txg_written_bytes_total"),
+			"Total bytes written by the committed transaction groups of the pool.",
+			[]string{"pool"}, nil,
+		),
+		pools: make(map[string]*txgPool),
+	}
+	if native {
+		c.native = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                           prometheus.BuildFQName(namespace, "pool", "txg_sync_seconds"),
+			Help:                           "Time spent syncing the committed transaction groups of the pool.",
+			NativeHistogramBucketFactor:    nativeHistogramBucketFactor,
+			NativeHistogramMaxBucketNumber: nativeHistogramMaxBuckets,
+		}, []string{"pool"})
+	}
+	return c
+}
+
+func (c *txgCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descSync
+	ch <- c.descWritten
+}
+
+func (c *txgCollector) Collect(ch chan<- prometheus.Metric) {
+	txgs, err := c.provider.ReadTXGs(context.Background())
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		c.unsupported.Do(func() {
+			c.logger.Info().Msg("txgs are not supported on this platform, the collector is disabled")
+		})
+		return
+	case err != nil:
+		c.logger.Error().Err(err).Msg("failed to read txgs")
+		ch <- prometheus.NewInvalidMetric(c.descSync, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name := range c.pools {
+		if _, ok := txgs[name]; !ok {
+			delete(c.pools, name)
+			c.deleteNative(name)
+		}
+	}
+	for name, poolTXGs := range txgs {
+		p, ok := c.pools[name]
+		if !ok || p.reset(poolTXGs) {
+			p = newTXGPool()
+			c.pools[name] = p
+			c.deleteNative(name)
+		}
+		added := p.add(poolTXGs)
+		ch <- prometheus.MustNewConstMetric(c.descWritten, prometheus.CounterValue, float64(p.written), name)
+
+		if c.native != nil {
+			h := c.native.WithLabelValues(name)
+			for _, txg := range added {
+				h.Observe(txg.Sync.Seconds())
+			}
+			continue
+		}
+		buckets := make(map[float64]uint64, len(p.buckets))
+		for b, n := range p.buckets {
+			buckets[b] = n
+		}
+		ch <- prometheus.MustNewConstHistogram(c.descSync, p.count, float64(p.sum)/float64(time.Second), buckets, name)
+	}
+	if c.native != nil {
+		c.native.Collect(ch)
+	}
+}
+
+func (c *txgCollector) deleteNative(pool string) {
+	if c.native != nil {
+		c.native.DeleteLabelValues(pool)
+	}
+}
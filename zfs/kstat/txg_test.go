@@ -0,0 +1,195 @@
+package kstat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTXGs(t *testing.T) {
+	txgs, err := ParseTXGs(openFixture(t, "txgs-1.txt"))
+	require.NoError(t, err)
+	require.Len(t, txgs, 5)
+	require.Equal(t, TXG{
+		ID:      3924122,
+		State:   TXGCommitted,
+		Written: 8929280,
+		Open:    5000298112 * time.Nanosecond,
+		Quiesce: 29811 * time.Nanosecond,
+		Wait:    38876 * time.Nanosecond,
+		Sync:    1830002314 * time.Nanosecond,
+	}, txgs[1])
+	require.Equal(t, "O", txgs[4].State)
+
+	for _, invalid := range []string{
+		"",
+		"22 0 0x01 5 560 6012348741 2343124451245\ntxg birth state\n",
+		"22 0 0x01 5 560 6012348741 2343124451245\ntxg state stime\n1 C\n",
+		"22 0 0x01 5 560 6012348741 2343124451245\ntxg state stime\n1 C x\n",
+	} {
+		_, err := ParseTXGs(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestProcProviderTXGs(t *testing.T) {
+	dir := t.TempDir()
+	data, err := os.ReadFile(filepath.Join("testdata", "txgs-1.txt"))
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "tank"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tank", "txgs"), data, 0o644))
+	// kstats of the module and pools without txgs are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "arcstats"), nil, 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "rpool"), 0o755))
+
+	p := NewProcProvider("/")
+	p.procPath = dir
+
+	txgs, err := p.ReadTXGs(context.Background())
+	require.NoError(t, err)
+	require.Len(t, txgs, 1)
+	require.Len(t, txgs["tank"], 5)
+}
+
+func TestTXGCollector(t *testing.T) {
+	p := new(fakeProvider)
+	c := NewTXGCollector(zerolog.Nop(), p, "zfs", false).(*txgCollector)
+	// setFixture sets the txgs of tank to the fixture, without a fixture
+	// the pool is exported
+	setFixture := func(fixture string) {
+		p.txgs = make(map[string][]TXG)
+		if fixture == "" {
+			return
+		}
+		txgs, err := ParseTXGs(openFixture(t, fixture))
+		require.NoError(t, err)
+		p.txgs["tank"] = txgs
+	}
+
+	// only the committed transaction groups are accounted for
+	setFixture("txgs-1.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_txg_sync_seconds Time spent syncing the committed transaction groups of the pool.
+# TYPE zfs_pool_txg_sync_seconds histogram
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.01"} 0
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.025"} 0
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.05"} 1
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.1"} 1
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.25"} 2
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.5"} 2
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="1"} 2
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="2.5"} 3
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="5"} 3
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="10"} 3
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="30"} 3
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="+Inf"} 3
+zfs_pool_txg_sync_seconds_sum{pool="tank"} 1.994480702
+zfs_pool_txg_sync_seconds_count{pool="tank"} 3
+# HELP zfs_pool_txg_written_bytes_total Total bytes written by the committed transaction groups of the pool.
+# TYPE zfs_pool_txg_written_bytes_total counter
+zfs_pool_txg_written_bytes_total{pool="tank"} 1.562624e+07
+`)))
+
+	// the window overlaps with the previous read, 3924123 is not counted
+	// again, the syncing 3924124 is counted once committed
+	setFixture("txgs-2.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_txg_sync_seconds Time spent syncing the committed transaction groups of the pool.
+# TYPE zfs_pool_txg_sync_seconds histogram
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.01"} 1
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.025"} 1
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.05"} 2
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.1"} 2
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.25"} 3
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="0.5"} 3
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="1"} 4
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="2.5"} 5
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="5"} 5
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="10"} 5
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="30"} 5
+zfs_pool_txg_sync_seconds_bucket{pool="tank",le="+Inf"} 5
+zfs_pool_txg_sync_seconds_sum{pool="tank"} 2.61003602
+zfs_pool_txg_sync_seconds_count{pool="tank"} 5
+# HELP zfs_pool_txg_written_bytes_total Total bytes written by the committed transaction groups of the pool.
+# TYPE zfs_pool_txg_written_bytes_total counter
+zfs_pool_txg_written_bytes_total{pool="tank"} 1.897472e+07
+`)))
+
+	// reading the same window again doesn't change the counters
+	setFixture("txgs-2.txt")
+	require.Equal(t, 2, testutil.CollectAndCount(c))
+	require.Equal(t, uint64(5), c.pools["tank"].count)
+	require.Equal(t, uint64(3924125), c.pools["tank"].last)
+
+	// the state of exported pools is dropped
+	setFixture("")
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+	require.Empty(t, c.pools)
+}
+
+func TestTXGCollectorNative(t *testing.T) {
+	p := new(fakeProvider)
+	c := NewTXGCollector(zerolog.Nop(), p, "zfs", true).(*txgCollector)
+	// setFixture sets the txgs of tank to the fixture, without a fixture
+	// the pool is exported
+	setFixture := func(fixture string) {
+		p.txgs = make(map[string][]TXG)
+		if fixture == "" {
+			return
+		}
+		txgs, err := ParseTXGs(openFixture(t, fixture))
+		require.NoError(t, err)
+		p.txgs["tank"] = txgs
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	syncHistogram := func() *dto.Histogram {
+		t.Helper()
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() == "zfs_pool_txg_sync_seconds" {
+				require.Len(t, mf.GetMetric(), 1)
+				return mf.GetMetric()[0].GetHistogram()
+			}
+		}
+		return nil
+	}
+
+	setFixture("txgs-1.txt")
+	h := syncHistogram()
+	require.Equal(t, uint64(3), h.GetSampleCount())
+	require.InDelta(t, 1.994480702, h.GetSampleSum(), 1e-9)
+	require.Equal(t, int32(3), h.GetSchema())
+	require.NotEmpty(t, h.GetPositiveSpan())
+	// there are no classic buckets
+	require.Empty(t, h.GetBucket())
+
+	setFixture("txgs-2.txt")
+	require.Equal(t, uint64(5), syncHistogram().GetSampleCount())
+
+	// the histograms of exported pools are dropped
+	setFixture("")
+	require.Nil(t, syncHistogram())
+}
+
+func TestTXGPoolReset(t *testing.T) {
+	p := newTXGPool()
+	p.add([]TXG{{ID: 100, State: TXGCommitted, Written: 10}, {ID: 101, State: "S"}})
+	require.Equal(t, uint64(100), p.last)
+	require.False(t, p.reset([]TXG{{ID: 100, State: TXGCommitted}, {ID: 101, State: TXGCommitted}}))
+	require.False(t, p.reset(nil))
+
+	// a recreated pool starts over with lower IDs
+	require.True(t, p.reset([]TXG{{ID: 5, State: TXGCommitted}, {ID: 6, State: "O"}}))
+}
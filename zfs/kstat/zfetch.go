@@ -0,0 +1,25 @@
+package kstat
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// zfetchMetrics are the fields of zfetchstats. Releases before 2.2 only have
+// some of them.
+var zfetchMetrics = []metric{
+	{field: "hits", name: "hits_total", help: "Total count of reads, which hit a prefetch stream.", valueType: prometheus.CounterValue},
+	{field: "misses", name: "misses_total", help: "Total count of reads, which didn't hit a prefetch stream.", valueType: prometheus.CounterValue},
+	{field: "future", name: "future_hits_total", help: "Total count of reads ahead of a prefetch stream.", valueType: prometheus.CounterValue},
+	{field: "stride", name: "stride_hits_total", help: "Total count of reads, which hit a strided prefetch stream.", valueType: prometheus.CounterValue},
+	{field: "past", name: "past_hits_total", help: "Total count of reads behind a prefetch stream.", valueType: prometheus.CounterValue},
+	{field: "max_streams", name: "max_streams_total", help: "Total count of prefetch streams not created, as the maximum number of streams was reached.", valueType: prometheus.CounterValue},
+	{field: "io_issued", name: "io_issued_total", help: "Total count of prefetch I/Os issued.", valueType: prometheus.CounterValue},
+	{field: "io_active", name: "io_active", help: "Number of prefetch I/Os in flight.", valueType: prometheus.GaugeValue},
+}
+
+// NewZfetchCollector creates a collector for the prefetch statistics of
+// zfetchstats. All metric names are prefixed with namespace.
+func NewZfetchCollector(logger zerolog.Logger, provider Provider, namespace string) prometheus.Collector {
+	return newStatsCollector(logger, provider, namespace, "zfetch", "zfetchstats", zfetchMetrics)
+}
@@ -0,0 +1,62 @@
+package kstat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestZfetchCollector(t *testing.T, fixture string) prometheus.Collector {
+	return NewZfetchCollector(zerolog.Nop(), newFixtureProvider(t, "zfetchstats", fixture), "zfs")
+}
+
+func TestZfetchCollector(t *testing.T) {
+	// the fields missing before 2.2 are left out
+	c := newTestZfetchCollector(t, "zfetchstats-2.1.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_zfetch_hits_total Total count of reads, which hit a prefetch stream.
+# TYPE zfs_zfetch_hits_total counter
+zfs_zfetch_hits_total 3.18234811e+08
+# HELP zfs_zfetch_io_issued_total Total count of prefetch I/Os issued.
+# TYPE zfs_zfetch_io_issued_total counter
+zfs_zfetch_io_issued_total 1.1726409e+07
+# HELP zfs_zfetch_max_streams_total Total count of prefetch streams not created, as the maximum number of streams was reached.
+# TYPE zfs_zfetch_max_streams_total counter
+zfs_zfetch_max_streams_total 8.5213012e+07
+# HELP zfs_zfetch_misses_total Total count of reads, which didn't hit a prefetch stream.
+# TYPE zfs_zfetch_misses_total counter
+zfs_zfetch_misses_total 8.7216631e+07
+`)))
+
+	c = newTestZfetchCollector(t, "zfetchstats-2.2.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_zfetch_future_hits_total Total count of reads ahead of a prefetch stream.
+# TYPE zfs_zfetch_future_hits_total counter
+zfs_zfetch_future_hits_total 93521
+# HELP zfs_zfetch_hits_total Total count of reads, which hit a prefetch stream.
+# TYPE zfs_zfetch_hits_total counter
+zfs_zfetch_hits_total 1.2741133e+07
+# HELP zfs_zfetch_io_active Number of prefetch I/Os in flight.
+# TYPE zfs_zfetch_io_active gauge
+zfs_zfetch_io_active 3
+# HELP zfs_zfetch_io_issued_total Total count of prefetch I/Os issued.
+# TYPE zfs_zfetch_io_issued_total counter
+zfs_zfetch_io_issued_total 421876
+# HELP zfs_zfetch_max_streams_total Total count of prefetch streams not created, as the maximum number of streams was reached.
+# TYPE zfs_zfetch_max_streams_total counter
+zfs_zfetch_max_streams_total 1.87421e+06
+# HELP zfs_zfetch_misses_total Total count of reads, which didn't hit a prefetch stream.
+# TYPE zfs_zfetch_misses_total counter
+zfs_zfetch_misses_total 2.218871e+06
+# HELP zfs_zfetch_past_hits_total Total count of reads behind a prefetch stream.
+# TYPE zfs_zfetch_past_hits_total counter
+zfs_zfetch_past_hits_total 61412
+# HELP zfs_zfetch_stride_hits_total Total count of reads, which hit a strided prefetch stream.
+# TYPE zfs_zfetch_stride_hits_total counter
+zfs_zfetch_stride_hits_total 2178
+`)))
+}
@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// Driver is the CSI driver of OpenEBS zfs-localpv.
+	Driver = "zfs.csi.openebs.io"
+
+	// PoolAttribute is the volume attribute of zfs-localpv, which contains
+	// the dataset the volumes are created in.
+	PoolAttribute = "openebs.io/poolname"
+)
+
+// Volume is the Kubernetes volume a dataset belongs to. Namespace and
+// PersistentVolumeClaim are empty for volumes, which are not bound.
+type Volume struct {
+	Namespace             string
+	PersistentVolumeClaim string
+	PersistentVolume      string
+}
+
+// Dataset returns the dataset of a zfs-localpv persistent volume and the
+// volume it belongs to. The dataset is named after the volume handle below
+// the pool of the storage class.
+func Dataset(pv *corev1.PersistentVolume) (string, Volume, bool) {
+	csi := pv.Spec.CSI
+	if csi == nil || csi.Driver != Driver || csi.VolumeHandle == "" {
+		return "", Volume{}, false
+	}
+	pool := csi.VolumeAttributes[PoolAttribute]
+	if pool == "" {
+		return "", Volume{}, false
+	}
+
+	v := Volume{PersistentVolume: pv.Name}
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		v.Namespace = ref.Namespace
+		v.PersistentVolumeClaim = ref.Name
+	}
+	return pool + "/" + csi.VolumeHandle, v, true
+}
+
+// NewClient creates a client using the kubeconfig file or the service account
+// of the pod, if it is empty.
+func NewClient(kubeconfig string) (kubernetes.Interface, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading kubernetes client config: %w", err)
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+type volumeCollector struct {
+	logger   zerolog.Logger
+	informer cache.SharedIndexInformer
+
+	descInfo *prometheus.Desc
+}
+
+// NewCollector creates a collector mapping the datasets of zfs-localpv
+// persistent volumes to the volumes and their claims. It watches the
+// persistent volumes once Run is called. All metric names are prefixed with
+// namespace.
+func NewCollector(logger zerolog.Logger, client kubernetes.Interface, namespace string) *volumeCollector {
+	return &volumeCollector{
+		logger:   logger.With().Str("collector", "kubernetes").Logger(),
+		informer: informers.NewSharedInformerFactory(client, 0).Core().V1().PersistentVolumes().Informer(),
+		descInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "dataset", "kubernetes_info"),
+			"Kubernetes persistent volume and claim of a dataset.",
+			[]string{"dataset", "namespace", "persistentvolumeclaim", "persistentvolume"},
+			nil,
+		),
+	}
+}
+
+// Run watches the persistent volumes until ctx is cancelled. The informer
+// lists them again, whenever the watch has to be re-established.
+func (c *volumeCollector) Run(ctx context.Context) {
+	c.informer.Run(ctx.Done())
+}
+
+// HasSynced reports whether the initial listing of the persistent volumes has
+// completed.
+func (c *volumeCollector) HasSynced() bool {
+	return c.informer.HasSynced()
+}
+
+func (c *volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descInfo
+}
+
+// Collect exports the mapping of the persistent volumes known at the time of
+// the collection, so volumes, which have been deleted or rebound, don't leave
+// stale series behind.
+func (c *volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	seen := make(map[string]bool)
+	for _, obj := range c.informer.GetStore().List() {
+		pv, ok := obj.(*corev1.PersistentVolume)
+		if !ok {
+			continue
+		}
+		dataset, v, ok := Dataset(pv)
+		if !ok {
+			continue
+		}
+		if seen[dataset] {
+			c.logger.Warn().Msgf("dataset %s belongs to multiple persistent volumes, ignoring %s", dataset, pv.Name)
+			continue
+		}
+		seen[dataset] = true
+		ch <- prometheus.MustNewConstMetric(c.descInfo, prometheus.GaugeValue, 1, dataset, v.Namespace, v.PersistentVolumeClaim, v.PersistentVolume)
+	}
+}
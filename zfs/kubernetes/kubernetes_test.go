@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPV(name, driver, pool, namespace, claim string) *corev1.PersistentVolume {
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           driver,
+					VolumeHandle:     name,
+					VolumeAttributes: map[string]string{PoolAttribute: pool},
+				},
+			},
+		},
+	}
+	if claim != "" {
+		pv.Spec.ClaimRef = &corev1.ObjectReference{Namespace: namespace, Name: claim}
+	}
+	return pv
+}
+
+func TestDataset(t *testing.T) {
+	dataset, v, ok := Dataset(newPV("pvc-1234", Driver, "tank/k8s", "monitoring", "data-prometheus-0"))
+	require.True(t, ok)
+	require.Equal(t, "tank/k8s/pvc-1234", dataset)
+	require.Equal(t, Volume{Namespace: "monitoring", PersistentVolumeClaim: "data-prometheus-0", PersistentVolume: "pvc-1234"}, v)
+
+	_, v, ok = Dataset(newPV("pvc-1234", Driver, "tank", "", ""))
+	require.True(t, ok)
+	require.Equal(t, Volume{PersistentVolume: "pvc-1234"}, v)
+
+	_, _, ok = Dataset(newPV("pvc-1234", "ebs.csi.aws.com", "tank", "", ""))
+	require.False(t, ok)
+	_, _, ok = Dataset(newPV("pvc-1234", Driver, "", "", ""))
+	require.False(t, ok)
+	_, _, ok = Dataset(&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "hostpath"}})
+	require.False(t, ok)
+}
+
+const kubernetesInfoHeader = `# HELP zfs_dataset_kubernetes_info Kubernetes persistent volume and claim of a dataset.
+# TYPE zfs_dataset_kubernetes_info gauge
+`
+
+func TestCollector(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newPV("pvc-1", Driver, "tank/k8s", "monitoring", "data-prometheus-0"),
+		newPV("pvc-2", Driver, "tank/k8s", "", ""),
+		newPV("pvc-3", "ebs.csi.aws.com", "tank/k8s", "default", "data"),
+	)
+	c := NewCollector(zerolog.Nop(), client, "zfs")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	require.Eventually(t, c.HasSynced, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(kubernetesInfoHeader+`
+zfs_dataset_kubernetes_info{dataset="tank/k8s/pvc-1",namespace="monitoring",persistentvolume="pvc-1",persistentvolumeclaim="data-prometheus-0"} 1
+zfs_dataset_kubernetes_info{dataset="tank/k8s/pvc-2",namespace="",persistentvolume="pvc-2",persistentvolumeclaim=""} 1
+`)))
+
+	// binding and deleting volumes is reflected without stale series
+	pvs := client.CoreV1().PersistentVolumes()
+	_, err := pvs.Update(ctx, newPV("pvc-2", Driver, "tank/k8s", "default", "data-redis-0"), metav1.UpdateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, pvs.Delete(ctx, "pvc-1", metav1.DeleteOptions{}))
+
+	expected := kubernetesInfoHeader + `
+zfs_dataset_kubernetes_info{dataset="tank/k8s/pvc-2",namespace="default",persistentvolume="pvc-2",persistentvolumeclaim="data-redis-0"} 1
+`
+	for i := 0; ; i++ {
+		err = testutil.CollectAndCompare(c, strings.NewReader(expected))
+		if err == nil || i == 100 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.NoError(t, err)
+}
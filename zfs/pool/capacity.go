@@ -0,0 +1,263 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// DefaultCapacityWindow is the default duration of the history of the
+// allocated bytes the fill rate is calculated from.
+const DefaultCapacityWindow = 6 * time.Hour
+
+// capacityHistorySize is the number of samples kept per pool, they are spread
+// over the window.
+const capacityHistorySize = 360
+
+func zpoolListCapacityCmd(runner command.CommandRunner) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return command.Output(context.Background(), runner, "zpool", "list", "-H", "-p", "-o", "name,size,allocated")
+	}
+}
+
+// Capacity is the size of a pool and the bytes allocated in it.
+type Capacity struct {
+	Pool      string
+	Size      uint64
+	Allocated uint64
+}
+
+// ParseCapacity parses the output of zpool list -H -p -o name,size,allocated.
+func ParseCapacity(r io.Reader) ([]Capacity, error) {
+	var (
+		result  []Capacity
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		if scanner.Text() == "" || scanner.Text() == "no pools available" {
+			continue
+		}
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line: %q", scanner.Text())
+		}
+		size, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of pool %s: %w", fields[0], err)
+		}
+		allocated, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allocated bytes of pool %s: %w", fields[0], err)
+		}
+		result = append(result, Capacity{Pool: fields[0], Size: size, Allocated: allocated})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type capacitySample struct {
+	ts        time.Time
+	allocated float64
+}
+
+// capacityHistory is a ring buffer of the allocated bytes of a pool.
+type capacityHistory struct {
+	samples []capacitySample
+	// next is the index the next sample is written to
+	next int
+	full bool
+}
+
+func newCapacityHistory() *capacityHistory {
+	return &capacityHistory{samples: make([]capacitySample, capacityHistorySize)}
+}
+
+func (h *capacityHistory) last() (capacitySample, bool) {
+	if !h.full && h.next == 0 {
+		return capacitySample{}, false
+	}
+	return h.samples[(h.next+len(h.samples)-1)%len(h.samples)], true
+}
+
+func (h *capacityHistory) add(s capacitySample) {
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// fillRate returns the slope of the linear regression of the allocated bytes
+// of the samples since, in bytes per second. It is false, if there are not
+// enough samples.
+func (h *capacityHistory) fillRate(since time.Time) (float64, bool) {
+	n := h.next
+	if h.full {
+		n = len(h.samples)
+	}
+
+	var (
+		count        int
+		first        time.Time
+		spread       bool
+		sumX, sumY   float64
+		sumXX, sumXY float64
+	)
+	for i := 0; i < n; i++ {
+		s := h.samples[i]
+		if s.ts.Before(since) {
+			continue
+		}
+		if count == 0 {
+			first = s.ts
+		} else if !s.ts.Equal(first) {
+			spread = true
+		}
+		// the time relative to a sample keeps the precision of the sums
+		x := s.ts.Sub(first).Seconds()
+		count++
+		sumX += x
+		sumY += s.allocated
+		sumXX += x * x
+		sumXY += x * s.allocated
+	}
+	if count < 2 || !spread {
+		return 0, false
+	}
+	c := float64(count)
+	return (c*sumXY - sumX*sumY) / (c*sumXX - sumX*sumX), true
+}
+
+type capacityCollector struct {
+	logger  zerolog.Logger
+	getList func() ([]byte, error)
+	window  time.Duration
+	now     func() time.Time
+
+	mtx     sync.Mutex
+	history map[string]*capacityHistory
+
+	descSize      *prometheus.Desc
+	descAllocated *prometheus.Desc
+	descFillRate  *prometheus.Desc
+	descUntilFull *prometheus.Desc
+}
+
+// NewCapacityCollector creates a collector for the size and the allocated
+// bytes of all pools, which runs zpool list using runner on every collection.
+// The allocated bytes of the last window are kept in memory to project when a
+// pool is full. All metric names are prefixed with namespace.
+func NewCapacityCollector(logger zerolog.Logger, runner command.CommandRunner, namespace string, window time.Duration) prometheus.Collector {
+	return newCapacityCollector(logger, zpoolListCapacityCmd(runner), namespace, window)
+}
+
+func newCapacityCollector(logger zerolog.Logger, getList func() ([]byte, error), namespace string, window time.Duration) *capacityCollector {
+	return &capacityCollector{
+		logger:  logger.With().Str("collector", "pool_capacity").Logger(),
+		getList: getList,
+		window:  window,
+		now:     time.Now,
+		history: make(map[string]*capacityHistory),
+		descSize: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "size_bytes"),
+			"Size of a ZFS pool.",
+			[]string{"pool"}, nil,
+		),
+		descAllocated: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "allocated_bytes"),
+			"Bytes allocated in a ZFS pool.",
+			[]string{"pool"}, nil,
+		),
+		descFillRate: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "fill_rate_bytes_per_second"),
+			"Rate the allocated bytes of a ZFS pool changed by, based on a linear regression over the history kept by the exporter.",
+			[]string{"pool"}, nil,
+		),
+		descUntilFull: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "seconds_until_full"),
+			"Projected time until a ZFS pool is full at its fill rate, only exported while it is filling up.",
+			[]string{"pool"}, nil,
+		),
+	}
+}
+
+func (c *capacityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descSize
+	ch <- c.descAllocated
+	ch <- c.descFillRate
+	ch <- c.descUntilFull
+}
+
+func (c *capacityCollector) Collect(ch chan<- prometheus.Metric) {
+	data, err := c.getList()
+	if errors.Is(err, command.ErrUnavailable) {
+		// there are no pools without ZFS, this is reported by zfs_up
+		c.logger.Debug().Err(err).Msg("ZFS is not available")
+		return
+	}
+	if err != nil {
+		// the history is kept, the regression copes with the gap
+		c.logger.Error().Err(err).Msg("failed to get zpool list")
+		ch <- prometheus.NewInvalidMetric(c.descSize, fmt.Errorf("failed to get zpool list: %w", err))
+		return
+	}
+
+	pools, err := ParseCapacity(bytes.NewReader(data))
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to parse zpool list")
+		ch <- prometheus.NewInvalidMetric(c.descSize, fmt.Errorf("failed to parse zpool list: %w", err))
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.now()
+	seen := make(map[string]bool, len(pools))
+	for _, p := range pools {
+		seen[p.Pool] = true
+		ch <- prometheus.MustNewConstMetric(c.descSize, prometheus.GaugeValue, float64(p.Size), p.Pool)
+		ch <- prometheus.MustNewConstMetric(c.descAllocated, prometheus.GaugeValue, float64(p.Allocated), p.Pool)
+
+		h, ok := c.history[p.Pool]
+		if !ok {
+			h = newCapacityHistory()
+			c.history[p.Pool] = h
+		}
+		// the samples are spread over the window, more frequent
+		// collections don't add samples
+		if last, ok := h.last(); !ok || now.Sub(last.ts) >= c.window/capacityHistorySize {
+			h.add(capacitySample{ts: now, allocated: float64(p.Allocated)})
+		}
+
+		rate, ok := h.fillRate(now.Add(-c.window))
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descFillRate, prometheus.GaugeValue, rate, p.Pool)
+		if rate > 0 && p.Size > p.Allocated {
+			ch <- prometheus.MustNewConstMetric(c.descUntilFull, prometheus.GaugeValue, float64(p.Size-p.Allocated)/rate, p.Pool)
+		}
+	}
+
+	// the history of exported or destroyed pools is dropped
+	for pool := range c.history {
+		if !seen[pool] {
+			delete(c.history, pool)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+const gib = 1 << 30
+
+func TestParseCapacity(t *testing.T) {
+	pools, err := ParseCapacity(strings.NewReader("rpool\t1073741824\t536870912\ntank\t10995116277760\t0\n"))
+	require.NoError(t, err)
+	require.Equal(t, []Capacity{
+		{Pool: "rpool", Size: 1 << 30, Allocated: 1 << 29},
+		{Pool: "tank", Size: 10 << 40},
+	}, pools)
+
+	pools, err = ParseCapacity(strings.NewReader("no pools available\n"))
+	require.NoError(t, err)
+	require.Empty(t, pools)
+
+	for _, invalid := range []string{"tank 1 2\n", "tank\t1\n", "tank\t10G\t0\n", "tank\t1\t-\n"} {
+		_, err := ParseCapacity(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+// fakeCapacity is a pool filled by a synthetic pattern, which is listed at
+// the time of an injected clock.
+type fakeCapacity struct {
+	now       time.Time
+	size      uint64
+	allocated func(elapsed time.Duration) uint64
+	start     time.Time
+	err       error
+}
+
+func newTestCapacityCollector(f *fakeCapacity, window time.Duration) *capacityCollector {
+	c := newCapacityCollector(zerolog.Nop(), func() ([]byte, error) {
+		if f.err != nil {
+			return nil, f.err
+		}
+		return []byte(fmt.Sprintf("tank\t%d\t%d\n", f.size, f.allocated(f.now.Sub(f.start)))), nil
+	}, "zfs", window)
+	c.now = func() time.Time { return f.now }
+	return c
+}
+
+// collectFor collects every interval for d and returns the values of the fill
+// rate and the seconds until full after the last collection.
+func collectFor(t *testing.T, c *capacityCollector, f *fakeCapacity, d, interval time.Duration) (rate, untilFull float64, ok bool) {
+	t.Helper()
+	end := f.now.Add(d)
+	for ; !f.now.After(end); f.now = f.now.Add(interval) {
+		testutil.CollectAndCount(c)
+	}
+	f.now = end
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		switch family.GetName() {
+		case "zfs_pool_fill_rate_bytes_per_second":
+			rate = family.GetMetric()[0].GetGauge().GetValue()
+		case "zfs_pool_seconds_until_full":
+			untilFull = family.GetMetric()[0].GetGauge().GetValue()
+			ok = true
+		}
+	}
+	return rate, untilFull, ok
+}
+
+func TestCapacityCollectorLinear(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	f := &fakeCapacity{
+		now:  start,
+		size: 100 * gib,
+		// 1 GiB per hour
+		allocated: func(elapsed time.Duration) uint64 { return uint64(10*gib + elapsed.Hours()*gib) },
+		start:     start,
+	}
+	c := newTestCapacityCollector(f, 6*time.Hour)
+
+	// a single sample doesn't have a trend
+	require.Equal(t, 2, testutil.CollectAndCount(c))
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_allocated_bytes Bytes allocated in a ZFS pool.
+# TYPE zfs_pool_allocated_bytes gauge
+zfs_pool_allocated_bytes{pool="tank"} 1.073741824e+10
+# HELP zfs_pool_size_bytes Size of a ZFS pool.
+# TYPE zfs_pool_size_bytes gauge
+zfs_pool_size_bytes{pool="tank"} 1.073741824e+11
+`), "zfs_pool_allocated_bytes", "zfs_pool_size_bytes", "zfs_pool_fill_rate_bytes_per_second"))
+
+	rate, untilFull, ok := collectFor(t, c, f, 12*time.Hour, 15*time.Second)
+	require.True(t, ok)
+	require.InDelta(t, gib/3600.0, rate, 1)
+	// 78 GiB are left after 12 hours
+	require.InDelta(t, 78*3600.0, untilFull, 60)
+	// the samples are spread over the window
+	require.True(t, c.history["tank"].full)
+}
+
+func TestCapacityCollectorFlat(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	f := &fakeCapacity{
+		now:       start,
+		size:      100 * gib,
+		allocated: func(time.Duration) uint64 { return 50 * gib },
+		start:     start,
+	}
+	c := newTestCapacityCollector(f, time.Hour)
+
+	rate, _, ok := collectFor(t, c, f, 2*time.Hour, time.Minute)
+	require.False(t, ok)
+	require.Equal(t, 0.0, rate)
+}
+
+func TestCapacityCollectorShrinking(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	f := &fakeCapacity{
+		now:  start,
+		size: 100 * gib,
+		// filling up at first, snapshots are destroyed later on
+		allocated: func(elapsed time.Duration) uint64 {
+			if elapsed < 6*time.Hour {
+				return uint64(50*gib + elapsed.Hours()*gib)
+			}
+			return uint64(56*gib - (elapsed-6*time.Hour).Hours()*2*gib)
+		},
+		start: start,
+	}
+	c := newTestCapacityCollector(f, time.Hour)
+
+	_, _, ok := collectFor(t, c, f, 5*time.Hour, time.Minute)
+	require.True(t, ok)
+
+	// once the samples of the window are shrinking, there is no projection
+	rate, _, ok := collectFor(t, c, f, 2*time.Hour, time.Minute)
+	require.False(t, ok)
+	require.InDelta(t, -2*gib/3600.0, rate, 1)
+}
+
+func TestCapacityCollectorGaps(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	f := &fakeCapacity{
+		now:       start,
+		size:      100 * gib,
+		allocated: func(elapsed time.Duration) uint64 { return uint64(10*gib + elapsed.Hours()*gib) },
+		start:     start,
+	}
+	c := newTestCapacityCollector(f, 6*time.Hour)
+	_, _, ok := collectFor(t, c, f, time.Hour, time.Minute)
+	require.True(t, ok)
+
+	// failed refreshes don't add samples, the trend is the same after them
+	f.err = errors.New("zpool list failed")
+	f.now = f.now.Add(3 * time.Hour)
+	require.Error(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+	f.err = nil
+	rate, untilFull, ok := collectFor(t, c, f, time.Minute, time.Minute)
+	require.True(t, ok)
+	require.InDelta(t, gib/3600.0, rate, 1)
+	// 86 GiB are left after 4 hours
+	require.InDelta(t, 86*3600.0, untilFull, 120)
+
+	// after a gap longer than the window the history starts over
+	f.now = f.now.Add(7 * time.Hour)
+	rate, _, ok = collectFor(t, c, f, 0, time.Minute)
+	require.False(t, ok)
+	require.Equal(t, 0.0, rate)
+}
+
+func TestCapacityCollectorPoolGone(t *testing.T) {
+	c := newCapacityCollector(zerolog.Nop(), func() ([]byte, error) {
+		return []byte("no pools available\n"), nil
+	}, "zfs", time.Hour)
+	c.history["tank"] = newCapacityHistory()
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+	require.Empty(t, c.history)
+
+	c.getList = func() ([]byte, error) { return nil, command.ErrUnavailable }
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+}
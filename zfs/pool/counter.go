@@ -0,0 +1,86 @@
+package pool
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue is the value of a counter read from zpool status.
+type counterValue struct {
+	value       float64
+	labelValues []string
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+	created     time.Time
+}
+
+// counterVec exports counters read from zpool status. Their created
+// timestamp is the time a series was first seen, it is reset once the value
+// decreases, e.g. after zpool clear. This way a restart of the exporter or a
+// cleared counter is exposed as the reset it is.
+type counterVec struct {
+	desc *prometheus.Desc
+
+	mtx    sync.Mutex
+	keys   []string
+	series map[string]*counterSeries
+}
+
+func newCounterVec(desc *prometheus.Desc) *counterVec {
+	return &counterVec{
+		desc:   desc,
+		series: make(map[string]*counterSeries),
+	}
+}
+
+// update replaces the counters with values read at now. Values with the same
+// labels are summed up, the series, which are not part of values, are
+// dropped.
+func (v *counterVec) update(now time.Time, values []counterValue) {
+	var (
+		keys   []string
+		series = make(map[string]*counterSeries, len(values))
+	)
+	for _, value := range values {
+		key := strings.Join(value.labelValues, "\xff")
+		s, ok := series[key]
+		if !ok {
+			s = &counterSeries{labelValues: value.labelValues}
+			series[key] = s
+			keys = append(keys, key)
+		}
+		s.value += value.value
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	for key, s := range series {
+		s.created = now
+		if last, ok := v.series[key]; ok && s.value >= last.value {
+			s.created = last.created
+		}
+	}
+	v.keys = keys
+	v.series = series
+}
+
+func (v *counterVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *counterVec) Collect(ch chan<- prometheus.Metric) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	for _, key := range v.keys {
+		s := v.series[key]
+		ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(v.desc, prometheus.CounterValue, s.value, s.created, s.labelValues...)
+	}
+}
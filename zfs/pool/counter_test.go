@@ -0,0 +1,86 @@
+package pool
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// createdTimestamps returns the created timestamps of the counters name
+// collected from c by their label values.
+func createdTimestamps(t *testing.T, c prometheus.Collector, name string) map[string]time.Time {
+	t.Helper()
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	result := make(map[string]time.Time)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetValue())
+			}
+			require.NotNil(t, m.GetCounter().GetCreatedTimestamp())
+			result[strings.Join(labels, ",")] = m.GetCounter().GetCreatedTimestamp().AsTime()
+		}
+	}
+	return result
+}
+
+func TestCounterVec(t *testing.T) {
+	var (
+		v  = newCounterVec(prometheus.NewDesc("zfs_pool_errors_total", "Total count of ZFS pool errors", []string{"pool", "type"}, nil))
+		t0 = time.Unix(1700000000, 0).UTC()
+		t1 = t0.Add(time.Minute)
+		t2 = t1.Add(time.Minute)
+	)
+
+	v.update(t0, []counterValue{
+		{value: 1, labelValues: []string{"tank", "read"}},
+		{value: 0, labelValues: []string{"rpool", "read"}},
+	})
+	require.Equal(t, map[string]time.Time{
+		"rpool,read": t0,
+		"tank,read":  t0,
+	}, createdTimestamps(t, v, "zfs_pool_errors_total"))
+
+	// series keep their created timestamp while they increase, a decrease
+	// is a reset and new series start at the time they are first seen
+	v.update(t1, []counterValue{
+		{value: 2, labelValues: []string{"tank", "read"}},
+		{value: 0, labelValues: []string{"rpool", "read"}},
+		{value: 0, labelValues: []string{"backup", "read"}},
+	})
+	v.update(t2, []counterValue{
+		{value: 0, labelValues: []string{"tank", "read"}},
+		{value: 0, labelValues: []string{"backup", "read"}},
+		{value: 0, labelValues: []string{"rpool", "read"}},
+	})
+	require.Equal(t, map[string]time.Time{
+		"backup,read": t1,
+		"rpool,read":  t0,
+		"tank,read":   t2,
+	}, createdTimestamps(t, v, "zfs_pool_errors_total"))
+
+	// series dropped in between start over, values of the same series are
+	// summed up
+	v.update(t2, nil)
+	v.update(t2.Add(time.Minute), []counterValue{
+		{value: 1, labelValues: []string{"tank", "read"}},
+		{value: 2, labelValues: []string{"tank", "read"}},
+	})
+	require.Equal(t, map[string]time.Time{
+		"tank,read": t2.Add(time.Minute),
+	}, createdTimestamps(t, v, "zfs_pool_errors_total"))
+	require.Equal(t, 3.0, testutil.ToFloat64(v))
+}
@@ -0,0 +1,300 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// DefaultDiskInterval is the default interval of the reports of zpool iostat
+// the I/O of the disks is summed up from.
+const DefaultDiskInterval = 10 * time.Second
+
+// DiskIO is the I/O of a leaf vdev during a report of zpool iostat -v, in
+// operations and bytes per second.
+type DiskIO struct {
+	// Pool is the pool and the vdev the disk belongs to, like the pool
+	// label of the disks of zpool status, e.g. tank/mirror-0
+	Pool       string
+	Disk       string
+	ReadOps    uint64
+	WriteOps   uint64
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// parseIostatDisks parses the reports of zpool iostat -v -p -P and calls disk
+// for every leaf vdev and report with the count of skipped rows once a report
+// is complete. The rows of pools, vdevs and leaf vdevs are placed in the
+// hierarchy like the config of zpool status, so the pool and disk labels are
+// the same. Rows, which can't be parsed, are skipped. Only errors reading r are
+// returned.
+func parseIostatDisks(r io.Reader, disk func(DiskIO), report func(skipped int)) error {
+	var (
+		trace poolTrace
+		// rows and skipped are the counts of the current report
+		rows, skipped int
+		// the first row after a separator is a pool
+		poolRow bool
+	)
+	endReport := func() {
+		if rows > 0 {
+			report(skipped)
+		}
+		rows, skipped = 0, 0
+		trace = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := zpoolConfigLine(scanner.Text())
+		fields := line.Fields()
+		switch {
+		case len(fields) == 0:
+			endReport()
+			continue
+		case fields[0] == "capacity" || fields[0] == "pool":
+			// the headers are repeated for every report
+			endReport()
+			continue
+		case strings.HasPrefix(fields[0], "---"):
+			poolRow = true
+			continue
+		case scanner.Text() == "no pools available":
+			continue
+		}
+
+		rows++
+		if poolRow {
+			trace = poolTrace{fields[0]}
+			poolRow = false
+		}
+		level := line.Level()
+		if len(trace) == 0 || level+1 > len(trace) {
+			skipped++
+			continue
+		}
+		trace = append(trace[0:level+1], fields[0])
+
+		d := trace.Disk()
+		if d == "" {
+			continue
+		}
+		if len(fields) != 7 {
+			skipped++
+			continue
+		}
+		// older releases show no capacity of leaf vdevs, only the
+		// operations and the bandwidth are used
+		values, ok := parseUints(fields[3:])
+		if !ok {
+			skipped++
+			continue
+		}
+		disk(DiskIO{
+			Pool:       trace.Pool(),
+			Disk:       d,
+			ReadOps:    values[0],
+			WriteOps:   values[1],
+			ReadBytes:  values[2],
+			WriteBytes: values[3],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	endReport()
+	return nil
+}
+
+func parseUints(fields []string) ([]uint64, bool) {
+	result := make([]uint64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		result[i] = v
+	}
+	return result, true
+}
+
+type diskKey struct {
+	pool string
+	disk string
+}
+
+type diskCounters struct {
+	// created is the time the disk was first reported, the counters start
+	// at 0 then
+	created time.Time
+
+	readOps    float64
+	writeOps   float64
+	readBytes  float64
+	writeBytes float64
+}
+
+// DiskCollector exports the I/O of the leaf vdevs of all pools. As zpool
+// iostat only reports rates, it follows zpool iostat -v and sums up the I/O of
+// every report into counters, once Run is called.
+type DiskCollector struct {
+	logger   zerolog.Logger
+	runner   command.CommandRunner
+	interval time.Duration
+
+	mtx      sync.Mutex
+	counters map[diskKey]*diskCounters
+	// seen are the disks of the current report
+	seen map[diskKey]bool
+
+	descReadOps    *prometheus.Desc
+	descWriteOps   *prometheus.Desc
+	descReadBytes  *prometheus.Desc
+	descWriteBytes *prometheus.Desc
+
+	metricSkippedLines prometheus.Counter
+}
+
+// NewDiskCollector creates a collector for the I/O of the disks of all pools,
+// which follows zpool iostat using runner with a report every interval. All
+// metric names are prefixed with namespace.
+func NewDiskCollector(logger zerolog.Logger, runner command.CommandRunner, namespace string, interval time.Duration) *DiskCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", name),
+			help,
+			[]string{"pool", "disk"}, nil,
+		)
+	}
+	return &DiskCollector{
+		logger:         logger.With().Str("collector", "pool_disks").Logger(),
+		runner:         runner,
+		interval:       interval,
+		counters:       make(map[diskKey]*diskCounters),
+		seen:           make(map[diskKey]bool),
+		descReadOps:    desc("disk_read_ops_total", "Total count of read operations of a disk of a ZFS pool since the exporter started, summed up from zpool iostat."),
+		descWriteOps:   desc("disk_write_ops_total", "Total count of write operations of a disk of a ZFS pool since the exporter started, summed up from zpool iostat."),
+		descReadBytes:  desc("disk_read_bytes_total", "Total bytes read from a disk of a ZFS pool since the exporter started, summed up from zpool iostat."),
+		descWriteBytes: desc("disk_write_bytes_total", "Total bytes written to a disk of a ZFS pool since the exporter started, summed up from zpool iostat."),
+		metricSkippedLines: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "zfs_exporter_skipped_lines_total",
+			Help:        "Total count of lines skipped, as they couldn't be parsed.",
+			ConstLabels: prometheus.Labels{"parser": "zpool_iostat"},
+		}),
+	}
+}
+
+// Run follows zpool iostat until ctx is cancelled. While ZFS is not available,
+// starting it is retried. It returns an error, once zpool iostat exits.
+func (c *DiskCollector) Run(ctx context.Context) error {
+	// -y skips the first report, which has the average since the pool
+	// was imported
+	args := []string{"iostat", "-v", "-p", "-P", "-y", strconv.FormatFloat(c.interval.Seconds(), 'f', -1, 64)}
+	for {
+		p, err := c.runner.Start(ctx, "zpool", args...)
+		if errors.Is(err, command.ErrUnavailable) {
+			c.logger.Debug().Err(err).Msgf("ZFS is not available, retrying in %s", c.interval)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(c.interval):
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to start zpool iostat: %w", err)
+		}
+
+		if err := c.consume(p.Stdout); err != nil {
+			_ = p.Kill()
+			_ = p.Wait()
+			return fmt.Errorf("failed to read zpool iostat: %w", err)
+		}
+		err = p.Wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("zpool iostat failed: %w", err)
+		}
+		return errors.New("zpool iostat exited")
+	}
+}
+
+// consume sums up the reports of zpool iostat in r.
+func (c *DiskCollector) consume(r io.Reader) error {
+	return parseIostatDisks(r, c.add, c.endReport)
+}
+
+func (c *DiskCollector) add(d DiskIO) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := diskKey{pool: d.Pool, disk: d.Disk}
+	counters, ok := c.counters[key]
+	if !ok {
+		counters = &diskCounters{created: time.Now()}
+		c.counters[key] = counters
+	}
+	c.seen[key] = true
+
+	seconds := c.interval.Seconds()
+	counters.readOps += float64(d.ReadOps) * seconds
+	counters.writeOps += float64(d.WriteOps) * seconds
+	counters.readBytes += float64(d.ReadBytes) * seconds
+	counters.writeBytes += float64(d.WriteBytes) * seconds
+}
+
+// endReport drops the disks, which were removed from the pools.
+func (c *DiskCollector) endReport(skipped int) {
+	if skipped > 0 {
+		c.logger.Warn().Int("lines", skipped).Msg("skipped unparsable lines of zpool iostat")
+		c.metricSkippedLines.Add(float64(skipped))
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for key := range c.counters {
+		if !c.seen[key] {
+			delete(c.counters, key)
+		}
+	}
+	c.seen = make(map[diskKey]bool)
+}
+
+func (c *DiskCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descReadOps
+	ch <- c.descWriteOps
+	ch <- c.descReadBytes
+	ch <- c.descWriteBytes
+	c.metricSkippedLines.Describe(ch)
+}
+
+func (c *DiskCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for key, counters := range c.counters {
+		counter := func(desc *prometheus.Desc, value float64) prometheus.Metric {
+			return prometheus.MustNewConstMetricWithCreatedTimestamp(desc, prometheus.CounterValue, value, counters.created, key.pool, key.disk)
+		}
+		ch <- counter(c.descReadOps, counters.readOps)
+		ch <- counter(c.descWriteOps, counters.writeOps)
+		ch <- counter(c.descReadBytes, counters.readBytes)
+		ch <- counter(c.descWriteBytes, counters.writeBytes)
+	}
+	c.metricSkippedLines.Collect(ch)
+}
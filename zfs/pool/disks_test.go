@@ -0,0 +1,152 @@
+package pool
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParseIostatDisks(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "iostat", "disks.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	var (
+		disks   []DiskIO
+		reports []int
+	)
+	require.NoError(t, parseIostatDisks(f, func(d DiskIO) {
+		disks = append(disks, d)
+	}, func(skipped int) {
+		reports = append(reports, skipped)
+	}))
+
+	// 7 leaf vdevs of a mirror, a raidz, a log and a cache device
+	require.Equal(t, []int{0, 0}, reports)
+	require.Len(t, disks, 14)
+	require.Equal(t, DiskIO{Pool: "rpool/mirror-0", Disk: "/dev/disk/by-id/ata-SSD1-part3", ReadOps: 12, WriteOps: 20, ReadBytes: 491520, WriteBytes: 819200}, disks[0])
+	require.Equal(t, DiskIO{Pool: "tank/raidz1-0", Disk: "/dev/disk/by-id/ata-HDD3", ReadOps: 10, WriteOps: 20, ReadBytes: 1310720, WriteBytes: 2621440}, disks[4])
+	require.Equal(t, DiskIO{Pool: "tank/logs", Disk: "/dev/disk/by-id/nvme-LOG1", WriteOps: 30, WriteBytes: 3932160}, disks[5])
+	require.Equal(t, DiskIO{Pool: "tank/cache", Disk: "/dev/disk/by-id/nvme-CACHE1", ReadOps: 10, WriteOps: 2, ReadBytes: 1310720, WriteBytes: 262144}, disks[13])
+}
+
+func TestParseIostatDisksSkipped(t *testing.T) {
+	var (
+		disks   []DiskIO
+		reports []int
+	)
+	require.NoError(t, parseIostatDisks(strings.NewReader(`pool   alloc   free   read  write   read  write
+-----  -----  -----  -----  -----  -----  -----
+tank       1      2      3      4      5      6
+      /dev/sda  -  -  1  1  1  1
+  mirror-0 1 2 3 4 5 6
+    /dev/sdb  -  -  x  1  1  1
+    /dev/sdc  -  -  1  1  1
+    /dev/sdd  -  -  1  1  1  1
+-----  -----  -----  -----  -----  -----  -----
+no pools available
+`), func(d DiskIO) {
+		disks = append(disks, d)
+	}, func(skipped int) {
+		reports = append(reports, skipped)
+	}))
+	require.Equal(t, []int{3}, reports)
+	require.Equal(t, []DiskIO{{Pool: "tank/mirror-0", Disk: "/dev/sdd", ReadOps: 1, WriteOps: 1, ReadBytes: 1, WriteBytes: 1}}, disks)
+}
+
+func FuzzParseIostatDisks(f *testing.F) {
+	data, err := os.ReadFile(filepath.Join("testdata", "iostat", "disks.txt"))
+	require.NoError(f, err)
+	f.Add(string(data))
+	f.Add("pool\n---\ntank 1 2 3 4 5 6\n  /dev/sda - - 1 2 3 4\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		require.NoError(t, parseIostatDisks(strings.NewReader(input), func(d DiskIO) {
+			require.NotEmpty(t, d.Pool)
+			require.True(t, strings.HasPrefix(d.Disk, "/"))
+		}, func(int) {}))
+	})
+}
+
+func TestDiskCollector(t *testing.T) {
+	c := NewDiskCollector(zerolog.Nop(), nil, "zfs", 10*time.Second)
+	require.Equal(t, 0, testutil.CollectAndCount(c, "zfs_pool_disk_read_ops_total"))
+
+	f, err := os.Open(filepath.Join("testdata", "iostat", "disks.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, c.consume(f))
+
+	// the rates of both reports are summed up over their interval
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_disk_read_ops_total Total count of read operations of a disk of a ZFS pool since the exporter started, summed up from zpool iostat.
+# TYPE zfs_pool_disk_read_ops_total counter
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/ata-HDD1",pool="tank/raidz1-0"} 300
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/ata-HDD2",pool="tank/raidz1-0"} 300
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/ata-HDD3",pool="tank/raidz1-0"} 300
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/ata-SSD1-part3",pool="rpool/mirror-0"} 360
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/ata-SSD2-part3",pool="rpool/mirror-0"} 240
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/nvme-CACHE1",pool="tank/cache"} 150
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/nvme-LOG1",pool="tank/logs"} 0
+# HELP zfs_pool_disk_write_bytes_total Total bytes written to a disk of a ZFS pool since the exporter started, summed up from zpool iostat.
+# TYPE zfs_pool_disk_write_bytes_total counter
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/ata-HDD1",pool="tank/raidz1-0"} 7.86432e+07
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/ata-HDD2",pool="tank/raidz1-0"} 7.86432e+07
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/ata-HDD3",pool="tank/raidz1-0"} 7.86432e+07
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/ata-SSD1-part3",pool="rpool/mirror-0"} 2.4576e+07
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/ata-SSD2-part3",pool="rpool/mirror-0"} 2.4576e+07
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/nvme-CACHE1",pool="tank/cache"} 3.93216e+06
+zfs_pool_disk_write_bytes_total{disk="/dev/disk/by-id/nvme-LOG1",pool="tank/logs"} 1.179648e+08
+`), "zfs_pool_disk_read_ops_total", "zfs_pool_disk_write_bytes_total"))
+	// the counters of a disk are created once it is first reported
+	created := createdTimestamps(t, c, "zfs_pool_disk_read_ops_total")
+	require.Len(t, created, 7)
+	ssd := created["/dev/disk/by-id/ata-SSD1-part3,rpool/mirror-0"]
+	require.WithinDuration(t, time.Now(), ssd, time.Minute)
+
+	// disks missing in a report are dropped
+	require.NoError(t, c.consume(strings.NewReader(`pool   alloc   free   read  write   read  write
+-----  -----  -----  -----  -----  -----  -----
+rpool  1  2  3  4  5  6
+  mirror-0  1  2  3  4  5  6
+    /dev/disk/by-id/ata-SSD1-part3  -  -  1  0  0  0
+-----  -----  -----  -----  -----  -----  -----
+`)))
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_disk_read_ops_total Total count of read operations of a disk of a ZFS pool since the exporter started, summed up from zpool iostat.
+# TYPE zfs_pool_disk_read_ops_total counter
+zfs_pool_disk_read_ops_total{disk="/dev/disk/by-id/ata-SSD1-part3",pool="rpool/mirror-0"} 370
+`), "zfs_pool_disk_read_ops_total"))
+	require.Equal(t, map[string]time.Time{
+		"/dev/disk/by-id/ata-SSD1-part3,rpool/mirror-0": ssd,
+	}, createdTimestamps(t, c, "zfs_pool_disk_read_ops_total"))
+}
+
+func TestDiskCollectorRun(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "iostat", "disks.txt"))
+	require.NoError(t, err)
+
+	fake := command.NewFakeExecutor()
+	c := NewDiskCollector(zerolog.Nop(), fake.Runner(), "zfs", 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// zpool iostat is retried until ZFS is available
+	errCh := make(chan error, 1)
+	go func() { errCh <- c.Run(ctx) }()
+	require.Eventually(t, func() bool { return len(fake.Calls()) >= 2 }, 5*time.Second, time.Millisecond)
+	fake.On("zpool iostat", command.FakeCommand{Stdout: string(data)})
+
+	err = <-errCh
+	require.EqualError(t, err, "zpool iostat exited")
+	require.Equal(t, []string{"zpool", "iostat", "-v", "-p", "-P", "-y", "0.01"}, fake.Calls()[0])
+	require.Equal(t, 7, testutil.CollectAndCount(c, "zfs_pool_disk_read_ops_total"))
+}
@@ -0,0 +1,85 @@
+package pool
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// iostatHistogram is a histogram table of zpool iostat -r or -w for a pool.
+// Every column group, e.g. sync_read, spans one or more columns, the rows are
+// the buckets.
+type iostatHistogram struct {
+	Pool    string
+	Groups  []string
+	Columns []string
+	Rows    []iostatHistogramRow
+}
+
+// iostatHistogramRow is a bucket of a histogram table with the counts of every
+// column.
+type iostatHistogramRow struct {
+	Bucket uint64
+	Counts []uint64
+}
+
+// parseIostatHistograms parses the histogram tables of zpool iostat -r or -w
+// with -p, one table per pool. A table starts with the pool and the column
+// groups, followed by the headers of the columns, and its rows are enclosed in
+// separators. The buckets are the sizes or times the rows are labeled with,
+// zpool prints them as exact numbers with -p.
+func parseIostatHistograms(r io.Reader) ([]iostatHistogram, error) {
+	var (
+		result  []iostatHistogram
+		current *iostatHistogram
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+			continue
+		case scanner.Text() == "no pools available":
+			return nil, nil
+		case strings.HasPrefix(fields[0], "---"):
+			// the separator after the rows ends the table
+			if current != nil && len(current.Rows) > 0 {
+				result = append(result, *current)
+				current = nil
+			}
+			continue
+		case current == nil:
+			current = &iostatHistogram{Pool: fields[0], Groups: fields[1:]}
+			continue
+		case current.Columns == nil:
+			current.Columns = fields[1:]
+			continue
+		}
+
+		if len(fields)-1 != len(current.Columns) {
+			return nil, fmt.Errorf("invalid line: %q", scanner.Text())
+		}
+		bucket, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket of pool %s: %w", current.Pool, err)
+		}
+		counts, ok := parseUints(fields[1:])
+		if !ok {
+			return nil, fmt.Errorf("invalid counts of bucket %d of pool %s: %q", bucket, current.Pool, scanner.Text())
+		}
+		current.Rows = append(current.Rows, iostatHistogramRow{Bucket: bucket, Counts: counts})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		if current.Columns == nil {
+			return nil, errors.New("missing column headers")
+		}
+		result = append(result, *current)
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package pool
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIostatHistograms(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "iostat", "request-sizes.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+	tables, err := parseIostatHistograms(f)
+	require.NoError(t, err)
+	require.Len(t, tables, 2)
+	require.Equal(t, "tank", tables[1].Pool)
+	require.Equal(t, []string{"sync_read", "sync_write", "async_read", "async_write", "scrub", "trim", "rebuild"}, tables[1].Groups)
+	require.Len(t, tables[1].Columns, 14)
+	// the rows from 512 bytes to 16 MiB
+	require.Len(t, tables[1].Rows, 16)
+	require.Equal(t, iostatHistogramRow{Bucket: 4096, Counts: []uint64{120, 0, 9800, 0, 0, 0, 200, 0, 0, 0, 0, 0, 0, 0}}, tables[1].Rows[3])
+
+	tables, err = parseIostatHistograms(strings.NewReader("no pools available\n"))
+	require.NoError(t, err)
+	require.Empty(t, tables)
+
+	// a table without the closing separator is complete as well
+	tables, err = parseIostatHistograms(strings.NewReader("tank  scrub\nreq_size  ind  agg\n---  ---  ---\n512  1  2\n"))
+	require.NoError(t, err)
+	require.Equal(t, []iostatHistogram{{
+		Pool:    "tank",
+		Groups:  []string{"scrub"},
+		Columns: []string{"ind", "agg"},
+		Rows:    []iostatHistogramRow{{Bucket: 512, Counts: []uint64{1, 2}}},
+	}}, tables)
+
+	for _, invalid := range []string{
+		"tank  scrub\n",
+		"tank  scrub\nreq_size  ind  agg\n---\n512  1\n",
+		"tank  scrub\nreq_size  ind  agg\n---\n1K  1  2\n",
+		"tank  scrub\nreq_size  ind  agg\n---\n512  1  x\n",
+	} {
+		_, err := parseIostatHistograms(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func FuzzParseIostatHistograms(f *testing.F) {
+	data, err := os.ReadFile(filepath.Join("testdata", "iostat", "request-sizes.txt"))
+	require.NoError(f, err)
+	f.Add(string(data))
+	f.Add("tank  scrub\nreq_size  ind  agg\n---\n512  1  2\n")
+	f.Fuzz(func(t *testing.T, input string) {
+		tables, err := parseIostatHistograms(strings.NewReader(input))
+		if err != nil {
+			return
+		}
+		for _, table := range tables {
+			for _, row := range table.Rows {
+				require.Len(t, row.Counts, len(table.Columns))
+			}
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func zpoolIostatQueuesCmd(runner command.CommandRunner) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		// without -H, as the columns are looked up by the headers
+		return command.Output(context.Background(), runner, "zpool", "iostat", "-q", "-p")
+	}
+}
+
+// Queue is the number of I/Os in a queue of a pool.
+type Queue struct {
+	Pool    string
+	Queue   string
+	Pending uint64
+	Active  uint64
+}
+
+// ParseIostatQueues parses the output of zpool iostat -q -p. The queues are
+// looked up by the headers, as they differ between releases. The queue names
+// are the ones of zpool without the q, e.g. sync_read for syncq_read.
+func ParseIostatQueues(r io.Reader) ([]Queue, error) {
+	var (
+		result  []Queue
+		groups  []string
+		columns []string
+		scanner = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(fields[0], "---"):
+			continue
+		case scanner.Text() == "no pools available":
+			return nil, nil
+		case groups == nil:
+			groups = fields
+			continue
+		case columns == nil:
+			columns = fields
+			// the first column is the pool, every group spans two columns
+			if columns[0] != "pool" || len(columns)-1 != 2*len(groups) {
+				return nil, fmt.Errorf("unexpected headers %q and %q", strings.Join(groups, " "), strings.Join(columns, " "))
+			}
+			continue
+		}
+
+		if len(fields) != len(columns) {
+			return nil, fmt.Errorf("invalid line: %q", scanner.Text())
+		}
+		for i, group := range groups {
+			name, op, ok := strings.Cut(group, "q_")
+			if !ok {
+				continue
+			}
+			pend, activ := 1+2*i, 2+2*i
+			if columns[pend] != "pend" || columns[activ] != "activ" {
+				return nil, fmt.Errorf("unexpected columns %s and %s of queue %s", columns[pend], columns[activ], group)
+			}
+			pending, err := strconv.ParseUint(fields[pend], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pending I/Os of queue %s: %w", group, err)
+			}
+			active, err := strconv.ParseUint(fields[activ], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid active I/Os of queue %s: %w", group, err)
+			}
+			result = append(result, Queue{
+				Pool:    fields[0],
+				Queue:   name + "_" + op,
+				Pending: pending,
+				Active:  active,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if columns == nil && groups != nil {
+		return nil, errors.New("missing column headers")
+	}
+	return result, nil
+}
+
+type queueCollector struct {
+	logger     zerolog.Logger
+	getIostat  func() ([]byte, error)
+	descPend   *prometheus.Desc
+	descActive *prometheus.Desc
+}
+
+// NewQueueCollector creates a collector for the queued I/Os of all pools,
+// which runs zpool iostat -q using runner on every collection. All metric
+// names are prefixed with namespace.
+func NewQueueCollector(logger zerolog.Logger, runner command.CommandRunner, namespace string) prometheus.Collector {
+	return newQueueCollector(logger, zpoolIostatQueuesCmd(runner), namespace)
+}
+
+func newQueueCollector(logger zerolog.Logger, getIostat func() ([]byte, error), namespace string) *queueCollector {
+	return &queueCollector{
+		logger:    logger.With().Str("collector", "pool_queue").Logger(),
+		getIostat: getIostat,
+		descPend: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "queue_pending"),
+			"Number of I/Os waiting in a queue of a ZFS pool.",
+			[]string{"pool", "queue"}, nil,
+		),
+		descActive: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "queue_active"),
+			"Number of I/Os of a queue of a ZFS pool issued to the disks.",
+			[]string{"pool", "queue"}, nil,
+		),
+	}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descPend
+	ch <- c.descActive
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	data, err := c.getIostat()
+	if errors.Is(err, command.ErrUnavailable) {
+		// there are no pools without ZFS, this is reported by zfs_up
+		c.logger.Debug().Err(err).Msg("ZFS is not available")
+		return
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to get zpool iostat")
+		ch <- prometheus.NewInvalidMetric(c.descPend, fmt.Errorf("failed to get zpool iostat: %w", err))
+		return
+	}
+
+	queues, err := ParseIostatQueues(bytes.NewReader(data))
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to parse zpool iostat")
+		ch <- prometheus.NewInvalidMetric(c.descPend, fmt.Errorf("failed to parse zpool iostat: %w", err))
+		return
+	}
+	for _, q := range queues {
+		ch <- prometheus.MustNewConstMetric(c.descPend, prometheus.GaugeValue, float64(q.Pending), q.Pool, q.Queue)
+		ch <- prometheus.MustNewConstMetric(c.descActive, prometheus.GaugeValue, float64(q.Active), q.Pool, q.Queue)
+	}
+}
@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func newTestQueueCollector(t *testing.T, fixture string) *queueCollector {
+	return newQueueCollector(zerolog.Nop(), func() ([]byte, error) {
+		return os.ReadFile(filepath.Join("testdata", "iostat", fixture))
+	}, "zfs")
+}
+
+func TestParseIostatQueues(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "iostat", "queues-2.1.txt"))
+	require.NoError(t, err)
+	queues, err := ParseIostatQueues(strings.NewReader(string(data)))
+	require.NoError(t, err)
+	// 6 queues of 2 pools
+	require.Len(t, queues, 12)
+	require.Equal(t, Queue{Pool: "tank", Queue: "async_write", Pending: 42, Active: 8}, queues[9])
+
+	queues, err = ParseIostatQueues(strings.NewReader("no pools available\n"))
+	require.NoError(t, err)
+	require.Empty(t, queues)
+
+	for _, invalid := range []string{
+		"              capacity     operations\n",
+		"              capacity     operations\npool        alloc   free   read\n",
+		"    syncq_read\npool  read  write\ntank 1 2\n",
+		"    syncq_read\npool  pend  activ\ntank 1\n",
+		"    syncq_read\npool  pend  activ\ntank 1 x\n",
+	} {
+		_, err := ParseIostatQueues(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestQueueCollector(t *testing.T) {
+	// the rebuild queue is missing in the output of older releases
+	c := newTestQueueCollector(t, "queues-2.2.txt")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_queue_active Number of I/Os of a queue of a ZFS pool issued to the disks.
+# TYPE zfs_pool_queue_active gauge
+zfs_pool_queue_active{pool="tank",queue="async_read"} 0
+zfs_pool_queue_active{pool="tank",queue="async_write"} 4
+zfs_pool_queue_active{pool="tank",queue="rebuild_write"} 1
+zfs_pool_queue_active{pool="tank",queue="scrub_read"} 2
+zfs_pool_queue_active{pool="tank",queue="sync_read"} 1
+zfs_pool_queue_active{pool="tank",queue="sync_write"} 0
+zfs_pool_queue_active{pool="tank",queue="trim_write"} 0
+# HELP zfs_pool_queue_pending Number of I/Os waiting in a queue of a ZFS pool.
+# TYPE zfs_pool_queue_pending gauge
+zfs_pool_queue_pending{pool="tank",queue="async_read"} 0
+zfs_pool_queue_pending{pool="tank",queue="async_write"} 17
+zfs_pool_queue_pending{pool="tank",queue="rebuild_write"} 5
+zfs_pool_queue_pending{pool="tank",queue="scrub_read"} 10
+zfs_pool_queue_pending{pool="tank",queue="sync_read"} 3
+zfs_pool_queue_pending{pool="tank",queue="sync_write"} 0
+zfs_pool_queue_pending{pool="tank",queue="trim_write"} 0
+`)))
+
+	c = newTestQueueCollector(t, "queues-2.1.txt")
+	require.Equal(t, 24, testutil.CollectAndCount(c))
+
+	c = newQueueCollector(zerolog.Nop(), func() ([]byte, error) { return nil, command.ErrUnavailable }, "zfs")
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	c = newQueueCollector(zerolog.Nop(), func() ([]byte, error) { return nil, errors.New("exit status 1") }, "zfs")
+	require.Error(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+}
@@ -3,15 +3,21 @@ package pool
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/version"
 )
 
 var (
@@ -25,8 +31,14 @@ var (
 	}
 )
 
-func zpoolStatusCmd() ([]byte, error) {
-	return exec.Command("zpool", "status", "-pP").Output()
+func zpoolStatusCmd(runner command.CommandRunner, versions version.Source) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		args := []string{"status", "-pP"}
+		if versions().Supports(version.ZpoolStatusSlowIOs) {
+			args = append(args, "-s")
+		}
+		return command.Output(context.Background(), runner, "zpool", args...)
+	}
 }
 
 func setStatus(m *prometheus.GaugeVec, labelValues ...string) {
@@ -48,48 +60,148 @@ func setStatus(m *prometheus.GaugeVec, labelValues ...string) {
 type poolCollector struct {
 	logger zerolog.Logger
 
-	metricStatus     *prometheus.GaugeVec
-	metricErrors     *prometheus.CounterVec
-	metricDiskStatus *prometheus.GaugeVec
-	metricDiskErrors *prometheus.CounterVec
+	metricStatus      *prometheus.GaugeVec
+	metricErrors      *counterVec
+	metricDiskStatus  *prometheus.GaugeVec
+	metricDiskErrors  *counterVec
+	metricDiskSlowIOs *counterVec
+
+	metricTrackedPools prometheus.Gauge
+	metricTrackedDisks prometheus.Gauge
+	metricSkippedLines prometheus.Counter
+
+	// descError is used to report failures of the collector
+	descError *prometheus.Desc
 
 	getStatus func() ([]byte, error)
+
+	// group shares a run of zpool status between Collect and Refresh
+	group singleflight.Group
+
+	// state keeps the last parsed status for debugging, parsed is the time
+	// the last run of zpool status completed
+	mtx    sync.Mutex
+	state  State
+	parsed time.Time
+	now    func() time.Time
 }
 
-func NewCollector(logger zerolog.Logger) *poolCollector {
+// Errors are the error counters of a pool or disk.
+type Errors struct {
+	Read     uint64 `json:"read"`
+	Write    uint64 `json:"write"`
+	Checksum uint64 `json:"checksum"`
+}
+
+// PoolState is the parsed status of a pool.
+type PoolState struct {
+	Name   string `json:"name"`
+	Health string `json:"health"`
+	Errors Errors `json:"errors"`
+
+	// LastScrub is the time the last scrub finished, it is only known for
+	// the pools themselves and not their vdevs.
+	LastScrub *time.Time `json:"last_scrub,omitempty"`
+
+	// DataErrors is the number of data errors of the errors line of a pool,
+	// unlike Errors they are permanent. UpgradeAvailable is set, if zpool
+	// status recommends zpool upgrade. Both are unknown for vdevs.
+	DataErrors       uint64 `json:"data_errors,omitempty"`
+	UpgradeAvailable bool   `json:"upgrade_available,omitempty"`
+}
+
+// DiskState is the parsed status of a disk in a pool.
+type DiskState struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool"`
+	Health string `json:"health"`
+	Errors Errors `json:"errors"`
+
+	// SlowIOs is only known, if zpool status supports -s.
+	SlowIOs *uint64 `json:"slow_ios,omitempty"`
+}
+
+// Status describes the lifecycle of the pool collector.
+type Status struct {
+	// InitialParseDone is set once zpool status has been parsed successfully.
+	InitialParseDone bool
+}
+
+// State is the last zpool status parsed by the collector.
+type State struct {
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	Pools []PoolState `json:"pools"`
+	Disks []DiskState `json:"disks"`
+}
+
+// NewCollector creates a collector for the status of all pools, which runs
+// zpool using runner. The arguments of zpool status depend on the
+// capabilities of versions. All metric names are prefixed with namespace.
+func NewCollector(logger zerolog.Logger, runner command.CommandRunner, versions version.Source, namespace string) *poolCollector {
+	return NewStatusCollector(logger, zpoolStatusCmd(runner, versions), namespace)
+}
+
+// NewStatusCollector creates a collector for the status of all pools, which
+// parses the output of zpool status -pP returned by getStatus on every
+// collection. All metric names are prefixed with namespace.
+func NewStatusCollector(logger zerolog.Logger, getStatus func() ([]byte, error), namespace string) *poolCollector {
 	return &poolCollector{
 		logger: logger.With().Str("collector", "pool").Logger(),
 
-		getStatus: zpoolStatusCmd,
+		getStatus: getStatus,
+		now:       time.Now,
+
+		descError: prometheus.NewDesc(prometheus.BuildFQName(namespace, "pool", "status"), "Status of ZFS pool", nil, nil),
 
 		metricStatus: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "zfs_pool_status",
-				Help: "Status of ZFS pool",
+				Namespace: namespace,
+				Subsystem: "pool",
+				Name:      "status",
+				Help:      "Status of ZFS pool",
 			},
 			[]string{"pool", "state"},
 		),
-		metricErrors: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "zfs_pool_errors_total",
-				Help: "Total count of ZFS pool errors",
-			},
-			[]string{"pool", "type"},
-		),
+		metricErrors: newCounterVec(prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "errors_total"),
+			"Total count of ZFS pool errors",
+			[]string{"pool", "type"}, nil,
+		)),
 		metricDiskStatus: prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
-				Name: "zfs_pool_disk_status",
-				Help: "Status of a single disk in a ZFS pool",
+				Namespace: namespace,
+				Subsystem: "pool",
+				Name:      "disk_status",
+				Help:      "Status of a single disk in a ZFS pool",
 			},
 			[]string{"disk", "pool", "state"},
 		),
-		metricDiskErrors: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "zfs_pool_disk_errors_total",
-				Help: "Total count of ZFS disk errors",
-			},
-			[]string{"disk", "pool", "type"},
-		),
+		metricDiskErrors: newCounterVec(prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "disk_errors_total"),
+			"Total count of ZFS disk errors",
+			[]string{"disk", "pool", "type"}, nil,
+		)),
+		metricDiskSlowIOs: newCounterVec(prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "disk_slow_ios_total"),
+			"Total count of I/Os of a single disk in a ZFS pool, which did not complete in time",
+			[]string{"disk", "pool"}, nil,
+		)),
+		metricTrackedPools: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zfs_exporter_tracked_pools",
+			Help: "Number of pools and vdevs in the last parsed zpool status.",
+		}),
+		metricTrackedDisks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zfs_exporter_tracked_disks",
+			Help: "Number of disks in the last parsed zpool status.",
+		}),
+		metricSkippedLines: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "zfs_exporter_skipped_lines_total",
+			Help:        "Total count of lines skipped, as they couldn't be parsed.",
+			ConstLabels: prometheus.Labels{"parser": "zpool_status"},
+		}),
 	}
 }
 
@@ -99,13 +211,23 @@ type zpoolErrors struct {
 	Write uint64
 }
 
-func (e *zpoolErrors) setErrors(m *prometheus.CounterVec, labelValues ...string) {
+// appendErrors appends the error counters with labelValues and their type to
+// values.
+func (e *zpoolErrors) appendErrors(values []counterValue, labelValues ...string) []counterValue {
 	if e == nil {
-		return
+		return values
+	}
+	counter := func(value uint64, typ string) counterValue {
+		return counterValue{
+			value:       float64(value),
+			labelValues: append(append([]string{}, labelValues...), typ),
+		}
 	}
-	m.WithLabelValues(append(labelValues, "read")...).Add(float64(e.Read))
-	m.WithLabelValues(append(labelValues, "write")...).Add(float64(e.Write))
-	m.WithLabelValues(append(labelValues, "checksum")...).Add(float64(e.Cksum))
+	return append(values,
+		counter(e.Read, "read"),
+		counter(e.Write, "write"),
+		counter(e.Cksum, "checksum"),
+	)
 }
 
 type poolStatus struct {
@@ -116,12 +238,25 @@ type poolStatus struct {
 
 type diskStatus struct {
 	poolStatus
-	Pool string
+	Pool    string
+	SlowIOs *uint64
 }
 
 type zpoolStatus struct {
 	pools []*poolStatus
 	disks []*diskStatus
+
+	// scrubs are the times the last scrub of the pools finished
+	scrubs map[string]time.Time
+
+	// dataErrors are the data errors of the pools, upgrades the pools
+	// zpool upgrade is recommended for
+	dataErrors map[string]uint64
+	upgrades   map[string]bool
+
+	// skipped counts the lines, which looked like vdevs, but couldn't be
+	// parsed
+	skipped int
 }
 
 func parseErrors(fields []string) (*zpoolErrors, error) {
@@ -155,6 +290,52 @@ func parseErrors(fields []string) (*zpoolErrors, error) {
 	}, nil
 }
 
+// parseScrubFinished returns the time the scrub of the scan line finished,
+// e.g. "scan: scrub repaired 0B in 00:04:12 with 0 errors on Sun Oct  1
+// 03:04:12 2023". Scrubs in progress, canceled ones and resilvers have none.
+func parseScrubFinished(line string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "scan: scrub repaired ")
+	if !ok {
+		return time.Time{}, false
+	}
+	idx := strings.LastIndex(rest, " on ")
+	if idx < 0 {
+		return time.Time{}, false
+	}
+	// zpool status prints the time in the local time zone
+	ts, err := time.ParseInLocation(time.ANSIC, rest[idx+len(" on "):], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// parseDataErrors returns the number of data errors of the errors line, e.g.
+// "errors: No known data errors" or "errors: 3 data errors, use '-v' for a
+// list". With -v, the damaged files are listed instead of their number, they
+// count as a single error.
+func parseDataErrors(line string) (uint64, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), "errors: ")
+	if !ok {
+		return 0, false
+	}
+	if rest == "No known data errors" {
+		return 0, true
+	}
+	if strings.HasPrefix(rest, "Permanent errors have been detected") {
+		return 1, true
+	}
+	count, _, ok := strings.Cut(rest, " data error")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(count, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
 type zpoolConfigLine string
 
 func (z zpoolConfigLine) Fields() []string {
@@ -198,12 +379,27 @@ func (p poolTrace) Disk() string {
 	return ""
 }
 
+// parseStatus parses the output of zpool status. Lines of the config, which
+// can't be parsed, e.g. as they are truncated or their error counters aren't
+// numbers, are skipped and counted, so a single broken line doesn't hide the
+// state of all pools. Only errors reading r are returned.
 func parseStatus(r io.Reader) (*zpoolStatus, error) {
 
 	var (
-		result         = new(zpoolStatus)
-		diskLineOffset int
-		trace          poolTrace
+		result = &zpoolStatus{
+			scrubs:     make(map[string]time.Time),
+			dataErrors: make(map[string]uint64),
+			upgrades:   make(map[string]bool),
+		}
+		trace poolTrace
+
+		// slowColumn is the index of the SLOW column added by zpool status
+		// -s, if it is present
+		slowColumn = -1
+
+		// lines before the config of the first pool, e.g. "no pools
+		// available", are not disks
+		diskLineOffset = -1
 	)
 
 	scanner := bufio.NewScanner(r)
@@ -215,19 +411,54 @@ func parseStatus(r io.Reader) (*zpoolStatus, error) {
 		}
 		if fields[0] == "pool:" {
 			diskLineOffset = -1
+			trace = nil
+			if len(fields) < 2 {
+				result.skipped++
+				continue
+			}
 			trace = []string{fields[1]}
 		}
+		if fields[0] == "scan:" && len(trace) > 0 {
+			if ts, ok := parseScrubFinished(string(line)); ok {
+				result.scrubs[trace[0]] = ts
+			}
+		}
+		if fields[0] == "action:" && len(trace) > 0 && strings.Contains(string(line), "'zpool upgrade'") {
+			result.upgrades[trace[0]] = true
+		}
+		if fields[0] == "errors:" && len(trace) > 0 {
+			if n, ok := parseDataErrors(string(line)); ok {
+				result.dataErrors[trace[0]] = n
+			}
+		}
 		if fields[0][len(fields[0])-1] != ':' {
 			if fields[0] == "NAME" {
 				if offset := strings.Index(string(line), "NAME"); offset > 0 {
 					diskLineOffset = offset
 				}
+				slowColumn = -1
+				for i, f := range fields {
+					if f == "SLOW" {
+						slowColumn = i
+					}
+				}
 			} else if diskLineOffset >= 0 {
-				// remove whitespaces before the disk name
+				// remove whitespaces before the disk name, a shorter line
+				// or a level beyond the trace can't be placed in the
+				// hierarchy
+				if len(line) < diskLineOffset || len(trace) == 0 {
+					result.skipped++
+					continue
+				}
 				line = line[diskLineOffset:]
+				level := line.Level()
+				if level+1 > len(trace) {
+					result.skipped++
+					continue
+				}
 
 				// add the disk name to the trace (at the right level), to respect the hierarchy.
-				trace = trace[0 : line.Level()+1]
+				trace = trace[0 : level+1]
 				trace = append(trace, fields[0])
 
 				// line doesn't contain error counts
@@ -237,19 +468,30 @@ func parseStatus(r io.Reader) (*zpoolStatus, error) {
 
 				e, err := parseErrors(fields)
 				if err != nil {
-					return nil, err
+					result.skipped++
+					continue
 				}
 
 				if disk := trace.Disk(); disk != "" {
 					// we are a disk
-					result.disks = append(result.disks, &diskStatus{
+					d := &diskStatus{
 						Pool: trace.Pool(),
 						poolStatus: poolStatus{
 							Name:   disk,
 							Health: fields[1],
 							Errors: e,
 						},
-					})
+					}
+					// only leaf vdevs have slow I/Os, others show "-"
+					if slowColumn > 0 && len(fields) > slowColumn && fields[slowColumn] != "-" {
+						slow, err := strconv.ParseUint(fields[slowColumn], 10, 64)
+						if err != nil {
+							result.skipped++
+						} else {
+							d.SlowIOs = &slow
+						}
+					}
+					result.disks = append(result.disks, d)
 				} else {
 					// we are a pool
 					result.pools = append(result.pools, &poolStatus{
@@ -261,39 +503,165 @@ func parseStatus(r io.Reader) (*zpoolStatus, error) {
 			}
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
 
 	return result, nil
 }
 
-func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
-	data, err := pc.getStatus()
+// state converts the error counters for State.
+func (e *zpoolErrors) state() Errors {
+	if e == nil {
+		return Errors{}
+	}
+	return Errors{Read: e.Read, Write: e.Write, Checksum: e.Cksum}
+}
+
+// setState records the outcome of a collection.
+func (pc *poolCollector) setState(attempt time.Time, zpools *zpoolStatus, err error) {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+
+	pc.state.LastAttempt = attempt
 	if err != nil {
-		panic(err)
+		pc.state.LastError = err.Error()
+		return
+	}
+	pc.state.LastSuccess = attempt
+	pc.state.LastError = ""
+	pc.state.Pools = make([]PoolState, 0, len(zpools.pools))
+	for _, p := range zpools.pools {
+		state := PoolState{Name: p.Name, Health: p.Health, Errors: p.Errors.state()}
+		if ts, ok := zpools.scrubs[p.Name]; ok {
+			state.LastScrub = &ts
+		}
+		state.DataErrors = zpools.dataErrors[p.Name]
+		state.UpgradeAvailable = zpools.upgrades[p.Name]
+		pc.state.Pools = append(pc.state.Pools, state)
+	}
+	pc.state.Disks = make([]DiskState, 0, len(zpools.disks))
+	for _, d := range zpools.disks {
+		pc.state.Disks = append(pc.state.Disks, DiskState{Name: d.Name, Pool: d.Pool, Health: d.Health, Errors: d.Errors.state(), SlowIOs: d.SlowIOs})
 	}
+}
+
+// State returns the last parsed zpool status. Pools and disks are kept from
+// the last successful collection.
+func (pc *poolCollector) State() State {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	return pc.state
+}
+
+// Status returns the current lifecycle status of the collector.
+func (pc *poolCollector) Status() Status {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	return Status{InitialParseDone: !pc.state.LastSuccess.IsZero()}
+}
+
+// parseResult is the outcome of a run of zpool status.
+type parseResult struct {
+	attempt time.Time
+	zpools  *zpoolStatus
+	err     error
+}
+
+// parse runs and parses zpool status and records the outcome in the state.
+// Concurrent calls share a single run.
+func (pc *poolCollector) parse() parseResult {
+	v, _, _ := pc.group.Do("", func() (interface{}, error) {
+		result := parseResult{attempt: pc.now()}
+		data, err := pc.getStatus()
+		if err != nil {
+			result.err = fmt.Errorf("failed to get zpool status: %w", err)
+		} else if result.zpools, err = parseStatus(bytes.NewReader(data)); err != nil {
+			result.err = fmt.Errorf("failed to parse zpool status: %w", err)
+		}
+		pc.setState(result.attempt, result.zpools, result.err)
+		if result.zpools != nil && result.zpools.skipped > 0 {
+			pc.logger.Warn().Int("lines", result.zpools.skipped).Msg("skipped unparsable lines of zpool status")
+			pc.metricSkippedLines.Add(float64(result.zpools.skipped))
+		}
+
+		pc.mtx.Lock()
+		pc.parsed = pc.now()
+		pc.mtx.Unlock()
+		return result, nil
+	})
+	return v.(parseResult)
+}
 
-	zpools, err := parseStatus(bytes.NewReader(data))
+// Refresh returns the state of a zpool status, whose run completed at most
+// maxAge ago. Otherwise zpool status is run again, sharing a run in flight of
+// a concurrent collection.
+func (pc *poolCollector) Refresh(maxAge time.Duration) State {
+	pc.mtx.Lock()
+	fresh := !pc.parsed.IsZero() && pc.now().Sub(pc.parsed) <= maxAge
+	pc.mtx.Unlock()
+	if !fresh {
+		pc.parse()
+	}
+	return pc.State()
+}
+
+func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	result := pc.parse()
+	attempt, zpools, err := result.attempt, result.zpools, result.err
+	if errors.Is(err, command.ErrStuck) && pc.Status().InitialParseDone {
+		// serve the last known status, while zpool status is stuck
+		pc.logger.Warn().Err(err).Msg("zpool status is stuck, serving the last known status")
+		pc.collectMetrics(ch)
+		return
+	}
+	if errors.Is(err, command.ErrUnavailable) {
+		// there are no pools without ZFS, this is reported by zfs_up
+		pc.logger.Debug().Err(err).Msg("ZFS is not available")
+		return
+	}
 	if err != nil {
-		panic(err)
+		pc.logger.Error().Err(err).Msg("failed to collect zpool status")
+		ch <- prometheus.NewInvalidMetric(pc.descError, err)
+		return
 	}
 
 	pc.metricStatus.Reset()
-	pc.metricErrors.Reset()
 	pc.metricDiskStatus.Reset()
-	pc.metricDiskErrors.Reset()
 
+	var poolErrors, diskErrors, diskSlowIOs []counterValue
 	for _, zpool := range zpools.pools {
 		setStatus(pc.metricStatus, zpool.Name, zpool.Health)
-		zpool.Errors.setErrors(pc.metricErrors, zpool.Name)
+		poolErrors = zpool.Errors.appendErrors(poolErrors, zpool.Name)
 	}
 	for _, disk := range zpools.disks {
 		setStatus(pc.metricDiskStatus, disk.Name, disk.Pool, disk.Health)
-		disk.Errors.setErrors(pc.metricDiskErrors, disk.Name, disk.Pool)
+		diskErrors = disk.Errors.appendErrors(diskErrors, disk.Name, disk.Pool)
+		if disk.SlowIOs != nil {
+			diskSlowIOs = append(diskSlowIOs, counterValue{value: float64(*disk.SlowIOs), labelValues: []string{disk.Name, disk.Pool}})
+		}
 	}
+	pc.metricErrors.update(attempt, poolErrors)
+	pc.metricDiskErrors.update(attempt, diskErrors)
+	pc.metricDiskSlowIOs.update(attempt, diskSlowIOs)
+
+	pc.collectMetrics(ch)
+}
 
+func (pc *poolCollector) collectMetrics(ch chan<- prometheus.Metric) {
 	pc.metricStatus.Collect(ch)
 	pc.metricErrors.Collect(ch)
 	pc.metricDiskStatus.Collect(ch)
 	pc.metricDiskErrors.Collect(ch)
+	pc.metricDiskSlowIOs.Collect(ch)
+
+	pc.mtx.Lock()
+	pc.metricTrackedPools.Set(float64(len(pc.state.Pools)))
+	pc.metricTrackedDisks.Set(float64(len(pc.state.Disks)))
+	pc.mtx.Unlock()
+	pc.metricTrackedPools.Collect(ch)
+	pc.metricTrackedDisks.Collect(ch)
+	pc.metricSkippedLines.Collect(ch)
 }
 
 func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -301,4 +669,8 @@ func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
 	pc.metricErrors.Describe(ch)
 	pc.metricDiskStatus.Describe(ch)
 	pc.metricDiskErrors.Describe(ch)
+	pc.metricDiskSlowIOs.Describe(ch)
+	pc.metricTrackedPools.Describe(ch)
+	pc.metricTrackedDisks.Describe(ch)
+	pc.metricSkippedLines.Describe(ch)
 }
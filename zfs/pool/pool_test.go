@@ -1,23 +1,28 @@
 package pool
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/fixture"
+	"github.com/simonswine/zfs-event-exporter/zfs/version"
 )
 
 func TestPoolMetrics(t *testing.T) {
-	reg := prometheus.NewPedanticRegistry()
-	c := NewCollector(zerolog.Nop())
-	reg.MustRegister(c)
-
-	for _, tc := range []struct {
+	testCases := []struct {
 		name string
 
 		expectedMetrics string
@@ -51,6 +56,12 @@ zfs_pool_status{pool="pool",state="offline"} 0
 zfs_pool_status{pool="pool",state="online"} 1
 zfs_pool_status{pool="pool",state="removed"} 0
 zfs_pool_status{pool="pool",state="unavail"} 0
+# HELP zfs_exporter_tracked_disks Number of disks in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_disks gauge
+zfs_exporter_tracked_disks 1
+# HELP zfs_exporter_tracked_pools Number of pools and vdevs in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_pools gauge
+zfs_exporter_tracked_pools 1
 			`,
 		},
 		{
@@ -82,6 +93,12 @@ zfs_pool_status{pool="pool",state="offline"} 0
 zfs_pool_status{pool="pool",state="online"} 0
 zfs_pool_status{pool="pool",state="removed"} 0
 zfs_pool_status{pool="pool",state="unavail"} 0
+# HELP zfs_exporter_tracked_disks Number of disks in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_disks gauge
+zfs_exporter_tracked_disks 1
+# HELP zfs_exporter_tracked_pools Number of pools and vdevs in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_pools gauge
+zfs_exporter_tracked_pools 1
 			`,
 		},
 		{
@@ -149,6 +166,12 @@ zfs_pool_disk_errors_total{disk="/dev/disk/by-id/dm-name-yyyyyyyyyyyyyyyyyyyyyyy
 zfs_pool_disk_errors_total{disk="/dev/disk/by-id/dm-name-zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz",pool="pool-ssd",type="read"} 0.0
 zfs_pool_disk_errors_total{disk="/dev/disk/by-id/dm-name-zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz",pool="pool-ssd",type="write"} 0.0
 zfs_pool_disk_errors_total{disk="/dev/disk/by-id/dm-name-zzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzzz",pool="pool-ssd",type="checksum"} 0.0
+# HELP zfs_exporter_tracked_disks Number of disks in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_disks gauge
+zfs_exporter_tracked_disks 3
+# HELP zfs_exporter_tracked_pools Number of pools and vdevs in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_pools gauge
+zfs_exporter_tracked_pools 3
 `,
 		},
 		{
@@ -216,18 +239,337 @@ zfs_pool_disk_errors_total{disk="/dev/disk/by-id/id3-part4",pool="rpool/raidz1-0
 zfs_pool_disk_errors_total{disk="/dev/sda3",pool="rpool/cache",type="read"} 0.0
 zfs_pool_disk_errors_total{disk="/dev/sda3",pool="rpool/cache",type="write"} 0.0
 zfs_pool_disk_errors_total{disk="/dev/sda3",pool="rpool/cache",type="checksum"} 0.0
+# HELP zfs_exporter_tracked_disks Number of disks in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_disks gauge
+zfs_exporter_tracked_disks 4
+# HELP zfs_exporter_tracked_pools Number of pools and vdevs in the last parsed zpool status.
+# TYPE zfs_exporter_tracked_pools gauge
+zfs_exporter_tracked_pools 2
 			`,
 		},
+	}
+
+	for _, prefix := range []string{"zfs", "storage_zfs"} {
+		t.Run(prefix, func(t *testing.T) {
+			reg := prometheus.NewPedanticRegistry()
+			c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), prefix)
+			reg.MustRegister(c)
+
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					data, err := os.ReadFile(filepath.Join("testdata", tc.name+".txt"))
+					require.NoError(t, err)
+					c.getStatus = func() ([]byte, error) {
+						return data, nil
+					}
+
+					// all fixtures are parsed without skipping any line
+					expectedMetrics := strings.ReplaceAll(tc.expectedMetrics, "zfs_pool_", prefix+"_pool_") + `
+# HELP zfs_exporter_skipped_lines_total Total count of lines skipped, as they couldn't be parsed.
+# TYPE zfs_exporter_skipped_lines_total counter
+zfs_exporter_skipped_lines_total{parser="zpool_status"} 0
+`
+					require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics)))
+					require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics)))
+				})
+			}
+		})
+	}
+}
+
+func TestPoolMetricsError(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), "zfs")
+	c.getStatus = func() ([]byte, error) {
+		return nil, errors.New("exit status 1")
+	}
+	reg.MustRegister(c)
+
+	_, err := reg.Gather()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to get zpool status: exit status 1")
+}
+
+func TestPoolUnavailable(t *testing.T) {
+	c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), "zfs")
+	c.getStatus = func() ([]byte, error) {
+		return nil, fmt.Errorf("zpool status failed: exit status 1: The ZFS modules are not loaded.: %w", command.ErrUnavailable)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	// without ZFS there are no pools, but the collection doesn't fail
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Empty(t, families)
+	require.Equal(t, Status{}, c.Status())
+
+	// without any imported pools, zpool status succeeds
+	c.getStatus = func() ([]byte, error) { return []byte("no pools available\n"), nil }
+	_, err = reg.Gather()
+	require.NoError(t, err)
+	require.Equal(t, Status{InitialParseDone: true}, c.Status())
+	require.Empty(t, c.State().Pools)
+	require.Equal(t, 0.0, testutil.ToFloat64(c.metricTrackedPools))
+}
+
+func TestPoolState(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "simple-errors.txt"))
+	require.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), "zfs")
+	c.now = func() time.Time { return now }
+	c.getStatus = func() ([]byte, error) { return data, nil }
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	require.Equal(t, Status{}, c.Status())
+
+	_, err = reg.Gather()
+	require.NoError(t, err)
+	require.Equal(t, Status{InitialParseDone: true}, c.Status())
+	state := c.State()
+	require.Equal(t, now, state.LastSuccess)
+	require.Empty(t, state.LastError)
+	scrub := time.Date(2023, 1, 15, 12, 43, 1, 0, time.Local)
+	require.Equal(t, []PoolState{{Name: "pool", Health: "FAULTED", Errors: Errors{Read: 2, Write: 4, Checksum: 6}, LastScrub: &scrub}}, state.Pools)
+	require.Len(t, state.Disks, 1)
+	require.Equal(t, "/dev/sda", state.Disks[0].Name)
+	require.Equal(t, uint64(3), state.Disks[0].Errors.Checksum)
+
+	// a failure keeps the last parsed pools
+	now = now.Add(time.Minute)
+	c.getStatus = func() ([]byte, error) { return nil, errors.New("exit status 1") }
+	_, err = reg.Gather()
+	require.Error(t, err)
+	state = c.State()
+	require.Equal(t, now, state.LastAttempt)
+	require.Equal(t, now.Add(-time.Minute), state.LastSuccess)
+	require.Equal(t, "failed to get zpool status: exit status 1", state.LastError)
+	require.Len(t, state.Pools, 1)
+}
+
+func TestPoolStuck(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "simple-errors.txt"))
+	require.NoError(t, err)
+
+	stuck := fmt.Errorf("zpool status stuck: %w", command.ErrStuck)
+	c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), "zfs")
+	c.getStatus = func() ([]byte, error) { return nil, stuck }
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	// without a previous status there is nothing to serve
+	_, err = reg.Gather()
+	require.Error(t, err)
+
+	c.getStatus = func() ([]byte, error) { return data, nil }
+	expected, err := reg.Gather()
+	require.NoError(t, err)
+
+	// a stuck zpool status serves the last known status
+	c.getStatus = func() ([]byte, error) { return nil, stuck }
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Equal(t, expected, families)
+	require.Equal(t, "failed to get zpool status: zpool status stuck: process did not exit after being killed", c.State().LastError)
+}
+
+func TestParseStatusFreeBSD(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "freebsd.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	status, err := parseStatus(f)
+	require.NoError(t, err)
+	var pools []string
+	for _, p := range status.pools {
+		pools = append(pools, p.Name)
+	}
+	require.Equal(t, []string{"zroot", "zroot/mirror-0"}, pools)
+
+	var disks []string
+	for _, d := range status.disks {
+		require.Equal(t, "zroot/mirror-0", d.Pool)
+		disks = append(disks, d.Name)
+	}
+	require.Equal(t, []string{"/dev/ada0p4", "/dev/gpt/zfs1", "/dev/diskid/DISK-S3Z8NB0K1234p4"}, disks)
+	require.Equal(t, uint64(1), status.disks[1].Errors.Cksum)
+	// the vdevs have no scrubs of their own
+	require.Equal(t, map[string]time.Time{"zroot": time.Date(2023, 10, 1, 3, 4, 12, 0, time.Local)}, status.scrubs)
+}
+
+func TestParseScrubFinished(t *testing.T) {
+	for line, expected := range map[string]time.Time{
+		"  scan: scrub repaired 0B in 1 days 09:22:35 with 0 errors on Mon Mar 15 09:46:36 2021": time.Date(2021, 3, 15, 9, 46, 36, 0, time.Local),
+		"  scan: scrub repaired 0 in 0h5m with 0 errors on Sun Oct  1 03:04:12 2023":             time.Date(2023, 10, 1, 3, 4, 12, 0, time.Local),
+		"  scan: scrub in progress since Sun Oct  1 03:00:00 2023":                               {},
+		"  scan: scrub canceled on Sun Oct  1 03:04:12 2023":                                     {},
+		"  scan: resilvered 1.21G in 00:01:02 with 0 errors on Sun Oct  1 03:04:12 2023":         {},
+		"  scan: none requested": {},
+		"  scan: scrub repaired 0B in 00:04:12 with 0 errors on yesterday": {},
+	} {
+		ts, ok := parseScrubFinished(line)
+		require.Equal(t, !expected.IsZero(), ok, line)
+		require.Equal(t, expected, ts, line)
+	}
+}
+
+func TestParseDataErrors(t *testing.T) {
+	for line, expected := range map[string]uint64{
+		"errors: No known data errors":                                        0,
+		"errors: 3 data errors, use '-v' for a list":                          3,
+		"errors: 1 data error, use '-v' for a list":                           1,
+		"errors: Permanent errors have been detected in the following files:": 1,
 	} {
-		t.Run(tc.name, func(t *testing.T) {
-			data, err := os.ReadFile(filepath.Join("testdata", tc.name+".txt"))
+		n, ok := parseDataErrors(line)
+		require.True(t, ok, line)
+		require.Equal(t, expected, n, line)
+	}
+
+	_, ok := parseDataErrors("errors: many data errors")
+	require.False(t, ok)
+}
+
+func TestPoolRefresh(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "data-errors.txt"))
+	require.NoError(t, err)
+
+	var runs int
+	now := time.Unix(1700000000, 0)
+	c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), "zfs")
+	c.now = func() time.Time { return now }
+	c.getStatus = func() ([]byte, error) {
+		runs++
+		return data, nil
+	}
+
+	// the data errors and available upgrades are only known for pools
+	state := c.Refresh(time.Second)
+	require.Equal(t, 1, runs)
+	require.Len(t, state.Pools, 2)
+	require.Equal(t, "tank", state.Pools[0].Name)
+	require.Equal(t, uint64(0), state.Pools[0].DataErrors)
+	require.True(t, state.Pools[0].UpgradeAvailable)
+	require.Equal(t, "backup", state.Pools[1].Name)
+	require.Equal(t, uint64(2), state.Pools[1].DataErrors)
+	require.False(t, state.Pools[1].UpgradeAvailable)
+	require.Equal(t, uint64(4), state.Disks[1].Errors.Checksum)
+
+	// a recent run is reused, a collection always runs zpool status
+	c.Refresh(time.Second)
+	require.Equal(t, 1, runs)
+	testutil.CollectAndCount(c)
+	require.Equal(t, 2, runs)
+	now = now.Add(2 * time.Second)
+	c.Refresh(time.Second)
+	require.Equal(t, 3, runs)
+}
+
+func TestParseStatusSkipped(t *testing.T) {
+	status, err := parseStatus(strings.NewReader(`  pool: tank
+ state: ONLINE
+config:
+
+	NAME          STATE     READ WRITE CKSUM  SLOW
+	tank          ONLINE       0     0     0     -
+	  mirror-0    ONLINE       0     0     0     -
+	    /dev/sda  ONLINE       x     0     0     0
+	    /dev/sdb  ONLINE       0     0     0     y
+	        /dev/sdc ONLINE    0     0     0     0
+  pool:
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	backup      ONLINE       0     0     0
+`))
+	require.NoError(t, err)
+
+	// the broken counters, the line too deep in the hierarchy, the pool
+	// without a name and its config are skipped, the disk with the broken
+	// slow I/Os is kept without them
+	require.Equal(t, 5, status.skipped)
+	require.Len(t, status.pools, 2)
+	require.Len(t, status.disks, 1)
+	require.Equal(t, "/dev/sdb", status.disks[0].Name)
+	require.Equal(t, "tank/mirror-0", status.disks[0].Pool)
+	require.Nil(t, status.disks[0].SlowIOs)
+}
+
+func TestPoolSlowIOs(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "slow-ios.txt"))
+	require.NoError(t, err)
+
+	fake := command.NewFakeExecutor()
+	fake.On("zpool status", command.FakeCommand{Stdout: string(data)})
+	args := func() string {
+		calls := fake.Calls()
+		require.NotEmpty(t, calls)
+		return strings.Join(calls[len(calls)-1][1:], " ")
+	}
+
+	// releases before 0.8 don't support -s
+	c := NewCollector(zerolog.Nop(), fake.Runner(), version.Fixed(version.Versions{Userland: "0.7.13-1"}), "zfs")
+	require.Equal(t, 12, testutil.CollectAndCount(c, "zfs_pool_disk_status"))
+	require.Equal(t, "status -pP", args())
+
+	c = NewCollector(zerolog.Nop(), fake.Runner(), version.Fixed(version.Versions{Userland: "2.1.5-1ubuntu6~22.04.1"}), "zfs")
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP zfs_pool_disk_slow_ios_total Total count of I/Os of a single disk in a ZFS pool, which did not complete in time
+# TYPE zfs_pool_disk_slow_ios_total counter
+zfs_pool_disk_slow_ios_total{disk="/dev/sda",pool="tank/mirror-0"} 3
+zfs_pool_disk_slow_ios_total{disk="/dev/sdb",pool="tank/mirror-0"} 0
+`), "zfs_pool_disk_slow_ios_total"))
+	require.Equal(t, "status -pP -s", args())
+
+	state := c.State()
+	require.Len(t, state.Disks, 2)
+	require.Equal(t, uint64(3), *state.Disks[0].SlowIOs)
+}
+
+// TestRecordedFixtures parses the zpool status of every fixture recorded
+// with record-fixtures.
+func TestRecordedFixtures(t *testing.T) {
+	fixtures, err := fixture.LoadAll(filepath.Join("..", "testdata", "recorded"))
+	require.NoError(t, err)
+	require.NotEmpty(t, fixtures)
+
+	for _, f := range fixtures {
+		if !f.Has(fixture.ZpoolStatus) {
+			continue
+		}
+		t.Run(f.Name(), func(t *testing.T) {
+			data, err := f.Read(fixture.ZpoolStatus)
 			require.NoError(t, err)
-			c.getStatus = func() ([]byte, error) {
-				return data, nil
-			}
 
-			require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(tc.expectedMetrics)))
-			require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(tc.expectedMetrics)))
+			status, err := parseStatus(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.NotEmpty(t, status.pools)
+			for _, p := range status.pools {
+				require.NotEmpty(t, p.Health, p.Name)
+			}
 		})
 	}
 }
+
+func FuzzParseStatus(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	require.NoError(f, err)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(f, err)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		status, err := parseStatus(bytes.NewReader(data))
+		if err != nil {
+			// only lines exceeding the buffer of the scanner fail
+			require.ErrorIs(t, err, bufio.ErrTooLong)
+			return
+		}
+		for _, d := range status.disks {
+			require.NotEmpty(t, d.Pool)
+		}
+	})
+}
@@ -0,0 +1,217 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func zpoolIostatRequestSizesCmd(runner command.CommandRunner) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		// without an interval, the histograms cover all I/O since the pools
+		// were imported
+		return command.Output(context.Background(), runner, "zpool", "iostat", "-r", "-p")
+	}
+}
+
+// requestSizeTypes are the columns of every operation of zpool iostat -r, the
+// individual and the aggregated I/Os.
+var requestSizeTypes = []string{"ind", "agg"}
+
+// RequestSizes is the histogram of the sizes of the I/Os of an operation and a
+// type of a pool.
+type RequestSizes struct {
+	Pool string
+	// Op is the column group of zpool, e.g. sync_write or scrub
+	Op string
+	// Type is ind for individual and agg for aggregated I/Os
+	Type string
+	// Sizes are the sizes of the rows in bytes, a row counts the I/Os from
+	// its size up to the size of the next row
+	Sizes  []uint64
+	Counts []uint64
+}
+
+// ParseIostatRequestSizes parses the output of zpool iostat -r -p. The
+// operations are looked up by the headers, as they differ between releases.
+func ParseIostatRequestSizes(r io.Reader) ([]RequestSizes, error) {
+	tables, err := parseIostatHistograms(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []RequestSizes
+	for _, t := range tables {
+		if len(t.Columns) != len(requestSizeTypes)*len(t.Groups) {
+			return nil, fmt.Errorf("unexpected headers %q and %q of pool %s", strings.Join(t.Groups, " "), strings.Join(t.Columns, " "), t.Pool)
+		}
+		sizes := make([]uint64, len(t.Rows))
+		for i, row := range t.Rows {
+			sizes[i] = row.Bucket
+		}
+		for i, op := range t.Groups {
+			for j, typ := range requestSizeTypes {
+				column := len(requestSizeTypes)*i + j
+				if t.Columns[column] != typ {
+					return nil, fmt.Errorf("unexpected column %s of operation %s of pool %s", t.Columns[column], op, t.Pool)
+				}
+				counts := make([]uint64, len(t.Rows))
+				for k, row := range t.Rows {
+					counts[k] = row.Counts[column]
+				}
+				result = append(result, RequestSizes{Pool: t.Pool, Op: op, Type: typ, Sizes: sizes, Counts: counts})
+			}
+		}
+	}
+	return result, nil
+}
+
+// nativeRequestSizes adds the rows of zpool as the buckets of a native
+// histogram to a classic histogram, so both are exposed. The upper bounds of
+// the rows are powers of two, which are exactly the bucket boundaries of
+// schema 0.
+type nativeRequestSizes struct {
+	prometheus.Metric
+	sizes  []uint64
+	counts []uint64
+}
+
+func (m nativeRequestSizes) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	var (
+		h         = out.Histogram
+		schema    = int32(0)
+		threshold = prometheus.DefNativeHistogramZeroThreshold
+		last      int32
+		prev      int64
+	)
+	h.Schema = &schema
+	h.ZeroThreshold = &threshold
+	for i := range m.sizes {
+		// like the classic buckets, a row is counted in the bucket of its
+		// upper bound, which covers (upper/2, upper]
+		frac, exp := math.Frexp(float64(rowUpperBound(m.sizes, i)))
+		index := int32(exp)
+		if frac == 0.5 {
+			index--
+		}
+
+		count := int64(m.counts[i])
+		switch {
+		case len(h.PositiveSpan) > 0 && index == last:
+			// rows between two powers of two share their bucket
+			h.PositiveDelta[len(h.PositiveDelta)-1] += count
+			prev += count
+			continue
+		case len(h.PositiveSpan) > 0 && index == last+1:
+			*h.PositiveSpan[len(h.PositiveSpan)-1].Length++
+		default:
+			offset := index
+			if len(h.PositiveSpan) > 0 {
+				offset = index - last - 1
+			}
+			length := uint32(1)
+			h.PositiveSpan = append(h.PositiveSpan, &dto.BucketSpan{Offset: &offset, Length: &length})
+		}
+		// the counts of the buckets are deltas to the previous bucket
+		h.PositiveDelta = append(h.PositiveDelta, count-prev)
+		prev = count
+		last = index
+	}
+	return nil
+}
+
+// rowUpperBound returns the upper bound of the requests counted in the row i
+// of sizes: the size of the next row, or twice the size of the last row.
+func rowUpperBound(sizes []uint64, i int) uint64 {
+	if i+1 < len(sizes) {
+		return sizes[i+1]
+	}
+	return 2 * sizes[i]
+}
+
+type requestSizeCollector struct {
+	logger    zerolog.Logger
+	getIostat func() ([]byte, error)
+	desc      *prometheus.Desc
+	// native adds native histograms to the classic buckets
+	native bool
+}
+
+// NewRequestSizeCollector creates a collector for the request sizes of all
+// pools, which runs zpool iostat -r using runner on every collection. With
+// native set, the histograms are exported as native histograms in addition
+// to the classic buckets. All metric names are prefixed with namespace.
+func NewRequestSizeCollector(logger zerolog.Logger, runner command.CommandRunner, namespace string, native bool) prometheus.Collector {
+	c := newRequestSizeCollector(logger, zpoolIostatRequestSizesCmd(runner), namespace)
+	c.native = native
+	return c
+}
+
+func newRequestSizeCollector(logger zerolog.Logger, getIostat func() ([]byte, error), namespace string) *requestSizeCollector {
+	return &requestSizeCollector{
+		logger:    logger.With().Str("collector", "pool_request_sizes").Logger(),
+		getIostat: getIostat,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "request_size_bytes"),
+			"Sizes of the I/O requests of a ZFS pool since it was imported, by operation and individual or aggregated requests. The sum is estimated from the buckets.",
+			[]string{"pool", "op", "type"}, nil,
+		),
+	}
+}
+
+func (c *requestSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *requestSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	data, err := c.getIostat()
+	if errors.Is(err, command.ErrUnavailable) {
+		// there are no pools without ZFS, this is reported by zfs_up
+		c.logger.Debug().Err(err).Msg("ZFS is not available")
+		return
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to get zpool iostat")
+		ch <- prometheus.NewInvalidMetric(c.desc, fmt.Errorf("failed to get zpool iostat: %w", err))
+		return
+	}
+
+	histograms, err := ParseIostatRequestSizes(bytes.NewReader(data))
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to parse zpool iostat")
+		ch <- prometheus.NewInvalidMetric(c.desc, fmt.Errorf("failed to parse zpool iostat: %w", err))
+		return
+	}
+	for _, h := range histograms {
+		// zpool counts a request in the row of the largest size not above
+		// it, so the upper bound of a row is the size of the next one
+		var (
+			count   uint64
+			sum     float64
+			buckets = make(map[float64]uint64, len(h.Sizes))
+		)
+		for i, size := range h.Sizes {
+			count += h.Counts[i]
+			sum += float64(h.Counts[i]) * float64(size)
+			buckets[float64(rowUpperBound(h.Sizes, i))] = count
+		}
+		m := prometheus.MustNewConstHistogram(c.desc, count, sum, buckets, h.Pool, h.Op, h.Type)
+		if c.native {
+			m = nativeRequestSizes{Metric: m, sizes: h.Sizes, counts: h.Counts}
+		}
+		ch <- m
+	}
+}
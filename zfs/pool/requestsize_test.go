@@ -0,0 +1,150 @@
+package pool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParseIostatRequestSizes(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "iostat", "request-sizes.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+	histograms, err := ParseIostatRequestSizes(f)
+	require.NoError(t, err)
+	// 7 operations of 2 types of 2 pools
+	require.Len(t, histograms, 28)
+	h := histograms[16]
+	require.Equal(t, "tank", h.Pool)
+	require.Equal(t, "sync_write", h.Op)
+	require.Equal(t, "ind", h.Type)
+	require.Equal(t, []uint64{512, 1024, 2048, 4096, 8192, 16384}, h.Sizes[:6])
+	require.Equal(t, []uint64{7, 0, 0, 9800, 350, 12}, h.Counts[:6])
+
+	for _, invalid := range []string{
+		"tank  sync_read\nreq_size  ind\n---\n512  1\n",
+		"tank  sync_read\nreq_size  agg  ind\n---\n512  1  2\n",
+	} {
+		_, err := ParseIostatRequestSizes(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+// gatherHistogram returns the histogram of zfs_pool_request_size_bytes of
+// pool, op and typ.
+func gatherHistogram(t *testing.T, c prometheus.Collector, pool, op, typ string) *dto.Histogram {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "zfs_pool_request_size_bytes" {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				expected := map[string]string{"pool": pool, "op": op, "type": typ}[l.GetName()]
+				if l.GetValue() != expected {
+					continue metrics
+				}
+			}
+			return m.GetHistogram()
+		}
+	}
+	t.Fatalf("missing histogram of %s %s %s", pool, op, typ)
+	return nil
+}
+
+func TestRequestSizeCollector(t *testing.T) {
+	c := newRequestSizeCollector(zerolog.Nop(), func() ([]byte, error) {
+		return os.ReadFile(filepath.Join("testdata", "iostat", "request-sizes.txt"))
+	}, "zfs")
+	require.Equal(t, 28, testutil.CollectAndCount(c))
+
+	// small synchronous writes
+	h := gatherHistogram(t, c, "tank", "sync_write", "ind")
+	require.Equal(t, uint64(10169), h.GetSampleCount())
+	require.Equal(t, float64(7*512+9800*4096+350*8192+12*16384), h.GetSampleSum())
+	require.Len(t, h.GetBucket(), 16)
+	for i, expected := range []uint64{7, 7, 7, 9807, 10157, 10169, 10169} {
+		// a row counts the requests up to the size of the next row
+		require.Equal(t, float64(uint64(1024)<<i), h.GetBucket()[i].GetUpperBound())
+		require.Equal(t, expected, h.GetBucket()[i].GetCumulativeCount())
+	}
+	require.Equal(t, uint64(10169), h.GetBucket()[15].GetCumulativeCount())
+	require.Equal(t, float64(32<<20), h.GetBucket()[15].GetUpperBound())
+
+	// aggregated asynchronous writes
+	h = gatherHistogram(t, c, "tank", "async_write", "agg")
+	require.Equal(t, uint64(1270), h.GetSampleCount())
+	require.Equal(t, uint64(950), h.GetBucket()[9].GetCumulativeCount())
+
+	h = gatherHistogram(t, c, "rpool", "trim", "ind")
+	require.Equal(t, uint64(0), h.GetSampleCount())
+}
+
+func TestRequestSizeCollectorNative(t *testing.T) {
+	c := newRequestSizeCollector(zerolog.Nop(), func() ([]byte, error) {
+		return os.ReadFile(filepath.Join("testdata", "iostat", "request-sizes.txt"))
+	}, "zfs")
+	c.native = true
+
+	h := gatherHistogram(t, c, "tank", "sync_write", "ind")
+	require.Equal(t, uint64(10169), h.GetSampleCount())
+	require.Equal(t, int32(0), h.GetSchema())
+	require.Equal(t, uint64(0), h.GetZeroCount())
+	// a single span of the rows from 512 bytes to 16 MiB, which are counted
+	// in the buckets up to 1 KiB to 32 MiB
+	require.Len(t, h.GetPositiveSpan(), 1)
+	require.Equal(t, int32(10), h.GetPositiveSpan()[0].GetOffset())
+	require.Equal(t, uint32(16), h.GetPositiveSpan()[0].GetLength())
+	require.Equal(t, []int64{7, -7, 0, 9800, -9450, -338}, h.GetPositiveDelta()[:6])
+	// the classic buckets are kept for the text formats
+	require.Len(t, h.GetBucket(), 16)
+}
+
+func TestNativeRequestSizes(t *testing.T) {
+	desc := prometheus.NewDesc("zfs_pool_request_size_bytes", "Sizes.", nil, nil)
+	m := nativeRequestSizes{
+		Metric: prometheus.MustNewConstHistogram(desc, 14, 0, nil),
+		sizes:  []uint64{512, 768, 1024, 4096},
+		counts: []uint64{2, 3, 5, 4},
+	}
+	var out dto.Metric
+	require.NoError(t, m.Write(&out))
+	h := out.GetHistogram()
+	require.Equal(t, uint64(0), h.GetZeroCount())
+	// the rows up to 768 bytes and 1 KiB share the bucket up to 1 KiB, the
+	// bucket up to 2 KiB is left out
+	require.Len(t, h.GetPositiveSpan(), 2)
+	require.Equal(t, int32(10), h.GetPositiveSpan()[0].GetOffset())
+	require.Equal(t, uint32(1), h.GetPositiveSpan()[0].GetLength())
+	require.Equal(t, int32(1), h.GetPositiveSpan()[1].GetOffset())
+	require.Equal(t, uint32(2), h.GetPositiveSpan()[1].GetLength())
+	require.Equal(t, []int64{5, 0, -1}, h.GetPositiveDelta())
+}
+
+func TestRequestSizeCollectorErrors(t *testing.T) {
+	c := newRequestSizeCollector(zerolog.Nop(), func() ([]byte, error) {
+		return nil, command.ErrUnavailable
+	}, "zfs")
+	require.Equal(t, 0, testutil.CollectAndCount(c))
+
+	c.getIostat = func() ([]byte, error) { return nil, errors.New("zpool iostat failed") }
+	require.Error(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+
+	c.getIostat = func() ([]byte, error) { return []byte("tank  scrub\n"), nil }
+	require.Error(t, testutil.CollectAndCompare(c, strings.NewReader("")))
+}
@@ -0,0 +1,68 @@
+package pool
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+)
+
+// Rules returns the recommended rules for the pool metrics.
+func Rules(cfg rules.Config) []rules.Rule {
+	var (
+		status         = prometheus.BuildFQName(cfg.Namespace, "pool", "status")
+		errors         = prometheus.BuildFQName(cfg.Namespace, "pool", "errors_total")
+		diskStatus     = prometheus.BuildFQName(cfg.Namespace, "pool", "disk_status")
+		diskErrors     = prometheus.BuildFQName(cfg.Namespace, "pool", "disk_errors_total")
+		diskErrorsRate = cfg.Namespace + "_pool:disk_errors:increase1h"
+	)
+	return []rules.Rule{
+		{
+			Record:  diskErrorsRate,
+			Expr:    `increase(` + diskErrors + `[1h])`,
+			Metrics: []string{diskErrors},
+		},
+		{
+			Alert:   "ZFSPoolNotOnline",
+			Expr:    status + `{state!="online"} == 1`,
+			For:     model.Duration(cfg.For),
+			Labels:  map[string]string{"severity": "critical"},
+			Metrics: []string{status},
+			Annotations: map[string]string{
+				"summary":     "ZFS pool {{ $labels.pool }} is {{ $labels.state }}",
+				"description": "The pool {{ $labels.pool }} on {{ $labels.instance }} has been {{ $labels.state }} for more than " + model.Duration(cfg.For).String() + ".",
+			},
+		},
+		{
+			Alert:   "ZFSPoolErrorsIncreasing",
+			Expr:    `increase(` + errors + `[1h]) > 0`,
+			Labels:  map[string]string{"severity": "warning"},
+			Metrics: []string{errors},
+			Annotations: map[string]string{
+				"summary":     "ZFS pool {{ $labels.pool }} has new {{ $labels.type }} errors",
+				"description": "The pool {{ $labels.pool }} on {{ $labels.instance }} had {{ $value }} {{ $labels.type }} errors within the last hour.",
+			},
+		},
+		{
+			Alert:   "ZFSDiskNotOnline",
+			Expr:    diskStatus + `{state!="online"} == 1`,
+			For:     model.Duration(cfg.For),
+			Labels:  map[string]string{"severity": "warning"},
+			Metrics: []string{diskStatus},
+			Annotations: map[string]string{
+				"summary":     "Disk {{ $labels.disk }} of ZFS pool {{ $labels.pool }} is {{ $labels.state }}",
+				"description": "The disk {{ $labels.disk }} of {{ $labels.pool }} on {{ $labels.instance }} has been {{ $labels.state }} for more than " + model.Duration(cfg.For).String() + ".",
+			},
+		},
+		{
+			Alert:   "ZFSDiskErrorsIncreasing",
+			Expr:    diskErrorsRate + ` > 0`,
+			Labels:  map[string]string{"severity": "warning"},
+			Metrics: []string{diskErrorsRate},
+			Annotations: map[string]string{
+				"summary":     "Disk {{ $labels.disk }} of ZFS pool {{ $labels.pool }} has new {{ $labels.type }} errors",
+				"description": "The disk {{ $labels.disk }} of {{ $labels.pool }} on {{ $labels.instance }} had {{ $value }} {{ $labels.type }} errors within the last hour.",
+			},
+		},
+	}
+}
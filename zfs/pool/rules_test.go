@@ -0,0 +1,31 @@
+package pool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+	"github.com/simonswine/zfs-event-exporter/zfs/version"
+)
+
+func TestRules(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "simple-errors.txt"))
+	require.NoError(t, err)
+
+	for _, namespace := range []string{"zfs", "storage_zfs"} {
+		c := NewCollector(zerolog.Nop(), command.NewFakeExecutor().Runner(), version.Fixed(version.Versions{}), namespace)
+		c.getStatus = func() ([]byte, error) { return data, nil }
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+
+		cfg := rules.Config{Namespace: namespace, For: 15 * time.Minute}
+		require.NoError(t, rules.Verify(reg, Rules(cfg)), namespace)
+	}
+}
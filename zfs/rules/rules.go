@@ -0,0 +1,90 @@
+// Package rules defines Prometheus alerting and recording rules for the
+// metrics of the exporter. The collectors define the rules for their own
+// metrics, so they are kept in sync with the metric names.
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// Config parameterizes the generated rules.
+type Config struct {
+	// Namespace is the prefix of the ZFS metric names.
+	Namespace string
+	// For is the time a condition has to hold, before an alert fires.
+	For time.Duration
+	// SnapshotMaxAge is the age of the last snapshot of a dataset, after
+	// which an alert fires.
+	SnapshotMaxAge time.Duration
+}
+
+// Rule is an alerting or recording rule in the Prometheus rule file format.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+
+	// Metrics are the names of the metrics referenced by Expr.
+	Metrics []string `yaml:"-"`
+}
+
+// Group is a named group of rules.
+type Group struct {
+	Name string `yaml:"name"`
+	// Type is the datasource type of vmalert, it is empty for Prometheus.
+	Type  string `yaml:"type,omitempty"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// File is a rule file.
+type File struct {
+	Groups []Group `yaml:"groups"`
+}
+
+// Seconds formats d as number of seconds for use in an expression.
+func Seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// Verify checks that all metrics referenced by the rules are gathered by g or
+// recorded by one of the rules.
+func Verify(g prometheus.Gatherer, rs []Rule) error {
+	families, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, f := range families {
+		known[f.GetName()] = true
+	}
+	for _, r := range rs {
+		if r.Record != "" {
+			known[r.Record] = true
+		}
+	}
+
+	for _, r := range rs {
+		name := r.Alert + r.Record
+		if len(r.Metrics) == 0 {
+			return fmt.Errorf("rule %s references no metrics", name)
+		}
+		for _, m := range r.Metrics {
+			if !known[m] {
+				return fmt.Errorf("rule %s references unknown metric %s", name, m)
+			}
+			if !strings.Contains(r.Expr, m) {
+				return fmt.Errorf("rule %s doesn't use metric %s in its expression", name, m)
+			}
+		}
+	}
+	return nil
+}
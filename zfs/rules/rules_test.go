@@ -0,0 +1,33 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "zfs_pool_status"}))
+
+	valid := []Rule{
+		{Record: "zfs:pool_status:max", Expr: "max(zfs_pool_status)", Metrics: []string{"zfs_pool_status"}},
+		{Alert: "ZFSPoolStatus", Expr: "zfs:pool_status:max > 0", Metrics: []string{"zfs:pool_status:max"}},
+	}
+	require.NoError(t, Verify(reg, valid))
+
+	for _, invalid := range [][]Rule{
+		{{Alert: "Unknown", Expr: "zfs_snapshot_count > 0", Metrics: []string{"zfs_snapshot_count"}}},
+		{{Alert: "Unused", Expr: "vector(1)", Metrics: []string{"zfs_pool_status"}}},
+		{{Alert: "None", Expr: "vector(1)"}},
+	} {
+		require.Error(t, Verify(reg, invalid), invalid[0].Alert)
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	require.Equal(t, "86400", Seconds(24*time.Hour))
+	require.Equal(t, "1.5", Seconds(1500*time.Millisecond))
+}
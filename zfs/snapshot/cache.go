@@ -0,0 +1,229 @@
+package snapshot
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheVersion is the version of the cache file format. Caches of other
+// versions are discarded. Version 2 added the written space.
+const cacheVersion = 2
+
+type cacheHeader struct {
+	Version  int
+	Datasets int
+}
+
+// cachedDataset holds the snapshots of a dataset in columns, which gob
+// encodes a lot more compact than a slice of structs.
+type cachedDataset struct {
+	Name      string
+	Names     []string
+	Creations []int64
+	Used      []uint64
+	Written   []uint64
+}
+
+// clone returns a deep copy of s, which can be encoded without holding the
+// lock of the collector.
+func (s snapshotsState) clone() snapshotsState {
+	result := make(snapshotsState, len(s))
+	for dataset, snapshots := range s {
+		result[dataset] = append([]snapshotState(nil), snapshots...)
+	}
+	return result
+}
+
+// writeCache writes s gzip compressed and gob encoded to w.
+func (s snapshotsState) writeCache(w io.Writer) error {
+	gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(gz)
+	if err := enc.Encode(cacheHeader{Version: cacheVersion, Datasets: len(s)}); err != nil {
+		return err
+	}
+	// datasets are encoded one by one, so the encoder doesn't buffer all of
+	// them
+	for dataset, snapshots := range s {
+		d := cachedDataset{
+			Name:      dataset,
+			Names:     make([]string, len(snapshots)),
+			Creations: make([]int64, len(snapshots)),
+			Used:      make([]uint64, len(snapshots)),
+			Written:   make([]uint64, len(snapshots)),
+		}
+		for i, snap := range snapshots {
+			d.Names[i] = snap.name
+			d.Creations[i] = snap.ts.Unix()
+			d.Used[i] = snap.used
+			d.Written[i] = snap.written
+		}
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// readCache reads the snapshots written by writeCache from r.
+func readCache(r io.Reader) (snapshotsState, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := gob.NewDecoder(gz)
+
+	var header cacheHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, err
+	}
+	if header.Version != cacheVersion {
+		return nil, fmt.Errorf("unsupported cache version %d, expected %d", header.Version, cacheVersion)
+	}
+
+	result := make(snapshotsState)
+	for i := 0; i < header.Datasets; i++ {
+		var d cachedDataset
+		if err := dec.Decode(&d); err != nil {
+			return nil, err
+		}
+		if len(d.Creations) != len(d.Names) || len(d.Used) != len(d.Names) || len(d.Written) != len(d.Names) {
+			return nil, fmt.Errorf("dataset %s has %d names, %d creations, %d used and %d written", d.Name, len(d.Names), len(d.Creations), len(d.Used), len(d.Written))
+		}
+		for j, name := range d.Names {
+			result.add(d.Name, Snapshot{Name: name, Creation: time.Unix(d.Creations[j], 0), Used: d.Used[j], Written: d.Written[j]})
+		}
+	}
+	// a truncated file is only noticed by the checksum at its end
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UseCache makes Run serve the snapshots saved in filename until the initial
+// listing completes. Once it has completed, the snapshots are saved to
+// filename every interval and when Run returns. It has to be called before
+// Run.
+func (c *snapshotCollector) UseCache(filename string, interval time.Duration) {
+	c.cacheFile = filename
+	c.cacheInterval = interval
+}
+
+// startCache loads the cache and saves it in the background until the
+// returned stop is called. listed has to be called once the initial listing
+// has completed. Without a cache file, both do nothing.
+func (c *snapshotCollector) startCache(ctx context.Context) (listed func(), stop func()) {
+	if c.cacheFile == "" {
+		return func() {}, func() {}
+	}
+	c.loadCache()
+
+	ctx, cancel := context.WithCancel(ctx)
+	listedCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			return
+		case <-listedCh:
+		}
+
+		ticker := time.NewTicker(c.cacheInterval)
+		defer ticker.Stop()
+		for {
+			c.saveCache()
+			select {
+			case <-ctx.Done():
+				c.saveCache()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() { close(listedCh) }, func() {
+		cancel()
+		<-done
+	}
+}
+
+// loadCache serves the snapshots of the cache file until the initial listing
+// completes. Missing, corrupt or outdated caches are discarded.
+func (c *snapshotCollector) loadCache() {
+	// a restarted Run lists all snapshots again, they are newer than the
+	// cache
+	if c.Status().InitialListingDone {
+		return
+	}
+
+	f, err := os.Open(c.cacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		c.logger.Debug().Err(err).Msg("discarding snapshot cache")
+		return
+	}
+	defer f.Close()
+
+	datasets, err := readCache(f)
+	if err != nil {
+		c.logger.Debug().Err(err).Msg("discarding snapshot cache")
+		return
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.datasets = datasets
+	c.fromCache = true
+	c.logger.Info().Int("datasets", len(datasets)).Msg("serving snapshots from the cache until the initial listing completes")
+}
+
+// saveCache atomically replaces the cache file with the known snapshots.
+// Failures are only logged, the cache is an optimization.
+func (c *snapshotCollector) saveCache() {
+	c.lck.Lock()
+	datasets := c.datasets.clone()
+	c.lck.Unlock()
+
+	if err := writeCacheFile(c.cacheFile, datasets); err != nil {
+		c.logger.Warn().Err(err).Msg("failed to save snapshot cache")
+	}
+}
+
+func writeCacheFile(filename string, datasets snapshotsState) (err error) {
+	// the temporary file is created in the same directory, so the rename
+	// happens within the same filesystem
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating cache file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if err := datasets.writeCache(f); err != nil {
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing cache file: %w", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("error renaming cache file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticState returns the snapshots of datasets with perDataset hourly
+// snapshots each.
+func syntheticState(datasets, perDataset int) snapshotsState {
+	s := make(snapshotsState)
+	for i := 0; i < datasets; i++ {
+		dataset := fmt.Sprintf("tank/backup/host-%03d", i)
+		for j := 0; j < perDataset; j++ {
+			snap := Snapshot{
+				Name:     fmt.Sprintf("autosnap_%06d_hourly", j),
+				Creation: time.Unix(1600000000+int64(j)*3600, 0),
+				Used:     uint64(i*j) * 4096,
+			}
+			// written is only known for snapshots created while following
+			// the events
+			if j%10 == 0 {
+				snap.Written = uint64(j) * 4096
+			}
+			s.add(dataset, snap)
+		}
+	}
+	return s
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	state := syntheticState(200, 1000)
+
+	var buf bytes.Buffer
+	require.NoError(t, state.writeCache(&buf))
+	// it is a fraction of the size of the listing
+	var listing int
+	for dataset, snapshots := range state {
+		for _, snap := range snapshots {
+			listing += len(fmt.Sprintf("%s@%s\t%d\t%d\n", dataset, snap.name, snap.ts.Unix(), snap.used))
+		}
+	}
+	require.Less(t, buf.Len(), listing/4)
+
+	read, err := readCache(&buf)
+	require.NoError(t, err)
+	require.Equal(t, state, read)
+
+	empty := make(snapshotsState)
+	buf.Reset()
+	require.NoError(t, empty.writeCache(&buf))
+	read, err = readCache(&buf)
+	require.NoError(t, err)
+	require.Equal(t, empty, read)
+}
+
+func TestCacheDiscarded(t *testing.T) {
+	var valid bytes.Buffer
+	require.NoError(t, syntheticState(2, 10).writeCache(&valid))
+
+	var otherVersion bytes.Buffer
+	gz := gzip.NewWriter(&otherVersion)
+	require.NoError(t, gob.NewEncoder(gz).Encode(cacheHeader{Version: cacheVersion + 1}))
+	require.NoError(t, gz.Close())
+
+	// version 1 caches lack the written space
+	var previousVersion bytes.Buffer
+	gz = gzip.NewWriter(&previousVersion)
+	enc := gob.NewEncoder(gz)
+	require.NoError(t, enc.Encode(cacheHeader{Version: 1, Datasets: 1}))
+	require.NoError(t, enc.Encode(cachedDataset{Name: "pool-nvme/data", Names: []string{"migrate_v1"}, Creations: []int64{1602276001}, Used: []uint64{1744896}}))
+	require.NoError(t, gz.Close())
+
+	for name, content := range map[string][]byte{
+		"empty":            nil,
+		"garbage":          []byte("pool-nvme/data@migrate_v1\t1602276001\t1744896\n"),
+		"truncated":        valid.Bytes()[:valid.Len()-4],
+		"other version":    otherVersion.Bytes(),
+		"previous version": previousVersion.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "snapshots.cache")
+			require.NoError(t, os.WriteFile(filename, content, 0o600))
+
+			c := newSnapshotCollector(zerolog.Nop(), "zfs", nil, nil)
+			c.UseCache(filename, time.Hour)
+			c.loadCache()
+			require.False(t, c.fromCache)
+			require.Empty(t, c.datasets)
+		})
+	}
+}
+
+func TestCollectorCache(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "snapshots.cache")
+	require.NoError(t, writeCacheFile(filename, syntheticState(2, 3)))
+
+	// the listing only completes once released
+	release := make(chan struct{})
+	lister := TextLister(func(ctx context.Context, _ ...string) ([]byte, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-release:
+		}
+		return []byte("tank/backup/host-000@autosnap_000003_hourly\t1600010800\t4096\n"), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCollector(zerolog.Nop(), "zfs", lister, nil, nil)
+	c.UseCache(filename, time.Hour)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Run(ctx)
+	}()
+
+	names := []string{"zfs_snapshot_count", "zfs_snapshot_state_from_cache"}
+	require.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_snapshot_count Count of existing ZFS snapshots.
+# TYPE zfs_snapshot_count gauge
+zfs_snapshot_count{dataset="tank/backup/host-000"} 3
+zfs_snapshot_count{dataset="tank/backup/host-001"} 3
+# HELP zfs_snapshot_state_from_cache Whether the snapshots are served from the cache file until the initial listing completes.
+# TYPE zfs_snapshot_state_from_cache gauge
+zfs_snapshot_state_from_cache 1
+`), names...) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.False(t, c.Status().InitialListingDone)
+
+	// the listing replaces the cached snapshots
+	close(release)
+	require.Eventually(t, func() bool { return c.Status().InitialListingDone }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_snapshot_count Count of existing ZFS snapshots.
+# TYPE zfs_snapshot_count gauge
+zfs_snapshot_count{dataset="tank/backup/host-000"} 1
+# HELP zfs_snapshot_state_from_cache Whether the snapshots are served from the cache file until the initial listing completes.
+# TYPE zfs_snapshot_state_from_cache gauge
+zfs_snapshot_state_from_cache 0
+`), names...))
+
+	// the listed snapshots are saved
+	cancel()
+	<-done
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+	saved, err := readCache(f)
+	require.NoError(t, err)
+	require.Equal(t, snapshotsState{
+		"tank/backup/host-000": {{name: "autosnap_000003_hourly", ts: time.Unix(1600010800, 0), used: 4096}},
+	}, saved)
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(filename), ".*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
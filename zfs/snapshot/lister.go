@@ -0,0 +1,162 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+const (
+	// BackendExec lists snapshots by running zfs list
+	BackendExec = "exec"
+	// BackendLibZFS lists snapshots using libzfs, it is only available in
+	// builds with the libzfs tag
+	BackendLibZFS = "libzfs"
+	// BackendProgram lists snapshots by running a channel program with zfs
+	// program, it falls back to zfs list where they are not available
+	BackendProgram = "program"
+)
+
+// Lister lists the snapshots for the collector. The backends map their
+// results to Snapshot, so the collector doesn't depend on how they are
+// listed.
+type Lister interface {
+	// List calls add for every snapshot of datasets, for all snapshots
+	// without any datasets. Snapshots, which can't be read, are skipped
+	// and counted.
+	List(ctx context.Context, add func(dataset string, snap Snapshot), datasets ...string) (skipped int, err error)
+}
+
+// SnapshotLister is implemented by the Listers, which can list a single
+// snapshot. The collector uses it to apply the creation of a snapshot without
+// listing all snapshots of its dataset.
+type SnapshotLister interface {
+	// ListSnapshot calls add for the snapshot of dataset, if it exists.
+	ListSnapshot(ctx context.Context, add func(dataset string, snap Snapshot), dataset, snapshot string) (skipped int, err error)
+}
+
+// NewLister returns the Lister of backend. The exec and program backends run
+// zfs using runner, the libzfs backend always lists the snapshots of the local
+// host.
+func NewLister(logger zerolog.Logger, backend string, runner command.CommandRunner) (Lister, error) {
+	switch backend {
+	case BackendExec:
+		return cmdLister(runner), nil
+	case BackendLibZFS:
+		return newLibZFSLister()
+	case BackendProgram:
+		return newProgramLister(logger, runner), nil
+	default:
+		return nil, fmt.Errorf("unknown snapshot backend %q, expected %s, %s or %s", backend, BackendExec, BackendLibZFS, BackendProgram)
+	}
+}
+
+// cmdListSnapshots lists the snapshots using zfs list. A single snapshot is
+// listed with its written property as well, which is counted when its
+// creation is applied.
+func cmdListSnapshots(runner command.CommandRunner) func(context.Context, ...string) ([]byte, error) {
+	return func(ctx context.Context, args ...string) ([]byte, error) {
+		properties := "name,creation,used"
+		if len(args) == 1 && strings.Contains(args[0], "@") {
+			properties += ",written"
+		}
+		args = append([]string{"list", "-H", "-p", "-t", "snapshot", "-o", properties}, args...)
+		return command.Output(ctx, runner, "zfs", args...)
+	}
+}
+
+func cmdLister(runner command.CommandRunner) Lister {
+	return TextLister(cmdListSnapshots(runner))
+}
+
+type textLister func(context.Context, ...string) ([]byte, error)
+
+// TextLister returns a Lister parsing the output of list, which is in the
+// format of zfs list -H -p -t snapshot -o name,creation,used, optionally
+// followed by written. list gets the datasets to list as arguments, or the
+// name of a single snapshot. The Lister implements SnapshotLister.
+func TextLister(list func(context.Context, ...string) ([]byte, error)) Lister {
+	return textLister(list)
+}
+
+func (l textLister) List(ctx context.Context, add func(string, Snapshot), datasets ...string) (int, error) {
+	data, err := l(ctx, datasets...)
+	if err != nil {
+		return 0, err
+	}
+	return parseList(bytes.NewReader(data), add)
+}
+
+func (l textLister) ListSnapshot(ctx context.Context, add func(string, Snapshot), dataset, snapshot string) (int, error) {
+	return l.List(ctx, add, dataset+"@"+snapshot)
+}
+
+// parseList calls add for the snapshots listed by zfs list -H -p -o
+// name,creation,used with an optional written column. Lines, which can't be
+// parsed, are skipped and counted, so a single broken line doesn't drop all
+// snapshots. Only errors reading r are returned.
+func parseList(r io.Reader, add func(string, Snapshot)) (skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		// the fields are separated by tabs, as snapshot names may contain
+		// spaces
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 && len(fields) != 4 {
+			fields = strings.Fields(line)
+		}
+		if len(fields) != 3 && len(fields) != 4 {
+			skipped++
+			continue
+		}
+
+		idx := strings.LastIndex(fields[0], "@")
+		if idx <= 0 || idx == len(fields[0])-1 {
+			skipped++
+			continue
+		}
+
+		tsUnix, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		used, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			skipped++
+			continue
+		}
+
+		var written uint64
+		if len(fields) == 4 {
+			written, err = strconv.ParseUint(fields[3], 10, 64)
+			if err != nil {
+				skipped++
+				continue
+			}
+		}
+
+		add(fields[0][:idx], Snapshot{
+			Name:     fields[0][idx+1:],
+			Creation: time.Unix(tsUnix, 0),
+			Used:     used,
+			Written:  written,
+		})
+	}
+
+	return skipped, scanner.Err()
+}
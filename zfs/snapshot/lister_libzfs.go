@@ -0,0 +1,162 @@
+//go:build libzfs && cgo
+
+package snapshot
+
+/*
+#cgo pkg-config: libzfs
+#include <stdlib.h>
+#include <libzfs.h>
+
+extern int goIterDataset(zfs_handle_t *, void *);
+extern int goIterSnapshot(zfs_handle_t *, void *);
+*/
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"runtime/cgo"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// libzfsLister lists the snapshots using the iterators of libzfs, which read
+// them using ioctls instead of running zfs list and parsing its output. It
+// requires the API of OpenZFS 2.2 or later.
+type libzfsLister struct{}
+
+var _ SnapshotLister = libzfsLister{}
+
+func newLibZFSLister() (Lister, error) {
+	return libzfsLister{}, nil
+}
+
+// libzfsIteration is the state of a listing, it is passed to the callbacks
+// of the iterators using a cgo.Handle.
+type libzfsIteration struct {
+	ctx     context.Context
+	add     func(string, Snapshot)
+	skipped int
+
+	// written reads the written property as well, like zfs list does for a
+	// single snapshot
+	written bool
+}
+
+func (libzfsLister) List(ctx context.Context, add func(string, Snapshot), datasets ...string) (int, error) {
+	// every listing gets its own handle, as handles must not be shared
+	// between threads
+	hdl := C.libzfs_init()
+	if hdl == nil {
+		return 0, fmt.Errorf("failed to initialize libzfs: %w", command.ErrUnavailable)
+	}
+	defer C.libzfs_fini(hdl)
+	C.libzfs_print_on_error(hdl, C.B_FALSE)
+
+	it := &libzfsIteration{ctx: ctx, add: add}
+	h := cgo.NewHandle(it)
+	defer h.Delete()
+
+	if len(datasets) == 0 {
+		if rc := C.zfs_iter_root(hdl, C.zfs_iter_f(C.goIterDataset), unsafe.Pointer(&h)); rc != 0 {
+			return it.skipped, iterError(ctx, hdl, "datasets")
+		}
+		return it.skipped, ctx.Err()
+	}
+
+	for _, dataset := range datasets {
+		name := C.CString(dataset)
+		zhp := C.zfs_open(hdl, name, C.ZFS_TYPE_FILESYSTEM|C.ZFS_TYPE_VOLUME)
+		C.free(unsafe.Pointer(name))
+		if zhp == nil {
+			return it.skipped, fmt.Errorf("failed to open dataset %s: %s", dataset, C.GoString(C.libzfs_error_description(hdl)))
+		}
+		// like zfs list, only the snapshots of the dataset itself are
+		// listed
+		rc := C.zfs_iter_snapshots_v2(zhp, 0, C.zfs_iter_f(C.goIterSnapshot), unsafe.Pointer(&h), 0, 0)
+		C.zfs_close(zhp)
+		if rc != 0 {
+			return it.skipped, iterError(ctx, hdl, "snapshots of dataset "+dataset)
+		}
+	}
+	return it.skipped, ctx.Err()
+}
+
+// iterError returns the error of an iteration, which stopped early. The
+// callbacks stop it, once ctx is cancelled, otherwise libzfs failed to read
+// what, so the listing is incomplete.
+func iterError(ctx context.Context, hdl *C.libzfs_handle_t, what string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("failed to iterate %s: %s", what, C.GoString(C.libzfs_error_description(hdl)))
+}
+
+// ListSnapshot opens a single snapshot instead of iterating the snapshots of
+// its dataset.
+func (libzfsLister) ListSnapshot(ctx context.Context, add func(string, Snapshot), dataset, snapshot string) (int, error) {
+	hdl := C.libzfs_init()
+	if hdl == nil {
+		return 0, fmt.Errorf("failed to initialize libzfs: %w", command.ErrUnavailable)
+	}
+	defer C.libzfs_fini(hdl)
+	C.libzfs_print_on_error(hdl, C.B_FALSE)
+
+	name := C.CString(dataset + "@" + snapshot)
+	zhp := C.zfs_open(hdl, name, C.ZFS_TYPE_SNAPSHOT)
+	C.free(unsafe.Pointer(name))
+	if zhp == nil {
+		return 0, fmt.Errorf("failed to open snapshot %s@%s: %s", dataset, snapshot, C.GoString(C.libzfs_error_description(hdl)))
+	}
+
+	it := &libzfsIteration{ctx: ctx, add: add, written: true}
+	h := cgo.NewHandle(it)
+	defer h.Delete()
+	// the snapshot is read like the ones of an iteration, which closes it
+	goIterSnapshot(zhp, unsafe.Pointer(&h))
+	return it.skipped, ctx.Err()
+}
+
+//export goIterDataset
+func goIterDataset(zhp *C.zfs_handle_t, data unsafe.Pointer) C.int {
+	defer C.zfs_close(zhp)
+	it := (*(*cgo.Handle)(data)).Value().(*libzfsIteration)
+	if it.ctx.Err() != nil {
+		return 1
+	}
+
+	if rc := C.zfs_iter_snapshots_v2(zhp, 0, C.zfs_iter_f(C.goIterSnapshot), data, 0, 0); rc != 0 {
+		return rc
+	}
+	// the children include volumes
+	return C.zfs_iter_filesystems_v2(zhp, 0, C.zfs_iter_f(C.goIterDataset), data)
+}
+
+//export goIterSnapshot
+func goIterSnapshot(zhp *C.zfs_handle_t, data unsafe.Pointer) C.int {
+	defer C.zfs_close(zhp)
+	it := (*(*cgo.Handle)(data)).Value().(*libzfsIteration)
+	if it.ctx.Err() != nil {
+		return 1
+	}
+
+	name := C.GoString(C.zfs_get_name(zhp))
+	idx := strings.LastIndex(name, "@")
+	if idx <= 0 {
+		it.skipped++
+		return 0
+	}
+	snap := Snapshot{
+		Name:     name[idx+1:],
+		Creation: time.Unix(int64(C.zfs_prop_get_int(zhp, C.ZFS_PROP_CREATION)), 0),
+		Used:     uint64(C.zfs_prop_get_int(zhp, C.ZFS_PROP_USED)),
+	}
+	if it.written {
+		snap.Written = uint64(C.zfs_prop_get_int(zhp, C.ZFS_PROP_WRITTEN))
+	}
+	it.add(name[:idx], snap)
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build !libzfs || !cgo
+
+package snapshot
+
+import "fmt"
+
+func newLibZFSLister() (Lister, error) {
+	return nil, fmt.Errorf("the %s snapshot backend requires building with cgo and the libzfs tag", BackendLibZFS)
+}
@@ -0,0 +1,52 @@
+package snapshot
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextLister(t *testing.T) {
+	l := TextLister(ListFile(filepath.Join("testdata", "snapshots-simple.txt")))
+
+	listed := make(snapshotsState)
+	skipped, err := l.List(context.Background(), listed.add, "pool-nvme/data")
+	require.NoError(t, err)
+	require.Equal(t, 0, skipped)
+	require.Equal(t, snapshotsState{
+		"pool-nvme/data": {
+			{name: "migrate_v1", ts: time.Unix(1602276001, 0), used: 1744896},
+			{name: "migrate_v2", ts: time.Unix(1602276642, 0), used: 1826816},
+		},
+	}, listed)
+
+	// all snapshots are listed without datasets
+	listed = make(snapshotsState)
+	_, err = l.List(context.Background(), listed.add)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+}
+
+func TestParseListWritten(t *testing.T) {
+	listed := make(snapshotsState)
+	skipped, err := parseList(strings.NewReader("pool/data@new\t1700000000\t0\t4194304\npool/data@broken\t1700000000\t0\t-\n"), listed.add)
+	require.NoError(t, err)
+	require.Equal(t, 1, skipped)
+	require.Equal(t, snapshotsState{
+		"pool/data": {{name: "new", ts: time.Unix(1700000000, 0), written: 4194304}},
+	}, listed)
+}
+
+func TestNewLister(t *testing.T) {
+	l, err := NewLister(zerolog.Nop(), BackendExec, nil)
+	require.NoError(t, err)
+	require.IsType(t, textLister(nil), l)
+
+	_, err = NewLister(zerolog.Nop(), "json", nil)
+	require.ErrorContains(t, err, "unknown snapshot backend")
+}
@@ -0,0 +1,244 @@
+package snapshot
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// programScript is the channel program listing the snapshots of a pool.
+//
+//go:embed program.lua
+var programScript []byte
+
+// The limits of the channel program are the maximum allowed by default, so
+// pools with many snapshots can be listed. A program exceeding them fails and
+// the snapshots are listed by zfs list instead.
+const (
+	programInstructionLimit = "100000000"
+	programMemoryLimit      = "104857600"
+)
+
+// programLister lists the snapshots by running a channel program per pool,
+// which reads them within a single txg. Unlike zfs list, snapshots created or
+// destroyed while listing are never missed or listed twice. Where zfs program
+// isn't supported or permitted, it falls back to zfs list.
+type programLister struct {
+	logger   zerolog.Logger
+	runner   command.CommandRunner
+	fallback textLister
+
+	mtx sync.Mutex
+	// unsupported is set, once zfs program failed in a way, which won't
+	// change until the exporter is restarted
+	unsupported bool
+}
+
+var (
+	_ Lister         = (*programLister)(nil)
+	_ SnapshotLister = (*programLister)(nil)
+)
+
+func newProgramLister(logger zerolog.Logger, runner command.CommandRunner) *programLister {
+	return &programLister{
+		logger:   logger.With().Str("lister", BackendProgram).Logger(),
+		runner:   runner,
+		fallback: textLister(cmdListSnapshots(runner)),
+	}
+}
+
+func (l *programLister) isUnsupported() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.unsupported
+}
+
+func (l *programLister) setUnsupported() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.unsupported = true
+}
+
+// isUnsupportedErr reports whether err of zfs program is going to persist,
+// as the channel programs are not supported by the release of zfs or not
+// permitted for the user of the exporter.
+func isUnsupportedErr(err error) bool {
+	return errors.Is(err, command.ErrPermission) || strings.Contains(err.Error(), "unrecognized command 'program'")
+}
+
+func (l *programLister) List(ctx context.Context, add func(string, Snapshot), datasets ...string) (int, error) {
+	if l.isUnsupported() {
+		return l.fallback.List(ctx, add, datasets...)
+	}
+
+	skipped, err := l.listPrograms(ctx, add, datasets)
+	if err == nil || ctx.Err() != nil || errors.Is(err, command.ErrUnavailable) {
+		return skipped, err
+	}
+	if isUnsupportedErr(err) {
+		l.logger.Warn().Err(err).Msg("channel programs are not available, listing snapshots using zfs list from now on")
+		l.setUnsupported()
+	} else {
+		l.logger.Warn().Err(err).Msg("failed to list snapshots using a channel program, falling back to zfs list")
+	}
+	// the snapshots already added are added again, which is a no-op
+	return l.fallback.List(ctx, add, datasets...)
+}
+
+// ListSnapshot lists a single snapshot using zfs list, there is nothing to
+// gain from a channel program.
+func (l *programLister) ListSnapshot(ctx context.Context, add func(string, Snapshot), dataset, snapshot string) (int, error) {
+	return l.fallback.ListSnapshot(ctx, add, dataset, snapshot)
+}
+
+// listPrograms runs the channel program for every pool of datasets, for all
+// pools without datasets.
+func (l *programLister) listPrograms(ctx context.Context, add func(string, Snapshot), datasets []string) (int, error) {
+	byPool, err := l.poolDatasets(ctx, datasets)
+	if err != nil {
+		return 0, err
+	}
+	if len(byPool) == 0 {
+		return 0, nil
+	}
+
+	script, err := writeProgramScript()
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(script)
+
+	pools := make([]string, 0, len(byPool))
+	for pool := range byPool {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	var skipped int
+	for _, pool := range pools {
+		// the pool is the first argument of the script, followed by the
+		// datasets to list
+		args := append([]string{"program", "-j", "-n", "-t", programInstructionLimit, "-m", programMemoryLimit, pool, script, pool}, byPool[pool]...)
+		r, err := l.runner.Run(ctx, "zfs", args...)
+		if err != nil {
+			return skipped, err
+		}
+		n, err := parseProgram(r, add)
+		skipped += n
+		if err != nil {
+			return skipped, fmt.Errorf("failed to parse the channel program result of pool %s: %w", pool, err)
+		}
+	}
+	return skipped, nil
+}
+
+// poolDatasets groups datasets by their pool. Without datasets all pools are
+// listed using zpool list, with no datasets each.
+func (l *programLister) poolDatasets(ctx context.Context, datasets []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	if len(datasets) > 0 {
+		for _, d := range datasets {
+			pool, _, _ := strings.Cut(d, "/")
+			result[pool] = append(result[pool], d)
+		}
+		return result, nil
+	}
+
+	r, err := l.runner.Run(ctx, "zpool", "list", "-H", "-o", "name")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if pool := scanner.Text(); pool != "" && pool != "no pools available" {
+			result[pool] = nil
+		}
+	}
+	return result, scanner.Err()
+}
+
+// writeProgramScript writes the channel program to a temporary file, which is
+// removed by the caller.
+func writeProgramScript() (string, error) {
+	f, err := os.CreateTemp("", "zfs-event-exporter-*.lua")
+	if err != nil {
+		return "", fmt.Errorf("failed to write channel program: %w", err)
+	}
+	if _, err := f.Write(programScript); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write channel program: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write channel program: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// programSnapshot is a snapshot returned by the channel program. The numbers
+// are parsed by the caller, as nvlists print uint64 values beyond the
+// precision of a float64.
+type programSnapshot struct {
+	Creation json.RawMessage `json:"creation"`
+	Used     json.RawMessage `json:"used"`
+}
+
+// parseProgram calls add for the snapshots in the result of the channel
+// program printed by zfs program -j. Snapshots, which can't be parsed, are
+// skipped and counted.
+func parseProgram(r io.Reader, add func(string, Snapshot)) (skipped int, err error) {
+	var result struct {
+		Return map[string]programSnapshot `json:"return"`
+	}
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return 0, err
+	}
+
+	// the snapshots are added in a stable order, the result is a table
+	// without one
+	names := make([]string, 0, len(result.Return))
+	for name := range result.Return {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		snap := result.Return[name]
+		idx := strings.LastIndex(name, "@")
+		if idx <= 0 || idx == len(name)-1 {
+			skipped++
+			continue
+		}
+		creation, err := strconv.ParseInt(string(snap.Creation), 10, 64)
+		if err != nil {
+			skipped++
+			continue
+		}
+		used, err := strconv.ParseUint(string(snap.Used), 10, 64)
+		if err != nil {
+			skipped++
+			continue
+		}
+		add(name[:idx], Snapshot{
+			Name:     name[idx+1:],
+			Creation: time.Unix(creation, 0),
+			Used:     used,
+		})
+	}
+	return skipped, nil
+}
@@ -0,0 +1,37 @@
+-- Lists the snapshots of a pool with their creation and used bytes for the
+-- program snapshot backend of zfs-event-exporter. It runs within a single txg,
+-- so snapshots created or destroyed concurrently are either listed completely
+-- or not at all.
+--
+-- Without arguments all snapshots of the pool are listed, otherwise only the
+-- snapshots of the datasets given as arguments, like zfs list does.
+
+local args = ...
+local argv = args["argv"]
+local result = {}
+
+local function snapshots(dataset)
+	for snap in zfs.list.snapshots(dataset) do
+		result[snap] = {
+			creation = zfs.get_prop(snap, "creation"),
+			used = zfs.get_prop(snap, "used"),
+		}
+	end
+end
+
+local function walk(dataset)
+	snapshots(dataset)
+	for child in zfs.list.children(dataset) do
+		walk(child)
+	end
+end
+
+if #argv == 1 then
+	walk(argv[1])
+else
+	for i = 2, #argv do
+		snapshots(argv[i])
+	end
+end
+
+return result
@@ -0,0 +1,160 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParseProgram(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "program.json"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	listed := make(snapshotsState)
+	skipped, err := parseProgram(f, listed.add)
+	require.NoError(t, err)
+	require.Equal(t, 0, skipped)
+	require.Equal(t, snapshotsState{
+		"pool-nvme": {
+			{name: "before upgrade", ts: time.Unix(1602270000, 0)},
+		},
+		"pool-nvme/data": {
+			{name: "migrate_v1", ts: time.Unix(1602276001, 0), used: 1744896},
+			{name: "migrate_v2", ts: time.Unix(1602276642, 0), used: 1826816},
+		},
+		// used bytes beyond the precision of a float64 are kept
+		"pool-nvme/data/vm-100-disk-0": {
+			{name: "zrepl_20231122_225701_000", ts: time.Unix(1700693821, 0), used: 9007199254740993},
+		},
+	}, listed)
+
+	// an empty pool
+	skipped, err = parseProgram(strings.NewReader(`{"return":{}}`), listed.add)
+	require.NoError(t, err)
+	require.Equal(t, 0, skipped)
+
+	skipped, err = parseProgram(strings.NewReader(`{"return":{"tank":{"creation":1,"used":1},"tank@a":{"creation":"x","used":1},"tank@b":{"creation":1,"used":-1},"tank@c":{"creation":1,"used":2}}}`), listed.add)
+	require.NoError(t, err)
+	require.Equal(t, 3, skipped)
+	require.Equal(t, []snapshotState{{name: "c", ts: time.Unix(1, 0), used: 2}}, listed["tank"])
+
+	_, err = parseProgram(strings.NewReader("Channel program execution failed"), listed.add)
+	require.Error(t, err)
+}
+
+func TestProgramLister(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "program.json"))
+	require.NoError(t, err)
+
+	fake := command.NewFakeExecutor()
+	fake.On("zpool list", command.FakeCommand{Stdout: "pool-nvme\nbackup\n"})
+	fake.On("zfs program", command.FakeCommand{Stdout: string(data)})
+	l, err := NewLister(zerolog.Nop(), BackendProgram, fake.Runner())
+	require.NoError(t, err)
+
+	listed := make(snapshotsState)
+	skipped, err := l.List(context.Background(), listed.add)
+	require.NoError(t, err)
+	require.Equal(t, 0, skipped)
+	require.Len(t, listed, 3)
+
+	// the program is run per pool in read-only mode
+	calls := fake.Calls()
+	require.Len(t, calls, 3)
+	require.Equal(t, []string{"zpool", "list", "-H", "-o", "name"}, calls[0])
+	for i, pool := range []string{"backup", "pool-nvme"} {
+		args := calls[i+1]
+		require.Equal(t, []string{"zfs", "program", "-j", "-n", "-t", programInstructionLimit, "-m", programMemoryLimit, pool}, args[:9])
+		require.Equal(t, []string{pool}, args[10:])
+		require.True(t, strings.HasSuffix(args[9], ".lua"), args[9])
+		// the script is removed after listing
+		require.NoFileExists(t, args[9])
+	}
+
+	// the datasets are listed in the program of their pool
+	_, err = l.List(context.Background(), listed.add, "pool-nvme/data", "tank/vm", "pool-nvme")
+	require.NoError(t, err)
+	calls = fake.Calls()[3:]
+	require.Len(t, calls, 2)
+	require.Equal(t, []string{"pool-nvme", "pool-nvme/data", "pool-nvme"}, calls[0][10:])
+	require.Equal(t, []string{"tank", "tank/vm"}, calls[1][10:])
+
+	// a single snapshot is listed by zfs list
+	fake.On("zfs list", command.FakeCommand{Stdout: "tank/vm@new\t1700000000\t0\n"})
+	_, err = l.(SnapshotLister).ListSnapshot(context.Background(), listed.add, "tank/vm", "new")
+	require.NoError(t, err)
+	require.Equal(t, "tank/vm@new", fake.Calls()[5][len(fake.Calls()[5])-1])
+	require.Len(t, listed["tank/vm"], 1)
+}
+
+func TestProgramListerFallback(t *testing.T) {
+	for name, tc := range map[string]struct {
+		program     command.FakeCommand
+		unsupported bool
+	}{
+		"unsupported": {
+			program:     command.FakeCommand{Stderr: "unrecognized command 'program'\nusage: zfs command args ...", ExitCode: 2},
+			unsupported: true,
+		},
+		"denied": {
+			program:     command.FakeCommand{Stderr: "cannot execute channel program: permission denied", ExitCode: 1},
+			unsupported: true,
+		},
+		"memory limit": {
+			program: command.FakeCommand{Stderr: "Channel program execution failed:\nMemory limit exhausted.", ExitCode: 1},
+		},
+		"invalid output": {
+			program: command.FakeCommand{Stdout: "{"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := command.NewFakeExecutor()
+			fake.On("zpool list", command.FakeCommand{Stdout: "pool-nvme\n"})
+			fake.On("zfs program", tc.program)
+			fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v1\t1602276001\t1744896\n"})
+			l := newProgramLister(zerolog.Nop(), fake.Runner())
+
+			// the snapshots are listed by zfs list instead
+			for i := 0; i < 2; i++ {
+				listed := make(snapshotsState)
+				_, err := l.List(context.Background(), listed.add)
+				require.NoError(t, err)
+				require.Equal(t, snapshotsState{
+					"pool-nvme/data": {{name: "migrate_v1", ts: time.Unix(1602276001, 0), used: 1744896}},
+				}, listed)
+			}
+
+			var programs int
+			for _, call := range fake.Calls() {
+				if call[1] == "program" {
+					programs++
+				}
+			}
+			// the program isn't run again, unless the failure might
+			// be temporary
+			if tc.unsupported {
+				require.Equal(t, 1, programs)
+			} else {
+				require.Equal(t, 2, programs)
+			}
+		})
+	}
+}
+
+func TestProgramListerUnavailable(t *testing.T) {
+	// without ZFS there is nothing to fall back to
+	fake := command.NewFakeExecutor()
+	l := newProgramLister(zerolog.Nop(), fake.Runner())
+	_, err := l.List(context.Background(), make(snapshotsState).add)
+	require.ErrorIs(t, err, command.ErrUnavailable)
+	require.Len(t, fake.Calls(), 1)
+}
@@ -0,0 +1,29 @@
+package snapshot
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+)
+
+// Rules returns the recommended rules for the snapshot metrics.
+func Rules(cfg rules.Config) []rules.Rule {
+	var (
+		lastUnixtime = prometheus.BuildFQName(cfg.Namespace, "snapshot", "last_unixtime")
+		maxAge       = model.Duration(cfg.SnapshotMaxAge).String()
+	)
+	return []rules.Rule{
+		{
+			Alert:   "ZFSSnapshotTooOld",
+			Expr:    `time() - ` + lastUnixtime + ` > ` + rules.Seconds(cfg.SnapshotMaxAge),
+			For:     model.Duration(cfg.For),
+			Labels:  map[string]string{"severity": "warning"},
+			Metrics: []string{lastUnixtime},
+			Annotations: map[string]string{
+				"summary":     "Last snapshot of {{ $labels.dataset }} is older than " + maxAge,
+				"description": "The last snapshot of the dataset {{ $labels.dataset }} on {{ $labels.instance }} has been taken {{ $value | humanizeDuration }} ago.",
+			},
+		},
+	}
+}
@@ -0,0 +1,34 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/rules"
+)
+
+func TestRules(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "snapshots-simple.txt"))
+	require.NoError(t, err)
+
+	for _, namespace := range []string{"zfs", "storage_zfs"} {
+		c := newSnapshotCollector(zerolog.Nop(), namespace, TextLister(func(context.Context, ...string) ([]byte, error) {
+			return data, nil
+		}), nil)
+		require.NoError(t, c.listAll(context.Background()))
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+
+		cfg := rules.Config{Namespace: namespace, For: 15 * time.Minute, SnapshotMaxAge: 24 * time.Hour}
+		rs := Rules(cfg)
+		require.NoError(t, rules.Verify(reg, rs), namespace)
+		require.Equal(t, "time() - "+namespace+"_snapshot_last_unixtime > 86400", rs[0].Expr)
+	}
+}
@@ -4,40 +4,61 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os/exec"
+	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
 )
 
-func cmdListSnapshots(ctx context.Context, args ...string) ([]byte, error) {
-	args = append([]string{"list", "-H", "-p", "-t", "snapshot", "-o", "name,creation,used"}, args...)
-	return exec.Command("zfs", args...).Output()
-}
+// ListFile returns a function listing snapshots from a file in the format of
+// zfs list -H -p -t snapshot -o name,creation,used instead of running zfs. The
+// file is read on every call. Like zfs list, only the snapshots of the given
+// datasets are returned, if there are any.
+func ListFile(filename string) func(context.Context, ...string) ([]byte, error) {
+	return func(_ context.Context, datasets ...string) ([]byte, error) {
+		data, err := os.ReadFile(filename)
+		if err != nil || len(datasets) == 0 {
+			return data, err
+		}
 
-func cmdZpoolEvents(ctx context.Context, out io.Writer) error {
-	cmd := exec.CommandContext(ctx,
-		"zpool",
-		"events",
-		"-f",
-		"-H",
-		"-v",
-	)
-	cmd.Stdout = out
-	return cmd.Start()
+		var result bytes.Buffer
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := scanner.Text()
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			name := fields[0]
+			if idx := strings.LastIndex(name, "@"); idx >= 0 {
+				for _, dataset := range datasets {
+					// like zfs list, a snapshot is listed by its name
+					if name[:idx] == dataset || name == dataset {
+						result.WriteString(line + "\n")
+						break
+					}
+				}
+			}
+		}
+		return result.Bytes(), scanner.Err()
+	}
 }
 
 type snapshotState struct {
-	name string
-	ts   time.Time
-	used uint64
+	name    string
+	ts      time.Time
+	used    uint64
+	written uint64
 }
 
 type snapshotCollector struct {
@@ -45,154 +66,655 @@ type snapshotCollector struct {
 	logger zerolog.Logger
 
 	datasets      snapshotsState
-	listSnapshots func(context.Context, ...string) ([]byte, error)
+	lister        Lister
 	keep          func(string, string) bool
+	retryInterval time.Duration
+	status        Status
+
+	// pollInterval is the interval of listing all snapshots in poll mode
+	pollInterval time.Duration
+
+	// cacheFile holds the snapshots across restarts, fromCache is set while
+	// they are served from it.
+	cacheFile     string
+	cacheInterval time.Duration
+	fromCache     bool
+
+	// resyncs and eventsApplied are exposed for debugging by State
+	resyncs       uint64
+	eventsApplied uint64
+
+	// source names the event stream in the logs, e.g. zpool events
+	source string
+	// followerDone is closed once the event stream has stopped
+	followerDone chan struct{}
+
+	// eventCh queues the events until they are applied by the event loop
+	eventCh chan *events.Event
+
+	// observers are called for every event and with nil after a resync
+	observers []func(*events.Event)
 
 	metricCount        *prometheus.GaugeVec
 	metricLastUnixtime *prometheus.GaugeVec
 	metricDiskUsed     *prometheus.GaugeVec
+	metricCreated      *prometheus.CounterVec
+	metricCreatedBytes *prometheus.CounterVec
+	metricDestroyed    *prometheus.CounterVec
+	metricFromCache    prometheus.Gauge
+
+	metricTrackedDatasets  prometheus.Gauge
+	metricTrackedSnapshots prometheus.Gauge
+	metricEventQueueLength prometheus.Gauge
+	metricSkippedLines     prometheus.Counter
+	// metricSkippedEventLines counts the lines of zpool events, which
+	// couldn't be parsed
+	metricSkippedEventLines prometheus.Counter
 }
 
-func keepAll(dataset, snapshot string) bool { return true }
+// The modes of the snapshot collector.
+const (
+	// ModeEvents applies the snapshots created and destroyed according to
+	// an event stream, like zpool events.
+	ModeEvents = "events"
+	// ModePoll lists all snapshots periodically.
+	ModePoll = "poll"
+)
 
-func NewCollector(ctx context.Context, logger zerolog.Logger, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
-	var (
-		eventCh                  = make(chan *zpoolEvent)
-		eventReader, eventWriter = io.Pipe()
-	)
+// Status describes the lifecycle of the snapshot collector.
+type Status struct {
+	// Mode is how the collector follows the changes of snapshots.
+	Mode string `json:"mode"`
 
-	if err := cmdZpoolEvents(ctx, eventWriter); err != nil {
-		return nil, fmt.Errorf("failed to start zpool events: %w", err)
-	}
+	// InitialListingDone is set once all snapshots have been listed at start up.
+	InitialListingDone bool `json:"initial_listing_done"`
 
-	go func() {
-		if err := parseZpoolEvents(eventReader, eventCh); err != nil {
-			logger.Error().Err(err).Msg("failed to parse zpool events")
-		}
-	}()
+	// EventStreamUp is true while the zpool events stream is attached. In
+	// poll mode, it is true while listing the snapshots succeeds.
+	EventStreamUp bool `json:"event_stream_up"`
+
+	// EventStreamChanged is the last time EventStreamUp changed.
+	EventStreamChanged time.Time `json:"event_stream_changed"`
+}
 
-	return newCollector(ctx, logger, cmdListSnapshots, eventCh, keep)
+// Snapshot is a snapshot known to the collector.
+type Snapshot struct {
+	Name     string    `json:"name"`
+	Creation time.Time `json:"creation"`
+	Used     uint64    `json:"used"`
 
+	// Written is the space written since the previous snapshot. It is only
+	// listed for a single snapshot, when its creation is applied.
+	Written uint64 `json:"written,omitempty"`
+
+	// Excluded is set for snapshots, which are not part of the metrics.
+	Excluded bool `json:"excluded,omitempty"`
 }
 
-type snapshotsState map[string][]snapshotState
+// State is a copy of the collector state for debugging.
+type State struct {
+	Status Status `json:"status"`
 
-func (s snapshotsState) parse(r io.Reader) error {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) != 3 {
-			return fmt.Errorf("invalid line: %q", line)
-		}
+	// Resyncs counts the listings of all snapshots after zpool events has
+	// been restarted.
+	Resyncs uint64 `json:"resyncs"`
 
-		idx := strings.LastIndex(fields[0], "@")
-		if idx == -1 {
-			return fmt.Errorf("invalid snapshot name: %q", fields[0])
-		}
+	// EventsApplied counts the snapshot and destroy events applied to the
+	// known snapshots.
+	EventsApplied uint64 `json:"events_applied"`
+
+	Datasets map[string][]Snapshot `json:"datasets"`
+}
+
+func keepAll(dataset, snapshot string) bool { return true }
 
-		tsUnix, err := strconv.ParseInt(fields[1], 10, 64)
+// retryInterval is the time between attempts to list snapshots or to restart
+// zpool events.
+var retryInterval = 30 * time.Second
+
+// eventQueueSize is the number of events queued while the event loop lists
+// the snapshots of a dataset, before reading zpool events blocks.
+const eventQueueSize = 1024
+
+// NewCollector creates a collector for snapshots, which lists all snapshots
+// and follows zpool events for changes, once Run is called. zpool events is
+// started right away and followed until ctx is cancelled. While ZFS is not
+// available, starting zpool events is retried instead of failing. All metric
+// names are prefixed with namespace. The snapshots are listed by lister, with
+// zfs list run by runner without one.
+func NewCollector(ctx context.Context, logger zerolog.Logger, runner command.CommandRunner, lister Lister, namespace string, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
+	return newStreamCollector(ctx, logger, runner, lister, "zpool events", func(ctx context.Context) (eventStream, error) {
+		follower, err := events.StartFollow(ctx, runner)
 		if err != nil {
-			return fmt.Errorf("invalid timestamp: %q", fields[1])
+			return nil, err
 		}
-		ts := time.Unix(tsUnix, 0)
+		return follower, nil
+	}, namespace, keep)
+}
 
-		used, err := strconv.ParseUint(fields[2], 10, 64)
+// NewHistoryCollector is like NewCollector, but polls zpool history every
+// interval for changes instead of following zpool events, which requires
+// root.
+func NewHistoryCollector(ctx context.Context, logger zerolog.Logger, runner command.CommandRunner, lister Lister, interval time.Duration, namespace string, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
+	return newStreamCollector(ctx, logger, runner, lister, "zpool history", func(ctx context.Context) (eventStream, error) {
+		history, err := events.StartHistory(ctx, runner, interval)
 		if err != nil {
-			return fmt.Errorf("invalid used bytes: %q", fields[2])
+			return nil, err
 		}
+		return history, nil
+	}, namespace, keep)
+}
 
-		dataset := fields[0][:idx]
-		snapshot := snapshotState{
-			name: fields[0][idx+1:],
-			ts:   ts,
-			used: used,
-		}
+// eventStream is a started source of events, like zpool events -f.
+type eventStream interface {
+	Run(ch chan<- *events.Event, raw bool) error
+}
 
-		// find position to insert
-		pos := sort.Search(len(s[dataset]), func(i int) bool {
-			return s[dataset][i].ts.UnixNano() >= snapshot.ts.UnixNano()
-		})
+// newStreamCollector creates a collector following the event stream started
+// by start, which is named source in the logs.
+func newStreamCollector(ctx context.Context, logger zerolog.Logger, runner command.CommandRunner, lister Lister, source string, start func(context.Context) (eventStream, error), namespace string, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
+	if lister == nil {
+		lister = cmdLister(runner)
+	}
 
-		// check it is not a duplicate
-		for {
+	stream, err := start(ctx)
+	if err != nil && !errors.Is(err, command.ErrUnavailable) {
+		return nil, fmt.Errorf("failed to start %s: %w", source, err)
+	}
 
-			// end of slice
-			if pos >= len(s[dataset]) {
-				break
-			}
+	eventCh := make(chan *events.Event, eventQueueSize)
+	c := newCollector(logger, namespace, lister, eventCh, keep)
+	c.source = source
+	c.followerDone = make(chan struct{})
+	if stream == nil {
+		c.logger.Warn().Err(err).Msgf("failed to start %s, retrying in %s", source, c.retryInterval)
+		c.setEventStreamUp(false)
+	}
+	go c.follow(ctx, stream, start, eventCh)
+	return c, nil
+}
 
-			// check if ts still matches
-			if s[dataset][pos].ts.UnixNano() != ts.UnixNano() {
-				break
+// retryLevel is the level for logging a failed attempt, which is retried.
+// Failures while ZFS is not available are expected until it shows up.
+func retryLevel(err error) zerolog.Level {
+	if errors.Is(err, command.ErrUnavailable) {
+		return zerolog.DebugLevel
+	}
+	return zerolog.ErrorLevel
+}
+
+// follow forwards the events of stream to eventCh until ctx is cancelled.
+// When the stream ends, e.g. because the connection to a remote host broke, it
+// is restarted and all snapshots are listed again, as events might have been
+// missed in the meantime. Without a stream, it is started first.
+func (c *snapshotCollector) follow(ctx context.Context, stream eventStream, start func(context.Context) (eventStream, error), eventCh chan<- *events.Event) {
+	defer close(c.followerDone)
+	defer close(eventCh)
+
+	for {
+		if stream != nil {
+			ch := make(chan *events.Event)
+			errCh := make(chan error, 1)
+			go func(stream eventStream) {
+				errCh <- stream.Run(ch, false)
+			}(stream)
+			for event := range ch {
+				// events are dropped once ctx is cancelled, as the event loop
+				// might not be running anymore
+				select {
+				case eventCh <- event:
+				case <-ctx.Done():
+				}
 			}
+			err := <-errCh
+			if ctx.Err() != nil {
+				return
+			}
+			c.setEventStreamUp(false)
+			c.logger.WithLevel(retryLevel(err)).Err(err).Msgf("%s exited, restarting in %s", c.source, c.retryInterval)
+		}
 
-			// duplicate of snapshot name
-			if s[dataset][pos].name == snapshot.name {
-				return nil
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.retryInterval):
 			}
+			var err error
+			if stream, err = start(ctx); err == nil {
+				break
+			}
+			c.logger.WithLevel(retryLevel(err)).Err(err).Msgf("failed to restart %s, retrying in %s", c.source, c.retryInterval)
+		}
+		c.setEventStreamUp(true)
 
-			pos++
+		if err := c.listAll(ctx); err != nil {
+			c.logger.WithLevel(retryLevel(err)).Err(err).Msgf("failed to list snapshots after restarting %s", c.source)
+			continue
 		}
+		c.lck.Lock()
+		c.resyncs++
+		c.lck.Unlock()
+		c.observe(nil)
+	}
+}
+
+// Observe registers f, which is called for every event of the stream. As
+// events might have been missed, while zpool events was restarted, it is
+// called with nil after all snapshots have been listed again. This allows
+// other collectors to follow the stream.
+func (c *snapshotCollector) Observe(f func(*events.Event)) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.observers = append(c.observers, f)
+}
 
-		// insert at pos
-		s[dataset] = append(s[dataset], snapshotState{})
-		copy(s[dataset][pos+1:], s[dataset][pos:])
-		s[dataset][pos] = snapshot
+func (c *snapshotCollector) observe(event *events.Event) {
+	c.lck.Lock()
+	observers := c.observers
+	c.lck.Unlock()
+	for _, f := range observers {
+		f(event)
 	}
+}
 
-	return nil
+// NewListCollector creates a collector for snapshots, which lists them using
+// listSnapshots instead of zfs and applies the events received from eventCh
+// instead of following zpool events, once Run is called. listSnapshots gets the
+// datasets to list as arguments, all snapshots are listed without any. The
+// event stream counts as attached until eventCh is closed.
+func NewListCollector(logger zerolog.Logger, listSnapshots func(context.Context, ...string) ([]byte, error), eventCh chan *events.Event, namespace string, keep func(dataset string, snapshot string) bool) *snapshotCollector {
+	return newCollector(logger, namespace, TextLister(listSnapshots), eventCh, keep)
 }
 
-func newCollector(ctx context.Context, logger zerolog.Logger, listSnapshots func(context.Context, ...string) ([]byte, error), eventCh chan *zpoolEvent, keep func(string, string) bool) (*snapshotCollector, error) {
-	data, err := listSnapshots(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+// NewPollCollector creates a collector for snapshots, which lists all
+// snapshots every interval instead of following zpool events, once Run is
+// called. The snapshots created and destroyed in between are counted from the
+// differences of the listings. Like for NewCollector, zfs list is run by
+// runner without a lister.
+func NewPollCollector(logger zerolog.Logger, runner command.CommandRunner, lister Lister, interval time.Duration, namespace string, keep func(dataset string, snapshot string) bool) *snapshotCollector {
+	if lister == nil {
+		lister = cmdLister(runner)
 	}
+	c := newSnapshotCollector(logger, namespace, lister, keep)
+	c.pollInterval = interval
+	c.status.Mode = ModePoll
+	c.setEventStreamUp(true)
+	return c
+}
 
-	if keep == nil {
-		keep = keepAll
+// NewOneShotCollector lists all snapshots once and returns a collector, which
+// doesn't follow zpool events. Like for NewCollector, zfs list is run by
+// runner without a lister.
+func NewOneShotCollector(ctx context.Context, logger zerolog.Logger, runner command.CommandRunner, lister Lister, namespace string, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
+	if lister == nil {
+		lister = cmdLister(runner)
 	}
+	return newOneShotCollector(ctx, logger, lister, namespace, keep)
+}
 
-	datasets := make(snapshotsState)
+// NewOneShotListCollector is like NewOneShotCollector, but lists the snapshots
+// using listSnapshots instead of zfs.
+func NewOneShotListCollector(ctx context.Context, logger zerolog.Logger, listSnapshots func(context.Context, ...string) ([]byte, error), namespace string, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
+	return newOneShotCollector(ctx, logger, TextLister(listSnapshots), namespace, keep)
+}
+
+func newOneShotCollector(ctx context.Context, logger zerolog.Logger, lister Lister, namespace string, keep func(dataset string, snapshot string) bool) (*snapshotCollector, error) {
+	c := newSnapshotCollector(logger, namespace, lister, keep)
+	if err := c.listAll(ctx); err != nil {
+		return nil, err
+	}
+	c.status.InitialListingDone = true
+	return c, nil
+}
+
+type snapshotsState map[string][]snapshotState
+
+// parse adds the snapshots listed by zfs list -H -p -o name,creation,used.
+func (s snapshotsState) parse(r io.Reader) (skipped int, err error) {
+	return parseList(r, s.add)
+}
+
+// without returns the snapshots of s, which are not part of other.
+func (s snapshotsState) without(other snapshotsState) snapshotsState {
+	result := make(snapshotsState)
+	for dataset, snapshots := range s {
+		known := other.names(dataset)
+		for _, snap := range snapshots {
+			if !known[snap.name] {
+				result[dataset] = append(result[dataset], snap)
+			}
+		}
+	}
+	return result
+}
+
+// names returns the names of the snapshots of dataset.
+func (s snapshotsState) names(dataset string) map[string]bool {
+	result := make(map[string]bool, len(s[dataset]))
+	for _, snap := range s[dataset] {
+		result[snap.name] = true
+	}
+	return result
+}
+
+// add inserts snap into the snapshots of dataset, which are sorted by their
+// creation. Snapshots, which are already known, are ignored.
+func (s snapshotsState) add(dataset string, snap Snapshot) {
+	snapshot := snapshotState{
+		name:    snap.Name,
+		ts:      snap.Creation,
+		used:    snap.Used,
+		written: snap.Written,
+	}
 
-	if err := datasets.parse(bytes.NewReader(data)); err != nil {
-		return nil, fmt.Errorf("failed to parse snapshots: %w", err)
+	// find position to insert
+	pos := sort.Search(len(s[dataset]), func(i int) bool {
+		return !s[dataset][i].ts.Before(snapshot.ts)
+	})
+
+	// check it is not a duplicate
+	for {
+
+		// end of slice
+		if pos >= len(s[dataset]) {
+			break
+		}
+
+		// check if ts still matches
+		if !s[dataset][pos].ts.Equal(snapshot.ts) {
+			break
+		}
+
+		// duplicate of snapshot name
+		if s[dataset][pos].name == snapshot.name {
+			return
+		}
+
+		pos++
 	}
 
-	c := &snapshotCollector{
+	// insert at pos
+	s[dataset] = append(s[dataset], snapshotState{})
+	copy(s[dataset][pos+1:], s[dataset][pos:])
+	s[dataset][pos] = snapshot
+}
+
+func newSnapshotCollector(logger zerolog.Logger, namespace string, lister Lister, keep func(string, string) bool) *snapshotCollector {
+	if keep == nil {
+		keep = keepAll
+	}
+
+	return &snapshotCollector{
 		logger:        logger.With().Str("collector", "snapshot").Logger(),
-		datasets:      datasets,
-		listSnapshots: listSnapshots,
+		datasets:      make(snapshotsState),
+		lister:        lister,
+		retryInterval: retryInterval,
+		status:        Status{Mode: ModeEvents},
 		metricCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: "zfs",
+			Namespace: namespace,
 			Subsystem: "snapshot",
 			Name:      "count",
 			Help:      "Count of existing ZFS snapshots.",
 		}, []string{"dataset"}),
 		metricDiskUsed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: "zfs",
+			Namespace: namespace,
 			Subsystem: "snapshot",
 			Name:      "disk_used",
 			Help:      "Disk space used by all snapshots.",
 		}, []string{"dataset"}),
 		metricLastUnixtime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Namespace: "zfs",
+			Namespace: namespace,
 			Subsystem: "snapshot",
 			Name:      "last_unixtime",
 			Help:      "Time of last ZFS snapshot",
 		}, []string{"dataset"}),
+		metricCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "created_total",
+			Help:      "Total count of ZFS snapshots created since the initial listing.",
+		}, []string{"dataset"}),
+		metricCreatedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "created_bytes_total",
+			Help:      "Total disk space written into ZFS snapshots created since the initial listing.",
+		}, []string{"dataset"}),
+		metricDestroyed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "destroyed_total",
+			Help:      "Total count of ZFS snapshots destroyed since the initial listing.",
+		}, []string{"dataset"}),
+		metricFromCache: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "snapshot",
+			Name:      "state_from_cache",
+			Help:      "Whether the snapshots are served from the cache file until the initial listing completes.",
+		}),
+		metricTrackedDatasets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zfs_exporter_tracked_datasets",
+			Help: "Number of datasets with snapshots known to the snapshot collector.",
+		}),
+		metricTrackedSnapshots: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zfs_exporter_tracked_snapshots",
+			Help: "Number of snapshots known to the snapshot collector, including excluded ones.",
+		}),
+		metricEventQueueLength: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "zfs_exporter_event_queue_length",
+			Help: "Number of zpool events waiting to be applied by the snapshot collector.",
+		}),
+		metricSkippedLines: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "zfs_exporter_skipped_lines_total",
+			Help:        "Total count of lines skipped, as they couldn't be parsed.",
+			ConstLabels: prometheus.Labels{"parser": "snapshot_list"},
+		}),
+		metricSkippedEventLines: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "zfs_exporter_skipped_lines_total",
+			Help:        "Total count of lines skipped, as they couldn't be parsed.",
+			ConstLabels: prometheus.Labels{"parser": "zpool_events"},
+		}),
 		keep: keep,
 	}
+}
+
+func newCollector(logger zerolog.Logger, namespace string, lister Lister, eventCh chan *events.Event, keep func(string, string) bool) *snapshotCollector {
+	c := newSnapshotCollector(logger, namespace, lister, keep)
+	c.eventCh = eventCh
+	c.setEventStreamUp(eventCh != nil)
+	return c
+}
+
+// Run lists all snapshots and applies the events until ctx is cancelled or
+// the event stream is closed. It returns an error, when an event can't be
+// applied. Running it again lists all snapshots again, as events have been
+// missed in the meantime.
+func (c *snapshotCollector) Run(ctx context.Context) error {
+	listed, stopCache := c.startCache(ctx)
+	defer stopCache()
 
-	go func() {
-		err := c.eventLoop(ctx, eventCh)
+	if err := c.initialListing(ctx); err != nil {
+		return nil
+	}
+	listed()
+	if c.pollInterval > 0 {
+		c.poll(ctx)
+		return nil
+	}
+	if err := c.eventLoop(ctx, c.eventCh); err != nil {
+		return fmt.Errorf("snapshot event loop failed: %w", err)
+	}
+	return nil
+}
+
+// initialListing lists all snapshots, it retries until it succeeds or ctx is
+// cancelled.
+func (c *snapshotCollector) initialListing(ctx context.Context) error {
+	for {
+		err := c.listAll(ctx)
+		if err == nil {
+			c.lck.Lock()
+			c.status.InitialListingDone = true
+			c.lck.Unlock()
+			return nil
+		}
+		c.logger.WithLevel(retryLevel(err)).Err(err).Msgf("initial snapshot listing failed, retrying in %s", c.retryInterval)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.retryInterval):
+		}
+	}
+}
+
+func (c *snapshotCollector) listAll(ctx context.Context) error {
+	datasets := make(snapshotsState)
+	skipped, err := c.lister.List(ctx, datasets.add)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	c.skippedLines(skipped)
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	// the initial listing has nothing to compare with
+	if c.status.InitialListingDone {
+		c.countChanges(c.datasets, datasets)
+	}
+	c.datasets = datasets
+	c.fromCache = false
+
+	return nil
+}
+
+// countChanges counts the snapshots created and destroyed between the
+// listings before and after. Excluded snapshots are not counted.
+func (c *snapshotCollector) countChanges(before, after snapshotsState) {
+	c.countCreated(after.without(before))
+	for dataset, snapshots := range before.without(after) {
+		for _, snap := range snapshots {
+			if c.keep(dataset, snap.name) {
+				c.metricDestroyed.WithLabelValues(dataset).Inc()
+			}
+		}
+	}
+}
+
+// countCreated counts the snapshots added and the disk space written into
+// them, which is only known for snapshots listed on their own. Excluded
+// snapshots are not counted.
+func (c *snapshotCollector) countCreated(added snapshotsState) {
+	for dataset, snapshots := range added {
+		for _, snap := range snapshots {
+			if !c.keep(dataset, snap.name) {
+				continue
+			}
+			c.metricCreated.WithLabelValues(dataset).Inc()
+			c.metricCreatedBytes.WithLabelValues(dataset).Add(float64(snap.written))
+		}
+	}
+}
+
+// poll lists all snapshots every poll interval until ctx is cancelled. While
+// listing fails, the event stream counts as down.
+func (c *snapshotCollector) poll(ctx context.Context) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := c.listAll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			c.logger.Error().Err(err).Msg("snapshot event loop failed")
+			c.logger.WithLevel(retryLevel(err)).Err(err).Msgf("failed to poll snapshots, retrying in %s", c.pollInterval)
+		}
+		if up := err == nil; up != c.Status().EventStreamUp {
+			c.setEventStreamUp(up)
 		}
-	}()
+	}
+}
 
-	return c, nil
+func (c *snapshotCollector) setEventStreamUp(up bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.status.EventStreamUp = up
+	c.status.EventStreamChanged = time.Now()
+}
+
+// Status returns the current lifecycle status of the collector.
+func (c *snapshotCollector) Status() Status {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.status
+}
+
+// State returns a copy of the known snapshots and counters. With a non-empty
+// dataset, only that dataset and its children are included. The copy is made
+// while holding the lock, so it can be marshalled without blocking the event
+// loop.
+func (c *snapshotCollector) State(dataset string) State {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	state := State{
+		Status:        c.status,
+		Resyncs:       c.resyncs,
+		EventsApplied: c.eventsApplied,
+		Datasets:      make(map[string][]Snapshot),
+	}
+	for name, snapshots := range c.datasets {
+		if dataset != "" && name != dataset && !strings.HasPrefix(name, dataset+"/") {
+			continue
+		}
+		result := make([]Snapshot, 0, len(snapshots))
+		for _, snap := range snapshots {
+			result = append(result, Snapshot{
+				Name:     snap.name,
+				Creation: snap.ts,
+				Used:     snap.used,
+				Written:  snap.written,
+				Excluded: !c.keep(name, snap.name),
+			})
+		}
+		state.Datasets[name] = result
+	}
+	return state
+}
+
+// LastCreated returns the creation of the last snapshot of every dataset.
+// Excluded snapshots are not considered, datasets with only excluded ones are
+// left out.
+func (c *snapshotCollector) LastCreated() map[string]time.Time {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	result := make(map[string]time.Time, len(c.datasets))
+	for dataset, snapshots := range c.datasets {
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			if c.keep(dataset, snapshots[i].name) {
+				result[dataset] = snapshots[i].ts
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Wait blocks until the event stream has stopped, which happens after
+// the context passed to NewCollector is cancelled.
+func (c *snapshotCollector) Wait() {
+	if c.followerDone != nil {
+		<-c.followerDone
+	}
 }
 
 func (c *snapshotCollector) removeSnapshot(datasetName string, snapshotName string) {
@@ -203,28 +725,67 @@ func (c *snapshotCollector) removeSnapshot(datasetName string, snapshotName stri
 	if !ok {
 		return
 	}
+	c.eventsApplied++
 
 	for i, snap := range snapshots {
 		if snap.name == snapshotName {
 			// remove snapshot
 			c.datasets[datasetName] = append(c.datasets[datasetName][:i], c.datasets[datasetName][i+1:]...)
+			if c.keep(datasetName, snapshotName) {
+				c.metricDestroyed.WithLabelValues(datasetName).Inc()
+			}
+			break
 		}
 	}
 }
 
-func (c *snapshotCollector) addSnapshot(datasetName string, snapshotName string) error {
-	data, err := c.listSnapshots(context.Background(), datasetName)
+// addSnapshot applies the creation of a snapshot. If the lister supports it,
+// only the snapshot itself is listed, otherwise or if that fails, e.g. as it
+// has been destroyed in the meantime, all snapshots of its dataset are listed
+// again. It returns the listed snapshots, which weren't known before.
+func (c *snapshotCollector) addSnapshot(datasetName string, snapshotName string) (snapshotsState, error) {
+	listed := make(snapshotsState)
+	skipped, err := c.listSnapshot(context.Background(), listed.add, datasetName, snapshotName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	c.skippedLines(skipped)
 
 	c.lck.Lock()
 	defer c.lck.Unlock()
 
-	return c.datasets.parse(bytes.NewReader(data))
+	added := listed.without(c.datasets)
+	for dataset, snapshots := range added {
+		for _, snap := range snapshots {
+			c.datasets.add(dataset, Snapshot{Name: snap.name, Creation: snap.ts, Used: snap.used, Written: snap.written})
+		}
+	}
+	c.eventsApplied++
+	return added, nil
+}
+
+func (c *snapshotCollector) listSnapshot(ctx context.Context, add func(string, Snapshot), datasetName, snapshotName string) (int, error) {
+	if l, ok := c.lister.(SnapshotLister); ok {
+		skipped, err := l.ListSnapshot(ctx, add, datasetName, snapshotName)
+		if err == nil {
+			return skipped, nil
+		}
+		c.logger.Debug().Err(err).Str("snapshot", datasetName+"@"+snapshotName).Msg("failed to list snapshot, listing all snapshots of its dataset")
+	}
+	return c.lister.List(ctx, add, datasetName)
+}
+
+// skippedLines logs and counts the lines of a listing, which couldn't be
+// parsed.
+func (c *snapshotCollector) skippedLines(skipped int) {
+	if skipped == 0 {
+		return
+	}
+	c.logger.Warn().Int("lines", skipped).Msg("skipped unparsable lines of the snapshot listing")
+	c.metricSkippedLines.Add(float64(skipped))
 }
 
-func (c *snapshotCollector) eventLoop(ctx context.Context, eventCh chan *zpoolEvent) error {
+func (c *snapshotCollector) eventLoop(ctx context.Context, eventCh chan *events.Event) error {
 	if eventCh == nil {
 		return nil
 	}
@@ -233,7 +794,20 @@ loop:
 		select {
 		case <-ctx.Done():
 			break loop
-		case event := <-eventCh:
+		case event, ok := <-eventCh:
+			if !ok {
+				if ctx.Err() != nil {
+					break loop
+				}
+				c.logger.Warn().Msg("zpool events stream closed")
+				c.setEventStreamUp(false)
+				break loop
+			}
+			c.observe(event)
+			if event.Skipped > 0 {
+				c.logger.Warn().Int("lines", event.Skipped).Str("class", event.Class).Msg("skipped unparsable lines of zpool events")
+				c.metricSkippedEventLines.Add(float64(event.Skipped))
+			}
 			if event.HistoryInternalName != "snapshot" && event.HistoryInternalName != "destroy" {
 				continue
 			}
@@ -251,9 +825,11 @@ loop:
 				continue
 			}
 
-			if err := c.addSnapshot(dataset, snapshot); err != nil {
+			added, err := c.addSnapshot(dataset, snapshot)
+			if err != nil {
 				return err
 			}
+			c.countCreated(added)
 		}
 	}
 	return nil
@@ -263,6 +839,17 @@ func (c *snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
 	c.metricCount.Describe(ch)
 	c.metricDiskUsed.Describe(ch)
 	c.metricLastUnixtime.Describe(ch)
+	c.metricCreated.Describe(ch)
+	c.metricCreatedBytes.Describe(ch)
+	c.metricDestroyed.Describe(ch)
+	if c.cacheFile != "" {
+		c.metricFromCache.Describe(ch)
+	}
+	c.metricTrackedDatasets.Describe(ch)
+	c.metricTrackedSnapshots.Describe(ch)
+	c.metricEventQueueLength.Describe(ch)
+	c.metricSkippedLines.Describe(ch)
+	c.metricSkippedEventLines.Describe(ch)
 }
 
 func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
@@ -276,9 +863,11 @@ func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
 	var (
 		used, count uint64
 		last        time.Time
+		tracked     int
 	)
 
 	for dataset, snapshots := range c.datasets {
+		tracked += len(snapshots)
 		used = 0
 		count = 0
 		last = time.Time{}
@@ -301,80 +890,23 @@ func (c *snapshotCollector) Collect(ch chan<- prometheus.Metric) {
 	c.metricCount.Collect(ch)
 	c.metricDiskUsed.Collect(ch)
 	c.metricLastUnixtime.Collect(ch)
-}
-
-type zpoolEvent struct {
-	HistoryInternalName string
-	HistoryDSName       string
-	Time                time.Time
-}
-
-func trimDoubleQuotes(s string) string {
-	if len(s) < 2 {
-		return s
-	}
-
-	if s[0] != '"' || s[len(s)-1] != '"' {
-		return s
-	}
-
-	return s[1 : len(s)-1]
-}
-
-func parseZpoolEvents(r io.Reader, ch chan *zpoolEvent) error {
-	var (
-		scanner = bufio.NewScanner(r)
-		lineno  = -1
-		event   = new(zpoolEvent)
-	)
-	for scanner.Scan() {
-		lineno++
-		line := scanner.Text()
-		if line == "" {
-			ch <- event
-			event = new(zpoolEvent)
-			lineno = -1
-			continue
-		}
-		if lineno == 0 {
-			continue
-		}
-		// find the separator between the key and the value
-		sep := strings.IndexByte(line, '=')
-		if sep < 1 {
-			continue
-		}
-		if len(line) < sep+2 {
-			continue
+	c.metricCreated.Collect(ch)
+	c.metricCreatedBytes.Collect(ch)
+	c.metricDestroyed.Collect(ch)
+	if c.cacheFile != "" {
+		c.metricFromCache.Set(0)
+		if c.fromCache {
+			c.metricFromCache.Set(1)
 		}
-		key := strings.TrimSpace(line[:sep-1])
-		value := line[sep+2:]
-
-		switch key {
-		case "time":
-			fields := strings.Fields(value)
-			if len(fields) >= 2 {
-				secs, err := strconv.ParseInt(fields[0], 0, 64)
-				if err != nil {
-					return fmt.Errorf("unable to parse seconds: %w", err)
-				}
-				nanos, err := strconv.ParseInt(fields[1], 0, 64)
-				if err != nil {
-					return fmt.Errorf("unable to parse nano seconds: %w", err)
-				}
-				event.Time = time.Unix(secs, nanos)
-			}
-		case "history_internal_name":
-			event.HistoryInternalName = trimDoubleQuotes(value)
-		case "history_dsname":
-			event.HistoryDSName = trimDoubleQuotes(value)
-		default:
-			break
-		}
-	}
-	if scanner.Err() != nil {
-		return fmt.Errorf("scanner error: %w", scanner.Err())
+		c.metricFromCache.Collect(ch)
 	}
 
-	return nil
+	c.metricTrackedDatasets.Set(float64(len(c.datasets)))
+	c.metricTrackedSnapshots.Set(float64(tracked))
+	c.metricEventQueueLength.Set(float64(len(c.eventCh)))
+	c.metricTrackedDatasets.Collect(ch)
+	c.metricTrackedSnapshots.Collect(ch)
+	c.metricEventQueueLength.Collect(ch)
+	c.metricSkippedLines.Collect(ch)
+	c.metricSkippedEventLines.Collect(ch)
 }
@@ -1,9 +1,12 @@
 package snapshot
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,6 +17,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+	"github.com/simonswine/zfs-event-exporter/zfs/events"
+	"github.com/simonswine/zfs-event-exporter/zfs/fixture"
 )
 
 func retryMax(t *testing.T, max int, f func() error) error {
@@ -29,14 +36,34 @@ func retryMax(t *testing.T, max int, f func() error) error {
 		max--
 		time.Sleep(50 * time.Millisecond)
 	}
-	return nil
+	return err
+}
+
+// runCollector runs the event loop of c until ctx is cancelled.
+func runCollector(ctx context.Context, c *snapshotCollector) *snapshotCollector {
+	go func() {
+		_ = c.Run(ctx)
+	}()
+	return c
 }
 
 func TestPoolMetrics(t *testing.T) {
+	for _, prefix := range []string{"zfs", "storage_zfs"} {
+		t.Run(prefix, func(t *testing.T) {
+			testPoolMetrics(t, prefix)
+		})
+	}
+}
+
+func testPoolMetrics(t *testing.T, prefix string) {
+	withPrefix := func(expected string) io.Reader {
+		return strings.NewReader(strings.ReplaceAll(expected, "zfs_snapshot_", prefix+"_snapshot_"))
+	}
+
 	var (
 		callback func(ctx context.Context, args ...string) ([]byte, error)
 		reg      = prometheus.NewPedanticRegistry()
-		eventCh  = make(chan *zpoolEvent)
+		eventCh  = make(chan *events.Event)
 	)
 
 	t.Run("static snapshots after start up", func(t *testing.T) {
@@ -47,9 +74,9 @@ func TestPoolMetrics(t *testing.T) {
 		}
 
 		ctx := context.Background()
-		c, err := newCollector(ctx, zerolog.Nop(), func(ctx context.Context, args ...string) ([]byte, error) { return callback(ctx, args...) }, eventCh, func(_, _ string) bool { return true })
-		require.NoError(t, err)
+		c := runCollector(ctx, newCollector(zerolog.Nop(), prefix, TextLister(func(ctx context.Context, args ...string) ([]byte, error) { return callback(ctx, args...) }), eventCh, func(_, _ string) bool { return true }))
 		reg.MustRegister(c)
+		require.Eventually(t, func() bool { return c.Status().InitialListingDone }, time.Second, 10*time.Millisecond)
 
 		expectedMetrics := `
 # HELP zfs_snapshot_count Count of existing ZFS snapshots.
@@ -64,18 +91,34 @@ zfs_snapshot_disk_used{dataset="pool-nvme/data"} 3571712
 # TYPE zfs_snapshot_last_unixtime gauge
 zfs_snapshot_last_unixtime{dataset="pool-hdd/backup/pull/node-a/data"} 1667320886
 zfs_snapshot_last_unixtime{dataset="pool-nvme/data"} 1602276642
+# HELP zfs_exporter_event_queue_length Number of zpool events waiting to be applied by the snapshot collector.
+# TYPE zfs_exporter_event_queue_length gauge
+zfs_exporter_event_queue_length 0
+# HELP zfs_exporter_skipped_lines_total Total count of lines skipped, as they couldn't be parsed.
+# TYPE zfs_exporter_skipped_lines_total counter
+zfs_exporter_skipped_lines_total{parser="snapshot_list"} 0
+zfs_exporter_skipped_lines_total{parser="zpool_events"} 0
+# HELP zfs_exporter_tracked_datasets Number of datasets with snapshots known to the snapshot collector.
+# TYPE zfs_exporter_tracked_datasets gauge
+zfs_exporter_tracked_datasets 2
+# HELP zfs_exporter_tracked_snapshots Number of snapshots known to the snapshot collector, including excluded ones.
+# TYPE zfs_exporter_tracked_snapshots gauge
+zfs_exporter_tracked_snapshots 4
 			`
-		require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics)))
-		require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics)))
+		require.NoError(t, testutil.GatherAndCompare(reg, withPrefix(expectedMetrics)))
+		require.NoError(t, testutil.GatherAndCompare(reg, withPrefix(expectedMetrics)))
 	})
 
 	t.Run("add additional snapshot", func(t *testing.T) {
 		callback = func(_ context.Context, args ...string) ([]byte, error) {
-			require.Contains(t, args, "pool-nvme/data")
-			return []byte("pool-nvme/data@migrate_v3	1700000000	4000000\n"), nil
+			// only the created snapshot is listed
+			require.Equal(t, []string{"pool-nvme/data@migrate_v3"}, args)
+			// right after its creation, nothing is unique to the snapshot,
+			// but 4MB have been written into it
+			return []byte("pool-nvme/data@migrate_v3	1700000000	0	4000000\n"), nil
 		}
 		// prepare data call
-		eventCh <- &zpoolEvent{
+		eventCh <- &events.Event{
 			HistoryInternalName: "snapshot",
 			HistoryDSName:       "pool-nvme/data@migrate_v3",
 			Time:                time.Now(), // not really used
@@ -86,17 +129,36 @@ zfs_snapshot_last_unixtime{dataset="pool-nvme/data"} 1602276642
 # TYPE zfs_snapshot_count gauge
 zfs_snapshot_count{dataset="pool-hdd/backup/pull/node-a/data"} 2
 zfs_snapshot_count{dataset="pool-nvme/data"} 3
+# HELP zfs_snapshot_created_bytes_total Total disk space written into ZFS snapshots created since the initial listing.
+# TYPE zfs_snapshot_created_bytes_total counter
+zfs_snapshot_created_bytes_total{dataset="pool-nvme/data"} 4e+06
+# HELP zfs_snapshot_created_total Total count of ZFS snapshots created since the initial listing.
+# TYPE zfs_snapshot_created_total counter
+zfs_snapshot_created_total{dataset="pool-nvme/data"} 1
 # HELP zfs_snapshot_disk_used Disk space used by all snapshots.
 # TYPE zfs_snapshot_disk_used gauge
 zfs_snapshot_disk_used{dataset="pool-hdd/backup/pull/node-a/data"} 24772608
-zfs_snapshot_disk_used{dataset="pool-nvme/data"} 7571712
+zfs_snapshot_disk_used{dataset="pool-nvme/data"} 3571712
 # HELP zfs_snapshot_last_unixtime Time of last ZFS snapshot
 # TYPE zfs_snapshot_last_unixtime gauge
 zfs_snapshot_last_unixtime{dataset="pool-hdd/backup/pull/node-a/data"} 1667320886
 zfs_snapshot_last_unixtime{dataset="pool-nvme/data"} 1700000000
+# HELP zfs_exporter_event_queue_length Number of zpool events waiting to be applied by the snapshot collector.
+# TYPE zfs_exporter_event_queue_length gauge
+zfs_exporter_event_queue_length 0
+# HELP zfs_exporter_skipped_lines_total Total count of lines skipped, as they couldn't be parsed.
+# TYPE zfs_exporter_skipped_lines_total counter
+zfs_exporter_skipped_lines_total{parser="snapshot_list"} 0
+zfs_exporter_skipped_lines_total{parser="zpool_events"} 0
+# HELP zfs_exporter_tracked_datasets Number of datasets with snapshots known to the snapshot collector.
+# TYPE zfs_exporter_tracked_datasets gauge
+zfs_exporter_tracked_datasets 2
+# HELP zfs_exporter_tracked_snapshots Number of snapshots known to the snapshot collector, including excluded ones.
+# TYPE zfs_exporter_tracked_snapshots gauge
+zfs_exporter_tracked_snapshots 5
 			`
 		require.NoError(t, retryMax(t, 10, func() error {
-			return testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics))
+			return testutil.GatherAndCompare(reg, withPrefix(expectedMetrics))
 		}))
 	})
 
@@ -105,7 +167,7 @@ zfs_snapshot_last_unixtime{dataset="pool-nvme/data"} 1700000000
 			panic("should not be called")
 		}
 		// prepare data call
-		eventCh <- &zpoolEvent{
+		eventCh <- &events.Event{
 			HistoryInternalName: "destroy",
 			HistoryDSName:       "pool-nvme/data@migrate_v1",
 			Time:                time.Now(), // not really used
@@ -115,141 +177,559 @@ zfs_snapshot_last_unixtime{dataset="pool-nvme/data"} 1700000000
 # HELP zfs_snapshot_count Count of existing ZFS snapshots.
 # TYPE zfs_snapshot_count gauge
 zfs_snapshot_count{dataset="pool-hdd/backup/pull/node-a/data"} 2
-zfs_snapshot_count{dataset="pool-nvme/data"} 3
+zfs_snapshot_count{dataset="pool-nvme/data"} 2
+# HELP zfs_snapshot_created_bytes_total Total disk space written into ZFS snapshots created since the initial listing.
+# TYPE zfs_snapshot_created_bytes_total counter
+zfs_snapshot_created_bytes_total{dataset="pool-nvme/data"} 4e+06
+# HELP zfs_snapshot_created_total Total count of ZFS snapshots created since the initial listing.
+# TYPE zfs_snapshot_created_total counter
+zfs_snapshot_created_total{dataset="pool-nvme/data"} 1
+# HELP zfs_snapshot_destroyed_total Total count of ZFS snapshots destroyed since the initial listing.
+# TYPE zfs_snapshot_destroyed_total counter
+zfs_snapshot_destroyed_total{dataset="pool-nvme/data"} 1
 # HELP zfs_snapshot_disk_used Disk space used by all snapshots.
 # TYPE zfs_snapshot_disk_used gauge
 zfs_snapshot_disk_used{dataset="pool-hdd/backup/pull/node-a/data"} 24772608
-zfs_snapshot_disk_used{dataset="pool-nvme/data"} 7571712
+zfs_snapshot_disk_used{dataset="pool-nvme/data"} 1826816
 # HELP zfs_snapshot_last_unixtime Time of last ZFS snapshot
 # TYPE zfs_snapshot_last_unixtime gauge
 zfs_snapshot_last_unixtime{dataset="pool-hdd/backup/pull/node-a/data"} 1667320886
 zfs_snapshot_last_unixtime{dataset="pool-nvme/data"} 1700000000
+# HELP zfs_exporter_event_queue_length Number of zpool events waiting to be applied by the snapshot collector.
+# TYPE zfs_exporter_event_queue_length gauge
+zfs_exporter_event_queue_length 0
+# HELP zfs_exporter_skipped_lines_total Total count of lines skipped, as they couldn't be parsed.
+# TYPE zfs_exporter_skipped_lines_total counter
+zfs_exporter_skipped_lines_total{parser="snapshot_list"} 0
+zfs_exporter_skipped_lines_total{parser="zpool_events"} 0
+# HELP zfs_exporter_tracked_datasets Number of datasets with snapshots known to the snapshot collector.
+# TYPE zfs_exporter_tracked_datasets gauge
+zfs_exporter_tracked_datasets 2
+# HELP zfs_exporter_tracked_snapshots Number of snapshots known to the snapshot collector, including excluded ones.
+# TYPE zfs_exporter_tracked_snapshots gauge
+zfs_exporter_tracked_snapshots 4
 			`
 
 		require.NoError(t, retryMax(t, 10, func() error {
-			return testutil.GatherAndCompare(reg, strings.NewReader(expectedMetrics))
+			return testutil.GatherAndCompare(reg, withPrefix(expectedMetrics))
 		}))
 
 	})
-}
 
-func TestZpoolEvents(t *testing.T) {
-	data, err := os.ReadFile(filepath.Join("testdata", "events-simple.txt"))
-	require.NoError(t, err)
+}
 
+func TestStatus(t *testing.T) {
 	var (
-		ch     = make(chan *zpoolEvent)
-		done   = make(chan struct{})
-		events []*zpoolEvent
+		listed  = make(chan struct{})
+		eventCh = make(chan *events.Event)
+		calls   int
 	)
 
-	go func() {
-		for e := range ch {
-			events = append(events, e)
+	c := newCollector(zerolog.Nop(), "zfs", TextLister(func(context.Context, ...string) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			<-listed
+			return nil, errors.New("zfs not ready")
 		}
-		close(done)
+		return []byte("pool-nvme/data@migrate_v1	1602276001	1744896\n"), nil
+	}), eventCh, nil)
+	c.retryInterval = time.Millisecond
+	runCollector(context.Background(), c)
+
+	status := c.Status()
+	require.False(t, status.InitialListingDone)
+	require.True(t, status.EventStreamUp)
+
+	// listing completes after a failed attempt
+	close(listed)
+	require.Eventually(t, func() bool { return c.Status().InitialListingDone }, time.Second, time.Millisecond)
+
+	// event stream goes away
+	close(eventCh)
+	require.Eventually(t, func() bool { return !c.Status().EventStreamUp }, time.Second, time.Millisecond)
+}
+
+func TestParse(t *testing.T) {
+	s := make(snapshotsState)
+	skipped, err := s.parse(strings.NewReader(`pool/data@daily-1	1700000000	4096
+pool/data@daily 2	1700086400	8192
+pool/data@daily-3	yesterday	4096
+pool/data	1700000000	4096
+@daily-4	1700000000	4096
+pool/data@daily-1	1700000000	4096
+pool/home@daily-1 1700000000 2048
+pool/home@daily-2	1700086400
+`))
+	require.NoError(t, err)
+
+	// names with spaces are separated by tabs, duplicates don't stop the
+	// parsing
+	require.Equal(t, 4, skipped)
+	require.Equal(t, snapshotsState{
+		"pool/data": {
+			{name: "daily-1", ts: time.Unix(1700000000, 0), used: 4096},
+			{name: "daily 2", ts: time.Unix(1700086400, 0), used: 8192},
+		},
+		"pool/home": {
+			{name: "daily-1", ts: time.Unix(1700000000, 0), used: 2048},
+		},
+	}, s)
+}
+
+func TestTrackedState(t *testing.T) {
+	c := newSnapshotCollector(zerolog.Nop(), "zfs", nil, func(_, snapshot string) bool { return snapshot != "hourly-1" })
+	_, err := c.datasets.parse(strings.NewReader("pool/data@daily-1\t1700000000\t4096\npool/data@hourly-1\t1700003600\t1024\npool/home@daily-1\t1700000000\t2048\n"))
+	require.NoError(t, err)
+
+	// events waiting for the event loop
+	c.eventCh = make(chan *events.Event, eventQueueSize)
+	c.eventCh <- &events.Event{HistoryInternalName: "snapshot", HistoryDSName: "pool/data@daily-2"}
+	c.eventCh <- &events.Event{HistoryInternalName: "destroy", HistoryDSName: "pool/data@daily-1"}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_exporter_event_queue_length Number of zpool events waiting to be applied by the snapshot collector.
+# TYPE zfs_exporter_event_queue_length gauge
+zfs_exporter_event_queue_length 2
+# HELP zfs_exporter_skipped_lines_total Total count of lines skipped, as they couldn't be parsed.
+# TYPE zfs_exporter_skipped_lines_total counter
+zfs_exporter_skipped_lines_total{parser="snapshot_list"} 0
+zfs_exporter_skipped_lines_total{parser="zpool_events"} 0
+# HELP zfs_exporter_tracked_datasets Number of datasets with snapshots known to the snapshot collector.
+# TYPE zfs_exporter_tracked_datasets gauge
+zfs_exporter_tracked_datasets 2
+# HELP zfs_exporter_tracked_snapshots Number of snapshots known to the snapshot collector, including excluded ones.
+# TYPE zfs_exporter_tracked_snapshots gauge
+zfs_exporter_tracked_snapshots 3
+`), "zfs_exporter_event_queue_length", "zfs_exporter_tracked_datasets", "zfs_exporter_tracked_snapshots"))
+}
+
+func TestFollowRestart(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	// every run of zpool events exits immediately
+	fake.On("zpool events", command.FakeCommand{})
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v1\t1602276001\t1744896\n"})
+
+	oldRetryInterval := retryInterval
+	retryInterval = 10 * time.Millisecond
+	defer func() { retryInterval = oldRetryInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := NewCollector(ctx, zerolog.Nop(), fake.Runner(), nil, "zfs", nil)
+	require.NoError(t, err)
+	resyncs := make(chan struct{}, 16)
+	c.Observe(func(event *events.Event) {
+		if event == nil {
+			select {
+			case resyncs <- struct{}{}:
+			default:
+			}
+		}
+	})
+	runCollector(ctx, c)
+
+	runs := func(command string) int {
+		var count int
+		for _, call := range fake.Calls() {
+			if call[0]+" "+call[1] == command {
+				count++
+			}
+		}
+		return count
+	}
+
+	// zpool events is restarted and the snapshots are listed again
+	require.Eventually(t, func() bool {
+		return runs("zpool events") >= 3 && runs("zfs list") >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, c.Status().InitialListingDone)
+	// observers learn about the resyncs
+	require.NotEmpty(t, resyncs)
+
+	cancel()
+	c.Wait()
+}
+
+func TestHistoryCollector(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	fake.On("zpool list", command.FakeCommand{Stdout: "pool-nvme\n"})
+	fake.On("zpool history", command.FakeCommand{Stdout: "History for 'pool-nvme':\n" +
+		"2020-10-09.22:40:01 [txg:100] snapshot pool-nvme/data@migrate_v1 (257)  [on host]\n"})
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v1\t1602276001\t1744896\n"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := NewHistoryCollector(ctx, zerolog.Nop(), fake.Runner(), nil, time.Millisecond, "zfs", nil)
+	require.NoError(t, err)
+	runCollector(ctx, c)
+	require.Eventually(t, func() bool {
+		return c.Status().InitialListingDone
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the records added to the history are applied
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v2\t1602276642\t1826816\n"})
+	fake.On("zpool history", command.FakeCommand{Stdout: "History for 'pool-nvme':\n" +
+		"2020-10-09.22:40:01 [txg:100] snapshot pool-nvme/data@migrate_v1 (257)  [on host]\n" +
+		"2020-10-09.22:50:42 [txg:200] snapshot pool-nvme/data@migrate_v2 (258)  [on host]\n" +
+		"2020-10-09.22:50:43 [txg:201] destroy pool-nvme/data@migrate_v1 (257)  [on host]\n"})
+	require.Eventually(t, func() bool {
+		snapshots := c.State("").Datasets["pool-nvme/data"]
+		return len(snapshots) == 1 && snapshots[0].Name == "migrate_v2"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, c.Status().EventStreamUp)
+
+	// every record is applied once
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, uint64(2), c.State("").EventsApplied)
+
+	cancel()
+	c.Wait()
+}
+
+func TestPollCollector(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v1\t1602276001\t1744896\n" +
+		"pool-nvme/data@tmp\t1602276100\t4096\n"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewPollCollector(zerolog.Nop(), fake.Runner(), nil, 10*time.Millisecond, "zfs", func(_, snapshot string) bool {
+		return snapshot != "tmp"
+	})
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Run(ctx)
 	}()
+	require.Eventually(t, func() bool { return c.Status().InitialListingDone }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, ModePoll, c.Status().Mode)
+	require.True(t, c.Status().EventStreamUp)
+
+	// the changes between two polls are counted, except for excluded
+	// snapshots
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v2\t1602276642\t1826816\n" +
+		"pool-nvme/data@migrate_v3\t1602277000\t4096\n" +
+		"pool-hdd/data@daily-1\t1602277000\t4096\n"})
+	expected := `
+# HELP zfs_snapshot_count Count of existing ZFS snapshots.
+# TYPE zfs_snapshot_count gauge
+zfs_snapshot_count{dataset="pool-hdd/data"} 1
+zfs_snapshot_count{dataset="pool-nvme/data"} 2
+# HELP zfs_snapshot_created_total Total count of ZFS snapshots created since the initial listing.
+# TYPE zfs_snapshot_created_total counter
+zfs_snapshot_created_total{dataset="pool-hdd/data"} 1
+zfs_snapshot_created_total{dataset="pool-nvme/data"} 2
+# HELP zfs_snapshot_destroyed_total Total count of ZFS snapshots destroyed since the initial listing.
+# TYPE zfs_snapshot_destroyed_total counter
+zfs_snapshot_destroyed_total{dataset="pool-nvme/data"} 1
+`
+	names := []string{"zfs_snapshot_count", "zfs_snapshot_created_total", "zfs_snapshot_destroyed_total"}
+	require.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(expected), names...) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the same listing again doesn't change the counters
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), names...))
 
-	require.NoError(t, parseZpoolEvents(bytes.NewReader(data), ch))
-	close(ch)
+	// failing polls are reported like a broken event stream
+	fake.On("zfs list", command.FakeCommand{ExitCode: 1, Stderr: "cannot open 'pool-nvme': pool I/O is currently suspended"})
+	require.Eventually(t, func() bool { return !c.Status().EventStreamUp }, 5*time.Second, 10*time.Millisecond)
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v3\t1602277000\t4096\n"})
+	require.Eventually(t, func() bool { return c.Status().EventStreamUp }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP zfs_snapshot_created_total Total count of ZFS snapshots created since the initial listing.
+# TYPE zfs_snapshot_created_total counter
+zfs_snapshot_created_total{dataset="pool-hdd/data"} 1
+zfs_snapshot_created_total{dataset="pool-nvme/data"} 2
+# HELP zfs_snapshot_destroyed_total Total count of ZFS snapshots destroyed since the initial listing.
+# TYPE zfs_snapshot_destroyed_total counter
+zfs_snapshot_destroyed_total{dataset="pool-hdd/data"} 1
+zfs_snapshot_destroyed_total{dataset="pool-nvme/data"} 2
+`), "zfs_snapshot_created_total", "zfs_snapshot_destroyed_total"))
+
+	// no event stream is started
+	for _, call := range fake.Calls() {
+		require.Equal(t, "zfs", call[0])
+	}
 
+	cancel()
 	<-done
+}
+
+func TestObserve(t *testing.T) {
+	eventCh := make(chan *events.Event)
+	c := newCollector(zerolog.Nop(), "zfs", TextLister(func(context.Context, ...string) ([]byte, error) {
+		return nil, nil
+	}), eventCh, nil)
 
-	result, err := json.Marshal(events)
-	require.NoError(t, err)
-
-	require.JSONEq(t, `
-[
-    {
-        "HistoryInternalName": "destroy",
-        "HistoryDSName": "pool-hdd/backup/data0/%recv",
-        "Time": "2023-11-23T03:45:50.763089998Z"
-    },
-    {
-        "HistoryInternalName": "hold",
-        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_230701_000",
-        "Time": "2023-11-23T03:45:51.005089471Z"
-    },
-    {
-        "HistoryInternalName": "release",
-        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_225701_000",
-        "Time": "2023-11-23T03:45:51.210089024Z"
-    },
-    {
-        "HistoryInternalName": "receive",
-        "HistoryDSName": "pool-hdd/backup/var/%recv",
-        "Time": "2023-11-23T03:45:52.374086487Z"
-    },
-    {
-        "HistoryInternalName": "finish receiving",
-        "HistoryDSName": "pool-hdd/backup/var/%recv",
-        "Time": "2023-11-23T03:45:52.591086014Z"
-    },
-    {
-        "HistoryInternalName": "clone swap",
-        "HistoryDSName": "pool-hdd/backup/var/%recv",
-        "Time": "2023-11-23T03:45:52.592086012Z"
-    },
-    {
-        "HistoryInternalName": "snapshot",
-        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231122_231701_000",
-        "Time": "2023-11-23T03:45:52.59308601Z"
-    },
-    {
-        "HistoryInternalName": "destroy",
-        "HistoryDSName": "pool-hdd/backup/var/%recv",
-        "Time": "2023-11-23T03:45:52.596086004Z"
-    },
-    {
-        "HistoryInternalName": "hold",
-        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231122_231701_000",
-        "Time": "2023-11-23T03:45:52.819085518Z"
-    },
-    {
-        "HistoryInternalName": "release",
-        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231122_230701_000",
-        "Time": "2023-11-23T03:45:52.999085125Z"
-    },
-    {
-        "HistoryInternalName": "receive",
-        "HistoryDSName": "pool-hdd/backup/data0/%recv",
-        "Time": "2023-11-23T03:45:54.156082603Z"
-    },
-    {
-        "HistoryInternalName": "finish receiving",
-        "HistoryDSName": "pool-hdd/backup/data0/%recv",
-        "Time": "2023-11-23T03:45:54.480081897Z"
-    },
-    {
-        "HistoryInternalName": "clone swap",
-        "HistoryDSName": "pool-hdd/backup/data0/%recv",
-        "Time": "2023-11-23T03:45:54.481081895Z"
-    },
-    {
-        "HistoryInternalName": "snapshot",
-        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_231701_000",
-        "Time": "2023-11-23T03:45:54.482081893Z"
-    },
-    {
-        "HistoryInternalName": "destroy",
-        "HistoryDSName": "pool-hdd/backup/data0/%recv",
-        "Time": "2023-11-23T03:45:54.486081884Z"
-    },
-    {
-        "HistoryInternalName": "hold",
-        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_231701_000",
-        "Time": "2023-11-23T03:45:54.801081197Z"
-    },
-    {
-        "HistoryInternalName": "release",
-        "HistoryDSName": "pool-hdd/backup/data0@zrepl_20231122_230701_000",
-        "Time": "2023-11-23T03:45:54.976080816Z"
-    },
-    {
-        "HistoryInternalName": "destroy",
-        "HistoryDSName": "pool-hdd/backup/var@zrepl_20231120_095659_000",
-        "Time": "2023-11-23T03:47:36.814857739Z"
-    }
-]`, string(result))
+	observed := make(chan *events.Event, 2)
+	c.Observe(func(event *events.Event) { observed <- event })
+	other := make(chan *events.Event, 2)
+	c.Observe(func(event *events.Event) { other <- event })
+	runCollector(context.Background(), c)
+
+	// all events are observed, not just the ones about snapshots
+	eventCh <- &events.Event{HistoryInternalName: "load-key", HistoryDSName: "pool/secret"}
+	eventCh <- &events.Event{HistoryInternalName: "destroy", HistoryDSName: "pool/data@daily-1"}
+	require.Equal(t, "load-key", (<-observed).HistoryInternalName)
+	require.Equal(t, "destroy", (<-observed).HistoryInternalName)
+	// by every observer
+	require.Equal(t, "load-key", (<-other).HistoryInternalName)
+	require.Equal(t, "destroy", (<-other).HistoryInternalName)
+	close(eventCh)
+}
 
+func TestUnavailable(t *testing.T) {
+	// zfs and zpool are not installed yet
+	fake := command.NewFakeExecutor()
+
+	oldRetryInterval := retryInterval
+	retryInterval = 10 * time.Millisecond
+	defer func() { retryInterval = oldRetryInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, err := NewCollector(ctx, zerolog.Nop(), fake.Runner(), nil, "zfs", nil)
+	require.NoError(t, err)
+	runCollector(ctx, c)
+	require.False(t, c.Status().EventStreamUp)
+
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, c.Status().InitialListingDone)
+
+	// once ZFS shows up, zpool events is started and the snapshots are listed
+	fake.On("zpool events", command.FakeCommand{Follow: true})
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool-nvme/data@migrate_v1\t1602276001\t1744896\n"})
+	require.Eventually(t, func() bool {
+		s := c.Status()
+		return s.InitialListingDone && s.EventStreamUp
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	c.Wait()
+}
+
+func TestState(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "snapshots-simple.txt"))
+	require.NoError(t, err)
+
+	c := newSnapshotCollector(zerolog.Nop(), "zfs", TextLister(func(context.Context, ...string) ([]byte, error) {
+		return data, nil
+	}), func(_, snapshot string) bool { return snapshot != "migrate_v1" })
+	require.NoError(t, c.listAll(context.Background()))
+	c.removeSnapshot("pool-nvme/data", "migrate_v2")
+
+	state := c.State("")
+	require.Equal(t, uint64(1), state.EventsApplied)
+	require.Len(t, state.Datasets, 2)
+	require.Len(t, state.Datasets["pool-hdd/backup/pull/node-a/data"], 2)
+
+	state = c.State("pool-nvme")
+	require.Equal(t, map[string][]Snapshot{
+		"pool-nvme/data": {{Name: "migrate_v1", Creation: time.Unix(1602276001, 0), Used: 1744896, Excluded: true}},
+	}, state.Datasets)
+
+	require.Empty(t, c.State("pool-nvme/da").Datasets)
+
+	// the dataset with only an excluded snapshot left has none
+	require.Equal(t, map[string]time.Time{
+		"pool-hdd/backup/pull/node-a/data": time.Unix(1667320886, 0),
+	}, c.LastCreated())
+}
+
+// TestRecordedFixtures parses the snapshot listing and the events of every
+// fixture recorded with record-fixtures.
+func TestRecordedFixtures(t *testing.T) {
+	fixtures, err := fixture.LoadAll(filepath.Join("..", "testdata", "recorded"))
+	require.NoError(t, err)
+	require.NotEmpty(t, fixtures)
+
+	for _, f := range fixtures {
+		t.Run(f.Name(), func(t *testing.T) {
+			if f.Has(fixture.SnapshotsList) {
+				data, err := f.Read(fixture.SnapshotsList)
+				require.NoError(t, err)
+
+				c := newSnapshotCollector(zerolog.Nop(), "zfs", TextLister(func(context.Context, ...string) ([]byte, error) {
+					return data, nil
+				}), nil)
+				require.NoError(t, c.listAll(context.Background()))
+				require.NotEmpty(t, c.State("").Datasets)
+			}
+
+			if f.Has(fixture.ZpoolEvents) {
+				data, err := f.Read(fixture.ZpoolEvents)
+				require.NoError(t, err)
+
+				var (
+					ch    = make(chan *events.Event)
+					done  = make(chan struct{})
+					count int
+				)
+				go func() {
+					defer close(done)
+					for range ch {
+						count++
+					}
+				}()
+				require.NoError(t, events.Parse(bytes.NewReader(data), ch, false))
+				close(ch)
+				<-done
+				require.NotZero(t, count)
+			}
+		})
+	}
+}
+
+func TestListFile(t *testing.T) {
+	list := ListFile("testdata/snapshots-simple.txt")
+
+	all, err := list(context.Background())
+	require.NoError(t, err)
+	expected, err := os.ReadFile("testdata/snapshots-simple.txt")
+	require.NoError(t, err)
+	require.Equal(t, expected, all)
+
+	// like zfs list, only the snapshots of the dataset itself are returned
+	data, err := list(context.Background(), "pool-nvme/data")
+	require.NoError(t, err)
+	require.Equal(t, "pool-nvme/data@migrate_v1\t1602276001\t1744896\npool-nvme/data@migrate_v2\t1602276642\t1826816\n", string(data))
+
+	data, err = list(context.Background(), "pool-nvme")
+	require.NoError(t, err)
+	require.Empty(t, data)
+
+	// a single snapshot is listed by its name
+	data, err = list(context.Background(), "pool-nvme/data@migrate_v2")
+	require.NoError(t, err)
+	require.Equal(t, "pool-nvme/data@migrate_v2\t1602276642\t1826816\n", string(data))
+
+	_, err = ListFile("testdata/missing.txt")(context.Background())
+	require.Error(t, err)
+}
+
+const (
+	listArgs         = "zfs list -H -p -t snapshot -o name,creation,used "
+	listSnapshotArgs = "zfs list -H -p -t snapshot -o name,creation,used,written "
+)
+
+func TestAddSnapshot(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	fake.On("zfs list", command.FakeCommand{Stdout: "pool/data@a\t1\t10\npool/data@b\t2\t20\n"})
+	c := newSnapshotCollector(zerolog.Nop(), "zfs", cmdLister(fake.Runner()), nil)
+	require.NoError(t, c.listAll(context.Background()))
+
+	// only the created snapshot is listed
+	fake.On(listSnapshotArgs+"pool/data@c", command.FakeCommand{Stdout: "pool/data@c\t3\t30\t300\n"})
+	added, err := c.addSnapshot("pool/data", "c")
+	require.NoError(t, err)
+	require.Equal(t, snapshotsState{"pool/data": {{name: "c", ts: time.Unix(3, 0), used: 30, written: 300}}}, added)
+	calls := fake.Calls()
+	require.Len(t, calls, 2)
+	require.Equal(t, "pool/data@c", calls[1][len(calls[1])-1])
+	require.Equal(t, []snapshotState{
+		{name: "a", ts: time.Unix(1, 0), used: 10},
+		{name: "b", ts: time.Unix(2, 0), used: 20},
+		{name: "c", ts: time.Unix(3, 0), used: 30, written: 300},
+	}, c.datasets["pool/data"])
+
+	// a snapshot, which is destroyed before it is listed, relists its
+	// dataset
+	fake.On(listSnapshotArgs+"pool/data@d", command.FakeCommand{Stderr: "cannot open 'pool/data@d': dataset does not exist", ExitCode: 1})
+	fake.On(listArgs+"pool/data", command.FakeCommand{Stdout: "pool/data@a\t1\t10\npool/data@b\t2\t20\npool/data@c\t3\t30\npool/data@e\t5\t50\n"})
+	added, err = c.addSnapshot("pool/data", "d")
+	require.NoError(t, err)
+	calls = fake.Calls()
+	require.Len(t, calls, 4)
+	require.Equal(t, "pool/data", calls[3][len(calls[3])-1])
+	// snapshots missed in the meantime are added as well
+	require.Len(t, c.datasets["pool/data"], 4)
+	require.Equal(t, snapshotsState{"pool/data": {{name: "e", ts: time.Unix(5, 0), used: 50}}}, added)
+	require.Equal(t, uint64(2), c.eventsApplied)
+
+	// the relisting fails as well
+	fake.On(listArgs+"pool/data", command.FakeCommand{ExitCode: 1})
+	_, err = c.addSnapshot("pool/data", "d")
+	require.Error(t, err)
+}
+
+func TestAddSnapshotLister(t *testing.T) {
+	var args [][]string
+	list := func(_ context.Context, datasets ...string) ([]byte, error) {
+		args = append(args, datasets)
+		return []byte("pool/data@a\t1\t10\n"), nil
+	}
+
+	// listers without support for a single snapshot relist the dataset
+	c := newSnapshotCollector(zerolog.Nop(), "zfs", struct{ Lister }{TextLister(list)}, nil)
+	_, err := c.addSnapshot("pool/data", "a")
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"pool/data"}}, args)
+
+	args = nil
+	c = newSnapshotCollector(zerolog.Nop(), "zfs", TextLister(list), nil)
+	_, err = c.addSnapshot("pool/data", "a")
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"pool/data@a"}}, args)
+	require.Len(t, c.datasets["pool/data"], 1)
+}
+
+// BenchmarkAddSnapshot applies the creation of a snapshot in a dataset with
+// 10k snapshots.
+func BenchmarkAddSnapshot(b *testing.B) {
+	const count = 10000
+	var all bytes.Buffer
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&all, "pool/data@auto-%05d\t%d\t%d\n", i, 1600000000+i*60, i)
+	}
+	single := []byte(fmt.Sprintf("pool/data@auto-%05d\t%d\t%d\n", count-1, 1600000000+(count-1)*60, count-1))
+	list := func(_ context.Context, datasets ...string) ([]byte, error) {
+		if len(datasets) == 1 && strings.Contains(datasets[0], "@") {
+			return single, nil
+		}
+		return all.Bytes(), nil
+	}
+
+	for name, lister := range map[string]Lister{
+		"snapshot": TextLister(list),
+		"dataset":  struct{ Lister }{TextLister(list)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			c := newSnapshotCollector(zerolog.Nop(), "zfs", lister, nil)
+			require.NoError(b, c.listAll(context.Background()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := c.addSnapshot("pool/data", fmt.Sprintf("auto-%05d", count-1))
+				require.NoError(b, err)
+			}
+			require.Len(b, c.datasets["pool/data"], count)
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	require.NoError(f, err)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		require.NoError(f, err)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := make(snapshotsState)
+		if _, err := s.parse(bytes.NewReader(data)); err != nil {
+			// only lines exceeding the buffer of the scanner fail
+			require.ErrorIs(t, err, bufio.ErrTooLong)
+			return
+		}
+		for dataset, snapshots := range s {
+			require.NotEmpty(t, dataset)
+			for i := 1; i < len(snapshots); i++ {
+				require.False(t, snapshots[i].ts.Before(snapshots[i-1].ts), "snapshots of %s are not sorted", dataset)
+			}
+		}
+	})
 }
@@ -0,0 +1,259 @@
+// Package version probes the OpenZFS versions of the userland tools and the
+// kernel module and derives the capabilities of zfs and zpool from them.
+package version
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+// Version is an OpenZFS release, e.g. 2.1.5.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Less reports whether v is an earlier release than o.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// ParseVersion parses the release of a version string like
+// 2.1.5-1ubuntu6~22.04.1, the distribution specific suffix is ignored.
+func ParseVersion(s string) (Version, error) {
+	release, _, _ := strings.Cut(s, "-")
+	parts := strings.Split(release, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		numbers[i] = n
+	}
+	return Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// Versions are the versions of the userland tools and of the kernel module as
+// reported by zfs version, e.g. 2.1.5-1ubuntu6~22.04.1. They are empty if
+// unknown.
+type Versions struct {
+	Userland string `json:"userland"`
+	Kernel   string `json:"kernel"`
+}
+
+// Parse parses the output of zfs version or zpool version:
+//
+//	zfs-2.1.5-1ubuntu6~22.04.1
+//	zfs-kmod-2.1.5-1ubuntu6~22.04.1
+//
+// The kernel module line is missing, when the module is not loaded.
+func Parse(data []byte) (Versions, error) {
+	var (
+		v       Versions
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "zfs-kmod-"):
+			v.Kernel = strings.TrimPrefix(line, "zfs-kmod-")
+		case strings.HasPrefix(line, "zfs-"):
+			v.Userland = strings.TrimPrefix(line, "zfs-")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return v, err
+	}
+	if v.Userland == "" {
+		return v, fmt.Errorf("no userland version found in %q", strings.TrimSpace(string(data)))
+	}
+	if _, err := ParseVersion(v.Userland); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// Probe runs zfs version and falls back to zpool version, e.g. when only zpool
+// is available in a container.
+func Probe(ctx context.Context, runner *command.Runner) (Versions, error) {
+	var errs error
+	for _, name := range []string{"zfs", "zpool"} {
+		out, err := runner.Output(ctx, name, "version")
+		if err == nil {
+			return Parse(out)
+		}
+		errs = errors.Join(errs, err)
+	}
+	return Versions{}, errs
+}
+
+// Mismatch reports whether the userland tools and the kernel module are of
+// different releases. This happens when the kernel module hasn't been reloaded
+// after an upgrade and the tools might misinterpret the data of the module.
+func (v Versions) Mismatch() bool {
+	userland, err := ParseVersion(v.Userland)
+	if err != nil {
+		return false
+	}
+	kernel, err := ParseVersion(v.Kernel)
+	if err != nil {
+		return false
+	}
+	return userland != kernel
+}
+
+// Capability is an argument of zfs or zpool, which isn't supported by all
+// releases.
+type Capability string
+
+// Capabilities consulted by the collectors, when they construct the arguments
+// of their commands.
+const (
+	// ZpoolStatusSlowIOs adds the slow I/Os of leaf vdevs to zpool status.
+	ZpoolStatusSlowIOs Capability = "zpool status -s"
+)
+
+// capabilities are the releases of the userland tools introducing the
+// capabilities.
+var capabilities = map[Capability]Version{
+	ZpoolStatusSlowIOs: {Major: 0, Minor: 8, Patch: 0},
+}
+
+// Supports reports whether the userland tools support c. Nothing is supported
+// with an unknown version, so the collectors fall back to the arguments all
+// releases understand.
+func (v Versions) Supports(c Capability) bool {
+	since, ok := capabilities[c]
+	if !ok {
+		return false
+	}
+	userland, err := ParseVersion(v.Userland)
+	if err != nil {
+		return false
+	}
+	return !userland.Less(since)
+}
+
+// Source returns the current versions.
+type Source func() Versions
+
+// Fixed returns a source of v, which never changes.
+func Fixed(v Versions) Source {
+	return func() Versions { return v }
+}
+
+// Prober keeps the versions probed using runner. They are probed again, once
+// ZFS becomes available after it has been unavailable, e.g. as the kernel
+// module has only been loaded after the start of the exporter or has been
+// reloaded after an upgrade.
+type Prober struct {
+	logger zerolog.Logger
+	runner *command.Runner
+
+	mtx       sync.Mutex
+	versions  Versions
+	available bool
+}
+
+// NewProber creates a prober, which probes the versions right away.
+func NewProber(logger zerolog.Logger, runner *command.Runner) *Prober {
+	p := &Prober{logger: logger, runner: runner}
+	p.Versions()
+	return p
+}
+
+// Versions returns the probed versions, they are probed again if ZFS has
+// become available since the last call.
+func (p *Prober) Versions() Versions {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if !p.available && p.runner.Available() {
+		p.versions = p.probe()
+	}
+	p.available = p.runner.Available()
+	return p.versions
+}
+
+func (p *Prober) probe() Versions {
+	v, err := Probe(context.Background(), p.runner)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("failed to probe the ZFS version, using the arguments supported by all releases")
+		return Versions{}
+	}
+	if v.Mismatch() {
+		p.logger.Warn().Msgf("the ZFS userland tools %s don't match the kernel module %s, reload the module after upgrades", v.Userland, v.Kernel)
+	}
+	p.logger.Debug().Msgf("probed ZFS userland %s and kernel module %s", v.Userland, v.Kernel)
+	return v
+}
+
+// NewCollector exports the versions of source and whether they mismatch. All
+// metric names are prefixed with namespace.
+func NewCollector(source Source, namespace string) prometheus.Collector {
+	return &versionCollector{
+		versions: source,
+		descInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "version", "info"),
+			"A metric with a constant '1' value labeled by the versions of the ZFS userland tools and kernel module.",
+			[]string{"userland", "kmod"}, nil,
+		),
+		descMismatch: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "version", "mismatch"),
+			"Whether the versions of the ZFS userland tools and kernel module differ.",
+			nil, nil,
+		),
+	}
+}
+
+type versionCollector struct {
+	versions     Source
+	descInfo     *prometheus.Desc
+	descMismatch *prometheus.Desc
+}
+
+func (c *versionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.descInfo
+	ch <- c.descMismatch
+}
+
+func (c *versionCollector) Collect(ch chan<- prometheus.Metric) {
+	v := c.versions()
+	// without a successful probe there is nothing to report
+	if v.Userland == "" {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.descInfo, prometheus.GaugeValue, 1, v.Userland, v.Kernel)
+
+	mismatch := 0.0
+	if v.Mismatch() {
+		mismatch = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.descMismatch, prometheus.GaugeValue, mismatch)
+}
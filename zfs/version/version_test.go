@@ -0,0 +1,182 @@
+package version
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/simonswine/zfs-event-exporter/zfs/command"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		output   string
+		expected Versions
+		release  Version
+	}{
+		{
+			name:     "0.8",
+			output:   "zfs-0.8.3-1ubuntu12.14\nzfs-kmod-0.8.3-1ubuntu12.14\n",
+			expected: Versions{Userland: "0.8.3-1ubuntu12.14", Kernel: "0.8.3-1ubuntu12.14"},
+			release:  Version{Major: 0, Minor: 8, Patch: 3},
+		},
+		{
+			name:     "2.1",
+			output:   "zfs-2.1.5-1ubuntu6~22.04.1\nzfs-kmod-2.1.5-1ubuntu6~22.04.1\n",
+			expected: Versions{Userland: "2.1.5-1ubuntu6~22.04.1", Kernel: "2.1.5-1ubuntu6~22.04.1"},
+			release:  Version{Major: 2, Minor: 1, Patch: 5},
+		},
+		{
+			name:     "2.1 Ubuntu update",
+			output:   "zfs-2.1.5-1ubuntu6~22.04.2\nzfs-kmod-2.1.5-1ubuntu6~22.04.2\n",
+			expected: Versions{Userland: "2.1.5-1ubuntu6~22.04.2", Kernel: "2.1.5-1ubuntu6~22.04.2"},
+			release:  Version{Major: 2, Minor: 1, Patch: 5},
+		},
+		{
+			name:     "2.2 Proxmox",
+			output:   "zfs-2.2.4-pve1\nzfs-kmod-2.2.4-pve1\n",
+			expected: Versions{Userland: "2.2.4-pve1", Kernel: "2.2.4-pve1"},
+			release:  Version{Major: 2, Minor: 2, Patch: 4},
+		},
+		{
+			name:     "2.2 TrueNAS",
+			output:   "zfs-2.2.99-1\r\nzfs-kmod-2.2.99-1\r\n",
+			expected: Versions{Userland: "2.2.99-1", Kernel: "2.2.99-1"},
+			release:  Version{Major: 2, Minor: 2, Patch: 99},
+		},
+		{
+			name:     "2.2 FreeBSD",
+			output:   "zfs-2.2.0-FreeBSD_g95785196f\nzfs-kmod-2.2.0-FreeBSD_g95785196f\n",
+			expected: Versions{Userland: "2.2.0-FreeBSD_g95785196f", Kernel: "2.2.0-FreeBSD_g95785196f"},
+			release:  Version{Major: 2, Minor: 2, Patch: 0},
+		},
+		{
+			name:     "2.3 release candidate",
+			output:   "zfs-2.3.0-rc5\nzfs-kmod-2.3.0-rc5\n",
+			expected: Versions{Userland: "2.3.0-rc5", Kernel: "2.3.0-rc5"},
+			release:  Version{Major: 2, Minor: 3, Patch: 0},
+		},
+		{
+			name:     "kernel module not loaded",
+			output:   "zfs-2.2.6-1\n",
+			expected: Versions{Userland: "2.2.6-1"},
+			release:  Version{Major: 2, Minor: 2, Patch: 6},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := Parse([]byte(tc.output))
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, v)
+			release, err := ParseVersion(v.Userland)
+			require.NoError(t, err)
+			require.Equal(t, tc.release, release)
+			require.False(t, v.Mismatch())
+		})
+	}
+
+	for _, invalid := range []string{
+		"",
+		"unrecognized command 'version'\n",
+		"zfs-kmod-2.1.5-1\n",
+		"zfs-two.one-1\n",
+	} {
+		_, err := Parse([]byte(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestMismatch(t *testing.T) {
+	require.True(t, Versions{Userland: "2.2.2-0ubuntu9", Kernel: "2.1.5-1ubuntu6~22.04.1"}.Mismatch())
+	// a partial upgrade of the Ubuntu packages without a reboot
+	v, err := Parse([]byte("zfs-2.1.5-1ubuntu6~22.04.2\nzfs-kmod-2.1.4-0ubuntu0.1\n"))
+	require.NoError(t, err)
+	require.True(t, v.Mismatch())
+	// only the release counts, packaging suffixes may differ
+	require.False(t, Versions{Userland: "2.1.5-1ubuntu6", Kernel: "2.1.5-1ubuntu6~22.04.1"}.Mismatch())
+	require.False(t, Versions{}.Mismatch())
+}
+
+func TestSupports(t *testing.T) {
+	for _, tc := range []struct {
+		userland  string
+		supported []Capability
+	}{
+		{userland: ""},
+		{userland: "0.7.13-1"},
+		{userland: "0.8.3-1ubuntu12.14", supported: []Capability{ZpoolStatusSlowIOs}},
+		{userland: "2.1.5-1ubuntu6~22.04.1", supported: []Capability{ZpoolStatusSlowIOs}},
+		{userland: "2.3.0-rc5", supported: []Capability{ZpoolStatusSlowIOs}},
+	} {
+		v := Versions{Userland: tc.userland}
+		var supported []Capability
+		for _, c := range []Capability{ZpoolStatusSlowIOs} {
+			if v.Supports(c) {
+				supported = append(supported, c)
+			}
+		}
+		require.Equal(t, tc.supported, supported, tc.userland)
+	}
+	require.False(t, Versions{Userland: "2.3.0-1"}.Supports("zfs list -x"))
+}
+
+func TestProbe(t *testing.T) {
+	// only zpool is installed
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "zpool"), []byte("#!/bin/sh\necho zfs-2.2.6-1\necho zfs-kmod-2.1.14-1\n"), 0o755))
+	t.Setenv("PATH", dir)
+
+	v, err := Probe(context.Background(), command.NewRunner(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, Versions{Userland: "2.2.6-1", Kernel: "2.1.14-1"}, v)
+
+	require.NoError(t, testutil.CollectAndCompare(NewCollector(Fixed(v), "zfs"), strings.NewReader(`
+# HELP zfs_version_info A metric with a constant '1' value labeled by the versions of the ZFS userland tools and kernel module.
+# TYPE zfs_version_info gauge
+zfs_version_info{kmod="2.1.14-1",userland="2.2.6-1"} 1
+# HELP zfs_version_mismatch Whether the versions of the ZFS userland tools and kernel module differ.
+# TYPE zfs_version_mismatch gauge
+zfs_version_mismatch 1
+`)))
+
+	// nothing is exported without a version
+	require.Equal(t, 0, testutil.CollectAndCount(NewCollector(Fixed(Versions{}), "zfs")))
+}
+
+func TestProber(t *testing.T) {
+	fake := command.NewFakeExecutor()
+	fake.On("zfs version", command.FakeCommand{Stderr: "The ZFS modules are not loaded.\nTry running '/sbin/modprobe zfs' as root to load them.", ExitCode: 1})
+	fake.On("zpool version", command.FakeCommand{Stderr: "The ZFS modules are not loaded.\nTry running '/sbin/modprobe zfs' as root to load them.", ExitCode: 1})
+	runner := fake.Runner()
+
+	// the module isn't loaded at start up
+	p := NewProber(zerolog.Nop(), runner)
+	require.Equal(t, Versions{}, p.Versions())
+	require.False(t, runner.Available())
+	calls := len(fake.Calls())
+
+	// the versions aren't probed again while ZFS is unavailable
+	require.Equal(t, Versions{}, p.Versions())
+	require.Len(t, fake.Calls(), calls)
+
+	// once another command succeeds, the versions are probed again
+	fake.On("zfs version", command.FakeCommand{Stdout: "zfs-2.2.6-1\nzfs-kmod-2.2.6-1\n"})
+	fake.On("zpool status", command.FakeCommand{})
+	_, err := runner.Output(context.Background(), "zpool", "status")
+	require.NoError(t, err)
+	require.Equal(t, Versions{Userland: "2.2.6-1", Kernel: "2.2.6-1"}, p.Versions())
+	require.Equal(t, 1, testutil.CollectAndCount(NewCollector(p.Versions, "zfs"), "zfs_version_info"))
+
+	// as long as ZFS stays available, they aren't probed again
+	calls = len(fake.Calls())
+	require.Equal(t, Versions{Userland: "2.2.6-1", Kernel: "2.2.6-1"}, p.Versions())
+	require.Len(t, fake.Calls(), calls)
+}